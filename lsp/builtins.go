@@ -17,13 +17,32 @@ const (
 	KindType
 )
 
-// Builtin represents a language element with all its metadata
+// String returns the kind's name as shown to users
+func (k BuiltinKind) String() string {
+	switch k {
+	case KindKeyword:
+		return "keyword"
+	case KindOperator:
+		return "operator"
+	case KindAggregate:
+		return "aggregate"
+	case KindType:
+		return "type"
+	default:
+		return "function"
+	}
+}
+
+// Builtin represents a language element with all its metadata. In
+// signatures, "name?" marks an optional trailing parameter and a final
+// "..." repeats the parameter before it.
 type Builtin struct {
 	Name       string
 	Kind       BuiltinKind
 	Brief      string       // Short description for completion
 	Doc        string       // Full documentation for hover
 	Signature  string       // Function signature (for functions/aggregates)
+	Overloads  []string     // Other signatures, such as the aggregate form of max
 	Parameters []ParamDef   // Parameter definitions (for signature help)
 }
 
@@ -153,8 +172,8 @@ var allBuiltins = []Builtin{
 	{
 		Name: "compare", Kind: KindFunction,
 		Brief: "Compare two values", Doc: "Compare two values, returning -1, 0, or 1",
-		Signature: "compare(a: any, b: any) -> int64",
-		Parameters: []ParamDef{{Name: "a", Doc: "First value"}, {Name: "b", Doc: "Second value"}},
+		Signature: "compare(a: any, b: any, nullsMax?: bool) -> int64",
+		Parameters: []ParamDef{{Name: "a", Doc: "First value"}, {Name: "b", Doc: "Second value"}, {Name: "nullsMax", Doc: "Whether nulls sort after other values (default: true)"}},
 	},
 	{
 		Name: "date_part", Kind: KindFunction,
@@ -189,8 +208,8 @@ var allBuiltins = []Builtin{
 	{
 		Name: "grok", Kind: KindFunction,
 		Brief: "Parse with grok pattern", Doc: "Parse a string using a grok pattern",
-		Signature: "grok(pattern: string, value: string) -> record",
-		Parameters: []ParamDef{{Name: "pattern", Doc: "Grok pattern"}, {Name: "value", Doc: "String to parse"}},
+		Signature: "grok(pattern: string, value: string, definitions?: string) -> record",
+		Parameters: []ParamDef{{Name: "pattern", Doc: "Grok pattern"}, {Name: "value", Doc: "String to parse"}, {Name: "definitions", Doc: "Additional pattern definitions, one per line"}},
 	},
 	{
 		Name: "has", Kind: KindFunction,
@@ -291,7 +310,7 @@ var allBuiltins = []Builtin{
 	{
 		Name: "network_of", Kind: KindFunction,
 		Brief: "Get network from IP", Doc: "Get the network address from an IP and mask",
-		Signature: "network_of(ip: ip, mask: net) -> net",
+		Signature: "network_of(ip: ip, mask?: net) -> net",
 		Parameters: []ParamDef{{Name: "ip", Doc: "IP address"}, {Name: "mask", Doc: "Network mask"}},
 	},
 	{
@@ -430,15 +449,17 @@ var allBuiltins = []Builtin{
 	},
 	{
 		Name: "max", Kind: KindFunction,
-		Brief: "Maximum of values", Doc: "Return the maximum of two values",
-		Signature: "max(a: number, b: number) -> number",
-		Parameters: []ParamDef{{Name: "a", Doc: "First value"}, {Name: "b", Doc: "Second value"}},
+		Brief: "Maximum of values", Doc: "Return the maximum of the arguments or, as an aggregate, of all input values",
+		Signature: "max(value: number, ...) -> number",
+		Overloads: []string{"max(value: number) -> number"},
+		Parameters: []ParamDef{{Name: "value", Doc: "Values to compare"}},
 	},
 	{
 		Name: "min", Kind: KindFunction,
-		Brief: "Minimum of values", Doc: "Return the minimum of two values",
-		Signature: "min(a: number, b: number) -> number",
-		Parameters: []ParamDef{{Name: "a", Doc: "First value"}, {Name: "b", Doc: "Second value"}},
+		Brief: "Minimum of values", Doc: "Return the minimum of the arguments or, as an aggregate, of all input values",
+		Signature: "min(value: number, ...) -> number",
+		Overloads: []string{"min(value: number) -> number"},
+		Parameters: []ParamDef{{Name: "value", Doc: "Values to compare"}},
 	},
 
 	// =========================================================================
@@ -1,85 +1,379 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 )
 
-// getCompletions returns completion items based on the current context
-func getCompletions(text string, pos Position) []CompletionItem {
+// completionEnv holds what completion knows about a document beyond its
+// text
+type completionEnv struct {
+	dir      string        // Directory of the document, searched for data sources
+	fields   []sampleField // Fields of the query's sample input
+	snippets bool          // The client accepts snippets
+}
+
+// completionsIn returns completion items for the cursor position in a
+// parsed document, offering the syntactic categories the grammar expects
+// there
+func completionsIn(tree *SyntaxTree, pos Position, env completionEnv) []CompletionItem {
 	var items []CompletionItem
 
-	// Get the current line and word being typed
-	lines := strings.Split(text, "\n")
-	if pos.Line >= len(lines) {
+	// Nothing to complete inside strings and comments
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
 		return items
 	}
 
-	line := lines[pos.Line]
+	// Get the word prefix before cursor
 	prefix := ""
-	if pos.Character <= len(line) {
-		// Get the word prefix before cursor
-		start := pos.Character
-		for start > 0 && isIdentifierChar(line[start-1]) {
-			start--
-		}
-		if start < pos.Character {
-			prefix = strings.ToLower(line[start:pos.Character])
-		}
+	if word := tree.WordAt(offset); word != nil && word.pos < offset {
+		prefix = strings.ToLower(word.value[:offset-word.pos])
 	}
 
-	// Check context for better completions
-	context := getCompletionContext(line, pos.Character)
-
-	// Add completions based on context
-	switch context {
+	site := completionSiteAt(tree, offset)
+	switch site.context {
+	case contextStatement:
+		items = append(items, getKeywordListCompletions(declKeywords, prefix)...)
+		items = append(items, getStageCompletions(prefix)...)
+		items = append(items, getSnippetCompletions(prefix, true, env.snippets)...)
+	case contextOperator:
+		items = append(items, getStageCompletions(prefix)...)
+		items = append(items, getSnippetCompletions(prefix, false, env.snippets)...)
+	case contextSource:
+		items = append(items, getSourceCompletions(env.dir, prefix)...)
+	case contextSortKey:
+		items = append(items, getFieldCompletions(env.fields, nil, prefix)...)
+		items = append(items, getExprCompletions(prefix, env.snippets)...)
+		items = append(items, getKeywordListCompletions(sortOrderKeywords, prefix)...)
+	case contextExpr:
+		items = append(items, getFieldCompletions(env.fields, nil, prefix)...)
+		items = append(items, getExprCompletions(prefix, env.snippets)...)
+	case contextClause:
+		items = append(items, getKeywordListCompletions(nextClauses[site.clause], prefix)...)
+		items = append(items, getKeywordListCompletions(exprOperatorKeywords, prefix)...)
 	case contextType:
-		// After type-related keywords, suggest types
 		items = append(items, getTypeCompletions(prefix)...)
-	case contextFunction:
-		// After opening paren or in function context
-		items = append(items, getFunctionCompletions(prefix)...)
-		items = append(items, getAggregateCompletions(prefix)...)
+	case contextField:
+		if parent := pathBefore(tree, offset); parent != nil {
+			items = append(items, getFieldCompletions(env.fields, parent, prefix)...)
+		}
+	case contextName:
+		// New names aren't known here
 	default:
-		// General context - suggest everything
+		// Unknown position - suggest everything
 		items = append(items, getKeywordCompletions(prefix)...)
 		items = append(items, getOperatorCompletions(prefix)...)
-		items = append(items, getFunctionCompletions(prefix)...)
-		items = append(items, getAggregateCompletions(prefix)...)
+		items = append(items, getFunctionCompletions(prefix, env.snippets)...)
+		items = append(items, getAggregateCompletions(prefix, env.snippets)...)
 		items = append(items, getTypeCompletions(prefix)...)
 	}
 
+	rankCompletions(items, prefix, site, recentNames(tree, offset-len(prefix)))
+	// Clients sort by sortText, so keep the ranked order
+	for i := range items {
+		items[i].SortText = fmt.Sprintf("%04d", i)
+	}
 	return items
 }
 
+// completionContext is the syntactic category expected at the cursor
 type completionContext int
 
 const (
-	contextGeneral completionContext = iota
-	contextType
-	contextFunction
+	contextGeneral   completionContext = iota // Unknown: anything may follow
+	contextType                               // A type name, after "::" or in cast()
+	contextExpr                               // The start of an expression
+	contextStatement                          // The start of a declaration or query
+	contextOperator                           // The start of a pipeline stage
+	contextSource                             // A data source after from or join
+	contextSortKey                            // A sort key or its order, after sort or order by
+	contextClause                             // A keyword continuing a complete expression
+	contextField                              // A field name after "."
+	contextName                               // A name being declared
+)
+
+// completionSite is the expected category at the cursor and the keyword
+// of the clause holding it, such as "select" or "group"
+type completionSite struct {
+	context  completionContext
+	clause   string
+	complete bool // A complete sort key precedes the cursor
+}
+
+// Keywords offered at each grammar position
+var (
+	declKeywords         = []string{"const", "fn", "op", "type", "let", "pragma"}
+	sortOrderKeywords    = []string{"asc", "desc", "nulls first", "nulls last"}
+	exprOperatorKeywords = []string{"and", "or", "not", "in", "like", "between", "is"}
+
+	// termKeywords start an expression operand
+	termKeywords = map[string]bool{
+		"case": true, "cast": true, "date": true, "error": true, "exists": true,
+		"extract": true, "false": true, "lambda": true, "not": true,
+		"substring": true, "timestamp": true, "true": true,
+	}
+
+	// nextClauses are the keywords that may follow a complete expression
+	// in each clause
+	nextClauses = map[string][]string{
+		"select":    {"as", "from", "where", "group", "having", "order", "limit", "offset", "union"},
+		"from":      {"as", "join", "left", "right", "inner", "full", "cross", "anti", "where", "group", "order", "limit"},
+		"join":      {"as", "on", "using"},
+		"on":        {"join", "left", "right", "inner", "full", "cross", "anti", "where", "group", "order", "limit"},
+		"where":     {"group", "having", "order", "limit"},
+		"group":     {"having", "order", "limit"},
+		"having":    {"order", "limit"},
+		"limit":     {"offset"},
+		"summarize": {"by"},
+		"aggregate": {"by"},
+		"left":      {"join", "outer"},
+		"right":     {"join", "outer"},
+		"full":      {"join", "outer"},
+		"inner":     {"join"},
+		"outer":     {"join"},
+		"cross":     {"join"},
+		"anti":      {"join"},
+	}
+
+	// sqlClauses are the stage operators that continue with SQL clauses
+	sqlClauses = map[string]bool{
+		"select": true, "from": true, "join": true, "summarize": true, "aggregate": true,
+	}
 )
 
-// getCompletionContext analyzes the line to determine the completion context
-func getCompletionContext(line string, col int) completionContext {
-	if col > len(line) {
-		col = len(line)
+// completionSiteAt classifies the cursor position by the token before the
+// word being typed and the tree nodes holding that token: the stage and
+// clause it belongs to, or the bracket group, declaration or lambda
+func completionSiteAt(tree *SyntaxTree, offset int) completionSite {
+	start := offset
+	if w := tree.WordAt(offset); w != nil && w.pos < offset {
+		start = w.pos
+	}
+	prev := tree.TokenBefore(offset)
+	if prev == nil {
+		return completionSite{context: contextStatement}
+	}
+	switch strings.ToLower(prev.value) {
+	case "::":
+		return completionSite{context: contextType}
+	case "<":
+		// A type value such as <int64>, not a comparison
+		if before := tokenBefore(tree, prev); before == nil || !endsOperand(before) || isStageName(tree, before) {
+			return completionSite{context: contextType}
+		}
+	case ".":
+		return completionSite{context: contextField}
+	case "|", "|>", "=>":
+		return completionSite{context: contextOperator}
+	case ";":
+		return completionSite{context: contextStatement}
+	case "as":
+		return completionSite{context: contextName}
+	case "const", "fn", "func", "op", "type", "let", "pragma":
+		// A declaration keyword at the start of a statement
+		if before := tokenBefore(tree, prev); before == nil || before.value == ";" {
+			return completionSite{context: contextName}
+		}
+	}
+
+	for n := tree.NodeAt(prev.pos); n != nil; n = n.Parent {
+		switch n.Kind {
+		case NodeGroup:
+			if n.Interior(start) {
+				return groupSite(tree, n, prev, start)
+			}
+		case NodeLambda:
+			if !hasChildBefore(n, ":", start) {
+				return completionSite{context: contextName}
+			}
+		case NodeBranch:
+			return exprSite(prev, nil, "")
+		case NodeStage:
+			return stageSite(n, prev, start)
+		case NodeDecl:
+			return declSite(tree, n, prev, start)
+		}
+	}
+	return completionSite{context: contextGeneral}
+}
+
+// stageSite classifies a position within a pipeline stage by the last
+// clause keyword before it, or the stage's operator
+func stageSite(stage *Node, prev *token, start int) completionSite {
+	var gov *token
+	clause, sql := "", false
+	if len(stage.Children) > 0 && stage.Children[0].Kind == NodeExpr && impliedAggregate(stage.Children[0]) {
+		clause, sql = "summarize", true
+	}
+	for i, c := range stage.Children {
+		if c.Start >= start {
+			break
+		}
+		if c.Kind != NodeToken {
+			continue
+		}
+		v := strings.ToLower(c.Tok.value)
+		switch {
+		case i == 0 && isStageOperator(c.Tok):
+			clause, sql = v, sqlClauses[v]
+		case v == "by" && (clause == "group" || clause == "order"):
+			// Part of "group by" and "order by"
+		case clauseKeywords[v]:
+			clause, sql = v, true
+		default:
+			continue
+		}
+		gov = c.Tok
+	}
+
+	if joinKind := strings.ToLower(prev.value); nextClauses[joinKind] != nil && sql && prev != gov && !endsOperand(prev) {
+		return completionSite{context: contextClause, clause: joinKind}
+	}
+	switch clause {
+	case "from", "join":
+		if prev == gov {
+			return completionSite{context: contextSource}
+		}
+	case "sort", "order":
+		return completionSite{context: contextSortKey, complete: prev != gov && endsOperand(prev)}
+	}
+	if !sql {
+		clause = ""
+	}
+	return exprSite(prev, gov, clause)
+}
+
+// exprSite tells the start of an expression from the position after a
+// complete one, where the clause's keywords and binary keyword operators
+// may follow. gov is the keyword governing the clause, if any.
+func exprSite(prev, gov *token, clause string) completionSite {
+	if prev != gov && endsOperand(prev) {
+		return completionSite{context: contextClause, clause: clause}
+	}
+	return completionSite{context: contextExpr, clause: clause}
+}
+
+// groupSite classifies a position inside a bracket group: declaration
+// parameters, an operator body, call arguments or a nested expression
+func groupSite(tree *SyntaxTree, g *Node, prev *token, start int) completionSite {
+	switch p := g.Parent; {
+	case p.Kind == NodeDecl:
+		switch {
+		case childIndex(g) == 2:
+			return completionSite{context: contextName}
+		case p.Keyword() == "op":
+			return completionSite{context: contextStatement}
+		}
+	case p.Kind == NodeCall && strings.EqualFold(p.Name().value, "cast"):
+		if _, arg := callAt(tree, start); arg > 0 {
+			return completionSite{context: contextType}
+		}
+	case p.Kind == NodeExpr && prev.value == "(":
+		// The body of fork, or a subquery after from or join
+		if stage := p.Parent; stage != nil && stage.Kind == NodeStage && stage.Name() != nil {
+			switch strings.ToLower(stage.Name().value) {
+			case "fork":
+				return completionSite{context: contextOperator}
+			case "from", "join":
+				return completionSite{context: contextStatement}
+			}
+		}
+	}
+	return exprSite(prev, nil, "")
+}
+
+// declSite classifies a position within a declaration outside its
+// parameters and body. A line after a complete declaration starts a new
+// statement.
+func declSite(tree *SyntaxTree, decl *Node, prev *token, start int) completionSite {
+	if c := tokenNode(decl, prev); c != nil && childIndex(c) < 2 {
+		return completionSite{context: contextName}
+	}
+	if endsOperand(prev) && strings.Contains(tree.Text[prev.end():start], "\n") {
+		return completionSite{context: contextStatement}
+	}
+	return exprSite(prev, nil, "")
+}
+
+// impliedAggregate reports whether a stage's first expression is a call to
+// an aggregate, making the stage an implied summarize
+func impliedAggregate(expr *Node) bool {
+	if len(expr.Children) != 1 || expr.Children[0].Kind != NodeCall {
+		return false
+	}
+	name := expr.Children[0].Name()
+	return name != nil && isAggregate(strings.ToLower(name.value))
+}
+
+// hasChildBefore reports whether n has a token child with the given value
+// starting before an offset
+func hasChildBefore(n *Node, value string, offset int) bool {
+	for _, c := range n.Children {
+		if c.Start < offset && c.Kind == NodeToken && c.Tok.value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenNode returns the child of n holding a token, or nil
+func tokenNode(n *Node, tok *token) *Node {
+	for _, c := range n.Children {
+		if c.Start <= tok.pos && tok.pos < c.End {
+			return c
+		}
 	}
-	prefix := strings.ToLower(line[:col])
+	return nil
+}
 
-	// Check if we're after a type cast operator
-	if strings.Contains(prefix, "cast(") ||
-		strings.Contains(prefix, "::") ||
-		strings.HasSuffix(strings.TrimSpace(prefix), "<") {
-		return contextType
+// tokenBefore returns the significant token before tok, or nil
+func tokenBefore(tree *SyntaxTree, tok *token) *token {
+	for i := tree.TokenAt(tok.pos) - 1; i >= 0; i-- {
+		switch tree.Tokens[i].typ {
+		case tokWhitespace, tokNewline, tokComment:
+			continue
+		}
+		return &tree.Tokens[i]
 	}
+	return nil
+}
+
+// isStageName reports whether a token names the operator of its stage
+func isStageName(tree *SyntaxTree, tok *token) bool {
+	n := tree.NodeAt(tok.pos)
+	return n.Kind == NodeToken && n.Parent.Kind == NodeStage && childIndex(n) == 0 && isStageOperator(tok)
+}
 
-	// Check if we're inside a function call
-	openParens := strings.Count(prefix, "(") - strings.Count(prefix, ")")
-	if openParens > 0 {
-		return contextFunction
+// endsOperand reports whether a token can end an operand, so a word after
+// it continues the expression rather than starting a new one
+func endsOperand(t *token) bool {
+	switch t.typ {
+	case tokIdentifier, tokNumber, tokString, tokRegexp:
+		return true
+	case tokKeyword:
+		switch strings.ToLower(t.value) {
+		case "true", "false", "null", "end", "asc", "desc":
+			return true
+		}
+	case tokPunctuation:
+		return t.value == ")" || t.value == "]" || t.value == "}"
 	}
+	return false
+}
 
-	return contextGeneral
+// enclosingGroupOf returns the nearest bracket group containing n
+func enclosingGroupOf(n *Node) *Node {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Kind == NodeGroup {
+			return p
+		}
+	}
+	return nil
 }
 
 func isIdentifierChar(b byte) bool {
@@ -97,36 +391,238 @@ func getOperatorCompletions(prefix string) []CompletionItem {
 	return getCompletionsByKind(KindOperator, prefix, CompletionItemKindFunction, "operator")
 }
 
-func getFunctionCompletions(prefix string) []CompletionItem {
+// deprecatedName is a name the migrations table replaces with a builtin,
+// such as parse_zson for parse_sup
+type deprecatedName struct {
+	name        string
+	replacement *Builtin
+}
+
+// deprecatedNames are the renamed keywords, operators and functions of
+// the migrations table
+var deprecatedNames = findDeprecatedNames()
+
+func findDeprecatedNames() []deprecatedName {
+	var names []deprecatedName
+	for _, m := range migrations {
+		if !strings.HasPrefix(m.Code, "deprecated-") || !isName(m.OldText) {
+			continue
+		}
+		if b := Builtins.Lookup(m.NewText); b != nil && b.Name == m.NewText {
+			names = append(names, deprecatedName{name: m.OldText, replacement: b})
+		}
+	}
+	return names
+}
+
+func isName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isIdentifierChar(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// getDeprecatedCompletions returns items for the deprecated names of
+// builtins of a kind. Each is tagged deprecated and inserts its
+// replacement, built by item.
+func getDeprecatedCompletions(kind BuiltinKind, prefix string, item func(*Builtin) CompletionItem) []CompletionItem {
 	var items []CompletionItem
-	for _, fn := range Builtins.Functions() {
-		if prefix == "" || strings.HasPrefix(strings.ToLower(fn.Name), prefix) {
+	for _, d := range deprecatedNames {
+		if d.replacement.Kind != kind || !matchesWord(prefix, d.name) {
+			continue
+		}
+		it := item(d.replacement)
+		it.Label = d.name
+		it.FilterText = d.name
+		it.Detail = "deprecated: use " + d.replacement.Name
+		if it.InsertText == "" {
+			it.InsertText = d.replacement.Name
+		}
+		it.Tags = []int{CompletionItemTagDeprecated}
+		it.Deprecated = true
+		items = append(items, it)
+	}
+	return items
+}
+
+// getStageCompletions returns the pipeline operators and the keywords that
+// start a stage, such as select and summarize
+func getStageCompletions(prefix string) []CompletionItem {
+	items := getOperatorCompletions(prefix)
+	for _, kw := range Builtins.Keywords() {
+		if stageOperators[kw.Name] && matchesWord(prefix, kw.Name) {
+			items = append(items, builtinCompletion(kw, CompletionItemKindKeyword, kw.Brief))
+		}
+	}
+	return items
+}
+
+// getExprCompletions returns what may start an expression: functions,
+// aggregates and keywords such as case and cast
+func getExprCompletions(prefix string, snippets bool) []CompletionItem {
+	var items []CompletionItem
+	items = append(items, getFunctionCompletions(prefix, snippets)...)
+	items = append(items, getAggregateCompletions(prefix, snippets)...)
+	for _, kw := range Builtins.Keywords() {
+		if termKeywords[kw.Name] && matchesWord(prefix, kw.Name) {
+			items = append(items, builtinCompletion(kw, CompletionItemKindKeyword, kw.Brief))
+		}
+	}
+	return items
+}
+
+// getKeywordListCompletions returns keyword items for a list of words,
+// which may be phrases such as "nulls first", and for the deprecated
+// names of the words
+func getKeywordListCompletions(words []string, prefix string) []CompletionItem {
+	var items []CompletionItem
+	for _, w := range words {
+		if matchesWord(prefix, w) {
 			items = append(items, CompletionItem{
-				Label:      fn.Name,
-				Kind:       CompletionItemKindFunction,
-				Detail:     "function: " + fn.Brief,
-				InsertText: fn.Name + "($1)",
+				Label: w,
+				Kind:  CompletionItemKindKeyword,
 			})
 		}
 	}
+	for _, it := range getDeprecatedCompletions(KindKeyword, prefix, keywordCompletion) {
+		if slices.Contains(words, it.InsertText) {
+			items = append(items, it)
+		}
+	}
 	return items
 }
 
-func getAggregateCompletions(prefix string) []CompletionItem {
+func keywordCompletion(b *Builtin) CompletionItem {
+	return builtinCompletion(b, CompletionItemKindKeyword, b.Brief)
+}
+
+// sourceExtensions are the file extensions offered as data sources
+var sourceExtensions = map[string]bool{
+	".sup": true, ".bsup": true, ".csup": true, ".json": true, ".jsonl": true,
+	".ndjson": true, ".csv": true, ".tsv": true, ".parquet": true,
+}
+
+// getSourceCompletions returns the data files in a directory as quoted
+// paths for from and join
+func getSourceCompletions(dir, prefix string) []CompletionItem {
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
 	var items []CompletionItem
-	for _, agg := range Builtins.Aggregates() {
-		if prefix == "" || strings.HasPrefix(strings.ToLower(agg.Name), prefix) {
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !sourceExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		if matchesWord(prefix, name) {
 			items = append(items, CompletionItem{
-				Label:      agg.Name,
-				Kind:       CompletionItemKindFunction,
-				Detail:     "aggregate: " + agg.Brief,
-				InsertText: agg.Name + "($1)",
+				Label:      name,
+				Kind:       CompletionItemKindFile,
+				Detail:     "data file",
+				InsertText: "'" + name + "'",
 			})
 		}
 	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
 	return items
 }
 
+// getFieldCompletions returns the sample data fields for an expression:
+// every field path at the start of one, or the members of the record at
+// parent after a "."
+func getFieldCompletions(fields []sampleField, parent []string, prefix string) []CompletionItem {
+	var items []CompletionItem
+	for _, f := range fields {
+		label := f.name()
+		if parent != nil {
+			if len(f.path) != len(parent)+1 || !hasPathPrefix(f.path, parent) {
+				continue
+			}
+			label = fieldName(f.path[len(parent)])
+		}
+		if matchesWord(prefix, strings.ReplaceAll(label, "`", "")) {
+			item := CompletionItem{
+				Label:        label,
+				LabelDetails: &CompletionItemLabelDetails{Description: f.typeName()},
+				Kind:         CompletionItemKindField,
+				Detail:       f.typeName(),
+			}
+			if strings.Contains(label, "`") {
+				// Match what is typed before the name is quoted
+				item.FilterText = strings.ReplaceAll(label, "`", "")
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func hasPathPrefix(path, prefix []string) bool {
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pathBefore returns the field path ending at the "." before the cursor,
+// e.g. [a b] for "a.b.", or nil when no field precedes the dot
+func pathBefore(tree *SyntaxTree, offset int) []string {
+	var path []string
+	dot := tree.TokenBefore(offset)
+	for dot != nil && dot.value == "." {
+		name := tokenBefore(tree, dot)
+		if name == nil || name.end() != dot.pos || (name.typ != tokIdentifier && name.typ != tokKeyword) {
+			break
+		}
+		path = append([]string{strings.Trim(name.value, "`")}, path...)
+		dot = tokenBefore(tree, name)
+	}
+	return path
+}
+
+func getFunctionCompletions(prefix string, snippets bool) []CompletionItem {
+	var items []CompletionItem
+	for _, fn := range Builtins.Functions() {
+		if matchesWord(prefix, fn.Name) {
+			items = append(items, callCompletion(fn, "function: ", snippets))
+		}
+	}
+	items = append(items, getDeprecatedCompletions(KindFunction, prefix, func(b *Builtin) CompletionItem {
+		return callCompletion(b, "function: ", snippets)
+	})...)
+	return items
+}
+
+func getAggregateCompletions(prefix string, snippets bool) []CompletionItem {
+	var items []CompletionItem
+	for _, agg := range Builtins.Aggregates() {
+		if matchesWord(prefix, agg.Name) {
+			items = append(items, callCompletion(agg, "aggregate: ", snippets))
+		}
+	}
+	return items
+}
+
+// callCompletion returns the item for a builtin function or aggregate.
+// With snippets it inserts the call with a placeholder per parameter;
+// without, only the name, leaving "(" to trigger signature help.
+func callCompletion(b *Builtin, detail string, snippets bool) CompletionItem {
+	item := builtinCompletion(b, CompletionItemKindFunction, detail+b.Brief)
+	if snippets {
+		item.InsertText = callSnippet(b)
+		item.InsertTextFormat = InsertTextFormatSnippet
+	}
+	return item
+}
+
 func getTypeCompletions(prefix string) []CompletionItem {
 	return getCompletionsByKind(KindType, prefix, CompletionItemKindClass, "type")
 }
@@ -135,17 +631,41 @@ func getTypeCompletions(prefix string) []CompletionItem {
 func getCompletionsByKind(kind BuiltinKind, prefix string, itemKind int, labelPrefix string) []CompletionItem {
 	var items []CompletionItem
 	for _, b := range Builtins.ByKind(kind) {
-		if prefix == "" || strings.HasPrefix(strings.ToLower(b.Name), prefix) {
-			detail := b.Brief
-			if labelPrefix != "" {
-				detail = labelPrefix + ": " + detail
-			}
-			items = append(items, CompletionItem{
-				Label:  b.Name,
-				Kind:   itemKind,
-				Detail: detail,
-			})
+		if matchesWord(prefix, b.Name) {
+			items = append(items, registryCompletion(b, itemKind, labelPrefix))
 		}
 	}
+	items = append(items, getDeprecatedCompletions(kind, prefix, func(b *Builtin) CompletionItem {
+		return registryCompletion(b, itemKind, labelPrefix)
+	})...)
 	return items
 }
+
+func registryCompletion(b *Builtin, itemKind int, labelPrefix string) CompletionItem {
+	detail := b.Brief
+	if labelPrefix != "" {
+		detail = labelPrefix + ": " + detail
+	}
+	return builtinCompletion(b, itemKind, detail)
+}
+
+// builtinCompletion returns the item for a registry entry, showing its
+// parameters and result type, or else its kind, beside the label. The
+// documentation is left to completionItem/resolve.
+func builtinCompletion(b *Builtin, itemKind int, detail string) CompletionItem {
+	details := &CompletionItemLabelDetails{Description: b.Kind.String()}
+	if strings.HasPrefix(b.Signature, b.Name+"(") {
+		params, result, ok := strings.Cut(b.Signature[len(b.Name):], " -> ")
+		details.Detail = params
+		if ok {
+			details.Description = result
+		}
+	}
+	return CompletionItem{
+		Label:        b.Name,
+		LabelDetails: details,
+		Kind:         itemKind,
+		Detail:       detail,
+		Data:         &completionData{Builtin: b.Name, Kind: b.Kind},
+	}
+}
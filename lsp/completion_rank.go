@@ -0,0 +1,172 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// completion_rank.go - Matching and ranking of completion items. The word
+// being typed matches an item fuzzily, so "dp" finds date_part, and items
+// are ordered by how well they match, whether the document already uses
+// the name and whether their kind suits the clause. Long lists are cut
+// short and marked incomplete so the client asks again as the word grows.
+
+// completionLimit is the most items returned for one request
+const completionLimit = 100
+
+// aggregateClauses are the clauses where aggregate calls are expected
+var aggregateClauses = map[string]bool{
+	"summarize": true, "aggregate": true, "select": true, "having": true,
+}
+
+// groupingClauses are the clauses listing grouping keys, which can't be
+// aggregate calls
+var groupingClauses = map[string]bool{"by": true, "group": true}
+
+// matchesWord reports whether the word being typed, already lowercased,
+// matches a name as a subsequence of its characters
+func matchesWord(prefix, name string) bool {
+	_, ok := fuzzyScore(prefix, name)
+	return ok
+}
+
+// rankCompletions orders items best first: names starting with the word
+// before other matches, then by match score plus bonuses for recent use
+// and for kinds suited to the site. Ties keep the order items were
+// offered in.
+func rankCompletions(items []CompletionItem, prefix string, site completionSite, recent map[recentName]int) {
+	type ranked struct {
+		item   CompletionItem
+		prefix bool
+		score  int
+	}
+	ranks := make([]ranked, len(items))
+	for i, item := range items {
+		name := strings.ToLower(item.FilterText)
+		if name == "" {
+			name = strings.ToLower(item.Label)
+		}
+		score, _ := fuzzyScore(prefix, name)
+		if use, ok := itemUse(item, site); ok {
+			if r, ok := recent[recentName{name, use}]; ok {
+				score += recentBonus(r)
+			}
+		}
+		ranks[i] = ranked{item, strings.HasPrefix(name, prefix), score + kindBonus(item, site)}
+	}
+	sort.SliceStable(ranks, func(i, j int) bool {
+		a, b := ranks[i], ranks[j]
+		if a.prefix != b.prefix {
+			return a.prefix
+		}
+		return a.score > b.score
+	})
+	for i, r := range ranks {
+		items[i] = r.item
+	}
+}
+
+// recentBonus favors names the document uses, most of all the few used
+// last before the cursor
+func recentBonus(rank int) int {
+	return 5 + max(0, 5-rank)
+}
+
+// kindBonus favors the kinds of item likeliest at a site: the sort order
+// after a complete sort key, the clause keywords after a complete
+// expression, fields of the sample data, then functions, with aggregates
+// only where they are expected. Deprecated names rank below their
+// replacements.
+func kindBonus(item CompletionItem, site completionSite) int {
+	switch {
+	case item.Deprecated:
+		return -5
+	case site.context == contextSortKey && site.complete && slices.Contains(sortOrderKeywords, item.Label):
+		return 6
+	case site.context == contextClause && slices.Contains(nextClauses[site.clause], item.Label):
+		return 6
+	case item.Kind == CompletionItemKindField:
+		return 3
+	case item.Data == nil:
+		return 0
+	case item.Data.Kind == KindAggregate:
+		if aggregateClauses[site.clause] {
+			return 4
+		}
+	case item.Data.Kind == KindFunction:
+		return 2
+	}
+	return 0
+}
+
+// recentUse is what a name used in the document refers to
+type recentUse int
+
+const (
+	usedField recentUse = iota
+	usedSymbol
+	usedBuiltin
+)
+
+// recentName is a name used before the cursor and what it referred to
+type recentName struct {
+	name string
+	use  recentUse
+}
+
+// itemUse returns the use that makes an item's name recent: fields for
+// field items and builtin calls for functions and aggregates, except for
+// aggregates among grouping keys. Keywords and other items are never
+// recent.
+func itemUse(item CompletionItem, site completionSite) (recentUse, bool) {
+	switch {
+	case item.Kind == CompletionItemKindField:
+		return usedField, true
+	case item.Data == nil:
+	case item.Data.Kind == KindFunction:
+		return usedBuiltin, true
+	case item.Data.Kind == KindAggregate && !groupingClauses[site.clause]:
+		return usedBuiltin, true
+	}
+	return 0, false
+}
+
+// recentNames ranks the identifiers used before an offset that name a
+// field, a user declaration or a builtin call, the latest use first
+func recentNames(tree *SyntaxTree, offset int) map[recentName]int {
+	symbols := tree.Symbols()
+	recent := make(map[recentName]int)
+	for i := len(tree.Tokens) - 1; i >= 0; i-- {
+		t := &tree.Tokens[i]
+		if t.pos >= offset || t.typ != tokIdentifier {
+			continue
+		}
+		name := strings.ToLower(strings.Trim(t.value, "`"))
+		var use recentUse
+		switch {
+		case symbols.IsField(t):
+			use = usedField
+		case symbols.refs[t] != nil:
+			use = usedSymbol
+		case symbols.IsUnresolvedCall(t) && (lookupBuiltin(name, KindFunction) != nil || lookupBuiltin(name, KindAggregate) != nil):
+			use = usedBuiltin
+		default:
+			continue
+		}
+		key := recentName{name, use}
+		if _, ok := recent[key]; !ok {
+			recent[key] = len(recent)
+		}
+	}
+	return recent
+}
+
+// completionList trims items to the limit, marking the list incomplete
+// so the client requests it again as the word grows
+func completionList(items []CompletionItem) CompletionList {
+	if len(items) > completionLimit {
+		return CompletionList{IsIncomplete: true, Items: items[:completionLimit]}
+	}
+	return CompletionList{Items: items}
+}
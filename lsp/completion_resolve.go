@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// completion_resolve.go - Documentation for completion items, loaded by
+// completionItem/resolve for the item the user selects rather than sent
+// with every item of a completion list.
+
+// completionData identifies what an item completes so that resolving it
+// can find the documentation
+type completionData struct {
+	Builtin string      `json:"builtin,omitempty"`
+	Kind    BuiltinKind `json:"kind,omitempty"`
+	Snippet string      `json:"snippet,omitempty"`
+}
+
+// resolveCompletion fills in the documentation of an item from the builtin
+// or snippet it completes
+func resolveCompletion(item CompletionItem) CompletionItem {
+	if item.Data == nil || item.Documentation != nil {
+		return item
+	}
+	var doc string
+	switch {
+	case item.Data.Builtin != "":
+		b := lookupBuiltin(item.Data.Builtin, item.Data.Kind)
+		if b == nil {
+			return item
+		}
+		doc = builtinDocumentation(b)
+		if item.Deprecated {
+			doc = fmt.Sprintf("**Deprecated:** use `%s`\n\n%s", b.Name, doc)
+		}
+	case item.Data.Snippet != "":
+		for _, s := range snippetLibrary {
+			if s.label == item.Data.Snippet {
+				doc = fmt.Sprintf("%s\n\n```spq\n%s\n```", s.detail, plainSnippet(s.body))
+			}
+		}
+	}
+	if doc != "" {
+		item.Documentation = &MarkupContent{Kind: MarkupKindMarkdown, Value: doc}
+	}
+	return item
+}
+
+// lookupBuiltin finds a builtin by name and kind, since a keyword or
+// operator may share its name with a function
+func lookupBuiltin(name string, kind BuiltinKind) *Builtin {
+	for _, b := range Builtins.ByKind(kind) {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// builtinDocumentation formats the full documentation of a builtin: every
+// signature form, the doc text and a table of the parameters
+func builtinDocumentation(b *Builtin) string {
+	if b.Signature == "" {
+		return formatHoverContent(b)
+	}
+	doc := b.Doc
+	if doc == "" {
+		doc = b.Brief
+	}
+	var sb strings.Builder
+	forms := append([]string{b.Signature}, b.Overloads...)
+	fmt.Fprintf(&sb, "```spq\n%s\n```\n\n%s", strings.Join(forms, "\n"), doc)
+	if len(b.Parameters) > 0 {
+		sb.WriteString("\n\n| Parameter | Description |\n| --- | --- |")
+		for _, p := range b.Parameters {
+			fmt.Fprintf(&sb, "\n| `%s` | %s |", p.Name, strings.ReplaceAll(p.Doc, "|", `\|`))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,18 @@
+package main
+
+// definitionAt returns the declaration of the user-defined symbol under the
+// cursor. Builtins, fields and unresolved names have no definition.
+func definitionAt(uri string, tree *SyntaxTree, pos Position) *Location {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+	sym, _ := tree.Symbols().At(tree, offset)
+	if sym == nil {
+		return nil
+	}
+	return &Location{
+		URI:   uri,
+		Range: tree.Range(sym.Tok.pos, sym.Tok.end()),
+	}
+}
@@ -1,60 +1,242 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"log"
 	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
-
-	"github.com/brimdata/super/compiler/parser"
+	"sync"
+	"time"
 )
 
-// publishDiagnostics parses the document and publishes diagnostics
-func (s *Server) publishDiagnostics(uri, text string, version int) (interface{}, error) {
-	var diagnostics []Diagnostic
-	if isDataFile(uri) {
-		// Parse as SUP data file
-		diagnostics = parseDataFileAndGetDiagnostics(text)
-	} else {
-		// Parse as SuperSQL query
-		diagnostics = parseAndGetDiagnostics(text)
+// defaultDiagnosticsDelay is how long a document must stay unchanged before
+// it is re-parsed. Clients can override it with initializationOptions.
+const defaultDiagnosticsDelay = 250 * time.Millisecond
+
+// diagnosticScheduler debounces diagnostics per document. Each change resets
+// the URI's timer; when it fires, run computes and publishes diagnostics on
+// the timer's goroutine, off the read loop.
+type diagnosticScheduler struct {
+	run func(uri string, version int)
+
+	mu      sync.Mutex
+	delay   time.Duration
+	timers  map[string]*time.Timer
+	stopped bool
+	pending sync.WaitGroup
+}
+
+func newDiagnosticScheduler(delay time.Duration, run func(uri string, version int)) *diagnosticScheduler {
+	return &diagnosticScheduler{
+		run:    run,
+		delay:  delay,
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// setDelay changes the debounce delay for future changes
+func (d *diagnosticScheduler) setDelay(delay time.Duration) {
+	d.mu.Lock()
+	d.delay = delay
+	d.mu.Unlock()
+}
+
+// schedule queues diagnostics for a document version after the debounce
+// delay, replacing any run still waiting for an older version
+func (d *diagnosticScheduler) schedule(uri string, version int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.scheduleLocked(uri, version, d.delay)
+}
+
+// scheduleNow queues diagnostics for a document version without delay
+func (d *diagnosticScheduler) scheduleNow(uri string, version int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.scheduleLocked(uri, version, 0)
+}
+
+func (d *diagnosticScheduler) scheduleLocked(uri string, version int, delay time.Duration) {
+	if d.stopped {
+		return
+	}
+	d.cancelLocked(uri)
+
+	d.pending.Add(1)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		defer d.pending.Done()
+		d.mu.Lock()
+		if d.timers[uri] == timer {
+			delete(d.timers, uri)
+		}
+		d.mu.Unlock()
+		d.run(uri, version)
+	})
+	d.timers[uri] = timer
+}
+
+// cancel drops any diagnostics run still waiting for a document
+func (d *diagnosticScheduler) cancel(uri string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cancelLocked(uri)
+}
+
+func (d *diagnosticScheduler) cancelLocked(uri string) {
+	if timer, ok := d.timers[uri]; ok {
+		if timer.Stop() {
+			d.pending.Done()
+		}
+		delete(d.timers, uri)
+	}
+}
+
+// stop cancels waiting runs and waits for running ones to finish
+func (d *diagnosticScheduler) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	for uri := range d.timers {
+		d.cancelLocked(uri)
+	}
+	d.mu.Unlock()
+	d.pending.Wait()
+}
+
+// runDiagnostics computes and publishes diagnostics for one document version.
+// Versions superseded before or during parsing are dropped.
+func (s *Server) runDiagnostics(uri string, version int) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic computing diagnostics for %s: %v\n%s", uri, r, debug.Stack())
+		}
+	}()
+
+	doc, ok := s.documents.Get(uri)
+	if !ok || doc.Version != version {
+		return
+	}
+
+	diagnostics := s.documentDiagnostics(context.Background(), uri, doc.Syntax(), nil)
+
+	// Re-check under the publish lock so an older run can never overwrite
+	// diagnostics already published for a newer version
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	if current, ok := s.documents.Get(uri); !ok || current.Version != version {
+		log.Printf("Dropping stale diagnostics for %s (version=%d)", uri, version)
+		return
 	}
 
 	log.Printf("Publishing %d diagnostics for %s", len(diagnostics), uri)
 
-	params := PublishDiagnosticsParams{
+	err := s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
 		URI:         uri,
 		Version:     version,
 		Diagnostics: diagnostics,
+	})
+	if err != nil {
+		log.Printf("Error publishing diagnostics: %v", err)
 	}
+}
 
-	paramsBytes, err := json.Marshal(params)
-	if err != nil {
-		return nil, err
+// computeDiagnostics returns the diagnostics for a query or data document
+func computeDiagnostics(uri string, tree *SyntaxTree) []Diagnostic {
+	if isDataFile(uri) {
+		// Parse as SUP data file
+		return parseDataFileAndGetDiagnostics(tree.Text)
 	}
+	// Parse as SuperSQL query
+	return queryDiagnostics(tree)
+}
 
-	// Return a notification (no ID, no response expected)
-	return RPCMessage{
-		JSONRPC: "2.0",
-		Method:  "textDocument/publishDiagnostics",
-		Params:  paramsBytes,
-	}, nil
+// documentDiagnostics adds checks that depend on the rest of the workspace
+// to a document's own diagnostics. Unknown operators are only reported once
+// the workspace index is complete, since until then a missing declaration
+// may just not have been read yet. Callers checking many files pass the
+// workspace's callables, computed once; nil looks them up for this
+// document.
+func (s *Server) documentDiagnostics(ctx context.Context, uri string, tree *SyntaxTree, callables map[string][]indexedSymbol) []Diagnostic {
+	diagnostics := computeDiagnostics(uri, tree)
+	if isDataFile(uri) || !s.workspace.isReady() {
+		return diagnostics
+	}
+	if callables == nil {
+		callables = s.workspaceCallables(ctx, uri)
+	}
+	return append(diagnostics, unknownOperatorDiagnostics(tree, callables)...)
+}
+
+// unknownOperatorDiagnostics warns about stages that invoke an operator
+// that is neither a builtin, declared in the document, nor declared in
+// another workspace file
+func unknownOperatorDiagnostics(tree *SyntaxTree, workspace map[string][]indexedSymbol) []Diagnostic {
+	var diagnostics []Diagnostic
+	symbols := tree.Symbols()
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		if n.Kind == NodeStage {
+			if name := stageCallee(n); name != nil && symbols.IsUnresolvedCall(name) &&
+				Builtins.Lookup(name.value) == nil && len(workspace[name.value]) == 0 {
+				diagnostics = append(diagnostics, Diagnostic{
+					Range:    tree.Range(name.pos, name.end()),
+					Severity: DiagnosticSeverityWarning,
+					Code:     "unknown-operator",
+					Source:   "superdb-lsp",
+					Message:  fmt.Sprintf("unknown operator %q: not a builtin or declared in the workspace", name.value),
+				})
+			}
+		}
+		for _, c := range n.Children {
+			visit(c)
+		}
+	}
+	visit(tree.Root)
+	return diagnostics
+}
+
+// refreshDiagnostics re-checks open documents after declarations elsewhere
+// in the workspace change. Pull clients are asked to re-pull instead; the
+// request is coalesced, since a scan may change many files at once.
+func (s *Server) refreshDiagnostics() {
+	if s.pullDiagnostics {
+		if s.diagnosticRefresh && s.refreshPending.CompareAndSwap(false, true) {
+			time.AfterFunc(defaultDiagnosticsDelay, func() {
+				s.refreshPending.Store(false)
+				if err := s.request("workspace/diagnostic/refresh", nil); err != nil {
+					log.Printf("Error requesting diagnostic refresh: %v", err)
+				}
+			})
+		}
+		return
+	}
+	for _, doc := range s.documents.All() {
+		if !isDataFile(doc.URI) {
+			s.diagnostics.schedule(doc.URI, doc.Version)
+		}
+	}
 }
 
 // parseAndGetDiagnostics parses SuperSQL code and returns diagnostics
 func parseAndGetDiagnostics(text string) []Diagnostic {
+	return queryDiagnostics(parseSyntax(text))
+}
+
+// queryDiagnostics returns parser and migration diagnostics for a query
+func queryDiagnostics(tree *SyntaxTree) []Diagnostic {
 	var diagnostics []Diagnostic
 
 	// Parse using the brimdata/super compiler parser
-	_, err := parser.Parse("", []byte(text))
-	if err != nil {
-		diag := errorToDiagnostic(text, err)
+	if err := tree.ParseError(); err != nil {
+		diag := errorToDiagnostic(tree.Text, err)
 		diagnostics = append(diagnostics, diag)
 	}
 
 	// Add migration diagnostics for deprecated syntax
-	migrationDiags := getMigrationDiagnostics(text)
+	migrationDiags := migrationDiagnosticsFor(tree)
 	for _, md := range migrationDiags {
 		diagnostics = append(diagnostics, md.Diagnostic)
 	}
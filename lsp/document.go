@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+// document.go - Versioned document model and store.
+// Each Document is an immutable snapshot of one version of a file. Changes
+// produce a new Document, so readers can keep using the one they were handed.
+
+// Document is an immutable snapshot of an open text document
+type Document struct {
+	URI     string
+	Version int
+
+	rope     *rope
+	textOnce sync.Once
+	text     string
+
+	syntaxOnce sync.Once
+	syntax     *SyntaxTree
+}
+
+// NewDocument creates a document snapshot from its full text
+func NewDocument(uri string, version int, text string) *Document {
+	return &Document{
+		URI:     uri,
+		Version: version,
+		rope:    newRope(text),
+	}
+}
+
+// Text returns the full document text
+func (d *Document) Text() string {
+	d.textOnce.Do(func() {
+		d.text = d.rope.String()
+	})
+	return d.text
+}
+
+// Syntax returns the document's syntax tree, parsing it on first use. Each
+// version is parsed at most once, however many features ask for it.
+func (d *Document) Syntax() *SyntaxTree {
+	d.syntaxOnce.Do(func() {
+		d.syntax = parseSyntax(d.Text())
+	})
+	return d.syntax
+}
+
+// LineCount returns the number of lines in the document
+func (d *Document) LineCount() int {
+	return d.rope.LineCount()
+}
+
+// ApplyChanges returns a new snapshot with the change events applied in order.
+// Events without a range replace the whole document (full sync).
+func (d *Document) ApplyChanges(version int, changes []TextDocumentContentChangeEvent) (*Document, error) {
+	r := d.rope
+	for i, change := range changes {
+		if change.Range == nil {
+			r = newRope(change.Text)
+			continue
+		}
+		start := r.OffsetAt(change.Range.Start)
+		end := r.OffsetAt(change.Range.End)
+		if end < start {
+			return nil, fmt.Errorf("change %d: range end %d:%d before start %d:%d", i,
+				change.Range.End.Line, change.Range.End.Character,
+				change.Range.Start.Line, change.Range.Start.Character)
+		}
+		r = r.Replace(start, end, change.Text)
+	}
+	return &Document{URI: d.URI, Version: version, rope: r}, nil
+}
+
+// utf16ToByteOffset converts a UTF-16 column within a line into a byte offset
+func utf16ToByteOffset(line string, col int) int {
+	units := 0
+	for i, r := range line {
+		if units >= col {
+			return i
+		}
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return len(line)
+}
+
+// byteToUTF16Offset returns the number of UTF-16 code units in s
+func byteToUTF16Offset(s string) int {
+	units := 0
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+		s = s[size:]
+	}
+	return units
+}
+
+// DocumentStore holds the latest snapshot of every open document
+type DocumentStore struct {
+	mu   sync.RWMutex
+	docs map[string]*Document
+}
+
+// NewDocumentStore creates an empty document store
+func NewDocumentStore() *DocumentStore {
+	return &DocumentStore{docs: make(map[string]*Document)}
+}
+
+// Open stores a new document, replacing any previous snapshot for the URI
+func (s *DocumentStore) Open(uri string, version int, text string) *Document {
+	doc := NewDocument(uri, version, text)
+	s.mu.Lock()
+	s.docs[uri] = doc
+	s.mu.Unlock()
+	return doc
+}
+
+// Change applies change events to an open document. Versions must increase;
+// stale or duplicate versions are rejected and leave the document untouched.
+func (s *DocumentStore) Change(uri string, version int, changes []TextDocumentContentChangeEvent) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.docs[uri]
+	if !ok {
+		return nil, fmt.Errorf("document not open: %s", uri)
+	}
+	if version <= doc.Version {
+		return nil, fmt.Errorf("out-of-order change for %s: version %d after %d", uri, version, doc.Version)
+	}
+
+	next, err := doc.ApplyChanges(version, changes)
+	if err != nil {
+		return nil, fmt.Errorf("applying changes to %s: %w", uri, err)
+	}
+	s.docs[uri] = next
+	return next, nil
+}
+
+// Close removes a document from the store
+func (s *DocumentStore) Close(uri string) {
+	s.mu.Lock()
+	delete(s.docs, uri)
+	s.mu.Unlock()
+}
+
+// Get returns the current snapshot of a document
+func (s *DocumentStore) Get(uri string) (*Document, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, ok := s.docs[uri]
+	return doc, ok
+}
+
+// All returns every open document
+func (s *DocumentStore) All() []*Document {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	docs := make([]*Document, 0, len(s.docs))
+	for _, doc := range s.docs {
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// Snapshot returns a copy of the store that is unaffected by later changes
+func (s *DocumentStore) Snapshot() *DocumentStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	docs := make(map[string]*Document, len(s.docs))
+	for uri, doc := range s.docs {
+		docs[uri] = doc
+	}
+	return &DocumentStore{docs: docs}
+}
+
+type documentsKey struct{}
+
+// withDocuments attaches a document snapshot to a request context
+func withDocuments(ctx context.Context, docs *DocumentStore) context.Context {
+	return context.WithValue(ctx, documentsKey{}, docs)
+}
+
+// document looks up a document in the request's snapshot, falling back to
+// the live store for requests handled on the read loop
+func (s *Server) document(ctx context.Context, uri string) (*Document, bool) {
+	if docs, ok := ctx.Value(documentsKey{}).(*DocumentStore); ok {
+		return docs.Get(uri)
+	}
+	return s.documents.Get(uri)
+}
+
+// openDocuments returns every document in the request's snapshot
+func (s *Server) openDocuments(ctx context.Context) []*Document {
+	if docs, ok := ctx.Value(documentsKey{}).(*DocumentStore); ok {
+		return docs.All()
+	}
+	return s.documents.All()
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brimdata/super"
+)
+
+// eval.go - Estimated values of constant expressions for hover previews.
+// Expressions built from literals, constants, casts and operators are
+// evaluated in-process, under a time budget, to values rendered in SUP
+// form. This is not the super runtime, so hover labels the result as an
+// estimate, and only a conservative subset is evaluated: anything that
+// reads input data, calls a function, or whose result the runtime might
+// compute differently, such as casts of loosely formatted strings, is not.
+
+// evalBudget bounds the time spent evaluating one expression
+const evalBudget = 50 * time.Millisecond
+
+// evalStringLimit bounds the length of strings built by concatenation, so
+// constants that double a string on each reference can't outrun the budget
+const evalStringLimit = 1 << 16
+
+var (
+	// errNotConstant marks expressions that aren't evaluated; hover shows
+	// no value for them rather than an error
+	errNotConstant = errors.New("not a constant expression")
+	errEvalBudget  = errors.New("evaluation exceeded its time budget")
+	// errDurationRange marks a well-formed duration too long to represent
+	errDurationRange = errors.New("duration out of range")
+)
+
+// constant is an evaluated value. val holds an int64 for signed integers,
+// uint64 for unsigned integers, float64, string, bool, time.Time,
+// time.Duration, netip.Addr, or nil for null.
+type constant struct {
+	typ super.Type
+	val any
+}
+
+type evaluator struct {
+	symbols  *Symbols
+	deadline time.Time
+	seen     map[*Node]bool       // Constant declarations being evaluated
+	values   map[*Node]evalResult // Constant declarations already evaluated
+}
+
+// evalResult is the outcome of evaluating a constant declaration
+type evalResult struct {
+	c   constant
+	err error
+}
+
+// evalConstant evaluates the terms of an expression
+func evalConstant(tree *SyntaxTree, terms []*Node) (constant, error) {
+	e := &evaluator{
+		symbols:  tree.Symbols(),
+		deadline: time.Now().Add(evalBudget),
+		seen:     make(map[*Node]bool),
+		values:   make(map[*Node]evalResult),
+	}
+	return e.terms(terms)
+}
+
+func (e *evaluator) terms(terms []*Node) (constant, error) {
+	if time.Now().After(e.deadline) {
+		return constant{}, errEvalBudget
+	}
+	if len(terms) == 0 {
+		return constant{}, errNotConstant
+	}
+	// and binds tighter than or
+	for _, ops := range []map[string]bool{orOps, andOps} {
+		if i := lastBinaryOp(terms, ops); i >= 0 {
+			return e.binary(terms, i, logical)
+		}
+	}
+	if i := lastBinaryOp(terms, comparisonOps); i >= 0 {
+		return e.binary(terms, i, compare)
+	}
+	for _, ops := range []map[string]bool{additiveOps, multiplicativeOps} {
+		if i := lastBinaryOp(terms, ops); i >= 0 {
+			return e.binary(terms, i, arith)
+		}
+	}
+
+	first := terms[0]
+	if first.Kind == NodeToken && len(terms) > 1 {
+		switch strings.ToLower(first.Tok.value) {
+		case "-":
+			// A minus sign and a number form one literal, so the most
+			// negative integer is in range
+			if len(terms) == 2 && terms[1].Kind == NodeToken && terms[1].Tok.typ == tokNumber {
+				return parseLiteral(&token{typ: tokNumber, value: "-" + terms[1].Tok.value})
+			}
+			c, err := e.terms(terms[1:])
+			if err != nil {
+				return c, err
+			}
+			return negate(c)
+		case "!", "not":
+			c, err := e.terms(terms[1:])
+			if err != nil {
+				return c, err
+			}
+			if b, ok := c.val.(bool); ok {
+				return newConstant("bool", !b), nil
+			}
+			return constant{}, errNotConstant
+		}
+	}
+	if n := len(terms); n >= 3 && isCast(terms[n-2]) {
+		typ := castType(terms[n-1])
+		if typ == nil {
+			return constant{}, errNotConstant
+		}
+		c, err := e.terms(terms[:n-2])
+		if err != nil {
+			return c, err
+		}
+		return cast(c, typeName(typ))
+	}
+	if len(terms) == 1 {
+		return e.term(first)
+	}
+	return constant{}, errNotConstant
+}
+
+// binary evaluates both operands of the operator at index i and combines
+// them
+func (e *evaluator) binary(terms []*Node, i int, combine func(op string, l, r constant) (constant, error)) (constant, error) {
+	left, err := e.terms(terms[:i])
+	if err != nil {
+		return left, err
+	}
+	right, err := e.terms(terms[i+1:])
+	if err != nil {
+		return right, err
+	}
+	return combine(strings.ToLower(terms[i].Tok.value), left, right)
+}
+
+// term evaluates a single operand
+func (e *evaluator) term(n *Node) (constant, error) {
+	switch n.Kind {
+	case NodeToken:
+		if literalTokenType(n.Tok) != "" {
+			return parseLiteral(n.Tok)
+		}
+		sym := e.symbols.refs[n.Tok]
+		if sym == nil || sym.Kind != SymbolConst || e.seen[sym.Decl] {
+			return constant{}, errNotConstant
+		}
+		// Each constant is evaluated once, however often it is referenced
+		if r, ok := e.values[sym.Decl]; ok {
+			return r.c, r.err
+		}
+		value := constValue(sym.Decl)
+		if value == nil {
+			return constant{}, errNotConstant
+		}
+		e.seen[sym.Decl] = true
+		c, err := e.terms(value.Children)
+		delete(e.seen, sym.Decl)
+		e.values[sym.Decl] = evalResult{c, err}
+		return c, err
+	case NodeGroup:
+		if n.Closed() && n.leafAt(0).value == "(" && len(n.Children) == 3 && n.Children[1].Kind == NodeExpr {
+			return e.terms(n.Children[1].Children)
+		}
+	}
+	return constant{}, errNotConstant
+}
+
+func newConstant(typ string, val any) constant {
+	return constant{typ: super.LookupPrimitive(typ), val: val}
+}
+
+// parseLiteral evaluates a literal token
+func parseLiteral(tok *token) (constant, error) {
+	typ := literalTokenType(tok)
+	v := tok.value
+	switch typ {
+	case "string":
+		s, err := unquote(v)
+		if err != nil {
+			return constant{}, errNotConstant
+		}
+		return newConstant(typ, s), nil
+	case "int64":
+		i, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return constant{}, fmt.Errorf("integer literal %s out of range", v)
+		}
+		return newConstant(typ, i), nil
+	case "float64":
+		f, err := strconv.ParseFloat(v, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return constant{}, fmt.Errorf("float literal %s out of range", v)
+		}
+		if err != nil {
+			return constant{}, errNotConstant
+		}
+		return newConstant(typ, f), nil
+	case "duration":
+		d, err := parseDuration(v)
+		if errors.Is(err, errDurationRange) {
+			return constant{}, err
+		}
+		if err != nil {
+			return constant{}, errNotConstant
+		}
+		return newConstant(typ, d), nil
+	case "ip":
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return constant{}, errNotConstant
+		}
+		return newConstant(typ, addr), nil
+	case "bool":
+		return newConstant(typ, strings.EqualFold(v, "true")), nil
+	case "null":
+		return newConstant(typ, nil), nil
+	}
+	return constant{}, errNotConstant
+}
+
+// unquote decodes a single- or double-quoted string literal. Raw strings
+// keep their backslashes; format strings interpolate, so they aren't
+// constants.
+func unquote(s string) (string, error) {
+	if strings.HasPrefix(s, "f") || !isTerminatedString(s) {
+		return "", errNotConstant
+	}
+	if strings.HasPrefix(s, "r") {
+		return s[2 : len(s)-1], nil
+	}
+	quote, body := s[0], s[1:len(s)-1]
+	if quote != '\'' && quote != '"' {
+		return "", errNotConstant
+	}
+	var b strings.Builder
+	for len(body) > 0 {
+		r, _, rest, err := strconv.UnquoteChar(body, quote)
+		if err != nil {
+			return "", err
+		}
+		b.WriteRune(r)
+		body = rest
+	}
+	return b.String(), nil
+}
+
+// Duration units, longest suffix first where suffixes overlap
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"ns", time.Nanosecond},
+	{"us", time.Microsecond},
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// parseDuration parses a duration such as 1h30m, 1.5s or -5d
+func parseDuration(s string) (time.Duration, error) {
+	orig := s
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q", orig)
+	}
+	var total float64
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		n, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		s = s[i:]
+		found := false
+		for _, u := range durationUnits {
+			if strings.HasPrefix(s, u.suffix) {
+				total += n * float64(u.unit)
+				s = s[len(u.suffix):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+	}
+	if total >= math.MaxInt64 {
+		return 0, fmt.Errorf("%w: %s", errDurationRange, orig)
+	}
+	if neg {
+		total = -total
+	}
+	return time.Duration(total), nil
+}
+
+// formatDuration renders a duration the way SUP writes it, from days down
+// to fractional seconds, e.g. 1d2h, 1h30m or 1.5s
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	// The magnitude is unsigned, since the most negative duration has no
+	// positive counterpart
+	mag := uint64(d)
+	if d < 0 {
+		b.WriteByte('-')
+		mag = -mag
+	}
+	if mag < uint64(time.Second) {
+		for _, u := range []struct {
+			suffix string
+			unit   time.Duration
+		}{{"ms", time.Millisecond}, {"us", time.Microsecond}, {"ns", time.Nanosecond}} {
+			if mag >= uint64(u.unit) {
+				b.WriteString(strconv.FormatFloat(float64(mag)/float64(u.unit), 'f', -1, 64) + u.suffix)
+				return b.String()
+			}
+		}
+	}
+	for _, u := range []struct {
+		suffix string
+		unit   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}} {
+		if mag >= uint64(u.unit) {
+			fmt.Fprintf(&b, "%d%s", mag/uint64(u.unit), u.suffix)
+			mag %= uint64(u.unit)
+		}
+	}
+	if mag > 0 {
+		b.WriteString(strconv.FormatFloat(float64(mag)/float64(time.Second), 'f', -1, 64) + "s")
+	}
+	return b.String()
+}
+
+// Widths of the integer types, for range-checked casts
+var intBits = map[string]int{
+	"int8": 8, "int16": 16, "int32": 32, "int64": 64,
+	"uint8": 8, "uint16": 16, "uint32": 32, "uint64": 64,
+}
+
+// cast converts a constant to a primitive type. Only conversions whose
+// result is certain are previewed: strings that spell a literal of the
+// target type, as in '80'::uint16 or '1h'::duration, and values whose text
+// form is unambiguous when cast to string. Spellings the runtime may or
+// may not accept, such as ' 80' or '2024-01-01', aren't evaluated.
+func cast(c constant, to string) (constant, error) {
+	from := typeName(c.typ)
+	if from == to {
+		return c, nil
+	}
+	if c.val == nil {
+		return newConstant("null", nil), nil
+	}
+	if s, ok := c.val.(string); ok && to != "string" {
+		if to == "time" {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return constant{}, errNotConstant
+			}
+			return newConstant(to, t.UTC()), nil
+		}
+		if to == "bool" && (s == "true" || s == "false") {
+			return newConstant(to, s == "true"), nil
+		}
+		lit, ok := literalOf(s)
+		if !ok {
+			return constant{}, errNotConstant
+		}
+		c = lit
+		if typeName(c.typ) == to {
+			return c, nil
+		}
+	}
+	switch {
+	case to == "string":
+		switch c.val.(type) {
+		case int64, uint64, bool, netip.Addr:
+			return newConstant(to, formatValue(c)), nil
+		}
+	case intBits[to] > 0:
+		if v, ok := castInt(c.val, to); ok {
+			return newConstant(to, v), nil
+		}
+		if isNumeric(c.typ) {
+			return constant{}, fmt.Errorf("cannot cast %s to %s", formatConstant(c), to)
+		}
+	case strings.HasPrefix(to, "float"):
+		if f, ok := toFloat(c); ok {
+			if to == "float32" {
+				f = float64(float32(f))
+			}
+			return newConstant(to, f), nil
+		}
+	}
+	// Other conversions aren't previewed
+	return constant{}, errNotConstant
+}
+
+// literalOf evaluates a string that spells a single number, duration or IP
+// literal, optionally negated, exactly as it would be written in a query
+func literalOf(s string) (constant, bool) {
+	body := strings.TrimPrefix(s, "-")
+	toks := tokenize(body)
+	if len(toks) != 1 || toks[0].typ != tokNumber || toks[0].value != body {
+		return constant{}, false
+	}
+	c, err := parseLiteral(&token{typ: tokNumber, value: s})
+	return c, err == nil
+}
+
+// castInt converts a number to an integer type, truncating floats, and
+// reports whether it fits
+func castInt(val any, to string) (any, bool) {
+	bits := intBits[to]
+	unsigned := strings.HasPrefix(to, "uint")
+	switch v := val.(type) {
+	case int64:
+		if unsigned {
+			return uint64(v), v >= 0 && (bits == 64 || uint64(v) < 1<<bits)
+		}
+		return v, bits == 64 || (v >= -1<<(bits-1) && v < 1<<(bits-1))
+	case uint64:
+		if unsigned {
+			return v, bits == 64 || v < 1<<bits
+		}
+		return int64(v), v < 1<<(bits-1)
+	case float64:
+		v = math.Trunc(v)
+		if unsigned {
+			return uint64(v), v >= 0 && v < math.Ldexp(1, bits)
+		}
+		limit := math.Ldexp(1, bits-1)
+		return int64(v), v >= -limit && v < limit
+	}
+	return nil, false
+}
+
+// toFloat returns the value of a numeric constant as a float64
+func toFloat(c constant) (float64, bool) {
+	switch v := c.val.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// negate evaluates unary minus. Negating an unsigned integer other than
+// zero, or the most negative value of a signed type, overflows.
+func negate(c constant) (constant, error) {
+	switch v := c.val.(type) {
+	case int64, uint64:
+		return fitInt(new(big.Int).Neg(bigInt(c)), c.typ)
+	case float64:
+		return constant{c.typ, -v}, nil
+	case time.Duration:
+		if v == math.MinInt64 {
+			return constant{}, errDurationRange
+		}
+		return constant{c.typ, -v}, nil
+	}
+	return constant{}, errNotConstant
+}
+
+func logical(op string, l, r constant) (constant, error) {
+	a, ok1 := l.val.(bool)
+	b, ok2 := r.val.(bool)
+	if !ok1 || !ok2 {
+		return constant{}, errNotConstant
+	}
+	if op == "and" || op == "&&" {
+		return newConstant("bool", a && b), nil
+	}
+	return newConstant("bool", a || b), nil
+}
+
+// compare evaluates comparisons between values of the same kind, or
+// between numbers
+func compare(op string, l, r constant) (constant, error) {
+	var cmp int
+	lf, lnum := toFloat(l)
+	rf, rnum := toFloat(r)
+	switch a := l.val.(type) {
+	case string:
+		b, ok := r.val.(string)
+		if !ok {
+			return constant{}, errNotConstant
+		}
+		cmp = strings.Compare(a, b)
+	case time.Time:
+		b, ok := r.val.(time.Time)
+		if !ok {
+			return constant{}, errNotConstant
+		}
+		cmp = a.Compare(b)
+	case time.Duration:
+		b, ok := r.val.(time.Duration)
+		if !ok {
+			return constant{}, errNotConstant
+		}
+		cmp = compareOrdered(a, b)
+	case bool:
+		b, ok := r.val.(bool)
+		if !ok || (op != "==" && op != "!=") {
+			return constant{}, errNotConstant
+		}
+		cmp = 1
+		if a == b {
+			cmp = 0
+		}
+	default:
+		if !lnum || !rnum {
+			return constant{}, errNotConstant
+		}
+		if a, ok := l.val.(int64); ok {
+			if b, ok := r.val.(int64); ok {
+				cmp = compareOrdered(a, b)
+				break
+			}
+		}
+		cmp = compareOrdered(lf, rf)
+	}
+	var result bool
+	switch op {
+	case "==":
+		result = cmp == 0
+	case "!=":
+		result = cmp != 0
+	case "<":
+		result = cmp < 0
+	case "<=":
+		result = cmp <= 0
+	case ">":
+		result = cmp > 0
+	case ">=":
+		result = cmp >= 0
+	default:
+		return constant{}, errNotConstant
+	}
+	return newConstant("bool", result), nil
+}
+
+func compareOrdered[T int64 | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// arith evaluates arithmetic, with the result type given by arithType
+func arith(op string, l, r constant) (constant, error) {
+	typ := arithType(op, l.typ, r.typ)
+	if typ == nil {
+		if l.val == nil || r.val == nil {
+			return constant{}, errNotConstant
+		}
+		return constant{}, fmt.Errorf("incompatible types %s and %s", typeName(l.typ), typeName(r.typ))
+	}
+	switch name := typeName(typ); {
+	case strings.HasPrefix(name, "float"):
+		a, _ := toFloat(l)
+		b, _ := toFloat(r)
+		return constant{typ, arithFloat(op, a, b)}, nil
+	case isNumeric(typ):
+		return arithInt(op, l, r, typ)
+	case name == "string":
+		a, b := l.val.(string), r.val.(string)
+		if len(a)+len(b) > evalStringLimit {
+			return constant{}, errNotConstant
+		}
+		return constant{typ, a + b}, nil
+	case name == "time":
+		if t, ok := l.val.(time.Time); ok {
+			d := r.val.(time.Duration)
+			if op == "-" {
+				d = -d
+			}
+			return constant{typ, t.Add(d)}, nil
+		}
+		return constant{typ, r.val.(time.Time).Add(l.val.(time.Duration))}, nil
+	case name == "duration":
+		if t, ok := l.val.(time.Time); ok {
+			// Sub saturates rather than overflowing
+			d := t.Sub(r.val.(time.Time))
+			if d == math.MaxInt64 || d == math.MinInt64 {
+				return constant{}, errDurationRange
+			}
+			return constant{typ, d}, nil
+		}
+		if _, ok := l.val.(time.Duration); !ok {
+			l, r = r, l // A number times a duration
+		}
+		d := l.val.(time.Duration)
+		if e, ok := r.val.(time.Duration); ok {
+			return fitDuration(op, big.NewInt(int64(d)), big.NewInt(int64(e)), typ)
+		}
+		f, _ := toFloat(r)
+		p := float64(d) * f
+		if op == "/" {
+			if f == 0 {
+				return constant{}, errors.New("divide by zero")
+			}
+			p = float64(d) / f
+		}
+		if math.IsNaN(p) || p >= math.Ldexp(1, 63) || p < -math.Ldexp(1, 63) {
+			return constant{}, errDurationRange
+		}
+		return constant{typ, time.Duration(p)}, nil
+	}
+	return constant{}, errNotConstant
+}
+
+// bigInt returns a signed or unsigned integer constant as a big.Int
+func bigInt(c constant) *big.Int {
+	if u, ok := c.val.(uint64); ok {
+		return new(big.Int).SetUint64(u)
+	}
+	return big.NewInt(c.val.(int64))
+}
+
+// arithInt evaluates integer arithmetic exactly, so results that don't fit
+// the result type are reported rather than wrapped
+func arithInt(op string, l, r constant, typ super.Type) (constant, error) {
+	a, b := bigInt(l), bigInt(r)
+	if (op == "/" || op == "%") && b.Sign() == 0 {
+		return constant{}, errors.New("divide by zero")
+	}
+	z := new(big.Int)
+	switch op {
+	case "+":
+		z.Add(a, b)
+	case "-":
+		z.Sub(a, b)
+	case "*":
+		z.Mul(a, b)
+	case "/":
+		z.Quo(a, b)
+	default:
+		z.Rem(a, b)
+	}
+	return fitInt(z, typ)
+}
+
+// fitInt converts an exact integer to a constant of an integer type, or
+// reports that it overflows the type
+func fitInt(z *big.Int, typ super.Type) (constant, error) {
+	name := typeName(typ)
+	bits := intBits[name]
+	if bits == 0 {
+		return constant{}, errNotConstant
+	}
+	if strings.HasPrefix(name, "uint") {
+		if z.Sign() < 0 || z.BitLen() > bits {
+			return constant{}, fmt.Errorf("%s overflows %s", z, name)
+		}
+		return constant{typ, z.Uint64()}, nil
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits-1))
+	if z.Cmp(limit) >= 0 || z.Cmp(limit.Neg(limit)) < 0 {
+		return constant{}, fmt.Errorf("%s overflows %s", z, name)
+	}
+	return constant{typ, z.Int64()}, nil
+}
+
+// fitDuration adds or subtracts two durations, reporting overflow
+func fitDuration(op string, a, b *big.Int, typ super.Type) (constant, error) {
+	z := new(big.Int)
+	if op == "-" {
+		z.Sub(a, b)
+	} else {
+		z.Add(a, b)
+	}
+	if !z.IsInt64() {
+		return constant{}, errDurationRange
+	}
+	return constant{typ, time.Duration(z.Int64())}, nil
+}
+
+func arithFloat(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	}
+	return math.Mod(a, b)
+}
+
+// defaultTypes are the types SUP infers from an undecorated value
+var defaultTypes = map[string]bool{
+	"int64": true, "float64": true, "string": true, "bool": true, "null": true,
+	"duration": true, "time": true, "ip": true,
+}
+
+// formatConstant renders a constant in SUP, decorating values whose type
+// SUP wouldn't infer, as in 80::uint16
+func formatConstant(c constant) string {
+	s := formatValue(c)
+	if name := typeName(c.typ); !defaultTypes[name] {
+		s += "::" + name
+	}
+	return s
+}
+
+// formatValue renders a constant's value in SUP without a decorator
+func formatValue(c constant) string {
+	switch v := c.val.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			return "+Inf"
+		case math.IsInf(v, -1):
+			return "-Inf"
+		case math.IsNaN(v):
+			return "NaN"
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += "."
+		}
+		return s
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Duration:
+		return formatDuration(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case netip.Addr:
+		return v.String()
+	}
+	return fmt.Sprint(c.val)
+}
+
+// formatEvalResult renders the outcome of an evaluation for hover: the
+// value, the error it raised, or nothing for expressions that aren't
+// evaluated
+func formatEvalResult(c constant, err error) string {
+	switch {
+	case errors.Is(err, errNotConstant):
+		return ""
+	case err != nil:
+		return fmt.Sprintf("\n\nEstimated error: %s", err)
+	}
+	return fmt.Sprintf("\n\nEstimated value: `%s`", formatConstant(c))
+}
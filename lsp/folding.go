@@ -0,0 +1,135 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// folding.go - Folding ranges for bracketed blocks, multi-line pipelines
+// and branches, comments, and "-- region" markers. Data files fold their
+// multi-line records, arrays, sets and maps.
+
+var (
+	regionStart = regexp.MustCompile(`^--\s*#?region\b`)
+	regionEnd   = regexp.MustCompile(`^--\s*#?endregion\b`)
+)
+
+// foldingRanges returns the folding ranges of a document, ordered by start
+// line
+func foldingRanges(tree *SyntaxTree, dataFile bool) []FoldingRange {
+	f := &folder{tree: tree, ranges: []FoldingRange{}, seen: make(map[[2]int]bool)}
+	f.node(tree.Root, dataFile)
+	f.comments()
+	sort.SliceStable(f.ranges, func(i, j int) bool {
+		a, b := f.ranges[i], f.ranges[j]
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.EndLine > b.EndLine
+	})
+	return f.ranges
+}
+
+type folder struct {
+	tree   *SyntaxTree
+	ranges []FoldingRange
+	seen   map[[2]int]bool
+}
+
+// add records a range spanning more than one line. A block and the
+// pipeline it encloses often cover the same lines; only one is kept.
+func (f *folder) add(start, end int, kind string) {
+	if end <= start || f.seen[[2]int{start, end}] {
+		return
+	}
+	f.seen[[2]int{start, end}] = true
+	f.ranges = append(f.ranges, FoldingRange{StartLine: start, EndLine: end, Kind: kind})
+}
+
+func (f *folder) line(offset int) int {
+	return f.tree.PositionAt(offset).Line
+}
+
+// node folds bracket groups everywhere, and pipelines and fork/switch
+// branches in queries
+func (f *folder) node(n *Node, dataFile bool) {
+	switch n.Kind {
+	case NodeGroup:
+		end := f.line(n.End)
+		if n.Closed() {
+			// Keep the closing bracket visible
+			closer := n.Children[len(n.Children)-1]
+			end = f.line(closer.Start) - 1
+		}
+		f.add(f.line(n.Start), end, "")
+	case NodePipeline, NodeBranch:
+		if !dataFile {
+			f.add(f.line(n.Start), f.line(n.End), "")
+		}
+	}
+	for _, c := range n.Children {
+		f.node(c, dataFile)
+	}
+}
+
+// comments folds block comments, runs of line comments and regions
+func (f *folder) comments() {
+	var regions []int
+	runStart, runEnd := -1, -1
+	endRun := func() {
+		if runStart >= 0 {
+			f.add(runStart, runEnd, FoldingRangeKindComment)
+		}
+		runStart, runEnd = -1, -1
+	}
+
+	for i, tok := range f.tree.Tokens {
+		if tok.typ != tokComment {
+			if tok.typ != tokWhitespace && tok.typ != tokNewline {
+				endRun()
+			}
+			continue
+		}
+		line := f.line(tok.pos)
+		switch {
+		case strings.HasPrefix(tok.value, "/*"):
+			endRun()
+			f.add(line, f.line(tok.end()), FoldingRangeKindComment)
+		case regionStart.MatchString(tok.value):
+			endRun()
+			regions = append(regions, line)
+		case regionEnd.MatchString(tok.value):
+			endRun()
+			if len(regions) > 0 {
+				f.add(regions[len(regions)-1], line, FoldingRangeKindRegion)
+				regions = regions[:len(regions)-1]
+			}
+		case !f.startsLine(i):
+			// A trailing comment after code on the same line
+			endRun()
+		case runStart >= 0 && line == runEnd+1:
+			runEnd = line
+		default:
+			endRun()
+			runStart, runEnd = line, line
+		}
+	}
+	endRun()
+}
+
+// startsLine reports whether only whitespace precedes the i-th token on
+// its line
+func (f *folder) startsLine(i int) bool {
+	for i--; i >= 0; i-- {
+		switch f.tree.Tokens[i].typ {
+		case tokNewline:
+			return true
+		case tokWhitespace:
+			continue
+		default:
+			return false
+		}
+	}
+	return true
+}
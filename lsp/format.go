@@ -3,6 +3,7 @@ package main
 import (
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // formatDocument formats a SuperSQL document
@@ -32,6 +33,12 @@ const (
 type token struct {
 	typ   tokenType
 	value string
+	pos   int // Byte offset of the token in the source text
+}
+
+// end returns the byte offset just past the token
+func (t token) end() int {
+	return t.pos + len(t.value)
 }
 
 // tokenize breaks the input into tokens
@@ -44,7 +51,7 @@ func tokenize(text string) []token {
 
 		// Newlines
 		if ch == '\n' {
-			tokens = append(tokens, token{tokNewline, "\n"})
+			tokens = append(tokens, token{typ: tokNewline, value: "\n"})
 			i++
 			continue
 		}
@@ -55,7 +62,7 @@ func tokenize(text string) []token {
 			for i < len(text) && (text[i] == ' ' || text[i] == '\t' || text[i] == '\r') {
 				i++
 			}
-			tokens = append(tokens, token{tokWhitespace, text[start:i]})
+			tokens = append(tokens, token{typ: tokWhitespace, value: text[start:i]})
 			continue
 		}
 
@@ -65,7 +72,7 @@ func tokenize(text string) []token {
 			for i < len(text) && text[i] != '\n' {
 				i++
 			}
-			tokens = append(tokens, token{tokComment, text[start:i]})
+			tokens = append(tokens, token{typ: tokComment, value: text[start:i]})
 			continue
 		}
 
@@ -79,7 +86,7 @@ func tokenize(text string) []token {
 			if i+1 < len(text) {
 				i += 2
 			}
-			tokens = append(tokens, token{tokComment, text[start:i]})
+			tokens = append(tokens, token{typ: tokComment, value: text[start:i]})
 			continue
 		}
 
@@ -103,7 +110,7 @@ func tokenize(text string) []token {
 			if i < len(text) {
 				i++ // skip closing quote
 			}
-			tokens = append(tokens, token{tokString, text[start:i]})
+			tokens = append(tokens, token{typ: tokString, value: text[start:i]})
 			continue
 		}
 
@@ -120,7 +127,7 @@ func tokenize(text string) []token {
 			}
 			if i < len(text) && text[i] == '/' {
 				i++ // skip closing /
-				tokens = append(tokens, token{tokRegexp, text[start:i]})
+				tokens = append(tokens, token{typ: tokRegexp, value: text[start:i]})
 				continue
 			}
 			// Not a regex, treat as operator
@@ -130,24 +137,24 @@ func tokenize(text string) []token {
 		// Pipe operators
 		if ch == '|' {
 			if i+1 < len(text) && text[i+1] == '>' {
-				tokens = append(tokens, token{tokPipe, "|>"})
+				tokens = append(tokens, token{typ: tokPipe, value: "|>"})
 				i += 2
 				continue
 			}
 			if i+1 < len(text) && text[i+1] == '|' {
 				// String concatenation operator
-				tokens = append(tokens, token{tokOperator, "||"})
+				tokens = append(tokens, token{typ: tokOperator, value: "||"})
 				i += 2
 				continue
 			}
-			tokens = append(tokens, token{tokPipe, "|"})
+			tokens = append(tokens, token{typ: tokPipe, value: "|"})
 			i++
 			continue
 		}
 
 		// Multi-character operators
 		if i+2 < len(text) && text[i:i+3] == "..." {
-			tokens = append(tokens, token{tokOperator, "..."})
+			tokens = append(tokens, token{typ: tokOperator, value: "..."})
 			i += 3
 			continue
 		}
@@ -155,8 +162,8 @@ func tokenize(text string) []token {
 			twoChar := text[i : i+2]
 			if twoChar == ":=" || twoChar == "::" || twoChar == "->" ||
 				twoChar == "==" || twoChar == "!=" || twoChar == "<>" ||
-				twoChar == "<=" || twoChar == ">=" || twoChar == "!~" {
-				tokens = append(tokens, token{tokOperator, twoChar})
+				twoChar == "<=" || twoChar == ">=" || twoChar == "!~" || twoChar == "=>" {
+				tokens = append(tokens, token{typ: tokOperator, value: twoChar})
 				i += 2
 				continue
 			}
@@ -164,13 +171,13 @@ func tokenize(text string) []token {
 
 		// Single-character operators and punctuation
 		if strings.ContainsRune("+-*/%<>=!~", rune(ch)) {
-			tokens = append(tokens, token{tokOperator, string(ch)})
+			tokens = append(tokens, token{typ: tokOperator, value: string(ch)})
 			i++
 			continue
 		}
 
 		if strings.ContainsRune("()[]{},:;.?", rune(ch)) {
-			tokens = append(tokens, token{tokPunctuation, string(ch)})
+			tokens = append(tokens, token{typ: tokPunctuation, value: string(ch)})
 			i++
 			continue
 		}
@@ -199,11 +206,14 @@ func tokenize(text string) []token {
 					}
 				}
 			}
-			// Handle duration suffixes
-			for i < len(text) && isLetter(text[i]) {
-				i++
+			// Handle duration suffixes, including compound durations
+			// such as 1h30m
+			if i < len(text) && isLetter(text[i]) {
+				for i < len(text) && (isLetter(text[i]) || isDigit(text[i]) || text[i] == '.') {
+					i++
+				}
 			}
-			tokens = append(tokens, token{tokNumber, text[start:i]})
+			tokens = append(tokens, token{typ: tokNumber, value: text[start:i]})
 			continue
 		}
 
@@ -226,16 +236,24 @@ func tokenize(text string) []token {
 			}
 			word := text[start:i]
 			if isKeyword(word) {
-				tokens = append(tokens, token{tokKeyword, word})
+				tokens = append(tokens, token{typ: tokKeyword, value: word})
 			} else {
-				tokens = append(tokens, token{tokIdentifier, word})
+				tokens = append(tokens, token{typ: tokIdentifier, value: word})
 			}
 			continue
 		}
 
-		// Unknown character - preserve it
-		tokens = append(tokens, token{tokPunctuation, string(ch)})
-		i++
+		// Unknown character - preserve it, keeping multi-byte runes whole
+		_, size := utf8.DecodeRuneInString(text[i:])
+		tokens = append(tokens, token{typ: tokPunctuation, value: text[i : i+size]})
+		i += size
+	}
+
+	// Tokens cover the text contiguously, so offsets follow from lengths
+	pos := 0
+	for i := range tokens {
+		tokens[i].pos = pos
+		pos += len(tokens[i].value)
 	}
 
 	return tokens
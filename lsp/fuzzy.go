@@ -0,0 +1,51 @@
+package main
+
+import "unicode"
+
+// fuzzy.go - Fuzzy name matching for symbol search and completion.
+// A pattern matches a name when its characters appear in the name in order,
+// ignoring case. Matches score higher when they start the name, land on word
+// boundaries (after "_" or at a camelCase hump) or run consecutively, so
+// "gcu" ranks "getCurrentUser" above "debugCount".
+
+// fuzzyScore reports whether pattern matches name and how well. An empty
+// pattern matches everything with a score of zero.
+func fuzzyScore(pattern, name string) (int, bool) {
+	p, n := []rune(pattern), []rune(name)
+	score, pi, prev := 0, 0, -2
+	for ni := 0; ni < len(n) && pi < len(p); ni++ {
+		if unicode.ToLower(n[ni]) != unicode.ToLower(p[pi]) {
+			continue
+		}
+		score++
+		switch {
+		case ni == 0:
+			score += 8
+		case isWordStart(n, ni):
+			score += 5
+		}
+		if ni == prev+1 {
+			score += 3
+		}
+		if n[ni] == p[pi] {
+			score++
+		}
+		prev = ni
+		pi++
+	}
+	if pi < len(p) {
+		return 0, false
+	}
+	if len(p) == len(n) && score > 0 {
+		// Exact (case-insensitive) matches rank first
+		score += 10
+	}
+	return score, true
+}
+
+// isWordStart reports whether name[i] begins a word within an identifier
+func isWordStart(name []rune, i int) bool {
+	prev, cur := name[i-1], name[i]
+	return prev == '_' || prev == '.' || (unicode.IsLower(prev) && unicode.IsUpper(cur)) ||
+		(!unicode.IsDigit(prev) && unicode.IsDigit(cur))
+}
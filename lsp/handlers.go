@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"os"
+	"path/filepath"
+	"time"
 )
 
-// response creates an RPCMessage response with the given ID and result
+// jsonNull is used where JSON-RPC requires an explicit null
+var jsonNull = json.RawMessage("null")
+
+// response creates an RPCMessage response with the given ID and result.
+// A nil result is sent as an explicit null, as the spec requires.
 func response(id interface{}, result interface{}) (interface{}, error) {
+	if result == nil {
+		result = jsonNull
+	}
 	return RPCMessage{
 		JSONRPC: "2.0",
 		ID:      id,
@@ -14,28 +26,155 @@ func response(id interface{}, result interface{}) (interface{}, error) {
 	}, nil
 }
 
+// errorResponse creates an error response. Errors that are not already an
+// *RPCError are reported as InternalError with the error text as data.
+func errorResponse(id interface{}, err error) RPCMessage {
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		rpcErr = &RPCError{
+			Code:    InternalError,
+			Message: "internal error",
+			Data:    err.Error(),
+		}
+	}
+	if id == nil {
+		id = jsonNull
+	}
+	return RPCMessage{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   rpcErr,
+	}
+}
+
+// parseErrorResponse creates the response for a message that is not valid JSON
+func parseErrorResponse(err error) RPCMessage {
+	return errorResponse(nil, &RPCError{
+		Code:    ParseError,
+		Message: "parse error",
+		Data:    err.Error(),
+	})
+}
+
+// decodeParams unmarshals message params, reporting failures as InvalidParams
+func decodeParams(msg RPCMessage, v interface{}) error {
+	if err := json.Unmarshal(msg.Params, v); err != nil {
+		return &RPCError{
+			Code:    InvalidParams,
+			Message: "invalid params for " + msg.Method,
+			Data:    err.Error(),
+		}
+	}
+	return nil
+}
+
+// parseInitializationOptions decodes the options a client sent with
+// initialize. Clients send all sorts of values here, so anything that isn't
+// an object, and any option of the wrong type, is logged and ignored rather
+// than failing initialize.
+func parseInitializationOptions(raw json.RawMessage) InitializationOptions {
+	var opts InitializationOptions
+	var fields map[string]json.RawMessage
+	if len(raw) == 0 || string(raw) == "null" {
+		return opts
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		log.Printf("Ignoring initializationOptions: %v", err)
+		return opts
+	}
+	decode := func(name string, v interface{}) bool {
+		value, ok := fields[name]
+		if !ok {
+			return false
+		}
+		if err := json.Unmarshal(value, v); err != nil {
+			log.Printf("Ignoring initializationOptions.%s: %v", name, err)
+			return false
+		}
+		return true
+	}
+	var delay int
+	if decode("diagnosticsDelay", &delay) {
+		opts.DiagnosticsDelay = &delay
+	}
+	var sampleData map[string]string
+	if decode("sampleData", &sampleData) {
+		opts.SampleData = sampleData
+	}
+	return opts
+}
+
 // handleInitialize processes the initialize request
 func (s *Server) handleInitialize(msg RPCMessage) (interface{}, error) {
 	var params InitializeParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
 	log.Printf("Initialize: processId=%d, rootUri=%s", params.ProcessID, params.RootURI)
+	s.initializeReceived = true
+	if w := params.Capabilities.Workspace.DidChangeWatchedFiles; w != nil {
+		s.watchFiles = w.DynamicRegistration
+	}
+	s.pullDiagnostics = params.Capabilities.TextDocument.Diagnostic != nil
+	if d := params.Capabilities.Workspace.Diagnostics; d != nil {
+		s.diagnosticRefresh = d.RefreshSupport
+	}
+	s.snippetSupport = params.Capabilities.TextDocument.Completion.CompletionItem.SnippetSupport
+	if ds := params.Capabilities.TextDocument.DocumentSymbol; ds != nil {
+		s.hierarchicalSymbols = ds.HierarchicalDocumentSymbolSupport
+	}
+	if sh := params.Capabilities.TextDocument.SignatureHelp; sh != nil {
+		s.noActiveParameter = sh.SignatureInformation.NoActiveParameterSupport
+	}
+	// Index after reading the capabilities; the index reports its changes
+	// using them
+	s.workspace.start(workspaceFolders(params))
+
+	opts := parseInitializationOptions(params.InitializationOptions)
+	if opts.DiagnosticsDelay != nil {
+		s.diagnostics.setDelay(time.Duration(*opts.DiagnosticsDelay) * time.Millisecond)
+	}
+	s.sampleData = opts.SampleData
 
 	return response(msg.ID, InitializeResult{
 		Capabilities: ServerCapabilities{
-			TextDocumentSync: 1, // Full document sync
+			TextDocumentSync: TextDocumentSyncKindIncremental,
 			CompletionProvider: &CompletionOptions{
 				TriggerCharacters: []string{".", "|", "(", ":", "="},
-				ResolveProvider:   false,
+				ResolveProvider:   true,
+			},
+			HoverProvider:             true,
+			DefinitionProvider:        true,
+			ReferencesProvider:        true,
+			DocumentHighlightProvider: true,
+			DocumentSymbolProvider:    true,
+			WorkspaceSymbolProvider:   true,
+			Workspace: &WorkspaceOptions{
+				WorkspaceFolders: &WorkspaceFoldersOptions{Supported: true, ChangeNotifications: true},
+			},
+			RenameProvider: &RenameOptions{
+				PrepareProvider: params.Capabilities.TextDocument.Rename != nil &&
+					params.Capabilities.TextDocument.Rename.PrepareSupport,
 			},
-			HoverProvider: true,
 			SignatureHelpProvider: &SignatureHelpOptions{
 				TriggerCharacters:   []string{"(", ","},
 				RetriggerCharacters: []string{","},
 			},
+			DiagnosticProvider: &DiagnosticOptions{
+				Identifier:            "superdb",
+				InterFileDependencies: true,
+				WorkspaceDiagnostics:  true,
+			},
 			DocumentFormattingProvider: true,
+			FoldingRangeProvider:       true,
+			SelectionRangeProvider:     true,
+			InlayHintProvider:          true,
+			SemanticTokensProvider: &SemanticTokensOptions{
+				Legend: semanticTokensLegend(),
+				Range:  true,
+				Full:   &SemanticTokensFullOptions{Delta: true},
+			},
 			CodeActionProvider: &CodeActionOptions{
 				CodeActionKinds: []string{
 					CodeActionKindQuickFix,
@@ -54,13 +193,14 @@ func (s *Server) handleInitialize(msg RPCMessage) (interface{}, error) {
 func (s *Server) handleShutdown(msg RPCMessage) (interface{}, error) {
 	log.Println("Shutdown requested")
 	s.shutdown = true
+	s.workspace.stop()
 	return response(msg.ID, nil)
 }
 
 // handleDidOpen processes textDocument/didOpen notifications
 func (s *Server) handleDidOpen(msg RPCMessage) (interface{}, error) {
 	var params DidOpenTextDocumentParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
@@ -70,114 +210,292 @@ func (s *Server) handleDidOpen(msg RPCMessage) (interface{}, error) {
 	log.Printf("Document opened: %s (lang=%s, version=%d)",
 		uri, params.TextDocument.LanguageID, params.TextDocument.Version)
 
-	s.documents[uri] = text
-	return s.publishDiagnostics(uri, text, params.TextDocument.Version)
+	s.documents.Open(uri, params.TextDocument.Version, text)
+	if !s.pullDiagnostics {
+		s.diagnostics.scheduleNow(uri, params.TextDocument.Version)
+	}
+	return nil, nil
 }
 
 // handleDidChange processes textDocument/didChange notifications
 func (s *Server) handleDidChange(msg RPCMessage) (interface{}, error) {
 	var params DidChangeTextDocumentParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
 	uri := params.TextDocument.URI
+	if len(params.ContentChanges) == 0 {
+		return nil, nil
+	}
 
-	// With TextDocumentSync=1 (Full), we get the full document content
-	if len(params.ContentChanges) > 0 {
-		text := params.ContentChanges[len(params.ContentChanges)-1].Text
-		s.documents[uri] = text
-
-		log.Printf("Document changed: %s (version=%d)", uri, params.TextDocument.Version)
-		return s.publishDiagnostics(uri, text, params.TextDocument.Version)
+	// Changes are either ranged edits (incremental sync) or whole-document
+	// replacements (full sync); the store applies both in order.
+	doc, err := s.documents.Change(uri, params.TextDocument.Version, params.ContentChanges)
+	if err != nil {
+		return nil, err
 	}
 
+	log.Printf("Document changed: %s (version=%d, changes=%d)", uri, doc.Version, len(params.ContentChanges))
+	if !s.pullDiagnostics {
+		s.diagnostics.schedule(uri, doc.Version)
+	}
 	return nil, nil
 }
 
 // handleDidClose processes textDocument/didClose notifications
 func (s *Server) handleDidClose(msg RPCMessage) (interface{}, error) {
 	var params DidCloseTextDocumentParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
 	uri := params.TextDocument.URI
-	delete(s.documents, uri)
+	s.documents.Close(uri)
+	s.diagnostics.cancel(uri)
+	s.semanticTokens.forget(uri)
 
 	log.Printf("Document closed: %s", uri)
 	return nil, nil
 }
 
 // handleCompletion processes textDocument/completion requests
-func (s *Server) handleCompletion(msg RPCMessage) (interface{}, error) {
+func (s *Server) handleCompletion(ctx context.Context, msg RPCMessage) (interface{}, error) {
 	var params CompletionParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
-	text, ok := s.documents[params.TextDocument.URI]
+	doc, ok := s.document(ctx, params.TextDocument.URI)
 	if !ok {
 		log.Printf("Document not found: %s", params.TextDocument.URI)
 		return response(msg.ID, CompletionList{Items: []CompletionItem{}})
 	}
-
 	log.Printf("Completion request: %s at line=%d, char=%d",
 		params.TextDocument.URI, params.Position.Line, params.Position.Character)
 
-	return response(msg.ID, CompletionList{Items: getCompletions(text, params.Position)})
+	tree := doc.Syntax()
+	env := completionEnv{snippets: s.snippetSupport}
+	if path, ok := uriToPath(doc.URI); ok {
+		env.dir = filepath.Dir(path)
+		env.fields = s.sampleFields(tree, tree.OffsetAt(params.Position), path)
+	}
+	return response(msg.ID, completionList(completionsIn(tree, params.Position, env)))
+}
+
+// handleCompletionResolve processes completionItem/resolve requests,
+// adding the documentation of the selected item
+func (s *Server) handleCompletionResolve(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var item CompletionItem
+	if err := decodeParams(msg, &item); err != nil {
+		return nil, err
+	}
+	return response(msg.ID, resolveCompletion(item))
 }
 
 // handleHover processes textDocument/hover requests
-func (s *Server) handleHover(msg RPCMessage) (interface{}, error) {
+func (s *Server) handleHover(ctx context.Context, msg RPCMessage) (interface{}, error) {
 	var params HoverParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
-	text, ok := s.documents[params.TextDocument.URI]
+	doc, ok := s.document(ctx, params.TextDocument.URI)
 	if !ok {
 		log.Printf("Document not found: %s", params.TextDocument.URI)
 		return response(msg.ID, nil)
 	}
-
 	log.Printf("Hover request: %s at line=%d, char=%d",
 		params.TextDocument.URI, params.Position.Line, params.Position.Character)
 
-	return response(msg.ID, getHover(text, params.Position))
+	hover := hoverAt(doc.Syntax(), params.Position)
+	if hover == nil {
+		// Operators and functions from shared library files
+		if name := unresolvedCallAt(doc.Syntax(), params.Position); name != nil {
+			if defs := s.workspaceCallables(ctx, doc.URI)[name.value]; len(defs) > 0 {
+				hover = workspaceHover(defs, s.workspace.roots())
+			}
+		}
+	}
+	return response(msg.ID, hover)
+}
+
+// handleDefinition processes textDocument/definition requests
+func (s *Server) handleDefinition(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params DefinitionParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Definition request: %s at line=%d, char=%d",
+		params.TextDocument.URI, params.Position.Line, params.Position.Character)
+
+	if loc := definitionAt(doc.URI, doc.Syntax(), params.Position); loc != nil {
+		return response(msg.ID, loc)
+	}
+	// Operators and functions from shared library files
+	var locations []Location
+	if name := unresolvedCallAt(doc.Syntax(), params.Position); name != nil {
+		for _, def := range s.workspaceCallables(ctx, doc.URI)[name.value] {
+			locations = append(locations, def.Location)
+		}
+	}
+	return response(msg.ID, locations)
+}
+
+// handleReferences processes textDocument/references requests
+func (s *Server) handleReferences(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params ReferenceParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("References request: %s at line=%d, char=%d",
+		params.TextDocument.URI, params.Position.Line, params.Position.Character)
+
+	return response(msg.ID, referencesAt(doc.URI, doc.Syntax(), params.Position, params.Context.IncludeDeclaration))
+}
+
+// handleDocumentHighlight processes textDocument/documentHighlight requests
+func (s *Server) handleDocumentHighlight(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params DocumentHighlightParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+
+	return response(msg.ID, highlightsAt(doc.Syntax(), params.Position))
+}
+
+// handlePrepareRename processes textDocument/prepareRename requests
+func (s *Server) handlePrepareRename(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params PrepareRenameParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+
+	result, err := prepareRenameAt(doc.Syntax(), params.Position)
+	if err != nil {
+		return nil, err
+	}
+	return response(msg.ID, result)
+}
+
+// handleRename processes textDocument/rename requests. Renaming a top-level
+// fn or op also renames its calls in other workspace files. Renames that
+// would shadow a builtin still go ahead, but the client is warned.
+func (s *Server) handleRename(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params RenameParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Rename request: %s at line=%d, char=%d to %q",
+		params.TextDocument.URI, params.Position.Line, params.Position.Character, params.NewName)
+
+	edit, warnings, err := renameAt(doc.URI, doc.Syntax(), params.Position, params.NewName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.renameInWorkspace(ctx, doc.URI, doc.Syntax(), params.Position, params.NewName, edit); err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		if err := s.notify("window/showMessage", ShowMessageParams{Type: MessageTypeWarning, Message: warning}); err != nil {
+			log.Printf("Error sending rename warning: %v", err)
+		}
+	}
+	return response(msg.ID, edit)
+}
+
+// handleDocumentSymbol processes textDocument/documentSymbol requests
+func (s *Server) handleDocumentSymbol(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params DocumentSymbolParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+
+	symbols := documentSymbols(doc.Syntax())
+	if !s.hierarchicalSymbols {
+		return response(msg.ID, flattenSymbols(doc.URI, symbols, ""))
+	}
+	return response(msg.ID, symbols)
 }
 
 // handleSignatureHelp processes textDocument/signatureHelp requests
-func (s *Server) handleSignatureHelp(msg RPCMessage) (interface{}, error) {
+func (s *Server) handleSignatureHelp(ctx context.Context, msg RPCMessage) (interface{}, error) {
 	var params SignatureHelpParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
-	text, ok := s.documents[params.TextDocument.URI]
+	doc, ok := s.document(ctx, params.TextDocument.URI)
 	if !ok {
 		log.Printf("Document not found: %s", params.TextDocument.URI)
 		return response(msg.ID, nil)
 	}
-
 	log.Printf("Signature help request: %s at line=%d, char=%d",
 		params.TextDocument.URI, params.Position.Line, params.Position.Character)
 
-	return response(msg.ID, getSignatureHelp(text, params.Position))
+	help := signatureHelpAt(doc.Syntax(), params.Position)
+	if help == nil {
+		// Operators and functions from shared library files
+		lookup := func(name string) []indexedSymbol {
+			return s.workspaceCallables(ctx, doc.URI)[name]
+		}
+		help = workspaceSignatureHelp(doc.Syntax(), params.Position, lookup, s.workspace.roots())
+	}
+	if help != nil && !s.noActiveParameter {
+		help.replaceNullActiveParameter()
+	}
+	return response(msg.ID, help)
 }
 
 // handleFormatting processes textDocument/formatting requests
-func (s *Server) handleFormatting(msg RPCMessage) (interface{}, error) {
+func (s *Server) handleFormatting(ctx context.Context, msg RPCMessage) (interface{}, error) {
 	var params DocumentFormattingParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
-	text, ok := s.documents[params.TextDocument.URI]
+	doc, ok := s.document(ctx, params.TextDocument.URI)
 	if !ok {
 		log.Printf("Document not found: %s", params.TextDocument.URI)
 		return response(msg.ID, []TextEdit{})
 	}
+	text := doc.Text()
 
 	log.Printf("Formatting request: %s (tabSize=%d, insertSpaces=%v)",
 		params.TextDocument.URI, params.Options.TabSize, params.Options.InsertSpaces)
@@ -187,8 +505,8 @@ func (s *Server) handleFormatting(msg RPCMessage) (interface{}, error) {
 		// Format as SUP data file
 		formatted = formatDataDocument(text, params.Options)
 	} else {
-		// Format as SuperSQL query
-		formatted = formatDocument(text, params.Options)
+		// Format as SuperSQL query, reusing the document's tokens
+		formatted = formatTokens(doc.Syntax().Tokens, params.Options)
 	}
 
 	// If no changes, return empty array
@@ -232,25 +550,317 @@ func splitLines(text string) []string {
 }
 
 // handleCodeAction processes textDocument/codeAction requests
-func (s *Server) handleCodeAction(msg RPCMessage) (interface{}, error) {
+func (s *Server) handleCodeAction(ctx context.Context, msg RPCMessage) (interface{}, error) {
 	var params CodeActionParams
-	if err := json.Unmarshal(msg.Params, &params); err != nil {
+	if err := decodeParams(msg, &params); err != nil {
 		return nil, err
 	}
 
-	text, ok := s.documents[params.TextDocument.URI]
+	doc, ok := s.document(ctx, params.TextDocument.URI)
 	if !ok {
 		log.Printf("Document not found: %s", params.TextDocument.URI)
 		return response(msg.ID, []CodeAction{})
 	}
-
 	log.Printf("Code action request: %s at line=%d-%d",
 		params.TextDocument.URI,
 		params.Range.Start.Line,
 		params.Range.End.Line)
 
 	// Get code actions for the diagnostics in context
-	actions := getCodeActionsForDiagnostics(params.TextDocument.URI, text, params.Context.Diagnostics)
+	actions := codeActionsFor(params.TextDocument.URI, doc.Syntax(), params.Context.Diagnostics)
 
 	return response(msg.ID, actions)
 }
+
+// handleDocumentDiagnostic processes textDocument/diagnostic requests
+func (s *Server) handleDocumentDiagnostic(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params DocumentDiagnosticParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	uri := params.TextDocument.URI
+	var tree *SyntaxTree
+	if doc, ok := s.document(ctx, uri); ok {
+		tree = doc.Syntax()
+	} else {
+		// Not open in the editor; check the file on disk
+		var data []byte
+		if path, ok := uriToPath(uri); ok {
+			var err error
+			if data, err = os.ReadFile(path); err != nil {
+				log.Printf("Document not found: %s", uri)
+			}
+		}
+		tree = parseSyntax(string(data))
+	}
+
+	log.Printf("Diagnostic request: %s (previousResultId=%q)", uri, params.PreviousResultID)
+	// Unknown operators can only be reported against a complete index
+	if err := s.workspace.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return response(msg.ID, s.documentDiagnosticReport(ctx, uri, tree, params.PreviousResultID, nil))
+}
+
+// handleWorkspaceDiagnostic processes workspace/diagnostic requests
+func (s *Server) handleWorkspaceDiagnostic(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params WorkspaceDiagnosticParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Workspace diagnostic request: roots=%v", s.workspace.roots())
+	if err := s.workspace.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	report, err := s.workspaceDiagnosticReport(ctx, params.PreviousResultIDs)
+	if err != nil {
+		return nil, err
+	}
+	return response(msg.ID, report)
+}
+
+// workspaceFolders returns the paths of the folders to index: the client's
+// workspace folders and its root URI, each once. Clients may send a root
+// URI outside every workspace folder.
+func workspaceFolders(params InitializeParams) []string {
+	uris := make([]string, 0, len(params.WorkspaceFolders)+1)
+	for _, f := range params.WorkspaceFolders {
+		uris = append(uris, f.URI)
+	}
+	uris = append(uris, params.RootURI)
+
+	var folders []string
+	seen := make(map[string]bool)
+	for _, uri := range uris {
+		if path, ok := uriToPath(uri); ok && !seen[filepath.Clean(path)] {
+			seen[filepath.Clean(path)] = true
+			folders = append(folders, path)
+		}
+	}
+	return folders
+}
+
+// registerFileWatchers asks the client to report changes to query files
+func (s *Server) registerFileWatchers() {
+	if !s.watchFiles {
+		return
+	}
+	err := s.request("client/registerCapability", RegistrationParams{
+		Registrations: []Registration{{
+			ID:     "superdb-watch-spq",
+			Method: "workspace/didChangeWatchedFiles",
+			RegisterOptions: DidChangeWatchedFilesRegistrationOptions{
+				Watchers: []FileSystemWatcher{{GlobPattern: "**/*.spq"}},
+			},
+		}},
+	})
+	if err != nil {
+		log.Printf("Error registering file watchers: %v", err)
+	}
+}
+
+// handleFoldingRange processes textDocument/foldingRange requests
+func (s *Server) handleFoldingRange(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params FoldingRangeParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Folding range request: %s", params.TextDocument.URI)
+
+	return response(msg.ID, foldingRanges(doc.Syntax(), isDataFile(doc.URI)))
+}
+
+// handleSelectionRange processes textDocument/selectionRange requests
+func (s *Server) handleSelectionRange(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params SelectionRangeParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Selection range request: %s (%d positions)", params.TextDocument.URI, len(params.Positions))
+
+	tree := doc.Syntax()
+	ranges := make([]SelectionRange, 0, len(params.Positions))
+	for _, pos := range params.Positions {
+		ranges = append(ranges, selectionRangeAt(tree, pos))
+	}
+	return response(msg.ID, ranges)
+}
+
+// handleInlayHint processes textDocument/inlayHint requests
+func (s *Server) handleInlayHint(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params InlayHintParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Inlay hint request: %s", params.TextDocument.URI)
+
+	if isDataFile(doc.URI) {
+		return response(msg.ID, []InlayHint{})
+	}
+	tree := doc.Syntax()
+	start, end := tree.OffsetAt(params.Range.Start), tree.OffsetAt(params.Range.End)
+	return response(msg.ID, inlayHints(tree, start, end))
+}
+
+// documentSemanticTokens classifies a document's tokens. Data files are
+// left to the client's syntax highlighting.
+func documentSemanticTokens(doc *Document) []semanticToken {
+	if isDataFile(doc.URI) {
+		return nil
+	}
+	return semanticTokens(doc.Syntax())
+}
+
+// handleSemanticTokensFull processes textDocument/semanticTokens/full
+// requests
+func (s *Server) handleSemanticTokensFull(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params SemanticTokensParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Semantic tokens request: %s", params.TextDocument.URI)
+
+	data := encodeSemanticTokens(doc.Syntax(), documentSemanticTokens(doc))
+	return response(msg.ID, SemanticTokens{
+		ResultID: s.semanticTokens.store(doc.URI, data),
+		Data:     data,
+	})
+}
+
+// handleSemanticTokensDelta processes textDocument/semanticTokens/full/delta
+// requests. Without the previous result, the full tokens are sent instead.
+func (s *Server) handleSemanticTokensDelta(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params SemanticTokensDeltaParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Semantic tokens delta request: %s (previousResultId=%q)",
+		params.TextDocument.URI, params.PreviousResultID)
+
+	previous, found := s.semanticTokens.previous(doc.URI, params.PreviousResultID)
+	data := encodeSemanticTokens(doc.Syntax(), documentSemanticTokens(doc))
+	resultID := s.semanticTokens.store(doc.URI, data)
+	if !found {
+		return response(msg.ID, SemanticTokens{ResultID: resultID, Data: data})
+	}
+	return response(msg.ID, SemanticTokensDelta{
+		ResultID: resultID,
+		Edits:    semanticTokensEdits(previous, data),
+	})
+}
+
+// handleSemanticTokensRange processes textDocument/semanticTokens/range
+// requests
+func (s *Server) handleSemanticTokensRange(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params SemanticTokensRangeParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.document(ctx, params.TextDocument.URI)
+	if !ok {
+		log.Printf("Document not found: %s", params.TextDocument.URI)
+		return response(msg.ID, nil)
+	}
+	log.Printf("Semantic tokens range request: %s", params.TextDocument.URI)
+
+	tree := doc.Syntax()
+	toks := tokensInRange(tree, documentSemanticTokens(doc), params.Range)
+	return response(msg.ID, SemanticTokens{Data: encodeSemanticTokens(tree, toks)})
+}
+
+// handleWorkspaceSymbol processes workspace/symbol requests. The first
+// request waits for the initial workspace scan to finish.
+func (s *Server) handleWorkspaceSymbol(ctx context.Context, msg RPCMessage) (interface{}, error) {
+	var params WorkspaceSymbolParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+	log.Printf("Workspace symbol request: query=%q", params.Query)
+
+	if err := s.workspace.wait(ctx); err != nil {
+		return nil, err
+	}
+	files := s.workspace.snapshot(s.openDocuments(ctx))
+	return response(msg.ID, workspaceSymbols(files, params.Query))
+}
+
+// handleDidChangeWatchedFiles processes workspace/didChangeWatchedFiles
+// notifications, re-indexing created and changed query files
+func (s *Server) handleDidChangeWatchedFiles(msg RPCMessage) (interface{}, error) {
+	var params DidChangeWatchedFilesParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	for _, change := range params.Changes {
+		path, ok := uriToPath(change.URI)
+		if !ok || !isQueryFile(path) {
+			continue
+		}
+		log.Printf("Watched file changed: %s (type=%d)", change.URI, change.Type)
+		if change.Type == FileChangeTypeDeleted {
+			s.workspace.remove(path)
+		} else {
+			s.workspace.update(path)
+		}
+	}
+	return nil, nil
+}
+
+// handleDidChangeWorkspaceFolders processes
+// workspace/didChangeWorkspaceFolders notifications
+func (s *Server) handleDidChangeWorkspaceFolders(msg RPCMessage) (interface{}, error) {
+	var params DidChangeWorkspaceFoldersParams
+	if err := decodeParams(msg, &params); err != nil {
+		return nil, err
+	}
+
+	for _, f := range params.Event.Removed {
+		if path, ok := uriToPath(f.URI); ok {
+			log.Printf("Workspace folder removed: %s", path)
+			s.workspace.removeFolder(path)
+		}
+	}
+	for _, f := range params.Event.Added {
+		if path, ok := uriToPath(f.URI); ok {
+			log.Printf("Workspace folder added: %s", path)
+			s.workspace.addFolder(path)
+		}
+	}
+	return nil, nil
+}
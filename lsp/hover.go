@@ -2,29 +2,121 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 )
 
-// getHover returns hover information for the word at the given position
-func getHover(text string, pos Position) *Hover {
-	word := getWordAtPosition(text, pos)
-	if word == "" {
+// hoverAt returns hover information for the word under the cursor.
+// Literals and casts show their type, so words inside a string only show
+// that it's a string; comments get no hover. User declarations take
+// precedence over builtins they shadow.
+func hoverAt(tree *SyntaxTree, pos Position) *Hover {
+	offset := tree.OffsetAt(pos)
+	if h := typeHoverAt(tree, offset); h != nil {
+		return h
+	}
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+	sym, word := tree.Symbols().At(tree, offset)
+	if word == nil {
 		return nil
 	}
+	if sym != nil {
+		return markdownHover(formatSymbolHover(tree, sym))
+	}
 
-	b := Builtins.Lookup(word)
+	b := Builtins.Lookup(word.value)
 	if b == nil {
 		return nil
 	}
 
+	return markdownHover(formatHoverContent(b))
+}
+
+// unresolvedCallAt returns the name under the cursor when it calls a
+// function or operator the document doesn't declare
+func unresolvedCallAt(tree *SyntaxTree, pos Position) *token {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+	tok := tree.WordAt(offset)
+	if tok == nil || !tree.Symbols().IsUnresolvedCall(tok) || Builtins.Lookup(tok.value) != nil {
+		return nil
+	}
+	return tok
+}
+
+// workspaceHover describes functions or operators declared in other
+// workspace files, naming each file relative to its workspace folder
+func workspaceHover(defs []indexedSymbol, roots []string) *Hover {
+	var parts []string
+	for _, def := range defs {
+		parts = append(parts, fmt.Sprintf("```spq\n%s\n```\n\nDefined in `%s`",
+			def.Signature, displayPath(def.Location.URI, roots)))
+	}
+	return markdownHover(strings.Join(parts, "\n\n---\n\n"))
+}
+
+// displayPath shortens a file URI to a path relative to the workspace
+// folder containing it
+func displayPath(uri string, roots []string) string {
+	path, ok := uriToPath(uri)
+	if !ok {
+		return uri
+	}
+	for _, root := range roots {
+		if withinFolder(path, root) {
+			if rel, err := filepath.Rel(root, path); err == nil {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+	return path
+}
+
+func markdownHover(value string) *Hover {
 	return &Hover{
 		Contents: MarkupContent{
 			Kind:  MarkupKindMarkdown,
-			Value: formatHoverContent(b),
+			Value: value,
 		},
 	}
 }
 
+// formatSymbolHover formats a user-declared symbol as markdown
+func formatSymbolHover(tree *SyntaxTree, sym *Symbol) string {
+	if sym.Kind == SymbolParam {
+		return fmt.Sprintf("```spq\n(parameter) %s\n```", sym.Name)
+	}
+	content := fmt.Sprintf("```spq\n%s\n```", declSignature(tree, sym.Decl))
+	if value := constValue(sym.Decl); sym.Kind == SymbolConst && value != nil {
+		if t := exprType(tree, value); t != nil {
+			content += fmt.Sprintf("\n\nType: `%s`", typeName(t))
+		}
+		content += formatEvalResult(evalConstant(tree, value.Children))
+	}
+	return content
+}
+
+// declSignature renders a declaration on one line: its parameters for
+// functions and operators, or its value otherwise
+func declSignature(tree *SyntaxTree, decl *Node) string {
+	name := decl.Name()
+	switch decl.Keyword() {
+	case "fn", "func", "op":
+		return declDetail(tree, decl)
+	}
+	if name == nil {
+		return decl.Keyword()
+	}
+	if detail := declDetail(tree, decl); strings.HasPrefix(detail, decl.Keyword()+" = ") {
+		return decl.Keyword() + " " + name.value + strings.TrimPrefix(detail, decl.Keyword())
+	}
+	return decl.Keyword() + " " + name.value
+}
+
 // formatHoverContent formats a Builtin into markdown hover content
 func formatHoverContent(b *Builtin) string {
 	switch b.Kind {
@@ -55,36 +147,3 @@ func formatHoverContent(b *Builtin) string {
 		return fmt.Sprintf("**%s**\n\n%s", b.Name, b.Brief)
 	}
 }
-
-// getWordAtPosition extracts the word at the given position
-func getWordAtPosition(text string, pos Position) string {
-	lines := strings.Split(text, "\n")
-	if pos.Line >= len(lines) {
-		return ""
-	}
-
-	line := lines[pos.Line]
-	if pos.Character > len(line) {
-		return ""
-	}
-
-	// Find word boundaries
-	start := pos.Character
-	end := pos.Character
-
-	// Move start backward to find word start
-	for start > 0 && isIdentifierChar(line[start-1]) {
-		start--
-	}
-
-	// Move end forward to find word end
-	for end < len(line) && isIdentifierChar(line[end]) {
-		end++
-	}
-
-	if start == end {
-		return ""
-	}
-
-	return line[start:end]
-}
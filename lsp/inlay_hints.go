@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// inlay_hints.go - Inlay hints for builtin call arguments, the output
+// fields of unnamed aggregations, and the types of constants declared
+// with a literal value.
+
+// inlayHints returns the hints between two byte offsets, in document order
+func inlayHints(tree *SyntaxTree, start, end int) []InlayHint {
+	hints := []InlayHint{}
+	symbols := tree.Symbols()
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		if n.End < start || n.Start > end {
+			return
+		}
+		switch n.Kind {
+		case NodeCall:
+			hints = append(hints, parameterHints(tree, symbols, n)...)
+		case NodeStage:
+			hints = append(hints, aggregateHints(tree, symbols, n)...)
+		case NodeDecl:
+			if hint, ok := constTypeHint(tree, n); ok {
+				hints = append(hints, hint)
+			}
+		}
+		for _, c := range n.Children {
+			visit(c)
+		}
+	}
+	visit(tree.Root)
+
+	inRange := hints[:0]
+	for _, h := range hints {
+		if offset := tree.OffsetAt(h.Position); offset >= start && offset <= end {
+			inRange = append(inRange, h)
+		}
+	}
+	return inRange
+}
+
+// callArgs returns the argument expressions of a call
+func callArgs(call *Node) []*Node {
+	var args []*Node
+	if len(call.Children) > 1 && call.Children[1].Kind == NodeGroup {
+		for _, c := range call.Children[1].Children {
+			if c.Kind == NodeExpr {
+				args = append(args, c)
+			}
+		}
+	}
+	return args
+}
+
+// builtinCall returns the builtin function or aggregate a call invokes,
+// unless a user declaration shadows it
+func builtinCall(symbols *Symbols, call *Node) *Builtin {
+	name := call.Name()
+	if name == nil || !symbols.IsUnresolvedCall(name) {
+		return nil
+	}
+	if b := Builtins.Lookup(name.value); b != nil && (b.Kind == KindFunction || b.Kind == KindAggregate) {
+		return b
+	}
+	return nil
+}
+
+// parameterHints labels the arguments of a builtin call with parameter
+// names from the signature form matching the call. Calls with a single
+// argument, variadic arguments, and arguments that already spell out the
+// parameter name get no hint.
+func parameterHints(tree *SyntaxTree, symbols *Symbols, call *Node) []InlayHint {
+	b := builtinCall(symbols, call)
+	args := callArgs(call)
+	if b == nil || b.Signature == "" || len(args) < 2 {
+		return nil
+	}
+	sigs := builtinSignatures(b)
+	active, _ := selectSignature(sigs, len(args), 0)
+	sig := sigs[active]
+	var hints []InlayHint
+	for i, arg := range args {
+		if i >= len(sig.params) || (sig.variadic && i == len(sig.params)-1) {
+			break
+		}
+		param := sig.params[i]
+		if strings.EqualFold(lastName(arg), param.name) {
+			continue
+		}
+		hints = append(hints, InlayHint{
+			Position:     tree.PositionAt(arg.Start),
+			Label:        param.name + ":",
+			Kind:         InlayHintKindParameter,
+			PaddingRight: true,
+			Tooltip:      param.doc,
+		})
+	}
+	return hints
+}
+
+// lastName returns the identifier an argument ends with when it is a plain
+// field or field path, e.g. "ts" for "event.ts"
+func lastName(arg *Node) string {
+	if len(arg.Children) != 1 {
+		return ""
+	}
+	n := arg.Children[0]
+	if n.Kind == NodePath {
+		n = n.Children[len(n.Children)-1]
+	}
+	if n.Kind != NodeToken || n.Tok.typ != tokIdentifier {
+		return ""
+	}
+	return n.Tok.value
+}
+
+// aggregateHints shows the output field of each unnamed aggregation in a
+// summarize stage, explicit or implied, e.g. "count" for "count()"
+func aggregateHints(tree *SyntaxTree, symbols *Symbols, stage *Node) []InlayHint {
+	children := stage.Children
+	if head := stage.Name(); head != nil {
+		switch strings.ToLower(head.value) {
+		case "summarize", "aggregate":
+			children = children[1:]
+		default:
+			return nil
+		}
+	}
+
+	var hints []InlayHint
+	for _, c := range children {
+		if c.Kind == NodeToken && clauseKeywords[strings.ToLower(c.Tok.value)] {
+			break // Grouping keys follow "by"
+		}
+		if c.Kind != NodeExpr || len(c.Children) != 1 || c.Children[0].Kind != NodeCall {
+			continue
+		}
+		b := builtinCall(symbols, c.Children[0])
+		if b == nil || !isAggregate(b.Name) {
+			if stage.Name() == nil {
+				return nil // Not an implied summarize after all
+			}
+			continue
+		}
+		hints = append(hints, InlayHint{
+			Position:     tree.PositionAt(c.Start),
+			Label:        b.Name + " :=",
+			PaddingRight: true,
+			Tooltip:      "Output field of this aggregation",
+		})
+	}
+	return hints
+}
+
+// scalarAggregates are aggregate functions that are registered as scalar
+// functions, since the registry holds one entry per name
+var scalarAggregates = map[string]bool{"max": true, "min": true}
+
+// isAggregate reports whether a name is an aggregate function
+func isAggregate(name string) bool {
+	if scalarAggregates[name] {
+		return true
+	}
+	for _, agg := range Builtins.Aggregates() {
+		if agg.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// constTypeHint shows the type of a constant declared with a literal
+func constTypeHint(tree *SyntaxTree, decl *Node) (InlayHint, bool) {
+	name, value := decl.Name(), constValue(decl)
+	if name == nil || value == nil {
+		return InlayHint{}, false
+	}
+	typ := literalType(tree, value)
+	if typ == "" {
+		return InlayHint{}, false
+	}
+	return InlayHint{
+		Position: tree.PositionAt(name.end()),
+		Label:    ": " + typ,
+		Kind:     InlayHintKindType,
+	}, true
+}
+
+// literalType returns the type of an expression that is a single literal,
+// possibly a negated number, or "" for anything else. IPv6 addresses and
+// networks span several tokens, so they are recognized from the text.
+func literalType(tree *SyntaxTree, expr *Node) string {
+	if typ := addressType(tree.Text[expr.Start:expr.End]); typ != "" {
+		return typ
+	}
+	children := expr.Children
+	if len(children) == 2 && children[0].Kind == NodeToken && children[0].Tok.value == "-" {
+		if children[1].Kind == NodeToken && children[1].Tok.typ == tokNumber {
+			return numberType(children[1].Tok.value)
+		}
+		return ""
+	}
+	if len(children) != 1 || children[0].Kind != NodeToken {
+		return ""
+	}
+	return literalTokenType(children[0].Tok)
+}
+
+// literalTokenType returns the type of a literal token, or "" for any
+// other token
+func literalTokenType(tok *token) string {
+	switch tok.typ {
+	case tokString:
+		return "string"
+	case tokNumber:
+		return numberType(tok.value)
+	case tokKeyword:
+		switch strings.ToLower(tok.value) {
+		case "true", "false":
+			return "bool"
+		case "null":
+			return "null"
+		}
+	}
+	return ""
+}
+
+// addressType returns "ip" for the text of an IP address literal and "net"
+// for a network in CIDR notation, or "" for any other text
+func addressType(text string) string {
+	if addr, err := netip.ParseAddr(text); err == nil && addr.Zone() == "" {
+		return "ip"
+	}
+	if _, err := netip.ParsePrefix(text); err == nil {
+		return "net"
+	}
+	return ""
+}
+
+// numberType classifies a numeric literal token, or a negated one. Malformed
+// numbers, such as 1e or 0x, have no type.
+func numberType(v string) string {
+	if typ := addressType(v); typ != "" {
+		return typ
+	}
+	var typ string
+	var err error
+	switch body := strings.TrimPrefix(v, "-"); {
+	case strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X"):
+		typ, err = "int64", numberSyntax(strconv.ParseInt(v, 0, 64))
+	case unicode.IsLetter(rune(v[len(v)-1])):
+		typ, err = "duration", numberSyntax(parseDuration(v))
+	case strings.ContainsAny(v, ".eE"):
+		typ, err = "float64", numberSyntax(strconv.ParseFloat(v, 64))
+	default:
+		typ, err = "int64", numberSyntax(strconv.ParseInt(v, 0, 64))
+	}
+	if err != nil {
+		return ""
+	}
+	return typ
+}
+
+// numberSyntax drops range errors from a parse, since a literal too big for
+// its type is still that type
+func numberSyntax[T any](_ T, err error) error {
+	if errors.Is(err, strconv.ErrRange) || errors.Is(err, errDurationRange) {
+		return nil
+	}
+	return err
+}
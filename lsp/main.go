@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // LSP Server for SuperSQL (SPQ) language
@@ -32,24 +36,90 @@ func main() {
 
 // Server represents the LSP server
 type Server struct {
-	documents  map[string]string // URI -> content
-	shutdown   bool
-	initialized bool
+	documents           *DocumentStore
+	initializeReceived  bool
+	initialized         bool
+	shutdown            bool
+	pullDiagnostics     bool // Client requests diagnostics; don't push them
+	hierarchicalSymbols bool // Client accepts DocumentSymbol trees
+	watchFiles          bool // Client accepts file watcher registrations
+	diagnosticRefresh   bool // Client accepts workspace/diagnostic/refresh
+	snippetSupport      bool // Client accepts snippet completions
+	noActiveParameter   bool // Client accepts a null activeParameter
+
+	workspace  *workspaceIndex
+	requestSeq atomic.Int64 // IDs for server-initiated requests
+
+	refreshPending atomic.Bool // A diagnostic refresh request is scheduled
+
+	out     io.Writer
+	writeMu sync.Mutex
+
+	diagnostics *diagnosticScheduler
+	publishMu   sync.Mutex
+
+	semanticTokens *semanticTokenCache // Last result per document, for deltas
+
+	sampleData map[string]string // Query file patterns to sample data files
+	samples    *sampleCache      // Fields inferred from sample data files
+
+	pendingMu sync.Mutex
+	pending   map[string]context.CancelFunc // In-flight concurrent requests
+	inflight  sync.WaitGroup
 }
 
 // NewServer creates a new LSP server instance
 func NewServer() *Server {
-	return &Server{
-		documents: make(map[string]string),
+	s := &Server{
+		documents:      NewDocumentStore(),
+		workspace:      newWorkspaceIndex(),
+		semanticTokens: newSemanticTokenCache(),
+		samples:        newSampleCache(),
+		out:            io.Discard,
+		pending:        make(map[string]context.CancelFunc),
 	}
+	s.diagnostics = newDiagnosticScheduler(defaultDiagnosticsDelay, s.runDiagnostics)
+	s.workspace.onChange = s.refreshDiagnostics
+	return s
+}
+
+// concurrentMethods are read-only requests that may run in parallel with
+// each other and with later messages. They see the document snapshot taken
+// when the request arrived. Everything else, including all notifications,
+// is handled in arrival order on the read loop.
+var concurrentMethods = map[string]bool{
+	"textDocument/completion":                true,
+	"completionItem/resolve":                 true,
+	"textDocument/hover":                     true,
+	"textDocument/definition":                true,
+	"textDocument/references":                true,
+	"textDocument/documentHighlight":         true,
+	"textDocument/prepareRename":             true,
+	"textDocument/rename":                    true,
+	"textDocument/documentSymbol":            true,
+	"textDocument/foldingRange":              true,
+	"textDocument/selectionRange":            true,
+	"textDocument/inlayHint":                 true,
+	"textDocument/semanticTokens/full":       true,
+	"textDocument/semanticTokens/full/delta": true,
+	"textDocument/semanticTokens/range":      true,
+	"textDocument/signatureHelp":             true,
+	"textDocument/formatting":                true,
+	"textDocument/codeAction":                true,
+	"textDocument/diagnostic":                true,
+	"workspace/diagnostic":                   true,
+	"workspace/symbol":                       true,
 }
 
 // Run starts the server's main loop
 func (s *Server) Run(in io.Reader, out io.Writer) error {
+	s.out = out
 	reader := bufio.NewReader(in)
+	defer s.diagnostics.stop()
+	defer s.inflight.Wait()
 
 	for {
-		msg, err := readMessage(reader)
+		rawMsg, err := readMessage(reader)
 		if err != nil {
 			if err == io.EOF {
 				return nil
@@ -57,20 +127,153 @@ func (s *Server) Run(in io.Reader, out io.Writer) error {
 			return fmt.Errorf("reading message: %w", err)
 		}
 
-		response, err := s.handleMessage(msg)
-		if err != nil {
-			log.Printf("Error handling message: %v", err)
-			continue
+		var response interface{}
+		var msg RPCMessage
+		if err := json.Unmarshal(rawMsg, &msg); err != nil {
+			log.Printf("Error decoding message: %v", err)
+			response = parseErrorResponse(err)
+		} else if msg.Method == "$/cancelRequest" {
+			s.handleCancelRequest(msg)
+		} else if err := s.admit(msg); err != nil {
+			response = s.reject(msg, err)
+		} else if msg.ID != nil && concurrentMethods[msg.Method] {
+			s.dispatchRequest(msg)
+		} else {
+			response = s.respond(context.Background(), msg)
 		}
 
 		if response != nil {
-			if err := writeMessage(out, response); err != nil {
+			if err := s.send(response); err != nil {
 				return fmt.Errorf("writing response: %w", err)
 			}
 		}
 	}
 }
 
+// send writes a message to the client. It is safe for concurrent use.
+func (s *Server) send(msg interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeMessage(s.out, msg)
+}
+
+// notify sends a server-initiated notification to the client
+func (s *Server) notify(method string, params interface{}) error {
+	paramsBytes, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.send(RPCMessage{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  paramsBytes,
+	})
+}
+
+// request sends a server-initiated request to the client. Responses are
+// not waited for; errors in them are logged when they arrive.
+func (s *Server) request(method string, params interface{}) error {
+	paramsBytes, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.send(RPCMessage{
+		JSONRPC: "2.0",
+		ID:      fmt.Sprintf("superdb-%d", s.requestSeq.Add(1)),
+		Method:  method,
+		Params:  paramsBytes,
+	})
+}
+
+// dispatchRequest runs a read-only request on its own goroutine against a
+// snapshot of the open documents
+func (s *Server) dispatchRequest(msg RPCMessage) {
+	ctx := withDocuments(context.Background(), s.documents.Snapshot())
+	ctx, key := s.beginRequest(ctx, msg.ID)
+
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		defer s.endRequest(key)
+
+		if response := s.runRequest(ctx, msg); response != nil {
+			if err := s.send(response); err != nil {
+				log.Printf("Error writing response: %v", err)
+			}
+		}
+	}()
+}
+
+// runRequest handles a request, replacing its result with a RequestCancelled
+// error if the client cancelled it before or while it ran
+func (s *Server) runRequest(ctx context.Context, msg RPCMessage) interface{} {
+	if ctx.Err() != nil {
+		return cancelledResponse(msg.ID)
+	}
+
+	response := s.respond(ctx, msg)
+	if ctx.Err() != nil {
+		return cancelledResponse(msg.ID)
+	}
+	return response
+}
+
+// beginRequest registers a cancellable context for an in-flight request
+func (s *Server) beginRequest(parent context.Context, id interface{}) (context.Context, string) {
+	ctx, cancel := context.WithCancel(parent)
+	key := requestKey(id)
+
+	s.pendingMu.Lock()
+	s.pending[key] = cancel
+	s.pendingMu.Unlock()
+
+	return ctx, key
+}
+
+// endRequest releases the context of a finished request
+func (s *Server) endRequest(key string) {
+	s.pendingMu.Lock()
+	cancel, ok := s.pending[key]
+	delete(s.pending, key)
+	s.pendingMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// handleCancelRequest processes $/cancelRequest notifications. Requests that
+// already finished (or were never concurrent) are ignored.
+func (s *Server) handleCancelRequest(msg RPCMessage) {
+	var params CancelParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		log.Printf("Error handling message: %v", err)
+		return
+	}
+
+	s.pendingMu.Lock()
+	cancel, ok := s.pending[requestKey(params.ID)]
+	s.pendingMu.Unlock()
+
+	if ok {
+		log.Printf("Cancelling request: id=%v", params.ID)
+		cancel()
+	}
+}
+
+// requestKey normalizes a JSON-RPC ID (number or string) into a map key
+func requestKey(id interface{}) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// cancelledResponse creates the error response for a cancelled request
+func cancelledResponse(id interface{}) RPCMessage {
+	return errorResponse(id, &RPCError{
+		Code:    RequestCancelled,
+		Message: "request cancelled",
+	})
+}
+
 // readMessage reads a JSON-RPC message from the LSP protocol
 func readMessage(reader *bufio.Reader) (json.RawMessage, error) {
 	// Read headers
@@ -126,13 +329,81 @@ func writeMessage(out io.Writer, msg interface{}) error {
 	return nil
 }
 
-// handleMessage dispatches incoming JSON-RPC messages
-func (s *Server) handleMessage(rawMsg json.RawMessage) (interface{}, error) {
+// handleMessage decodes and handles a single JSON-RPC message on the calling
+// goroutine, returning the response to send (nil for notifications)
+func (s *Server) handleMessage(rawMsg json.RawMessage) interface{} {
 	var msg RPCMessage
 	if err := json.Unmarshal(rawMsg, &msg); err != nil {
-		return nil, err
+		return parseErrorResponse(err)
+	}
+	if err := s.admit(msg); err != nil {
+		return s.reject(msg, err)
+	}
+	return s.respond(context.Background(), msg)
+}
+
+// admit enforces the LSP lifecycle: only initialize (or exit) may come
+// before initialize, and only exit may come after shutdown
+func (s *Server) admit(msg RPCMessage) error {
+	switch {
+	case msg.Method == "exit":
+		return nil
+	case s.shutdown:
+		return &RPCError{Code: InvalidRequest, Message: "server is shutting down"}
+	case msg.Method == "initialize" && s.initializeReceived:
+		return &RPCError{Code: InvalidRequest, Message: "server already initialized"}
+	case msg.Method != "initialize" && !s.initializeReceived:
+		return &RPCError{Code: ServerNotInitialized, Message: "server not initialized"}
 	}
+	return nil
+}
+
+// reject answers a message refused by admit. Requests get an error response;
+// notifications and responses to the server's own requests are dropped,
+// since nothing may answer them.
+func (s *Server) reject(msg RPCMessage, err error) interface{} {
+	if msg.ID == nil {
+		log.Printf("Dropping notification %s: %v", msg.Method, err)
+		return nil
+	}
+	if msg.Method == "" {
+		log.Printf("Dropping response %v: %v", msg.ID, err)
+		return nil
+	}
+	return errorResponse(msg.ID, err)
+}
+
+// respond runs the handler for a message and builds its response. Handler
+// errors and panics become error responses for requests and are logged for
+// notifications, so a single bad message cannot stop the server.
+func (s *Server) respond(ctx context.Context, msg RPCMessage) (response interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic handling %s: %v\n%s", msg.Method, r, debug.Stack())
+			response = nil
+			if msg.ID != nil {
+				response = errorResponse(msg.ID, &RPCError{
+					Code:    InternalError,
+					Message: "internal error handling " + msg.Method,
+					Data:    fmt.Sprint(r),
+				})
+			}
+		}
+	}()
 
+	result, err := s.handle(ctx, msg)
+	if err != nil {
+		if msg.ID == nil {
+			log.Printf("Error handling %s: %v", msg.Method, err)
+			return nil
+		}
+		return errorResponse(msg.ID, err)
+	}
+	return result
+}
+
+// handle dispatches a decoded JSON-RPC message to its handler
+func (s *Server) handle(ctx context.Context, msg RPCMessage) (interface{}, error) {
 	log.Printf("Received: method=%s, id=%v", msg.Method, msg.ID)
 
 	switch msg.Method {
@@ -140,6 +411,13 @@ func (s *Server) handleMessage(rawMsg json.RawMessage) (interface{}, error) {
 		return s.handleInitialize(msg)
 	case "initialized":
 		s.initialized = true
+		s.registerFileWatchers()
+		return nil, nil
+	case "":
+		// A response to one of our own requests
+		if msg.Error != nil {
+			log.Printf("Client returned error for request %v: %s", msg.ID, msg.Error.Message)
+		}
 		return nil, nil
 	case "shutdown":
 		return s.handleShutdown(msg)
@@ -155,17 +433,59 @@ func (s *Server) handleMessage(rawMsg json.RawMessage) (interface{}, error) {
 	case "textDocument/didClose":
 		return s.handleDidClose(msg)
 	case "textDocument/completion":
-		return s.handleCompletion(msg)
+		return s.handleCompletion(ctx, msg)
+	case "completionItem/resolve":
+		return s.handleCompletionResolve(ctx, msg)
 	case "textDocument/hover":
-		return s.handleHover(msg)
+		return s.handleHover(ctx, msg)
+	case "textDocument/definition":
+		return s.handleDefinition(ctx, msg)
+	case "textDocument/references":
+		return s.handleReferences(ctx, msg)
+	case "textDocument/documentHighlight":
+		return s.handleDocumentHighlight(ctx, msg)
+	case "textDocument/prepareRename":
+		return s.handlePrepareRename(ctx, msg)
+	case "textDocument/rename":
+		return s.handleRename(ctx, msg)
+	case "textDocument/documentSymbol":
+		return s.handleDocumentSymbol(ctx, msg)
+	case "textDocument/foldingRange":
+		return s.handleFoldingRange(ctx, msg)
+	case "textDocument/selectionRange":
+		return s.handleSelectionRange(ctx, msg)
+	case "textDocument/inlayHint":
+		return s.handleInlayHint(ctx, msg)
+	case "textDocument/semanticTokens/full":
+		return s.handleSemanticTokensFull(ctx, msg)
+	case "textDocument/semanticTokens/full/delta":
+		return s.handleSemanticTokensDelta(ctx, msg)
+	case "textDocument/semanticTokens/range":
+		return s.handleSemanticTokensRange(ctx, msg)
 	case "textDocument/signatureHelp":
-		return s.handleSignatureHelp(msg)
+		return s.handleSignatureHelp(ctx, msg)
 	case "textDocument/formatting":
-		return s.handleFormatting(msg)
+		return s.handleFormatting(ctx, msg)
 	case "textDocument/codeAction":
-		return s.handleCodeAction(msg)
+		return s.handleCodeAction(ctx, msg)
+	case "workspace/symbol":
+		return s.handleWorkspaceSymbol(ctx, msg)
+	case "workspace/didChangeWatchedFiles":
+		return s.handleDidChangeWatchedFiles(msg)
+	case "workspace/didChangeWorkspaceFolders":
+		return s.handleDidChangeWorkspaceFolders(msg)
+	case "textDocument/diagnostic":
+		return s.handleDocumentDiagnostic(ctx, msg)
+	case "workspace/diagnostic":
+		return s.handleWorkspaceDiagnostic(ctx, msg)
 	default:
-		log.Printf("Unhandled method: %s", msg.Method)
+		if msg.ID != nil {
+			return nil, &RPCError{Code: MethodNotFound, Message: "method not found: " + msg.Method}
+		}
+		// Optional notifications ($/...) may be ignored without comment
+		if !strings.HasPrefix(msg.Method, "$/") {
+			log.Printf("Unhandled method: %s", msg.Method)
+		}
 	}
 
 	return nil, nil
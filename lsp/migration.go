@@ -263,22 +263,28 @@ var migrations = []Migration{
 
 // getMigrationDiagnostics scans text for deprecated syntax patterns
 func getMigrationDiagnostics(text string) []MigrationDiagnostic {
+	return migrationDiagnosticsFor(parseSyntax(text))
+}
+
+// migrationDiagnosticsFor scans a parsed document for deprecated syntax
+// patterns, ignoring matches inside comments and string literals
+func migrationDiagnosticsFor(tree *SyntaxTree) []MigrationDiagnostic {
 	var diagnostics []MigrationDiagnostic
-	lines := strings.Split(text, "\n")
+	lines := strings.Split(tree.Text, "\n")
+	lineStart := 0
 
 	for lineNum, line := range lines {
-		// Skip lines that are already using -- comments
-		// to avoid false positives on comment content
-		commentIdx := strings.Index(line, "--")
-
 		for _, m := range migrations {
 			matches := m.Pattern.FindAllStringIndex(line, -1)
 			for _, match := range matches {
 				startCol := match[0]
 				endCol := match[1]
 
-				// Skip matches inside -- comments
-				if commentIdx >= 0 && startCol > commentIdx {
+				// Skip matches inside comments and strings. The pattern
+				// may capture a character before the match proper, so
+				// check where the match ends.
+				if i := tree.TokenAt(lineStart + endCol - 1); i >= 0 &&
+					(tree.Tokens[i].typ == tokComment || tree.Tokens[i].typ == tokString) {
 					continue
 				}
 
@@ -329,6 +335,7 @@ func getMigrationDiagnostics(text string) []MigrationDiagnostic {
 				diagnostics = append(diagnostics, diag)
 			}
 		}
+		lineStart += len(line) + 1
 	}
 
 	return diagnostics
@@ -336,10 +343,16 @@ func getMigrationDiagnostics(text string) []MigrationDiagnostic {
 
 // getCodeActionsForDiagnostics generates code actions for migration diagnostics
 func getCodeActionsForDiagnostics(uri string, text string, requestedDiags []Diagnostic) []CodeAction {
+	return codeActionsFor(uri, parseSyntax(text), requestedDiags)
+}
+
+// codeActionsFor generates code actions for the migration diagnostics of a
+// parsed document
+func codeActionsFor(uri string, tree *SyntaxTree, requestedDiags []Diagnostic) []CodeAction {
 	var actions []CodeAction
 
 	// Get all migration diagnostics for this document
-	migrationDiags := getMigrationDiagnostics(text)
+	migrationDiags := migrationDiagnosticsFor(tree)
 
 	// Build a map of fixable diagnostics by code+range
 	fixableDiags := make(map[string]MigrationDiagnostic)
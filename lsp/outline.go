@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// outline.go - Document symbols for the editor outline.
+// Declarations and queries are top-level symbols. A query's children are
+// its pipeline stages, and fork/switch branches nest under their stage. The
+// body of an op declaration is outlined under the declaration.
+
+// outlineDetailLength caps the length of generated names and details
+const outlineDetailLength = 60
+
+// documentSymbols returns the outline of a document
+func documentSymbols(tree *SyntaxTree) []DocumentSymbol {
+	return outlineScript(tree, tree.Root)
+}
+
+// outlineScript returns symbols for the declarations and queries of a script
+func outlineScript(tree *SyntaxTree, script *Node) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	for _, n := range script.Children {
+		switch n.Kind {
+		case NodeDecl:
+			if sym, ok := outlineDecl(tree, n); ok {
+				symbols = append(symbols, sym)
+			}
+		case NodePipeline:
+			first := firstToken(n)
+			if first == nil || first.typ == tokPipe {
+				continue
+			}
+			children := outlineStages(tree, n)
+			if len(children) == 1 && children[0].Name == oneLine(tree, n) && len(children[0].Children) == 0 {
+				// A lone expression such as "x > 1" would just repeat itself
+				children = nil
+			}
+			symbols = append(symbols, DocumentSymbol{
+				Name:           oneLine(tree, n),
+				Detail:         "query",
+				Kind:           SymbolKindNamespace,
+				Range:          tree.Range(n.Start, n.End),
+				SelectionRange: tree.Range(first.pos, first.end()),
+				Children:       children,
+			})
+		}
+	}
+	return symbols
+}
+
+// outlineDecl returns the symbol for a named declaration
+func outlineDecl(tree *SyntaxTree, decl *Node) (DocumentSymbol, bool) {
+	kind, ok := declKinds[decl.Keyword()]
+	name := decl.Name()
+	if !ok || name == nil || name.typ != tokIdentifier {
+		return DocumentSymbol{}, false
+	}
+	sym := DocumentSymbol{
+		Name:           name.value,
+		Detail:         declDetail(tree, decl),
+		Kind:           symbolKindToLSP(kind),
+		Range:          tree.Range(decl.Start, decl.End),
+		SelectionRange: tree.Range(name.pos, name.end()),
+	}
+	if decl.Keyword() == "op" {
+		for _, c := range decl.Children {
+			if c.Kind == NodeGroup {
+				for _, script := range c.Children {
+					if script.Kind == NodeScript {
+						sym.Children = outlineScript(tree, script)
+					}
+				}
+			}
+		}
+	}
+	return sym, true
+}
+
+// declDetail describes a declaration: its parameters for functions and
+// operators, or its value otherwise
+func declDetail(tree *SyntaxTree, decl *Node) string {
+	switch decl.Keyword() {
+	case "fn", "func", "op":
+		if len(decl.Children) > 2 && decl.Children[2].Kind == NodeGroup {
+			return decl.Keyword() + " " + decl.Name().value + oneLine(tree, decl.Children[2])
+		}
+		return decl.Keyword()
+	}
+	if last := decl.Children[len(decl.Children)-1]; len(decl.Children) > 2 && last.Kind == NodeExpr {
+		return decl.Keyword() + " = " + oneLine(tree, last)
+	}
+	return decl.Keyword()
+}
+
+// outlineStages returns a symbol for each stage of a pipeline
+func outlineStages(tree *SyntaxTree, pipeline *Node) []DocumentSymbol {
+	var symbols []DocumentSymbol
+	for _, stage := range pipeline.Children {
+		if stage.Kind != NodeStage {
+			continue
+		}
+		first := firstToken(stage)
+		name, selection := first.value, tree.Range(first.pos, first.end())
+		if op := stage.Name(); op == nil || !isStageOperator(op) {
+			// Bare expressions are implied operators, as in "x > 1" or
+			// "count()"; name them after the whole stage
+			name = oneLine(tree, stage)
+		}
+		symbols = append(symbols, DocumentSymbol{
+			Name:           name,
+			Detail:         stageDetail(tree, stage),
+			Kind:           SymbolKindOperator,
+			Range:          tree.Range(stage.Start, stage.End),
+			SelectionRange: selection,
+			Children:       outlineNested(tree, stage),
+		})
+	}
+	return symbols
+}
+
+// stageDetail returns a stage's arguments, without the operator name or
+// any fork/switch branches, which are outlined as children
+func stageDetail(tree *SyntaxTree, stage *Node) string {
+	if op := stage.Name(); op == nil || !isStageOperator(op) || len(stage.Children) < 2 {
+		return ""
+	}
+	end := stage.End
+	if g := branchGroup(stage); g != nil {
+		end = g.Start
+	}
+	return truncate(collapseSpace(tree.Text[stage.Children[1].Start:end]))
+}
+
+// branchGroup returns the bracket group holding a stage's branches
+func branchGroup(n *Node) *Node {
+	for _, c := range n.Children {
+		switch {
+		case c.Kind == NodeGroup && len(c.Children) > 1 && c.Children[1].Kind == NodeBranch:
+			return c
+		case c.Kind == NodeExpr:
+			if g := branchGroup(c); g != nil {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// outlineNested returns symbols for the branches and subqueries of a stage
+func outlineNested(tree *SyntaxTree, n *Node) []DocumentSymbol {
+	var symbols []DocumentSymbol
+	for _, c := range n.Children {
+		switch c.Kind {
+		case NodeBranch:
+			symbols = append(symbols, outlineBranch(tree, c, len(symbols)))
+		case NodeScript:
+			symbols = append(symbols, outlineScript(tree, c)...)
+		case NodeToken:
+		default:
+			symbols = append(symbols, outlineNested(tree, c)...)
+		}
+	}
+	return symbols
+}
+
+// outlineBranch returns the symbol for one fork or switch branch
+func outlineBranch(tree *SyntaxTree, branch *Node, index int) DocumentSymbol {
+	first := firstToken(branch)
+	var name string
+	var pipeline *Node
+	for _, c := range branch.Children {
+		if c.Kind == NodePipeline {
+			pipeline = c
+		}
+	}
+	switch strings.ToLower(first.value) {
+	case "case":
+		name = "case"
+		if len(branch.Children) > 1 && branch.Children[1].Kind == NodeExpr {
+			name += " " + oneLine(tree, branch.Children[1])
+		}
+	case "default":
+		name = "default"
+	default:
+		name = fmt.Sprintf("branch %d", index+1)
+	}
+
+	sym := DocumentSymbol{
+		Name:           name,
+		Kind:           SymbolKindNamespace,
+		Range:          tree.Range(branch.Start, branch.End),
+		SelectionRange: tree.Range(first.pos, first.end()),
+	}
+	if pipeline != nil {
+		sym.Detail = oneLine(tree, pipeline)
+		sym.Children = outlineStages(tree, pipeline)
+	}
+	return sym
+}
+
+// flattenSymbols converts an outline into flat symbol information for
+// clients without hierarchical document symbol support
+func flattenSymbols(uri string, symbols []DocumentSymbol, container string) []SymbolInformation {
+	flat := []SymbolInformation{}
+	for _, sym := range symbols {
+		flat = append(flat, SymbolInformation{
+			Name:          sym.Name,
+			Kind:          sym.Kind,
+			Location:      Location{URI: uri, Range: sym.Range},
+			ContainerName: container,
+		})
+		flat = append(flat, flattenSymbols(uri, sym.Children, sym.Name)...)
+	}
+	return flat
+}
+
+// symbolKindToLSP converts a declaration kind into an LSP symbol kind
+func symbolKindToLSP(kind SymbolKind) int {
+	switch kind {
+	case SymbolConst:
+		return SymbolKindConstant
+	case SymbolFunc:
+		return SymbolKindFunction
+	case SymbolOp:
+		return SymbolKindOperator
+	case SymbolType:
+		return SymbolKindTypeParameter
+	default:
+		return SymbolKindVariable
+	}
+}
+
+// firstToken returns the first token of a node
+func firstToken(n *Node) *token {
+	for n.Kind != NodeToken {
+		if len(n.Children) == 0 {
+			return nil
+		}
+		n = n.Children[0]
+	}
+	return n.Tok
+}
+
+// oneLine returns a node's text on one line, shortened for display
+func oneLine(tree *SyntaxTree, n *Node) string {
+	return truncate(collapseSpace(tree.Text[n.Start:n.End]))
+}
+
+// collapseSpace replaces runs of whitespace with single spaces
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// truncate shortens s to outlineDetailLength runes
+func truncate(s string) string {
+	if r := []rune(s); len(r) > outlineDetailLength {
+		return string(r[:outlineDetailLength-1]) + "…"
+	}
+	return s
+}
@@ -26,24 +26,102 @@ const (
 	MethodNotFound = -32601
 	InvalidParams  = -32602
 	InternalError  = -32603
+
+	// LSP-specific error codes
+	ServerNotInitialized = -32002
+	RequestFailed        = -32803
+	RequestCancelled     = -32800
 )
 
+// Error implements the error interface so handlers can return RPC errors
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// CancelParams for $/cancelRequest
+type CancelParams struct {
+	ID interface{} `json:"id"`
+}
+
 // InitializeParams represents the initialize request parameters
 type InitializeParams struct {
-	ProcessID             int                `json:"processId"`
-	RootURI               string             `json:"rootUri"`
-	Capabilities          ClientCapabilities `json:"capabilities"`
-	InitializationOptions interface{}        `json:"initializationOptions,omitempty"`
+	ProcessID             int                    `json:"processId"`
+	RootURI               string                 `json:"rootUri"`
+	WorkspaceFolders      []WorkspaceFolder      `json:"workspaceFolders,omitempty"`
+	Capabilities          ClientCapabilities     `json:"capabilities"`
+	InitializationOptions json.RawMessage        `json:"initializationOptions,omitempty"` // Decoded by parseInitializationOptions
+}
+
+// InitializationOptions are superdb-lsp specific settings sent by the client
+type InitializationOptions struct {
+	DiagnosticsDelay *int `json:"diagnosticsDelay,omitempty"` // Debounce delay in milliseconds
+	// Sample data file for the query files matching each pattern, both
+	// relative to the workspace root
+	SampleData map[string]string `json:"sampleData,omitempty"`
+}
+
+// WorkspaceFolder is a root folder open in the editor
+type WorkspaceFolder struct {
+	URI  string `json:"uri"`
+	Name string `json:"name"`
 }
 
 // ClientCapabilities represents client capabilities
 type ClientCapabilities struct {
+	Workspace    WorkspaceClientCapabilities    `json:"workspace,omitempty"`
 	TextDocument TextDocumentClientCapabilities `json:"textDocument,omitempty"`
 }
 
+// WorkspaceClientCapabilities represents workspace capabilities
+type WorkspaceClientCapabilities struct {
+	DidChangeWatchedFiles *DidChangeWatchedFilesClientCapabilities `json:"didChangeWatchedFiles,omitempty"`
+	Diagnostics           *DiagnosticWorkspaceClientCapabilities   `json:"diagnostics,omitempty"`
+}
+
+// DiagnosticWorkspaceClientCapabilities is present when the client lets the
+// server ask it to re-pull diagnostics (workspace/diagnostic/refresh)
+type DiagnosticWorkspaceClientCapabilities struct {
+	RefreshSupport bool `json:"refreshSupport,omitempty"`
+}
+
+// DidChangeWatchedFilesClientCapabilities represents file watching capabilities
+type DidChangeWatchedFilesClientCapabilities struct {
+	DynamicRegistration bool `json:"dynamicRegistration,omitempty"`
+}
+
 // TextDocumentClientCapabilities represents text document capabilities
 type TextDocumentClientCapabilities struct {
-	Completion CompletionClientCapabilities `json:"completion,omitempty"`
+	Completion CompletionClientCapabilities  `json:"completion,omitempty"`
+	Diagnostic *DiagnosticClientCapabilities `json:"diagnostic,omitempty"`
+	Rename     *RenameClientCapabilities     `json:"rename,omitempty"`
+
+	DocumentSymbol *DocumentSymbolClientCapabilities `json:"documentSymbol,omitempty"`
+	SignatureHelp  *SignatureHelpClientCapabilities  `json:"signatureHelp,omitempty"`
+}
+
+// SignatureHelpClientCapabilities represents signature help capabilities
+type SignatureHelpClientCapabilities struct {
+	SignatureInformation struct {
+		// The client accepts a null activeParameter (LSP 3.18)
+		NoActiveParameterSupport bool `json:"noActiveParameterSupport,omitempty"`
+	} `json:"signatureInformation,omitempty"`
+}
+
+// DocumentSymbolClientCapabilities represents document symbol capabilities
+type DocumentSymbolClientCapabilities struct {
+	HierarchicalDocumentSymbolSupport bool `json:"hierarchicalDocumentSymbolSupport,omitempty"`
+}
+
+// RenameClientCapabilities represents rename capabilities
+type RenameClientCapabilities struct {
+	PrepareSupport bool `json:"prepareSupport,omitempty"`
+}
+
+// DiagnosticClientCapabilities is present when the client supports pull
+// diagnostics (textDocument/diagnostic)
+type DiagnosticClientCapabilities struct {
+	DynamicRegistration    bool `json:"dynamicRegistration,omitempty"`
+	RelatedDocumentSupport bool `json:"relatedDocumentSupport,omitempty"`
 }
 
 // CompletionClientCapabilities represents completion capabilities
@@ -62,9 +140,21 @@ type ServerCapabilities struct {
 	CompletionProvider         *CompletionOptions    `json:"completionProvider,omitempty"`
 	DiagnosticProvider         *DiagnosticOptions    `json:"diagnosticProvider,omitempty"`
 	HoverProvider              bool                  `json:"hoverProvider,omitempty"`
+	DefinitionProvider         bool                  `json:"definitionProvider,omitempty"`
+	ReferencesProvider         bool                  `json:"referencesProvider,omitempty"`
+	DocumentHighlightProvider  bool                  `json:"documentHighlightProvider,omitempty"`
+	RenameProvider             *RenameOptions        `json:"renameProvider,omitempty"`
+	DocumentSymbolProvider     bool                  `json:"documentSymbolProvider,omitempty"`
+	WorkspaceSymbolProvider    bool                  `json:"workspaceSymbolProvider,omitempty"`
+	Workspace                  *WorkspaceOptions     `json:"workspace,omitempty"`
 	SignatureHelpProvider      *SignatureHelpOptions `json:"signatureHelpProvider,omitempty"`
 	DocumentFormattingProvider bool                  `json:"documentFormattingProvider,omitempty"`
 	CodeActionProvider         *CodeActionOptions    `json:"codeActionProvider,omitempty"`
+
+	SemanticTokensProvider *SemanticTokensOptions `json:"semanticTokensProvider,omitempty"`
+	FoldingRangeProvider   bool                   `json:"foldingRangeProvider,omitempty"`
+	SelectionRangeProvider bool                   `json:"selectionRangeProvider,omitempty"`
+	InlayHintProvider      bool                   `json:"inlayHintProvider,omitempty"`
 }
 
 // CompletionOptions represents completion provider options
@@ -73,12 +163,36 @@ type CompletionOptions struct {
 	ResolveProvider   bool     `json:"resolveProvider,omitempty"`
 }
 
+// WorkspaceOptions represents workspace-specific server capabilities
+type WorkspaceOptions struct {
+	WorkspaceFolders *WorkspaceFoldersOptions `json:"workspaceFolders,omitempty"`
+}
+
+// WorkspaceFoldersOptions represents workspace folder support
+type WorkspaceFoldersOptions struct {
+	Supported           bool `json:"supported"`
+	ChangeNotifications bool `json:"changeNotifications"`
+}
+
+// RenameOptions represents rename provider options
+type RenameOptions struct {
+	PrepareProvider bool `json:"prepareProvider,omitempty"`
+}
+
 // DiagnosticOptions represents diagnostic provider options
 type DiagnosticOptions struct {
-	InterFileDependencies bool `json:"interFileDependencies"`
-	WorkspaceDiagnostics  bool `json:"workspaceDiagnostics"`
+	Identifier            string `json:"identifier,omitempty"`
+	InterFileDependencies bool   `json:"interFileDependencies"`
+	WorkspaceDiagnostics  bool   `json:"workspaceDiagnostics"`
 }
 
+// Text document sync kinds
+const (
+	TextDocumentSyncKindNone        = 0
+	TextDocumentSyncKindFull        = 1
+	TextDocumentSyncKindIncremental = 2
+)
+
 // InitializeResult represents the initialize response
 type InitializeResult struct {
 	Capabilities ServerCapabilities `json:"capabilities"`
@@ -121,9 +235,12 @@ type DidChangeTextDocumentParams struct {
 	ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
 }
 
-// TextDocumentContentChangeEvent represents a change event
+// TextDocumentContentChangeEvent represents a change event. When Range is
+// nil the event carries the full document text.
 type TextDocumentContentChangeEvent struct {
-	Text string `json:"text"`
+	Range       *Range `json:"range,omitempty"`
+	RangeLength int    `json:"rangeLength,omitempty"` // Deprecated by LSP, ignored
+	Text        string `json:"text"`
 }
 
 // DidCloseTextDocumentParams for textDocument/didClose
@@ -173,6 +290,52 @@ type PublishDiagnosticsParams struct {
 	Diagnostics []Diagnostic `json:"diagnostics"`
 }
 
+// DocumentDiagnosticParams for textDocument/diagnostic
+type DocumentDiagnosticParams struct {
+	TextDocument     TextDocumentIdentifier `json:"textDocument"`
+	Identifier       string                 `json:"identifier,omitempty"`
+	PreviousResultID string                 `json:"previousResultId,omitempty"`
+}
+
+// Document diagnostic report kinds
+const (
+	DocumentDiagnosticReportKindFull      = "full"
+	DocumentDiagnosticReportKindUnchanged = "unchanged"
+)
+
+// DocumentDiagnosticReport is a full or unchanged diagnostic report.
+// Items is always sent for full reports, even when empty.
+type DocumentDiagnosticReport struct {
+	Kind     string        `json:"kind"`
+	ResultID string        `json:"resultId,omitempty"`
+	Items    *[]Diagnostic `json:"items,omitempty"`
+}
+
+// WorkspaceDiagnosticParams for workspace/diagnostic
+type WorkspaceDiagnosticParams struct {
+	Identifier        string             `json:"identifier,omitempty"`
+	PreviousResultIDs []PreviousResultID `json:"previousResultIds"`
+}
+
+// PreviousResultID is a result ID the client holds for a document
+type PreviousResultID struct {
+	URI   string `json:"uri"`
+	Value string `json:"value"`
+}
+
+// WorkspaceDiagnosticReport is the workspace/diagnostic response
+type WorkspaceDiagnosticReport struct {
+	Items []WorkspaceDocumentDiagnosticReport `json:"items"`
+}
+
+// WorkspaceDocumentDiagnosticReport is a document report within a
+// workspace report. Version is nil for documents not open in the editor.
+type WorkspaceDocumentDiagnosticReport struct {
+	DocumentDiagnosticReport
+	URI     string `json:"uri"`
+	Version *int   `json:"version"`
+}
+
 // CompletionParams for textDocument/completion
 type CompletionParams struct {
 	TextDocument TextDocumentIdentifier `json:"textDocument"`
@@ -195,12 +358,36 @@ const (
 
 // CompletionItem represents a completion item
 type CompletionItem struct {
-	Label         string `json:"label"`
-	Kind          int    `json:"kind,omitempty"`
-	Detail        string `json:"detail,omitempty"`
-	Documentation string `json:"documentation,omitempty"`
-	InsertText    string `json:"insertText,omitempty"`
-}
+	Label            string                      `json:"label"`
+	LabelDetails     *CompletionItemLabelDetails `json:"labelDetails,omitempty"`
+	Kind             int                         `json:"kind,omitempty"`
+	Tags             []int                       `json:"tags,omitempty"`
+	Detail           string                      `json:"detail,omitempty"`
+	Documentation    *MarkupContent              `json:"documentation,omitempty"` // Filled in by completionItem/resolve
+	Deprecated       bool                        `json:"deprecated,omitempty"`
+	SortText         string                      `json:"sortText,omitempty"`
+	FilterText       string                      `json:"filterText,omitempty"`
+	InsertText       string                      `json:"insertText,omitempty"`
+	InsertTextFormat int                         `json:"insertTextFormat,omitempty"` // Snippet when InsertText has placeholders
+	Data             *completionData             `json:"data,omitempty"`
+}
+
+// CompletionItemLabelDetails is shown next to an item's label
+type CompletionItemLabelDetails struct {
+	Detail      string `json:"detail,omitempty"`      // Right after the label, e.g. parameters
+	Description string `json:"description,omitempty"` // Less prominent, e.g. a kind or type
+}
+
+// Completion item tags
+const (
+	CompletionItemTagDeprecated = 1
+)
+
+// Insert text formats
+const (
+	InsertTextFormatPlainText = 1
+	InsertTextFormatSnippet   = 2
+)
 
 // Completion item kinds
 const (
@@ -243,6 +430,275 @@ type HoverParams struct {
 	Position     Position               `json:"position"`
 }
 
+// DefinitionParams for textDocument/definition
+type DefinitionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+// ReferenceParams for textDocument/references
+type ReferenceParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+	Context      ReferenceContext       `json:"context"`
+}
+
+// ReferenceContext controls which references are returned
+type ReferenceContext struct {
+	IncludeDeclaration bool `json:"includeDeclaration"`
+}
+
+// DocumentHighlightParams for textDocument/documentHighlight
+type DocumentHighlightParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+// DocumentHighlight marks one occurrence of the symbol under the cursor
+type DocumentHighlight struct {
+	Range Range `json:"range"`
+	Kind  int   `json:"kind,omitempty"`
+}
+
+// Document highlight kinds
+const (
+	DocumentHighlightKindText  = 1
+	DocumentHighlightKindRead  = 2
+	DocumentHighlightKindWrite = 3
+)
+
+// PrepareRenameParams for textDocument/prepareRename
+type PrepareRenameParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+// PrepareRenameResult is the range to rename and its current text
+type PrepareRenameResult struct {
+	Range       Range  `json:"range"`
+	Placeholder string `json:"placeholder"`
+}
+
+// RenameParams for textDocument/rename
+type RenameParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+	NewName      string                 `json:"newName"`
+}
+
+// ShowMessageParams for window/showMessage notifications
+type ShowMessageParams struct {
+	Type    int    `json:"type"`
+	Message string `json:"message"`
+}
+
+// Message types
+const (
+	MessageTypeError   = 1
+	MessageTypeWarning = 2
+	MessageTypeInfo    = 3
+	MessageTypeLog     = 4
+)
+
+// DocumentSymbolParams for textDocument/documentSymbol
+type DocumentSymbolParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// DocumentSymbol is one entry in a document's hierarchical outline
+type DocumentSymbol struct {
+	Name           string           `json:"name"`
+	Detail         string           `json:"detail,omitempty"`
+	Kind           int              `json:"kind"`
+	Range          Range            `json:"range"`
+	SelectionRange Range            `json:"selectionRange"`
+	Children       []DocumentSymbol `json:"children,omitempty"`
+}
+
+// SymbolInformation is a flat symbol entry, for clients without
+// hierarchical document symbol support
+type SymbolInformation struct {
+	Name          string   `json:"name"`
+	Kind          int      `json:"kind"`
+	Location      Location `json:"location"`
+	ContainerName string   `json:"containerName,omitempty"`
+}
+
+// Symbol kinds
+const (
+	SymbolKindNamespace     = 3
+	SymbolKindFunction      = 12
+	SymbolKindVariable      = 13
+	SymbolKindConstant      = 14
+	SymbolKindOperator      = 25
+	SymbolKindTypeParameter = 26
+)
+
+// WorkspaceSymbolParams for workspace/symbol
+type WorkspaceSymbolParams struct {
+	Query string `json:"query"`
+}
+
+// DidChangeWatchedFilesParams for workspace/didChangeWatchedFiles
+type DidChangeWatchedFilesParams struct {
+	Changes []FileEvent `json:"changes"`
+}
+
+// FileEvent describes a change to a watched file
+type FileEvent struct {
+	URI  string `json:"uri"`
+	Type int    `json:"type"`
+}
+
+// File change types
+const (
+	FileChangeTypeCreated = 1
+	FileChangeTypeChanged = 2
+	FileChangeTypeDeleted = 3
+)
+
+// DidChangeWorkspaceFoldersParams for workspace/didChangeWorkspaceFolders
+type DidChangeWorkspaceFoldersParams struct {
+	Event WorkspaceFoldersChangeEvent `json:"event"`
+}
+
+// WorkspaceFoldersChangeEvent lists added and removed workspace folders
+type WorkspaceFoldersChangeEvent struct {
+	Added   []WorkspaceFolder `json:"added"`
+	Removed []WorkspaceFolder `json:"removed"`
+}
+
+// RegistrationParams for client/registerCapability
+type RegistrationParams struct {
+	Registrations []Registration `json:"registrations"`
+}
+
+// Registration dynamically registers a capability with the client
+type Registration struct {
+	ID              string      `json:"id"`
+	Method          string      `json:"method"`
+	RegisterOptions interface{} `json:"registerOptions,omitempty"`
+}
+
+// DidChangeWatchedFilesRegistrationOptions lists the files to watch
+type DidChangeWatchedFilesRegistrationOptions struct {
+	Watchers []FileSystemWatcher `json:"watchers"`
+}
+
+// FileSystemWatcher watches files matching a glob pattern
+type FileSystemWatcher struct {
+	GlobPattern string `json:"globPattern"`
+}
+
+// FoldingRangeParams for textDocument/foldingRange
+type FoldingRangeParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// FoldingRange is a foldable span of whole lines
+type FoldingRange struct {
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Kind      string `json:"kind,omitempty"`
+}
+
+// Folding range kinds
+const (
+	FoldingRangeKindComment = "comment"
+	FoldingRangeKindRegion  = "region"
+)
+
+// SelectionRangeParams for textDocument/selectionRange
+type SelectionRangeParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Positions    []Position             `json:"positions"`
+}
+
+// SelectionRange is a range around a position and the ranges enclosing it
+type SelectionRange struct {
+	Range  Range           `json:"range"`
+	Parent *SelectionRange `json:"parent,omitempty"`
+}
+
+// InlayHintParams for textDocument/inlayHint
+type InlayHintParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Range        Range                  `json:"range"`
+}
+
+// InlayHint is a label shown inline in the editor
+type InlayHint struct {
+	Position     Position `json:"position"`
+	Label        string   `json:"label"`
+	Kind         int      `json:"kind,omitempty"`
+	Tooltip      string   `json:"tooltip,omitempty"`
+	PaddingLeft  bool     `json:"paddingLeft,omitempty"`
+	PaddingRight bool     `json:"paddingRight,omitempty"`
+}
+
+// Inlay hint kinds
+const (
+	InlayHintKindType      = 1
+	InlayHintKindParameter = 2
+)
+
+// SemanticTokensOptions for server capabilities
+type SemanticTokensOptions struct {
+	Legend SemanticTokensLegend       `json:"legend"`
+	Range  bool                       `json:"range,omitempty"`
+	Full   *SemanticTokensFullOptions `json:"full,omitempty"`
+}
+
+// SemanticTokensLegend names the token types and modifiers that encoded
+// tokens refer to by index
+type SemanticTokensLegend struct {
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+}
+
+// SemanticTokensFullOptions for full-document semantic tokens
+type SemanticTokensFullOptions struct {
+	Delta bool `json:"delta,omitempty"`
+}
+
+// SemanticTokensParams for textDocument/semanticTokens/full
+type SemanticTokensParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// SemanticTokensRangeParams for textDocument/semanticTokens/range
+type SemanticTokensRangeParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Range        Range                  `json:"range"`
+}
+
+// SemanticTokensDeltaParams for textDocument/semanticTokens/full/delta
+type SemanticTokensDeltaParams struct {
+	TextDocument     TextDocumentIdentifier `json:"textDocument"`
+	PreviousResultID string                 `json:"previousResultId"`
+}
+
+// SemanticTokens holds encoded tokens: five integers per token giving the
+// line and start relative to the previous token, the length, the type and
+// the modifier bits
+type SemanticTokens struct {
+	ResultID string   `json:"resultId,omitempty"`
+	Data     []uint32 `json:"data"`
+}
+
+// SemanticTokensDelta describes how to update a previous result
+type SemanticTokensDelta struct {
+	ResultID string               `json:"resultId,omitempty"`
+	Edits    []SemanticTokensEdit `json:"edits"`
+}
+
+// SemanticTokensEdit replaces part of the previous result's data
+type SemanticTokensEdit struct {
+	Start       int      `json:"start"`
+	DeleteCount int      `json:"deleteCount"`
+	Data        []uint32 `json:"data,omitempty"`
+}
+
 // Hover represents a hover response
 type Hover struct {
 	Contents MarkupContent `json:"contents"`
@@ -280,7 +736,7 @@ type SignatureHelpContext struct {
 type SignatureHelp struct {
 	Signatures      []SignatureInformation `json:"signatures"`
 	ActiveSignature int                    `json:"activeSignature,omitempty"`
-	ActiveParameter int                    `json:"activeParameter,omitempty"`
+	ActiveParameter *int                   `json:"activeParameter"` // null when no parameter is active, if the client allows it
 }
 
 // SignatureInformation represents a function signature
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+)
+
+// pull_diagnostics.go - LSP 3.17 pull diagnostics (textDocument/diagnostic
+// and workspace/diagnostic)
+
+// diagnosticResultID identifies the diagnostics of a document by hashing its
+// text, so a client holding the current result ID never causes a re-parse
+func diagnosticResultID(text string) string {
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// documentDiagnosticReport builds a full report for the document, or an
+// unchanged report when the client already has the current result. Query
+// results also depend on the declarations in other files, so their result
+// IDs include the workspace index generation. callables are passed on to
+// documentDiagnostics.
+func (s *Server) documentDiagnosticReport(ctx context.Context, uri string, tree *SyntaxTree, previousResultID string, callables map[string][]indexedSymbol) DocumentDiagnosticReport {
+	resultID := diagnosticResultID(tree.Text)
+	if !isDataFile(uri) && s.workspace.isReady() {
+		resultID += "." + strconv.FormatUint(s.workspace.version(), 16)
+	}
+	if previousResultID == resultID {
+		return DocumentDiagnosticReport{
+			Kind:     DocumentDiagnosticReportKindUnchanged,
+			ResultID: resultID,
+		}
+	}
+
+	items := s.documentDiagnostics(ctx, uri, tree, callables)
+	if items == nil {
+		items = []Diagnostic{}
+	}
+	return DocumentDiagnosticReport{
+		Kind:     DocumentDiagnosticReportKindFull,
+		ResultID: resultID,
+		Items:    &items,
+	}
+}
+
+// workspaceDiagnosticReport reports on every .spq and .sup file under the
+// workspace folders. Open documents are checked using their editor contents.
+func (s *Server) workspaceDiagnosticReport(ctx context.Context, previous []PreviousResultID) (WorkspaceDiagnosticReport, error) {
+	report := WorkspaceDiagnosticReport{Items: []WorkspaceDocumentDiagnosticReport{}}
+
+	previousByPath := make(map[string]string, len(previous))
+	for _, p := range previous {
+		if path, ok := uriToPath(p.URI); ok {
+			previousByPath[path] = p.Value
+		}
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, root := range s.workspace.roots() {
+		rootFiles, err := workspaceFiles(ctx, root)
+		if err != nil {
+			return report, err
+		}
+		// Nested workspace folders would otherwise report files twice
+		for _, path := range rootFiles {
+			if !seen[path] {
+				seen[path] = true
+				files = append(files, path)
+			}
+		}
+	}
+
+	// Every file is checked against the same declarations. A file's own
+	// top-level operators resolve within it before these are consulted,
+	// so they need not be left out per file.
+	callables := callableDecls(s.workspace.snapshot(s.openDocuments(ctx)), "")
+
+	for _, path := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		uri := pathToURI(path)
+		var tree *SyntaxTree
+		var version *int
+		if doc, ok := s.document(ctx, uri); ok {
+			tree = doc.Syntax()
+			v := doc.Version
+			version = &v
+		} else {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("Skipping unreadable workspace file %s: %v", path, err)
+				continue
+			}
+			tree = parseSyntax(string(data))
+		}
+
+		report.Items = append(report.Items, WorkspaceDocumentDiagnosticReport{
+			DocumentDiagnosticReport: s.documentDiagnosticReport(ctx, uri, tree, previousByPath[path], callables),
+			URI:                      uri,
+			Version:                  version,
+		})
+	}
+
+	return report, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+// referencesAt lists every use of the user-defined symbol under the cursor,
+// optionally including its declaration
+func referencesAt(uri string, tree *SyntaxTree, pos Position, includeDecl bool) []Location {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+	symbols := tree.Symbols()
+	sym, _ := symbols.At(tree, offset)
+	if sym == nil {
+		return nil
+	}
+
+	locations := []Location{}
+	for _, tok := range symbols.References(tree, sym, includeDecl) {
+		locations = append(locations, Location{URI: uri, Range: tree.Range(tok.pos, tok.end())})
+	}
+	return locations
+}
+
+// highlightsAt marks every occurrence of the symbol or field under the
+// cursor. Declarations and := assignments are writes; other uses are reads.
+func highlightsAt(tree *SyntaxTree, pos Position) []DocumentHighlight {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+	symbols := tree.Symbols()
+	sym, tok := symbols.At(tree, offset)
+
+	var toks []*token
+	switch {
+	case sym != nil:
+		toks = symbols.References(tree, sym, true)
+	case tok != nil && symbols.IsField(tok):
+		toks = symbols.Fields(tree, tok.value)
+	default:
+		return nil
+	}
+
+	highlights := make([]DocumentHighlight, 0, len(toks))
+	for _, t := range toks {
+		kind := DocumentHighlightKindRead
+		if symbols.IsWrite(t) {
+			kind = DocumentHighlightKindWrite
+		}
+		highlights = append(highlights, DocumentHighlight{
+			Range: tree.Range(t.pos, t.end()),
+			Kind:  kind,
+		})
+	}
+	return highlights
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// renameTarget returns the user-declared symbol under the cursor. Builtins,
+// keywords and fields can't be renamed.
+func renameTarget(tree *SyntaxTree, pos Position) (*Symbol, *token, error) {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil, nil, &RPCError{Code: RequestFailed, Message: "nothing to rename here"}
+	}
+	sym, tok := tree.Symbols().At(tree, offset)
+	switch {
+	case sym != nil:
+		return sym, tok, nil
+	case tok == nil:
+		return nil, nil, &RPCError{Code: RequestFailed, Message: "nothing to rename here"}
+	case tok.typ == tokKeyword:
+		return nil, nil, &RPCError{Code: RequestFailed, Message: fmt.Sprintf("cannot rename keyword %q", tok.value)}
+	}
+	if b := Builtins.Lookup(tok.value); b != nil {
+		return nil, nil, &RPCError{Code: RequestFailed, Message: fmt.Sprintf("cannot rename builtin %s %q", b.Kind, b.Name)}
+	}
+	return nil, nil, &RPCError{Code: RequestFailed, Message: fmt.Sprintf("%q is not a user-declared symbol", tok.value)}
+}
+
+// prepareRenameAt checks that the cursor is on a renameable symbol and
+// returns the range of the occurrence under it
+func prepareRenameAt(tree *SyntaxTree, pos Position) (*PrepareRenameResult, error) {
+	_, tok, err := renameTarget(tree, pos)
+	if err != nil {
+		return nil, err
+	}
+	return &PrepareRenameResult{
+		Range:       tree.Range(tok.pos, tok.end()),
+		Placeholder: tok.value,
+	}, nil
+}
+
+// renameAt renames every occurrence of the symbol under the cursor in its
+// document. A new name already declared in the same scope, or one that
+// would make any identifier refer to something else, is refused; the
+// returned warnings describe builtins the new name would shadow.
+func renameAt(uri string, tree *SyntaxTree, pos Position, newName string) (*WorkspaceEdit, []string, error) {
+	sym, _, err := renameTarget(tree, pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isIdentifierName(newName) {
+		return nil, nil, &RPCError{Code: InvalidParams, Message: fmt.Sprintf("%q is not a valid identifier", newName)}
+	}
+	if b := Builtins.Lookup(newName); b != nil && (b.Kind == KindKeyword || b.Kind == KindOperator) {
+		return nil, nil, &RPCError{Code: InvalidParams, Message: fmt.Sprintf("%q is a reserved %s", newName, b.Kind)}
+	}
+
+	var warnings []string
+	if b := Builtins.Lookup(newName); b != nil {
+		warnings = append(warnings, fmt.Sprintf("%q shadows the builtin %s %s", newName, b.Kind, b.Name))
+	}
+	for _, other := range sym.Scope.Symbols[newName] {
+		if other != sym {
+			line := tree.PositionAt(other.Tok.pos).Line + 1
+			return nil, nil, &RPCError{Code: RequestFailed, Message: fmt.Sprintf("%q collides with the %s declared on line %d", newName, other.Kind, line)}
+		}
+	}
+
+	toks := tree.Symbols().References(tree, sym, true)
+	if err := checkRebinding(tree, sym, toks, newName); err != nil {
+		return nil, nil, err
+	}
+	var edits []TextEdit
+	for _, tok := range toks {
+		edits = append(edits, TextEdit{Range: tree.Range(tok.pos, tok.end()), NewText: newName})
+	}
+	return &WorkspaceEdit{Changes: map[string][]TextEdit{uri: edits}}, warnings, nil
+}
+
+// checkRebinding resolves the document again with the rename applied and
+// refuses the rename if any identifier would then name something else: a
+// renamed reference binding to another declaration, an outer name or field
+// captured by the renamed symbol, or an inner binding shadowing it.
+func checkRebinding(tree *SyntaxTree, sym *Symbol, toks []*token, newName string) error {
+	var b strings.Builder
+	last := 0
+	for _, tok := range toks {
+		b.WriteString(tree.Text[last:tok.pos])
+		b.WriteString(newName)
+		last = tok.end()
+	}
+	b.WriteString(tree.Text[last:])
+	renamed := parseSyntax(b.String())
+	if len(renamed.Tokens) != len(tree.Tokens) {
+		return &RPCError{Code: RequestFailed, Message: fmt.Sprintf("cannot rename %q to %q safely", sym.Name, newName)}
+	}
+
+	before, after := tree.Symbols(), renamed.Symbols()
+	// Pair each declaration with its counterpart in the renamed document
+	counterpart := make(map[*Symbol]*Symbol)
+	for i := range tree.Tokens {
+		if old, ok := before.defs[&tree.Tokens[i]]; ok {
+			counterpart[old] = after.defs[&renamed.Tokens[i]]
+		}
+	}
+	for i := range tree.Tokens {
+		old, now := &tree.Tokens[i], &renamed.Tokens[i]
+		oldSym, wasRef := before.refs[old]
+		newSym, isRef := after.refs[now]
+		same := wasRef == isRef && (!wasRef || counterpart[oldSym] == newSym) &&
+			before.fields[old] == after.fields[now] && before.calls[old] == after.calls[now]
+		if !same {
+			line := tree.PositionAt(old.pos).Line + 1
+			return &RPCError{Code: RequestFailed, Message: fmt.Sprintf("renaming %q to %q would change what %q on line %d refers to",
+				sym.Name, newName, old.value, line)}
+		}
+	}
+	return nil
+}
+
+// renameInWorkspace extends the rename of a top-level fn or op to the
+// calls of it in other workspace files. Files that declare the name
+// themselves call their own declaration and are left alone. A new name
+// another file already declares, or that a call would resolve to once
+// renamed, is refused.
+func (s *Server) renameInWorkspace(ctx context.Context, uri string, tree *SyntaxTree, pos Position, newName string, edit *WorkspaceEdit) error {
+	sym, _, err := renameTarget(tree, pos)
+	if err != nil || !sym.Kind.callable() || sym.Scope.Parent != nil {
+		return err
+	}
+	// Files not read yet may call it too
+	if err := s.workspace.wait(ctx); err != nil {
+		return err
+	}
+	files := s.workspace.snapshot(s.openDocuments(ctx))
+	if defs := callableDecls(files, uri)[newName]; len(defs) > 0 {
+		path, _ := uriToPath(defs[0].Location.URI)
+		return &RPCError{Code: RequestFailed, Message: fmt.Sprintf("%q collides with the %s declared in %s",
+			newName, defs[0].Kind, filepath.Base(path))}
+	}
+	self, _ := uriToPath(uri)
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		if path != self {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		other := pathToURI(path)
+		if !declaredIn(callableDecls(files, other)[sym.Name], uri) {
+			continue
+		}
+		var calls *SyntaxTree
+		if doc, ok := s.document(ctx, other); ok {
+			calls = doc.Syntax()
+		} else {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("Skipping unreadable workspace file %s: %v", path, err)
+				continue
+			}
+			calls = parseSyntax(string(data))
+		}
+
+		symbols := calls.Symbols()
+		var edits []TextEdit
+		for i := range calls.Tokens {
+			tok := &calls.Tokens[i]
+			if tok.value != sym.Name || !symbols.IsUnresolvedCall(tok) {
+				continue
+			}
+			if capture := symbols.ScopeAt(calls, tok.pos).lookup(newName, true); capture != nil {
+				line := calls.PositionAt(capture.Tok.pos).Line + 1
+				return &RPCError{Code: RequestFailed, Message: fmt.Sprintf("%q collides with the %s declared on line %d of %s",
+					newName, capture.Kind, line, filepath.Base(path))}
+			}
+			edits = append(edits, TextEdit{Range: calls.Range(tok.pos, tok.end()), NewText: newName})
+		}
+		if len(edits) > 0 {
+			edit.Changes[other] = edits
+		}
+	}
+	return nil
+}
+
+// declaredIn reports whether one of a name's workspace declarations is in
+// a document
+func declaredIn(defs []indexedSymbol, uri string) bool {
+	for _, def := range defs {
+		if def.Location.URI == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdentifierName reports whether name lexes as a single plain identifier
+func isIdentifierName(name string) bool {
+	toks := tokenize(name)
+	return len(toks) == 1 && toks[0].typ == tokIdentifier && toks[0].value == name &&
+		!strings.HasPrefix(name, "`")
+}
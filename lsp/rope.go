@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// rope.go - Persistent rope used as the backing store for document text.
+// Ropes are immutable: edits return a new rope that shares every untouched
+// chunk with the original, so old document versions stay valid snapshots.
+
+const (
+	ropeLeafSize = 1024 // Maximum bytes held by a single leaf
+	ropeMaxDepth = 48   // Rebuild when the tree gets deeper than this
+)
+
+// rope is a binary tree of text chunks with cached byte and newline counts
+type rope struct {
+	left, right *rope
+	leaf        string
+	length      int // Total bytes in this subtree
+	newlines    int // Total '\n' bytes in this subtree
+	depth       int
+}
+
+// newRope builds a balanced rope from a string
+func newRope(s string) *rope {
+	if len(s) <= ropeLeafSize {
+		return &rope{
+			leaf:     s,
+			length:   len(s),
+			newlines: strings.Count(s, "\n"),
+		}
+	}
+	mid := len(s) / 2
+	return concatRope(newRope(s[:mid]), newRope(s[mid:]))
+}
+
+// concatRope joins two ropes, rebuilding when the result gets too deep
+func concatRope(a, b *rope) *rope {
+	if a == nil || a.length == 0 {
+		return b
+	}
+	if b == nil || b.length == 0 {
+		return a
+	}
+	if a.isLeaf() && b.isLeaf() && a.length+b.length <= ropeLeafSize {
+		return newRope(a.leaf + b.leaf)
+	}
+	depth := a.depth
+	if b.depth > depth {
+		depth = b.depth
+	}
+	r := &rope{
+		left:     a,
+		right:    b,
+		length:   a.length + b.length,
+		newlines: a.newlines + b.newlines,
+		depth:    depth + 1,
+	}
+	if r.depth > ropeMaxDepth {
+		return newRope(r.String())
+	}
+	return r
+}
+
+func (r *rope) isLeaf() bool {
+	return r.left == nil && r.right == nil
+}
+
+// Len returns the length of the rope in bytes
+func (r *rope) Len() int {
+	if r == nil {
+		return 0
+	}
+	return r.length
+}
+
+// LineCount returns the number of lines (newlines + 1)
+func (r *rope) LineCount() int {
+	if r == nil {
+		return 1
+	}
+	return r.newlines + 1
+}
+
+// String returns the full text held by the rope
+func (r *rope) String() string {
+	if r == nil {
+		return ""
+	}
+	if r.isLeaf() {
+		return r.leaf
+	}
+	var sb strings.Builder
+	sb.Grow(r.length)
+	r.writeTo(&sb)
+	return sb.String()
+}
+
+func (r *rope) writeTo(sb *strings.Builder) {
+	if r.isLeaf() {
+		sb.WriteString(r.leaf)
+		return
+	}
+	r.left.writeTo(sb)
+	r.right.writeTo(sb)
+}
+
+// split divides the rope at a byte offset
+func (r *rope) split(offset int) (*rope, *rope) {
+	if r == nil {
+		return nil, nil
+	}
+	if offset <= 0 {
+		return nil, r
+	}
+	if offset >= r.length {
+		return r, nil
+	}
+	if r.isLeaf() {
+		return newRope(r.leaf[:offset]), newRope(r.leaf[offset:])
+	}
+	if offset < r.left.length {
+		l, m := r.left.split(offset)
+		return l, concatRope(m, r.right)
+	}
+	m, rr := r.right.split(offset - r.left.length)
+	return concatRope(r.left, m), rr
+}
+
+// Replace returns a new rope with bytes [start, end) replaced by text
+func (r *rope) Replace(start, end int, text string) *rope {
+	left, rest := r.split(start)
+	_, right := rest.split(end - start)
+	return concatRope(concatRope(left, newRope(text)), right)
+}
+
+// Slice returns the text between two byte offsets
+func (r *rope) Slice(start, end int) string {
+	if r == nil || start >= end {
+		return ""
+	}
+	if r.isLeaf() {
+		return r.leaf[start:end]
+	}
+	var sb strings.Builder
+	sb.Grow(end - start)
+	r.sliceTo(&sb, start, end)
+	return sb.String()
+}
+
+func (r *rope) sliceTo(sb *strings.Builder, start, end int) {
+	if start >= end {
+		return
+	}
+	if r.isLeaf() {
+		sb.WriteString(r.leaf[start:end])
+		return
+	}
+	if start < r.left.length {
+		r.left.sliceTo(sb, start, min(end, r.left.length))
+	}
+	if end > r.left.length {
+		r.right.sliceTo(sb, max(start-r.left.length, 0), end-r.left.length)
+	}
+}
+
+// LineOffset returns the byte offset at which the given 0-based line starts.
+// Lines past the end of the rope map to its length.
+func (r *rope) LineOffset(line int) int {
+	if r == nil || line <= 0 {
+		return 0
+	}
+	if line > r.newlines {
+		return r.length
+	}
+	if r.isLeaf() {
+		offset := 0
+		for i := 0; i < line; i++ {
+			offset += strings.IndexByte(r.leaf[offset:], '\n') + 1
+		}
+		return offset
+	}
+	if line <= r.left.newlines {
+		return r.left.LineOffset(line)
+	}
+	return r.left.length + r.right.LineOffset(line-r.left.newlines)
+}
+
+// line returns the text of a 0-based line without its line terminator
+func (r *rope) line(line int) string {
+	start := r.LineOffset(line)
+	end := r.Len()
+	if line+1 < r.LineCount() {
+		end = r.LineOffset(line+1) - 1
+	}
+	return r.Slice(start, end)
+}
+
+// OffsetAt converts an LSP position (UTF-16 code units) into a byte offset.
+// Positions past the end of a line or the text are clamped.
+func (r *rope) OffsetAt(pos Position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= r.LineCount() {
+		return r.Len()
+	}
+	return r.LineOffset(pos.Line) + utf16ToByteOffset(r.line(pos.Line), pos.Character)
+}
+
+// PositionAt converts a byte offset into an LSP position (UTF-16 code units)
+func (r *rope) PositionAt(offset int) Position {
+	offset = max(0, min(offset, r.Len()))
+	// The line holding offset is the last one starting at or before it
+	line := sort.Search(r.LineCount(), func(i int) bool { return r.LineOffset(i) > offset }) - 1
+	return Position{Line: line, Character: byteToUTF16Offset(r.Slice(r.LineOffset(line), offset))}
+}
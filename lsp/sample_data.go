@@ -0,0 +1,322 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brimdata/super"
+	"github.com/brimdata/super/scode"
+	"github.com/brimdata/super/sup"
+)
+
+// sample_data.go - Field names inferred from a query's sample input. A
+// query names its input with a from source such as from 'events.sup', or
+// the sampleData initialization option maps query files to data files.
+// The first values of the file are read with the SUP reader, which also
+// reads JSON, and the fields of their record types are offered by
+// completion.
+
+// Limits on how much of a sample file is read
+const (
+	sampleBytes  = 1 << 20
+	sampleValues = 1000
+)
+
+// sampleExtensions are the data files whose fields can be inferred
+var sampleExtensions = map[string]bool{
+	".sup": true, ".json": true, ".jsonl": true, ".ndjson": true,
+}
+
+// sampleField is a field path found in sample data with the types it has
+type sampleField struct {
+	path  []string
+	types []super.Type
+}
+
+// name returns the field path in SuperSQL syntax, quoting names that
+// aren't identifiers
+func (f sampleField) name() string {
+	parts := make([]string, len(f.path))
+	for i, p := range f.path {
+		parts[i] = fieldName(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// typeName formats the field's type, or a union of the types it has in
+// different values
+func (f sampleField) typeName() string {
+	if len(f.types) == 1 {
+		return typeName(f.types[0])
+	}
+	names := make([]string, len(f.types))
+	for i, t := range f.types {
+		names[i] = typeName(t)
+	}
+	return "(" + strings.Join(names, ",") + ")"
+}
+
+// fieldName quotes a field name with backticks unless it's an identifier
+func fieldName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if !isIdentifierChar(name[i]) || (i == 0 && name[i] >= '0' && name[i] <= '9') {
+			return "`" + name + "`"
+		}
+	}
+	if name == "" || isKeyword(name) {
+		return "`" + name + "`"
+	}
+	return name
+}
+
+// inferFields collects the field paths of the records among values,
+// sorted by path
+func inferFields(values []*super.Value) []sampleField {
+	index := make(map[string]int)
+	var fields []sampleField
+	var visit func(path []string, t super.Type)
+	visit = func(path []string, t super.Type) {
+		rec, ok := super.TypeUnder(t).(*super.TypeRecord)
+		if !ok {
+			return
+		}
+		for _, f := range rec.Fields {
+			p := append(append([]string(nil), path...), f.Name)
+			key := strings.Join(p, "\x00")
+			i, seen := index[key]
+			if !seen {
+				i = len(fields)
+				index[key] = i
+				fields = append(fields, sampleField{path: p})
+			}
+			if !hasType(fields[i].types, f.Type) {
+				fields[i].types = append(fields[i].types, f.Type)
+			}
+			visit(p, f.Type)
+		}
+	}
+	for _, v := range values {
+		t := v.Type()
+		// A JSON file may hold an array of records
+		if arr, ok := super.TypeUnder(t).(*super.TypeArray); ok {
+			t = arr.Type
+		}
+		visit(nil, t)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name() < fields[j].name() })
+	return fields
+}
+
+func hasType(types []super.Type, t super.Type) bool {
+	for _, u := range types {
+		if typeName(u) == typeName(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSampleFields infers the fields of the first values in a data file
+func readSampleFields(path string) ([]sampleField, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	parser := sup.NewParser(io.LimitReader(f, sampleBytes))
+	sctx := super.NewContext()
+	analyzer := sup.NewAnalyzer()
+	builder := scode.NewBuilder()
+	var values []*super.Value
+	for len(values) < sampleValues {
+		// A value cut off by the size limit ends the sample
+		ast, err := parser.ParseValue()
+		if err != nil || ast == nil {
+			break
+		}
+		val, err := analyzer.ConvertValue(sctx, ast)
+		if err != nil {
+			continue
+		}
+		superVal, err := sup.Build(builder, val)
+		if err != nil {
+			continue
+		}
+		values = append(values, &superVal)
+	}
+	return inferFields(values), nil
+}
+
+// sampleCache holds the fields inferred from each sample file until the
+// file changes
+type sampleCache struct {
+	mu      sync.Mutex
+	entries map[string]sampleEntry
+}
+
+type sampleEntry struct {
+	modTime time.Time
+	size    int64
+	fields  []sampleField
+}
+
+func newSampleCache() *sampleCache {
+	return &sampleCache{entries: make(map[string]sampleEntry)}
+}
+
+// fields returns the fields of a sample file, reading it again only when
+// its size or modification time changed
+func (c *sampleCache) fields(path string) []sampleField {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.fields
+	}
+	fields, err := readSampleFields(path)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.entries[path] = sampleEntry{modTime: info.ModTime(), size: info.Size(), fields: fields}
+	c.mu.Unlock()
+	return fields
+}
+
+// sampleSource returns the data file that the statement holding the
+// cursor reads with from, or else the first one read in the document.
+// Relative paths are resolved against dir.
+func sampleSource(tree *SyntaxTree, offset int, dir string) string {
+	var stmt *Node
+	for _, c := range tree.Root.Children {
+		if c.Start <= offset {
+			stmt = c
+		}
+	}
+	for _, n := range []*Node{stmt, tree.Root} {
+		if n == nil {
+			continue
+		}
+		if src := fromSource(tree, n); src != "" {
+			if !filepath.IsAbs(src) {
+				src = filepath.Join(dir, src)
+			}
+			return src
+		}
+	}
+	return ""
+}
+
+// fromSource returns the first data file named by a from under n, as a
+// quoted string or a bare path such as events.sup
+func fromSource(tree *SyntaxTree, n *Node) string {
+	if n.Kind == NodeStage {
+		for i, c := range n.Children {
+			if c.Kind != NodeToken || !strings.EqualFold(c.Tok.value, "from") || i+1 >= len(n.Children) {
+				continue
+			}
+			expr := n.Children[i+1]
+			if expr.Kind != NodeExpr {
+				continue
+			}
+			src := tree.Text[expr.Start:expr.End]
+			if first := expr.Children[0]; first.Kind == NodeToken && first.Tok.typ == tokString {
+				src, _ = unquote(first.Tok.value)
+			}
+			if sampleExtensions[strings.ToLower(filepath.Ext(src))] {
+				return src
+			}
+		}
+	}
+	for _, c := range n.Children {
+		if src := fromSource(tree, c); src != "" {
+			return src
+		}
+	}
+	return ""
+}
+
+// configuredSample returns the data file the sampleData option maps a
+// query file to. Patterns and data files are relative to a workspace
+// root; a pattern without a slash matches the file name in any directory,
+// and a "**" segment matches any number of directories.
+func configuredSample(path string, roots []string, mapping map[string]string) string {
+	patterns := make([]string, 0, len(mapping))
+	for p := range mapping {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			name := rel
+			if !strings.Contains(pattern, "/") {
+				name = filepath.Base(rel)
+			}
+			if matchGlob(pattern, name) {
+				data := mapping[pattern]
+				if !filepath.IsAbs(data) {
+					data = filepath.Join(root, data)
+				}
+				return data
+			}
+		}
+	}
+	return ""
+}
+
+// matchGlob reports whether a slash-separated path matches a pattern. A
+// "**" segment matches any number of segments, including none; other
+// segments match as in path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// sampleFields returns the fields of the sample input of a query file for
+// a cursor position: the file its from reads, or the configured one
+func (s *Server) sampleFields(tree *SyntaxTree, offset int, path string) []sampleField {
+	sample := sampleSource(tree, offset, filepath.Dir(path))
+	if sample == "" {
+		sample = configuredSample(path, s.workspace.roots(), s.sampleData)
+	}
+	if sample == "" {
+		return nil
+	}
+	return s.samples.fields(sample)
+}
@@ -0,0 +1,72 @@
+package main
+
+// selection.go - Selection ranges that grow along the syntax tree:
+// identifier, field path, expression, call, clause, stage, pipeline,
+// declaration and finally the whole document.
+
+// selectionRangeAt returns the chain of ranges enclosing a position,
+// innermost first
+func selectionRangeAt(tree *SyntaxTree, pos Position) SelectionRange {
+	offset := tree.OffsetAt(pos)
+	var spans [][2]int
+	add := func(start, end int) {
+		if n := len(spans); n > 0 {
+			last := spans[n-1]
+			if start == last[0] && end == last[1] {
+				return
+			}
+			// Parents must contain their children
+			start, end = min(start, last[0]), max(end, last[1])
+		}
+		spans = append(spans, [2]int{start, end})
+	}
+
+	// Comments aren't part of the tree; start with the one under the cursor
+	if i := tree.TokenAt(offset); i >= 0 && tree.Tokens[i].typ == tokComment {
+		add(tree.Tokens[i].pos, tree.Tokens[i].end())
+	}
+	for n := tree.NodeAt(offset); n != nil; n = n.Parent {
+		switch {
+		case n.Kind == NodeGroup && n.Closed() && len(n.Children) > 2:
+			// The contents of the brackets, then the brackets too
+			add(n.Children[1].Start, n.Children[len(n.Children)-2].End)
+		case n.Kind == NodeScript && n.Parent == nil:
+			add(0, len(tree.Text))
+			continue
+		}
+		add(n.Start, n.End)
+		if n.Kind == NodeExpr && n.Parent != nil && n.Parent.Kind == NodeStage {
+			clauseSpans(n, add)
+		}
+	}
+	if len(spans) == 0 {
+		add(offset, offset)
+	}
+
+	var sel *SelectionRange
+	for i := len(spans) - 1; i >= 0; i-- {
+		sel = &SelectionRange{Range: tree.Range(spans[i][0], spans[i][1]), Parent: sel}
+	}
+	return *sel
+}
+
+// clauseSpans adds the comma-separated list an expression belongs to
+// within a stage, such as the aggregations or the keys of a summarize, and
+// then the list with the keyword that introduces it
+func clauseSpans(expr *Node, add func(start, end int)) {
+	siblings := expr.Parent.Children
+	first, last := childIndex(expr), childIndex(expr)
+	inList := func(n *Node) bool {
+		return n.Kind == NodeExpr || (n.Kind == NodeToken && n.Tok.value == ",")
+	}
+	for first > 0 && inList(siblings[first-1]) {
+		first--
+	}
+	for last < len(siblings)-1 && inList(siblings[last+1]) {
+		last++
+	}
+	add(siblings[first].Start, siblings[last].End)
+	if first > 0 && siblings[first-1].Kind == NodeToken {
+		add(siblings[first-1].Start, siblings[last].End)
+	}
+}
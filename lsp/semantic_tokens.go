@@ -0,0 +1,344 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// semantic_tokens.go - Semantic highlighting from the syntax tree.
+// TextMate grammars only see the text, so they can't tell a field from a
+// user function or a builtin. Tokens here are classified with the same
+// scope resolution used by definition and rename, and carry a deprecated
+// modifier wherever the migration table flags the syntax.
+
+// Semantic token types, in legend order
+const (
+	semKeyword = iota
+	semOperator
+	semFunction
+	semAggregate
+	semParameter
+	semVariable
+	semProperty
+	semType
+	semString
+	semRegexp
+	semNumber
+	semComment
+)
+
+var semanticTokenTypes = []string{
+	"keyword", "operator", "function", "aggregate", "parameter", "variable",
+	"property", "type", "string", "regexp", "number", "comment",
+}
+
+// Semantic token modifiers, as bits in legend order
+const (
+	semDeclaration = 1 << iota
+	semDeprecated
+	semReadonly
+	semDefaultLibrary
+)
+
+var semanticTokenModifiers = []string{"declaration", "deprecated", "readonly", "defaultLibrary"}
+
+// semanticTokensLegend is advertised in the server capabilities
+func semanticTokensLegend() SemanticTokensLegend {
+	return SemanticTokensLegend{TokenTypes: semanticTokenTypes, TokenModifiers: semanticTokenModifiers}
+}
+
+// semanticToken is a classified span of the document. Start and end are
+// byte offsets.
+type semanticToken struct {
+	start, end int
+	typ, mods  int
+}
+
+// semanticTokens classifies every token of a query in document order.
+// Punctuation, pipes and unresolvable words are left to the client's
+// syntax highlighting.
+func semanticTokens(tree *SyntaxTree) []semanticToken {
+	identifiers := make(map[*token]semanticToken)
+	symbols := tree.Symbols()
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		if n.Kind == NodeToken {
+			if n.Tok.typ == tokIdentifier {
+				if typ, mods, ok := classifyIdentifier(symbols, n); ok {
+					identifiers[n.Tok] = semanticToken{typ: typ, mods: mods}
+				}
+			}
+			return
+		}
+		for _, c := range n.Children {
+			visit(c)
+		}
+	}
+	visit(tree.Root)
+
+	deprecated := deprecatedSpans(tree)
+	var toks []semanticToken
+	for i := range tree.Tokens {
+		tok := &tree.Tokens[i]
+		st := semanticToken{start: tok.pos, end: tok.end()}
+		switch tok.typ {
+		case tokComment:
+			st.typ = semComment
+		case tokString:
+			st.typ = semString
+		case tokRegexp:
+			st.typ = semRegexp
+		case tokNumber:
+			st.typ = semNumber
+		case tokKeyword:
+			st.typ = semKeyword
+		case tokOperator:
+			st.typ = semOperator
+		case tokIdentifier:
+			c, ok := identifiers[tok]
+			if !ok {
+				continue
+			}
+			st.typ, st.mods = c.typ, c.mods
+		default:
+			continue
+		}
+		if overlapsAny(deprecated, st.start, st.end) {
+			st.mods |= semDeprecated
+		}
+		toks = append(toks, st)
+	}
+	return toks
+}
+
+// classifyIdentifier returns the token type and modifiers of an identifier
+func classifyIdentifier(symbols *Symbols, n *Node) (int, int, bool) {
+	tok := n.Tok
+	if sym, ok := symbols.defs[tok]; ok {
+		typ, mods := symbolTokenType(sym.Kind)
+		return typ, mods | semDeclaration, true
+	}
+	if sym, ok := symbols.refs[tok]; ok {
+		typ, mods := symbolTokenType(sym.Kind)
+		return typ, mods, true
+	}
+
+	b := Builtins.Lookup(tok.value)
+	switch {
+	case isMemberName(n):
+		return semProperty, 0, true
+	case symbols.IsUnresolvedCall(tok):
+		if b != nil {
+			return builtinTokenType(b.Kind), semDefaultLibrary, true
+		}
+		// Declared in another workspace file, or nowhere
+		for p := n.Parent; p != nil; p = p.Parent {
+			if p.Kind == NodeStage {
+				if stageCallee(p) == tok {
+					return semOperator, 0, true
+				}
+				break
+			}
+		}
+		return semFunction, 0, true
+	case b != nil && b.Kind == KindType && isTypeName(n):
+		return semType, semDefaultLibrary, true
+	case symbols.IsField(tok):
+		return semProperty, 0, true
+	case isOperatorWord(n):
+		if clauseKeywords[strings.ToLower(tok.value)] {
+			return semKeyword, 0, true
+		}
+		return semOperator, semDefaultLibrary, true
+	case b != nil:
+		return builtinTokenType(b.Kind), semDefaultLibrary, true
+	}
+	return 0, 0, false
+}
+
+// symbolTokenType returns the token type of a user-declared symbol
+func symbolTokenType(kind SymbolKind) (int, int) {
+	switch kind {
+	case SymbolConst:
+		return semVariable, semReadonly
+	case SymbolFunc:
+		return semFunction, 0
+	case SymbolOp:
+		return semOperator, 0
+	case SymbolType:
+		return semType, 0
+	case SymbolParam:
+		return semParameter, 0
+	default:
+		return semVariable, 0
+	}
+}
+
+// builtinTokenType returns the token type of a builtin name
+func builtinTokenType(kind BuiltinKind) int {
+	switch kind {
+	case KindOperator:
+		return semOperator
+	case KindFunction:
+		return semFunction
+	case KindAggregate:
+		return semAggregate
+	case KindType:
+		return semType
+	default:
+		return semKeyword
+	}
+}
+
+// isTypeName reports whether a builtin type name is used as a type rather
+// than as a field of the same name, such as "time": in a type value like
+// <int64> or on the right of a type declaration
+func isTypeName(n *Node) bool {
+	idx := childIndex(n)
+	prev, next := n.Parent.leafAt(idx-1), n.Parent.leafAt(idx+1)
+	if prev != nil && prev.value == "<" && next != nil && next.value == ">" {
+		return true
+	}
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Kind == NodeDecl {
+			return p.Keyword() == "type"
+		}
+	}
+	return false
+}
+
+// deprecatedSpans returns the byte ranges flagged by the migration table
+func deprecatedSpans(tree *SyntaxTree) [][2]int {
+	var spans [][2]int
+	for _, md := range migrationDiagnosticsFor(tree) {
+		r := md.Diagnostic.Range
+		spans = append(spans, [2]int{tree.OffsetAt(r.Start), tree.OffsetAt(r.End)})
+	}
+	return spans
+}
+
+func overlapsAny(spans [][2]int, start, end int) bool {
+	for _, s := range spans {
+		if s[0] < end && start < s[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// tokensInRange returns the tokens overlapping a range of the document
+func tokensInRange(tree *SyntaxTree, toks []semanticToken, r Range) []semanticToken {
+	start, end := tree.OffsetAt(r.Start), tree.OffsetAt(r.End)
+	first := sort.Search(len(toks), func(i int) bool { return toks[i].end > start })
+	last := first
+	for last < len(toks) && toks[last].start < end {
+		last++
+	}
+	return toks[first:last]
+}
+
+// encodeSemanticTokens encodes tokens in the LSP's relative format.
+// Tokens spanning lines, such as block comments, are split at each newline
+// since not every client supports multiline tokens.
+func encodeSemanticTokens(tree *SyntaxTree, toks []semanticToken) []uint32 {
+	data := []uint32{}
+	prevLine, prevChar := 0, 0
+	emit := func(start, end int, t semanticToken) {
+		text := strings.TrimSuffix(tree.Text[start:end], "\r")
+		if text == "" {
+			return
+		}
+		pos := tree.PositionAt(start)
+		char := pos.Character
+		if pos.Line == prevLine {
+			char -= prevChar
+		}
+		data = append(data,
+			uint32(pos.Line-prevLine), uint32(char), uint32(byteToUTF16Offset(text)),
+			uint32(t.typ), uint32(t.mods))
+		prevLine, prevChar = pos.Line, pos.Character
+	}
+	for _, t := range toks {
+		start := t.start
+		for {
+			nl := strings.IndexByte(tree.Text[start:t.end], '\n')
+			if nl < 0 {
+				emit(start, t.end, t)
+				break
+			}
+			emit(start, start+nl, t)
+			start += nl + 1
+		}
+	}
+	return data
+}
+
+// semanticTokensEdits returns the edit turning old data into new: the
+// span between their common prefix and common suffix
+func semanticTokensEdits(old, new []uint32) []SemanticTokensEdit {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	if prefix == len(old) && prefix == len(new) {
+		return []SemanticTokensEdit{}
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix &&
+		old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	return []SemanticTokensEdit{{
+		Start:       prefix,
+		DeleteCount: len(old) - prefix - suffix,
+		Data:        new[prefix : len(new)-suffix],
+	}}
+}
+
+// semanticTokenCache remembers the last full result sent for each document
+// so later requests can be answered with a delta
+type semanticTokenCache struct {
+	mu      sync.Mutex
+	seq     int
+	results map[string]semanticTokenResult
+}
+
+type semanticTokenResult struct {
+	id   string
+	data []uint32
+}
+
+func newSemanticTokenCache() *semanticTokenCache {
+	return &semanticTokenCache{results: make(map[string]semanticTokenResult)}
+}
+
+// store records a result for a document and returns its result ID
+func (c *semanticTokenCache) store(uri string, data []uint32) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	id := strconv.Itoa(c.seq)
+	c.results[uri] = semanticTokenResult{id: id, data: data}
+	return id
+}
+
+// previous returns the data of a document's last result if the client
+// still holds it
+func (c *semanticTokenCache) previous(uri, id string) ([]uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.results[uri]
+	if !ok || r.id != id {
+		return nil, false
+	}
+	return r.data, true
+}
+
+// forget drops a closed document's result
+func (c *semanticTokenCache) forget(uri string) {
+	c.mu.Lock()
+	delete(c.results, uri)
+	c.mu.Unlock()
+}
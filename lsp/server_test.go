@@ -3,26 +3,99 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/brimdata/super/compiler/ast"
 )
 
 // TestHelper provides utilities for testing the LSP server
 type TestHelper struct {
-	server *Server
-	input  *bytes.Buffer
-	output *bytes.Buffer
+	server        *Server
+	input         *bytes.Buffer
+	output        *bytes.Buffer
+	notifications *syncBuffer // Server-initiated messages
+	consumed      int
 }
 
 // NewTestHelper creates a new test helper
 func NewTestHelper() *TestHelper {
-	return &TestHelper{
-		server: NewServer(),
-		input:  &bytes.Buffer{},
-		output: &bytes.Buffer{},
+	h := &TestHelper{
+		server:        NewServer(),
+		input:         &bytes.Buffer{},
+		output:        &bytes.Buffer{},
+		notifications: &syncBuffer{},
+	}
+	h.server.out = h.notifications
+	h.server.diagnostics.setDelay(0)
+	return h
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent writes and reads
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// WaitNotification waits for the next server-initiated message with the
+// given method, skipping any others
+func (h *TestHelper) WaitNotification(method string) (*RPCMessage, error) {
+	return h.waitNotification(method, 2*time.Second)
+}
+
+// NoNotification reports whether no message with the given method arrives
+// within the wait period
+func (h *TestHelper) NoNotification(method string, wait time.Duration) bool {
+	_, err := h.waitNotification(method, wait)
+	return err != nil
+}
+
+func (h *TestHelper) waitNotification(method string, wait time.Duration) (*RPCMessage, error) {
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		data := h.notifications.Bytes()
+		for h.consumed < len(data) {
+			reader := bufio.NewReader(bytes.NewReader(data[h.consumed:]))
+			rawMsg, err := readMessage(reader)
+			if err != nil {
+				break
+			}
+			h.consumed = len(data) - reader.Buffered()
+			var msg RPCMessage
+			if err := json.Unmarshal(rawMsg, &msg); err != nil {
+				return nil, err
+			}
+			if msg.Method == method {
+				return &msg, nil
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
 	}
+	return nil, fmt.Errorf("timed out waiting for %s", method)
 }
 
 // SendRequest sends a JSON-RPC request to the server
@@ -89,11 +162,7 @@ func (h *TestHelper) ProcessRequest(id interface{}, method string, params interf
 		return nil, fmt.Errorf("read from input: %w", err)
 	}
 
-	response, err := h.server.handleMessage(rawMsg)
-	if err != nil {
-		return nil, fmt.Errorf("handle message: %w", err)
-	}
-
+	response := h.server.handleMessage(rawMsg)
 	if response != nil {
 		if err := writeMessage(h.output, response); err != nil {
 			return nil, fmt.Errorf("write response: %w", err)
@@ -116,11 +185,7 @@ func (h *TestHelper) ProcessNotification(method string, params interface{}) (*RP
 		return nil, fmt.Errorf("read from input: %w", err)
 	}
 
-	response, err := h.server.handleMessage(rawMsg)
-	if err != nil {
-		return nil, fmt.Errorf("handle message: %w", err)
-	}
-
+	response := h.server.handleMessage(rawMsg)
 	if response != nil {
 		if err := writeMessage(h.output, response); err != nil {
 			return nil, fmt.Errorf("write response: %w", err)
@@ -177,12 +242,15 @@ func TestInitializeHandshake(t *testing.T) {
 		t.Error("Expected server info with name 'superdb-lsp'")
 	}
 
-	if result.Capabilities.TextDocumentSync != 1 {
-		t.Errorf("Expected TextDocumentSync 1, got %d", result.Capabilities.TextDocumentSync)
+	if result.Capabilities.TextDocumentSync != TextDocumentSyncKindIncremental {
+		t.Errorf("Expected TextDocumentSync %d, got %d",
+			TextDocumentSyncKindIncremental, result.Capabilities.TextDocumentSync)
 	}
 
 	if result.Capabilities.CompletionProvider == nil {
 		t.Error("Expected completion provider")
+	} else if !result.Capabilities.CompletionProvider.ResolveProvider {
+		t.Error("Expected completion items to be resolvable")
 	}
 }
 
@@ -229,11 +297,15 @@ func TestDidOpenWithValidDocument(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	// Should receive diagnostics notification
 	if response == nil {
 		t.Fatal("Expected diagnostics notification, got nil")
@@ -263,11 +335,15 @@ func TestDidOpenWithInvalidDocument(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	if response == nil {
 		t.Fatal("Expected diagnostics notification, got nil")
 	}
@@ -529,7 +605,7 @@ func TestDocumentManagement(t *testing.T) {
 	}
 
 	// Check document is stored
-	if _, ok := h.server.documents[uri]; !ok {
+	if _, ok := h.server.documents.Get(uri); !ok {
 		t.Error("Document not stored after didOpen")
 	}
 
@@ -549,8 +625,9 @@ func TestDocumentManagement(t *testing.T) {
 	}
 
 	// Check document is updated
-	if h.server.documents[uri] != "from test | count()" {
-		t.Errorf("Document not updated after didChange: %s", h.server.documents[uri])
+	doc, _ := h.server.documents.Get(uri)
+	if doc.Text() != "from test | count()" {
+		t.Errorf("Document not updated after didChange: %s", doc.Text())
 	}
 
 	// Close document
@@ -563,7 +640,7 @@ func TestDocumentManagement(t *testing.T) {
 	}
 
 	// Check document is removed
-	if _, ok := h.server.documents[uri]; ok {
+	if _, ok := h.server.documents.Get(uri); ok {
 		t.Error("Document not removed after didClose")
 	}
 }
@@ -620,7 +697,7 @@ func TestCompletionPrefixMatching(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.text, func(t *testing.T) {
-			items := getCompletions(tt.text, tt.position)
+			items := completionsIn(parseSyntax(tt.text), tt.position, completionEnv{})
 
 			for _, exp := range tt.expected {
 				found := false
@@ -645,26 +722,34 @@ func TestCompletionPrefixMatching(t *testing.T) {
 }
 
 func TestCompletionSQLKeywords(t *testing.T) {
-	// Test that SQL keywords are available in completions
-	sqlKeywords := []string{
-		"select", "group", "having", "order", "limit", "offset",
-		"join", "left", "right", "inner", "outer", "on",
-		"case", "when", "then", "else", "end",
-		"and", "or", "not", "in", "like", "between",
-	}
-
-	items := getCompletions("", Position{Line: 0, Character: 0})
-
-	for _, kw := range sqlKeywords {
-		found := false
-		for _, item := range items {
-			if item.Label == kw {
-				found = true
-				break
+	// Test that SQL keywords are available where the grammar expects them
+	sqlKeywords := []struct {
+		text     string
+		keywords []string
+	}{
+		{"", []string{"select"}},
+		{"select x ", []string{"from", "where", "group", "having", "order", "limit", "offset"}},
+		{"select x from t ", []string{"join", "left", "right", "inner", "where"}},
+		{"select x from t left ", []string{"outer", "join"}},
+		{"select x from t join u ", []string{"on"}},
+		{"select x from t limit 1 ", []string{"offset"}},
+		{"values ", []string{"case", "not"}},
+		{"where x ", []string{"and", "or", "not", "in", "like", "between"}},
+	}
+
+	for _, tt := range sqlKeywords {
+		items := completionsIn(parseSyntax(tt.text), Position{Line: 0, Character: len(tt.text)}, completionEnv{})
+		for _, kw := range tt.keywords {
+			found := false
+			for _, item := range items {
+				if item.Label == kw {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("SQL keyword '%s' not found in completions after %q", kw, tt.text)
 			}
-		}
-		if !found {
-			t.Errorf("SQL keyword '%s' not found in completions", kw)
 		}
 	}
 }
@@ -678,7 +763,7 @@ func TestCompletionOperators(t *testing.T) {
 		"debug", "output", "skip", "unnest", "values",
 	}
 
-	items := getCompletions("", Position{Line: 0, Character: 0})
+	items := completionsIn(parseSyntax(""), Position{Line: 0, Character: 0}, completionEnv{})
 
 	for _, op := range ops {
 		found := false
@@ -703,7 +788,7 @@ func TestCompletionFunctions(t *testing.T) {
 		"date_part", "length", "nullif", "parse_sup", "position",
 	}
 
-	items := getCompletions("test(", Position{Line: 0, Character: 5})
+	items := completionsIn(parseSyntax("test("), Position{Line: 0, Character: 5}, completionEnv{})
 
 	for _, fn := range funcs {
 		found := false
@@ -726,7 +811,7 @@ func TestCompletionAggregates(t *testing.T) {
 		"collect", "collect_map", "dcount", "union", "any", "fuse",
 	}
 
-	items := getCompletions("summarize(", Position{Line: 0, Character: 10})
+	items := completionsIn(parseSyntax("summarize("), Position{Line: 0, Character: 10}, completionEnv{})
 
 	for _, agg := range aggs {
 		found := false
@@ -752,7 +837,7 @@ func TestCompletionAllTypes(t *testing.T) {
 		"bigint", "smallint", "boolean", "text", "bytea",
 	}
 
-	items := getCompletions("cast(x, ", Position{Line: 0, Character: 8})
+	items := completionsIn(parseSyntax("cast(x, "), Position{Line: 0, Character: 8}, completionEnv{})
 
 	for _, typ := range allTypes {
 		found := false
@@ -775,16 +860,17 @@ func TestCompletionContext(t *testing.T) {
 		col      int
 		expected completionContext
 	}{
-		{"general context", "from test", 9, contextGeneral},
+		{"source after from", "from test", 9, contextSource},
 		{"type context after cast", "cast(x, ", 8, contextType},
 		{"type context after ::", "x::", 3, contextType},
-		{"function context in parens", "foo(bar", 7, contextFunction},
-		{"general after closed parens", "foo()", 5, contextGeneral},
+		{"expression context in parens", "foo(bar", 7, contextExpr},
+		{"clause after closed parens", "foo() ", 6, contextClause},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx := getCompletionContext(tt.line, tt.col)
+			tree := parseSyntax(tt.line)
+			ctx := completionSiteAt(tree, tree.OffsetAt(Position{Character: tt.col})).context
 			if ctx != tt.expected {
 				t.Errorf("Expected context %d, got %d", tt.expected, ctx)
 			}
@@ -1129,7 +1215,7 @@ func TestHoverKeyword(t *testing.T) {
 	text := "from test | where x > 5"
 	pos := Position{Line: 0, Character: 13} // over "where"
 
-	hover := getHover(text, pos)
+	hover := hoverAt(parseSyntax(text), pos)
 	if hover == nil {
 		t.Fatal("Expected hover result, got nil")
 	}
@@ -1147,7 +1233,7 @@ func TestHoverFunction(t *testing.T) {
 	text := "from test | put y := ceil(x)"
 	pos := Position{Line: 0, Character: 22} // over "ceil"
 
-	hover := getHover(text, pos)
+	hover := hoverAt(parseSyntax(text), pos)
 	if hover == nil {
 		t.Fatal("Expected hover result, got nil")
 	}
@@ -1161,7 +1247,7 @@ func TestHoverAggregate(t *testing.T) {
 	text := "from test | summarize count() by x"
 	pos := Position{Line: 0, Character: 23} // over "count"
 
-	hover := getHover(text, pos)
+	hover := hoverAt(parseSyntax(text), pos)
 	if hover == nil {
 		t.Fatal("Expected hover result, got nil")
 	}
@@ -1175,7 +1261,7 @@ func TestHoverType(t *testing.T) {
 	text := "cast(x, int64)"
 	pos := Position{Line: 0, Character: 9} // over "int64"
 
-	hover := getHover(text, pos)
+	hover := hoverAt(parseSyntax(text), pos)
 	if hover == nil {
 		t.Fatal("Expected hover result, got nil")
 	}
@@ -1189,7 +1275,7 @@ func TestHoverNoResult(t *testing.T) {
 	text := "from test"
 	pos := Position{Line: 0, Character: 5} // over "test" (not a keyword)
 
-	hover := getHover(text, pos)
+	hover := hoverAt(parseSyntax(text), pos)
 	if hover != nil {
 		t.Errorf("Expected no hover for identifier, got: %v", hover)
 	}
@@ -1199,7 +1285,7 @@ func TestSignatureHelpFunction(t *testing.T) {
 	text := "from test | put y := ceil("
 	pos := Position{Line: 0, Character: 26} // after opening paren
 
-	sigHelp := getSignatureHelp(text, pos)
+	sigHelp := signatureHelpAt(parseSyntax(text), pos)
 	if sigHelp == nil {
 		t.Fatal("Expected signature help, got nil")
 	}
@@ -1218,7 +1304,7 @@ func TestSignatureHelpAggregate(t *testing.T) {
 	text := "from test | summarize sum("
 	pos := Position{Line: 0, Character: 26}
 
-	sigHelp := getSignatureHelp(text, pos)
+	sigHelp := signatureHelpAt(parseSyntax(text), pos)
 	if sigHelp == nil {
 		t.Fatal("Expected signature help, got nil")
 	}
@@ -1237,13 +1323,13 @@ func TestSignatureHelpMultipleParams(t *testing.T) {
 	text := "replace(s, old, "
 	pos := Position{Line: 0, Character: 16} // after second comma
 
-	sigHelp := getSignatureHelp(text, pos)
+	sigHelp := signatureHelpAt(parseSyntax(text), pos)
 	if sigHelp == nil {
 		t.Fatal("Expected signature help, got nil")
 	}
 
-	if sigHelp.ActiveParameter != 2 {
-		t.Errorf("Expected active parameter 2, got %d", sigHelp.ActiveParameter)
+	if sigHelp.ActiveParameter == nil || *sigHelp.ActiveParameter != 2 {
+		t.Errorf("Expected active parameter 2, got %v", sigHelp.ActiveParameter)
 	}
 }
 
@@ -1251,7 +1337,7 @@ func TestSignatureHelpNoContext(t *testing.T) {
 	text := "from test | sort x"
 	pos := Position{Line: 0, Character: 18}
 
-	sigHelp := getSignatureHelp(text, pos)
+	sigHelp := signatureHelpAt(parseSyntax(text), pos)
 	if sigHelp != nil {
 		t.Errorf("Expected no signature help outside function call, got: %v", sigHelp)
 	}
@@ -1702,11 +1788,15 @@ func TestSupFileSkipsDiagnostics(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	if response == nil {
 		t.Fatal("Expected diagnostics notification, got nil")
 	}
@@ -1748,11 +1838,15 @@ func TestSupFileCaseInsensitive(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	paramsBytes, err := json.Marshal(response.Params)
 	if err != nil {
 		t.Fatalf("Marshal params: %v", err)
@@ -1789,11 +1883,15 @@ func TestSupFileInvalidDataDiagnostics(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	paramsBytes, err := json.Marshal(response.Params)
 	if err != nil {
 		t.Fatalf("Marshal params: %v", err)
@@ -1894,11 +1992,15 @@ func TestSupFileMultipleValues(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	paramsBytes, err := json.Marshal(response.Params)
 	if err != nil {
 		t.Fatalf("Marshal params: %v", err)
@@ -1935,11 +2037,15 @@ func TestSupFileComplexData(t *testing.T) {
 		},
 	}
 
-	response, err := h.ProcessNotification("textDocument/didOpen", params)
-	if err != nil {
+	if _, err := h.ProcessNotification("textDocument/didOpen", params); err != nil {
 		t.Fatalf("didOpen failed: %v", err)
 	}
 
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Waiting for diagnostics failed: %v", err)
+	}
+
 	paramsBytes, err := json.Marshal(response.Params)
 	if err != nil {
 		t.Fatalf("Marshal params: %v", err)
@@ -2190,6 +2296,7 @@ func TestHandlerMalformedParams(t *testing.T) {
 		{"didChange", "textDocument/didChange", false},
 		{"didClose", "textDocument/didClose", false},
 		{"completion", "textDocument/completion", true},
+		{"completionResolve", "completionItem/resolve", true},
 		{"hover", "textDocument/hover", true},
 		{"signatureHelp", "textDocument/signatureHelp", true},
 		{"formatting", "textDocument/formatting", true},
@@ -2199,6 +2306,9 @@ func TestHandlerMalformedParams(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := NewServer()
+			if tt.method != "initialize" {
+				s.initializeReceived = true
+			}
 			// Build a raw JSON message with malformed params directly
 			var idField string
 			if tt.hasID {
@@ -2209,10 +2319,23 @@ func TestHandlerMalformedParams(t *testing.T) {
 				idField, tt.method,
 			))
 
-			result, err := s.handleMessage(raw)
-			// All handlers should return an error for malformed params
-			if err == nil && result != nil {
-				t.Error("Expected error for malformed params, got success")
+			result := s.handleMessage(raw)
+			if !tt.hasID {
+				// Notifications never get a response
+				if result != nil {
+					t.Errorf("Expected no response for notification, got %+v", result)
+				}
+				return
+			}
+			msg, ok := result.(RPCMessage)
+			if !ok || msg.Error == nil {
+				t.Fatalf("Expected error response for malformed params, got %+v", result)
+			}
+			if msg.Error.Code != InvalidParams {
+				t.Errorf("Expected InvalidParams (%d), got %d", InvalidParams, msg.Error.Code)
+			}
+			if msg.Result != nil {
+				t.Error("Error response must not carry a result")
 			}
 		})
 	}
@@ -2564,13 +2687,24 @@ func TestExtractDataErrorPosition(t *testing.T) {
 	}
 }
 
-// === Gap #5: findFunctionContext edge cases ===
+// === Gap #5: call context edge cases ===
+
+// callContextAt returns the name of the call whose argument list holds the
+// offset and the index of the argument the offset is in
+func callContextAt(tree *SyntaxTree, offset int) (string, int) {
+	call, paramIndex := callAt(tree, offset)
+	if call == nil {
+		return "", 0
+	}
+	return call.Name().value, paramIndex
+}
 
-func TestFindFunctionContextMultiLine(t *testing.T) {
+func TestCallContextMultiLine(t *testing.T) {
 	text := "from test\n| put y := ceil(\n  x"
 	pos := Position{Line: 2, Character: 3} // after "  x"
 
-	funcName, paramIndex := findFunctionContext(text, pos)
+	tree := parseSyntax(text)
+	funcName, paramIndex := callContextAt(tree, tree.OffsetAt(pos))
 	if funcName != "ceil" {
 		t.Errorf("Expected funcName 'ceil', got %q", funcName)
 	}
@@ -2579,23 +2713,25 @@ func TestFindFunctionContextMultiLine(t *testing.T) {
 	}
 }
 
-func TestFindFunctionContextCursorAtParen(t *testing.T) {
+func TestCallContextCursorAtParen(t *testing.T) {
 	// Cursor right at the opening paren with no preceding identifier
 	text := "("
 	pos := Position{Line: 0, Character: 1}
 
-	funcName, _ := findFunctionContext(text, pos)
+	tree := parseSyntax(text)
+	funcName, _ := callContextAt(tree, tree.OffsetAt(pos))
 	if funcName != "" {
 		t.Errorf("Expected empty funcName for bare paren, got %q", funcName)
 	}
 }
 
-func TestFindFunctionContextCharOverflow(t *testing.T) {
+func TestCallContextCharOverflow(t *testing.T) {
 	// Cursor character beyond line length
 	text := "ceil(x)"
 	pos := Position{Line: 0, Character: 999}
 
-	funcName, _ := findFunctionContext(text, pos)
+	tree := parseSyntax(text)
+	funcName, _ := callContextAt(tree, tree.OffsetAt(pos))
 	// Should not crash; should handle gracefully
 	// With character overflow, entire line is used
 	if funcName != "" {
@@ -2604,21 +2740,23 @@ func TestFindFunctionContextCharOverflow(t *testing.T) {
 	}
 }
 
-func TestFindFunctionContextLineOverflow(t *testing.T) {
+func TestCallContextLineOverflow(t *testing.T) {
 	text := "ceil(x)"
 	pos := Position{Line: 99, Character: 0}
 
-	funcName, _ := findFunctionContext(text, pos)
+	tree := parseSyntax(text)
+	funcName, _ := callContextAt(tree, tree.OffsetAt(pos))
 	if funcName != "" {
 		t.Errorf("Expected empty funcName for out-of-bounds line, got %q", funcName)
 	}
 }
 
-func TestFindFunctionContextNestedCalls(t *testing.T) {
+func TestCallContextNestedCalls(t *testing.T) {
 	text := "len(trim(x, "
 	pos := Position{Line: 0, Character: 13}
 
-	funcName, paramIndex := findFunctionContext(text, pos)
+	tree := parseSyntax(text)
+	funcName, paramIndex := callContextAt(tree, tree.OffsetAt(pos))
 	if funcName != "trim" {
 		t.Errorf("Expected funcName 'trim', got %q", funcName)
 	}
@@ -2627,11 +2765,12 @@ func TestFindFunctionContextNestedCalls(t *testing.T) {
 	}
 }
 
-func TestFindFunctionContextNoParen(t *testing.T) {
+func TestCallContextNoParen(t *testing.T) {
 	text := "from test | sort x"
 	pos := Position{Line: 0, Character: 18}
 
-	funcName, _ := findFunctionContext(text, pos)
+	tree := parseSyntax(text)
+	funcName, _ := callContextAt(tree, tree.OffsetAt(pos))
 	if funcName != "" {
 		t.Errorf("Expected empty funcName outside parens, got %q", funcName)
 	}
@@ -2779,3 +2918,3515 @@ func TestFormatSuperSQLCombinedTrimAndInsert(t *testing.T) {
 		t.Errorf("Expected only one final newline, got multiple: %q", result)
 	}
 }
+
+// === Incremental document sync ===
+
+func TestRopeEdits(t *testing.T) {
+	text := strings.Repeat("from test | count()\n", 200)
+	r := newRope(text)
+	if r.String() != text {
+		t.Fatal("rope did not round-trip its text")
+	}
+	if r.LineCount() != 201 {
+		t.Errorf("Expected 201 lines, got %d", r.LineCount())
+	}
+	if got := r.LineOffset(100); got != 100*20 {
+		t.Errorf("Expected line 100 at offset %d, got %d", 100*20, got)
+	}
+
+	edited := r.Replace(5, 9, "logs")
+	if want := "from logs | count()\n"; edited.Slice(0, 20) != want {
+		t.Errorf("Expected %q, got %q", want, edited.Slice(0, 20))
+	}
+	// The original rope is an unchanged snapshot
+	if r.Slice(0, 20) != "from test | count()\n" {
+		t.Error("Replace modified the original rope")
+	}
+
+	deleted := r.Replace(0, len(text)-20, "")
+	if deleted.String() != "from test | count()\n" {
+		t.Errorf("Expected single line after delete, got %q", deleted.String())
+	}
+}
+
+func TestDocumentApplyIncrementalChanges(t *testing.T) {
+	doc := NewDocument("file:///test.spq", 1, "from test\n| count()\n")
+
+	next, err := doc.ApplyChanges(2, []TextDocumentContentChangeEvent{
+		{
+			Range: &Range{Start: Position{Line: 1, Character: 2}, End: Position{Line: 1, Character: 7}},
+			Text:  "sum",
+		},
+		{
+			Range: &Range{Start: Position{Line: 1, Character: 6}, End: Position{Line: 1, Character: 6}},
+			Text:  "x",
+		},
+	})
+	if err != nil {
+		t.Fatalf("ApplyChanges failed: %v", err)
+	}
+
+	if want := "from test\n| sum(x)\n"; next.Text() != want {
+		t.Errorf("Expected %q, got %q", want, next.Text())
+	}
+	if next.Version != 2 {
+		t.Errorf("Expected version 2, got %d", next.Version)
+	}
+	if doc.Text() != "from test\n| count()\n" {
+		t.Error("ApplyChanges modified the previous snapshot")
+	}
+}
+
+func TestDocumentApplyFullChange(t *testing.T) {
+	doc := NewDocument("file:///test.spq", 1, "from test")
+
+	next, err := doc.ApplyChanges(2, []TextDocumentContentChangeEvent{
+		{Text: "values 1"},
+		{
+			Range: &Range{Start: Position{Line: 0, Character: 7}, End: Position{Line: 0, Character: 8}},
+			Text:  "2",
+		},
+	})
+	if err != nil {
+		t.Fatalf("ApplyChanges failed: %v", err)
+	}
+	if next.Text() != "values 2" {
+		t.Errorf("Expected %q, got %q", "values 2", next.Text())
+	}
+}
+
+func TestDocumentUTF16Positions(t *testing.T) {
+	// "é" is 2 bytes but 1 UTF-16 unit; "😀" is 4 bytes and 2 UTF-16 units
+	tree := NewDocument("file:///test.spq", 1, "values \"é😀\" | x").Syntax()
+
+	offset := tree.OffsetAt(Position{Line: 0, Character: 12})
+	if got := tree.Text[offset:]; got != " | x" {
+		t.Errorf("Expected offset before %q, got %q", " | x", got)
+	}
+	if pos := tree.PositionAt(offset); pos.Character != 12 {
+		t.Errorf("Expected character 12, got %d", pos.Character)
+	}
+
+	// Out-of-range positions are clamped to the line and document end
+	if got := tree.OffsetAt(Position{Line: 0, Character: 100}); got != len(tree.Text) {
+		t.Errorf("Expected clamp to %d, got %d", len(tree.Text), got)
+	}
+	if got := tree.OffsetAt(Position{Line: 5, Character: 0}); got != len(tree.Text) {
+		t.Errorf("Expected clamp to %d, got %d", len(tree.Text), got)
+	}
+}
+
+func TestDocumentPositionAtAcrossLeaves(t *testing.T) {
+	// Long enough to span many rope leaves
+	text := strings.Repeat("from test | count()\n", 200) + "values \"é\""
+	tree := parseSyntax(text)
+	for _, offset := range []int{0, 19, 20, 1999, 2000, 2001, 3999, 4000, len(text) - 1, len(text)} {
+		before := text[:offset]
+		want := Position{
+			Line:      strings.Count(before, "\n"),
+			Character: byteToUTF16Offset(before[strings.LastIndexByte(before, '\n')+1:]),
+		}
+		if got := tree.PositionAt(offset); got != want {
+			t.Errorf("PositionAt(%d): expected %+v, got %+v", offset, want, got)
+		}
+		if got := tree.OffsetAt(want); got != offset {
+			t.Errorf("OffsetAt(%+v): expected %d, got %d", want, offset, got)
+		}
+	}
+}
+
+func TestDocumentStoreRejectsOutOfOrderVersions(t *testing.T) {
+	store := NewDocumentStore()
+	uri := "file:///test.spq"
+	store.Open(uri, 3, "from test")
+
+	for _, version := range []int{2, 3} {
+		_, err := store.Change(uri, version, []TextDocumentContentChangeEvent{{Text: "stale"}})
+		if err == nil {
+			t.Errorf("Expected version %d to be rejected", version)
+		}
+	}
+
+	doc, _ := store.Get(uri)
+	if doc.Text() != "from test" || doc.Version != 3 {
+		t.Errorf("Rejected change modified document: version=%d text=%q", doc.Version, doc.Text())
+	}
+
+	if _, err := store.Change("file:///missing.spq", 1, nil); err == nil {
+		t.Error("Expected change to unopened document to fail")
+	}
+}
+
+func TestDidChangeIncremental(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+
+	_, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "from test\n| count()"},
+	})
+	if err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	_, err = h.ProcessNotification("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument: VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: TextDocumentIdentifier{URI: uri},
+			Version:                2,
+		},
+		ContentChanges: []TextDocumentContentChangeEvent{{
+			Range: &Range{Start: Position{Line: 0, Character: 5}, End: Position{Line: 0, Character: 9}},
+			Text:  "logs",
+		}},
+	})
+	if err != nil {
+		t.Fatalf("didChange failed: %v", err)
+	}
+
+	doc, _ := h.server.documents.Get(uri)
+	if doc.Text() != "from logs\n| count()" {
+		t.Errorf("Expected incremental edit to apply, got %q", doc.Text())
+	}
+}
+
+// === Concurrent request handling ===
+
+// rawRequest encodes a request (or a notification when id is nil) as it
+// would arrive on the wire
+func rawRequest(t *testing.T, id interface{}, method string, params interface{}) []byte {
+	t.Helper()
+	paramsBytes, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("encode %s: %v", method, err)
+	}
+	var buf bytes.Buffer
+	msg := RPCMessage{JSONRPC: "2.0", ID: id, Method: method, Params: paramsBytes}
+	if err := writeMessage(&buf, msg); err != nil {
+		t.Fatalf("encode %s: %v", method, err)
+	}
+	return buf.Bytes()
+}
+
+func TestRunConcurrentRequests(t *testing.T) {
+	var in bytes.Buffer
+	uri := "file:///test.spq"
+	in.Write(rawRequest(t, 1, "initialize", InitializeParams{ProcessID: 1}))
+	in.Write(rawRequest(t, nil, "textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "count()"},
+	}))
+	in.Write(rawRequest(t, 2, "textDocument/hover", HoverParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 0, Character: 2},
+	}))
+	// The change arrives after the hover; the hover still sees version 1
+	in.Write(rawRequest(t, nil, "textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument: VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: TextDocumentIdentifier{URI: uri},
+			Version:                2,
+		},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "from test"}},
+	}))
+	in.Write(rawRequest(t, 3, "textDocument/completion", CompletionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 0, Character: 4},
+	}))
+
+	var out bytes.Buffer
+	s := NewServer()
+	if err := s.Run(&in, &out); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// Run waits for in-flight requests before returning
+	responses := map[float64]*RPCMessage{}
+	reader := bufio.NewReader(&out)
+	for {
+		raw, err := readMessage(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+		var msg RPCMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if id, ok := msg.ID.(float64); ok {
+			responses[id] = &msg
+		}
+	}
+
+	for _, id := range []float64{1, 2, 3} {
+		if responses[id] == nil {
+			t.Errorf("Missing response for request %v", id)
+		}
+	}
+	if hover := responses[2]; hover != nil && hover.Result == nil {
+		t.Error("Expected hover for 'count' from the version 1 snapshot")
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	s := NewServer()
+	ctx, key := s.beginRequest(context.Background(), float64(7))
+
+	s.handleCancelRequest(RPCMessage{Params: json.RawMessage(`{"id":7}`)})
+	if ctx.Err() == nil {
+		t.Fatal("Expected request context to be cancelled")
+	}
+
+	response, ok := s.runRequest(ctx, RPCMessage{
+		JSONRPC: "2.0",
+		ID:      float64(7),
+		Method:  "textDocument/hover",
+		Params:  json.RawMessage(`{"textDocument":{"uri":"file:///test.spq"},"position":{"line":0,"character":0}}`),
+	}).(RPCMessage)
+	if !ok || response.Error == nil || response.Error.Code != RequestCancelled {
+		t.Errorf("Expected RequestCancelled error, got %+v", response)
+	}
+
+	s.endRequest(key)
+	if len(s.pending) != 0 {
+		t.Errorf("Expected no pending requests, got %d", len(s.pending))
+	}
+}
+
+func TestCancelUnknownRequestIgnored(t *testing.T) {
+	s := NewServer()
+	ctx, _ := s.beginRequest(context.Background(), "abc")
+
+	// Numeric 1 and unrelated IDs must not cancel string ID "abc"
+	s.handleCancelRequest(RPCMessage{Params: json.RawMessage(`{"id":1}`)})
+	s.handleCancelRequest(RPCMessage{Params: json.RawMessage(`{"id":"other"}`)})
+	if ctx.Err() != nil {
+		t.Error("Expected unrelated cancel to be ignored")
+	}
+
+	s.handleCancelRequest(RPCMessage{Params: json.RawMessage(`{"id":"abc"}`)})
+	if ctx.Err() == nil {
+		t.Error("Expected string ID cancel to apply")
+	}
+}
+
+func TestDocumentSnapshotIsolation(t *testing.T) {
+	s := NewServer()
+	uri := "file:///test.spq"
+	s.documents.Open(uri, 1, "from a")
+
+	ctx := withDocuments(context.Background(), s.documents.Snapshot())
+	if _, err := s.documents.Change(uri, 2, []TextDocumentContentChangeEvent{{Text: "from b"}}); err != nil {
+		t.Fatalf("Change failed: %v", err)
+	}
+
+	doc, _ := s.document(ctx, uri)
+	if doc.Text() != "from a" {
+		t.Errorf("Expected snapshot text %q, got %q", "from a", doc.Text())
+	}
+	live, _ := s.document(context.Background(), uri)
+	if live.Text() != "from b" {
+		t.Errorf("Expected live text %q, got %q", "from b", live.Text())
+	}
+}
+
+// === Debounced diagnostics ===
+
+// changeDocument sends a full-text didChange notification
+func (h *TestHelper) changeDocument(t *testing.T, uri string, version int, text string) {
+	t.Helper()
+	_, err := h.ProcessNotification("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument: VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: TextDocumentIdentifier{URI: uri},
+			Version:                version,
+		},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: text}},
+	})
+	if err != nil {
+		t.Fatalf("didChange failed: %v", err)
+	}
+}
+
+func TestDiagnosticsDebounced(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	h.server.diagnostics.setDelay(50 * time.Millisecond)
+	uri := "file:///test.spq"
+
+	_, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "from test"},
+	})
+	if err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	// didOpen publishes without waiting for the debounce delay
+	if _, err := h.WaitNotification("textDocument/publishDiagnostics"); err != nil {
+		t.Fatalf("Expected diagnostics after didOpen: %v", err)
+	}
+
+	// Rapid edits collapse into a single publish for the final version
+	h.changeDocument(t, uri, 2, "from test |")
+	h.changeDocument(t, uri, 3, "from test | yield x")
+	h.changeDocument(t, uri, 4, "from test | count()")
+
+	response, err := h.WaitNotification("textDocument/publishDiagnostics")
+	if err != nil {
+		t.Fatalf("Expected debounced diagnostics: %v", err)
+	}
+	var params PublishDiagnosticsParams
+	if err := json.Unmarshal(response.Params, &params); err != nil {
+		t.Fatalf("Unmarshal params: %v", err)
+	}
+	if params.Version != 4 {
+		t.Errorf("Expected diagnostics for version 4, got version %d", params.Version)
+	}
+	if len(params.Diagnostics) != 0 {
+		t.Errorf("Expected no diagnostics for valid query, got %v", params.Diagnostics)
+	}
+
+	if !h.NoNotification("textDocument/publishDiagnostics", 150*time.Millisecond) {
+		t.Error("Expected no further diagnostics for intermediate versions")
+	}
+}
+
+func TestDiagnosticsStaleVersionDropped(t *testing.T) {
+	h := NewTestHelper()
+	uri := "file:///test.spq"
+	h.server.documents.Open(uri, 2, "from test")
+
+	// A run for an older version must not publish anything
+	h.server.runDiagnostics(uri, 1)
+	h.server.runDiagnostics("file:///closed.spq", 1)
+
+	if !h.NoNotification("textDocument/publishDiagnostics", 50*time.Millisecond) {
+		t.Error("Expected stale diagnostics to be dropped")
+	}
+}
+
+func TestInitializationOptionsAreLenient(t *testing.T) {
+	for _, raw := range []string{`null`, `"fast"`, `[1, 2]`, `{"diagnosticsDelay": "soon"}`} {
+		h := NewTestHelper()
+		resp, err := h.ProcessRequest(1, "initialize", InitializeParams{
+			ProcessID:             1,
+			InitializationOptions: json.RawMessage(raw),
+		})
+		if err != nil || resp.Error != nil {
+			t.Errorf("%s: expected initialize to succeed, got %v %+v", raw, err, resp)
+		}
+	}
+
+	opts := parseInitializationOptions(json.RawMessage(`{"diagnosticsDelay": "soon", "sampleData": {"*.spq": "a.json"}}`))
+	if opts.DiagnosticsDelay != nil || opts.SampleData["*.spq"] != "a.json" {
+		t.Errorf("Expected the well-typed option to survive a bad one, got %+v", opts)
+	}
+}
+
+func TestDiagnosticsDelayOption(t *testing.T) {
+	h := NewTestHelper()
+	delay := 1234
+	_, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID:             1,
+		InitializationOptions: json.RawMessage(fmt.Sprintf(`{"diagnosticsDelay": %d}`, delay)),
+	})
+	if err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if h.server.diagnostics.delay != 1234*time.Millisecond {
+		t.Errorf("Expected delay 1234ms, got %v", h.server.diagnostics.delay)
+	}
+}
+
+// === JSON-RPC error responses ===
+
+// errorCode extracts the error code from a response, or 0 if there is none
+func errorCode(t *testing.T, response interface{}) int {
+	t.Helper()
+	msg, ok := response.(RPCMessage)
+	if !ok || msg.Error == nil {
+		t.Fatalf("Expected error response, got %+v", response)
+	}
+	return msg.Error.Code
+}
+
+func TestParseErrorResponse(t *testing.T) {
+	s := NewServer()
+	response := s.handleMessage(json.RawMessage(`{"jsonrpc":"2.0","id":1,`))
+	if code := errorCode(t, response); code != ParseError {
+		t.Errorf("Expected ParseError, got %d", code)
+	}
+
+	// The id is unknown, so it must be sent as null
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !strings.Contains(string(data), `"id":null`) {
+		t.Errorf("Expected null id in %s", data)
+	}
+}
+
+func TestMethodNotFound(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/unknownThing", map[string]string{})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if response == nil || response.Error == nil || response.Error.Code != MethodNotFound {
+		t.Errorf("Expected MethodNotFound error, got %+v", response)
+	}
+
+	// Unknown notifications are ignored without a response
+	response, err = h.ProcessNotification("$/setTrace", map[string]string{"value": "off"})
+	if err != nil || response != nil {
+		t.Errorf("Expected unknown notification to be ignored, got %+v (err=%v)", response, err)
+	}
+}
+
+func TestRequestBeforeInitialize(t *testing.T) {
+	h := NewTestHelper()
+
+	response, err := h.ProcessRequest(1, "textDocument/hover", HoverParams{
+		TextDocument: TextDocumentIdentifier{URI: "file:///test.spq"},
+	})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if response == nil || response.Error == nil || response.Error.Code != ServerNotInitialized {
+		t.Errorf("Expected ServerNotInitialized error, got %+v", response)
+	}
+
+	// Notifications before initialize are dropped
+	_, err = h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: "file:///test.spq", Text: "from test"},
+	})
+	if err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	if _, ok := h.server.documents.Get("file:///test.spq"); ok {
+		t.Error("Expected didOpen before initialize to be dropped")
+	}
+}
+
+func TestInitializeTwice(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "initialize", InitializeParams{ProcessID: 1})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if response == nil || response.Error == nil || response.Error.Code != InvalidRequest {
+		t.Errorf("Expected InvalidRequest error, got %+v", response)
+	}
+}
+
+func TestRequestAfterShutdown(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if _, err := h.ProcessRequest(2, "shutdown", nil); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	for i, method := range []string{"textDocument/hover", "shutdown"} {
+		response, err := h.ProcessRequest(3+i, method, HoverParams{})
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if response == nil || response.Error == nil || response.Error.Code != InvalidRequest {
+			t.Errorf("Expected InvalidRequest for %s after shutdown, got %+v", method, response)
+		}
+	}
+}
+
+func TestResponseAfterShutdownIsDropped(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if _, err := h.ProcessRequest(2, "shutdown", nil); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	// A late reply to a server request, such as workspace/diagnostic/refresh
+	if response := h.server.handleMessage(json.RawMessage(`{"jsonrpc":"2.0","id":7,"result":null}`)); response != nil {
+		t.Errorf("Expected no answer to a response, got %+v", response)
+	}
+}
+
+func TestNullResultIsExplicit(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+
+	result, _ := h.server.handleShutdown(RPCMessage{ID: float64(2)})
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !strings.Contains(string(data), `"result":null`) {
+		t.Errorf("Expected explicit null result in %s", data)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	s := NewServer()
+	s.initializeReceived = true
+	s.documents = nil // Any document access now panics
+
+	response := s.handleMessage(rawMessageBody(t, 1, "textDocument/hover", HoverParams{
+		TextDocument: TextDocumentIdentifier{URI: "file:///test.spq"},
+	}))
+	msg, ok := response.(RPCMessage)
+	if !ok || msg.Error == nil || msg.Error.Code != InternalError {
+		t.Fatalf("Expected InternalError response, got %+v", response)
+	}
+	if msg.Error.Data == nil {
+		t.Error("Expected panic details in error data")
+	}
+
+	// Notifications that panic are logged and produce no response
+	response = s.handleMessage(rawMessageBody(t, nil, "textDocument/didClose", DidCloseTextDocumentParams{}))
+	if response != nil {
+		t.Errorf("Expected no response for panicking notification, got %+v", response)
+	}
+}
+
+// rawMessageBody encodes a JSON-RPC message body without transport headers
+func rawMessageBody(t *testing.T, id interface{}, method string, params interface{}) json.RawMessage {
+	t.Helper()
+	paramsBytes, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("encode %s: %v", method, err)
+	}
+	data, err := json.Marshal(RPCMessage{JSONRPC: "2.0", ID: id, Method: method, Params: paramsBytes})
+	if err != nil {
+		t.Fatalf("encode %s: %v", method, err)
+	}
+	return data
+}
+
+// === Pull diagnostics ===
+
+// decodeResult re-encodes a response result into v
+func decodeResult(t *testing.T, response *RPCMessage, v interface{}) {
+	t.Helper()
+	if response == nil || response.Error != nil {
+		t.Fatalf("Expected result, got %+v", response)
+	}
+	data, err := json.Marshal(response.Result)
+	if err != nil {
+		t.Fatalf("Marshal result: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("Unmarshal result: %v", err)
+	}
+}
+
+func TestDocumentDiagnosticPull(t *testing.T) {
+	h := NewTestHelper()
+	_, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID: 1,
+		Capabilities: ClientCapabilities{
+			TextDocument: TextDocumentClientCapabilities{Diagnostic: &DiagnosticClientCapabilities{}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	_, err = h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "from test |"},
+	})
+	if err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	// Clients that pull diagnostics don't get them pushed as well
+	if !h.NoNotification("textDocument/publishDiagnostics", 50*time.Millisecond) {
+		t.Error("Expected no pushed diagnostics in pull mode")
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/diagnostic", DocumentDiagnosticParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+	})
+	if err != nil {
+		t.Fatalf("Diagnostic request failed: %v", err)
+	}
+	var report DocumentDiagnosticReport
+	decodeResult(t, response, &report)
+	if report.Kind != DocumentDiagnosticReportKindFull {
+		t.Fatalf("Expected full report, got %q", report.Kind)
+	}
+	if report.ResultID == "" {
+		t.Error("Expected a result ID")
+	}
+	if report.Items == nil || len(*report.Items) == 0 {
+		t.Error("Expected diagnostics for trailing pipe")
+	}
+
+	// Asking again with the same result ID gets an unchanged report
+	response, err = h.ProcessRequest(3, "textDocument/diagnostic", DocumentDiagnosticParams{
+		TextDocument:     TextDocumentIdentifier{URI: uri},
+		PreviousResultID: report.ResultID,
+	})
+	if err != nil {
+		t.Fatalf("Diagnostic request failed: %v", err)
+	}
+	var unchanged DocumentDiagnosticReport
+	decodeResult(t, response, &unchanged)
+	if unchanged.Kind != DocumentDiagnosticReportKindUnchanged || unchanged.ResultID != report.ResultID {
+		t.Errorf("Expected unchanged report with result ID %q, got %+v", report.ResultID, unchanged)
+	}
+
+	// Editing the document invalidates the result ID
+	h.changeDocument(t, uri, 2, "from test | count()")
+	response, err = h.ProcessRequest(4, "textDocument/diagnostic", DocumentDiagnosticParams{
+		TextDocument:     TextDocumentIdentifier{URI: uri},
+		PreviousResultID: report.ResultID,
+	})
+	if err != nil {
+		t.Fatalf("Diagnostic request failed: %v", err)
+	}
+	var changed DocumentDiagnosticReport
+	decodeResult(t, response, &changed)
+	if changed.Kind != DocumentDiagnosticReportKindFull || changed.ResultID == report.ResultID {
+		t.Errorf("Expected new full report after edit, got %+v", changed)
+	}
+	if changed.Items == nil || len(*changed.Items) != 0 {
+		t.Errorf("Expected empty items for valid query, got %+v", changed.Items)
+	}
+}
+
+func TestWorkspaceDiagnosticPull(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"good.spq":                 "from test | count()",
+		"sub/bad.spq":              "from test |",
+		"data.sup":                 "{a:1}",
+		"notes.txt":                "from test |",
+		".hidden/skip.spq":         "from test |",
+		"node_modules/pkg/dep.spq": "from test |",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1, RootURI: pathToURI(root)}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	// The open copy of good.spq takes precedence over the file on disk
+	openURI := pathToURI(filepath.Join(root, "good.spq"))
+	_, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: openURI, LanguageID: "spq", Version: 7, Text: "from test |"},
+	})
+	if err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "workspace/diagnostic", WorkspaceDiagnosticParams{})
+	if err != nil {
+		t.Fatalf("Workspace diagnostic request failed: %v", err)
+	}
+	var report WorkspaceDiagnosticReport
+	decodeResult(t, response, &report)
+
+	byURI := map[string]WorkspaceDocumentDiagnosticReport{}
+	for _, item := range report.Items {
+		byURI[item.URI] = item
+	}
+	if len(byURI) != 3 {
+		t.Fatalf("Expected reports for 3 files, got %d: %+v", len(byURI), report.Items)
+	}
+
+	open, ok := byURI[openURI]
+	if !ok {
+		t.Fatalf("Expected report for %s", openURI)
+	}
+	if open.Version == nil || *open.Version != 7 {
+		t.Errorf("Expected version 7 for open document, got %v", open.Version)
+	}
+	if open.Items == nil || len(*open.Items) == 0 {
+		t.Error("Expected diagnostics from the open document's contents")
+	}
+
+	bad := byURI[pathToURI(filepath.Join(root, "sub", "bad.spq"))]
+	if bad.Version != nil {
+		t.Errorf("Expected nil version for unopened file, got %v", *bad.Version)
+	}
+	if bad.Items == nil || len(*bad.Items) == 0 {
+		t.Error("Expected diagnostics for sub/bad.spq")
+	}
+
+	// Passing back the previous result IDs yields unchanged reports
+	var previous []PreviousResultID
+	for _, item := range report.Items {
+		previous = append(previous, PreviousResultID{URI: item.URI, Value: item.ResultID})
+	}
+	response, err = h.ProcessRequest(3, "workspace/diagnostic", WorkspaceDiagnosticParams{PreviousResultIDs: previous})
+	if err != nil {
+		t.Fatalf("Workspace diagnostic request failed: %v", err)
+	}
+	var again WorkspaceDiagnosticReport
+	decodeResult(t, response, &again)
+	for _, item := range again.Items {
+		if item.Kind != DocumentDiagnosticReportKindUnchanged {
+			t.Errorf("Expected unchanged report for %s, got %q", item.URI, item.Kind)
+		}
+	}
+}
+
+func TestWorkspaceDiagnosticUnknownOperators(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "lib.spq"), "op shared(): (pass)\nop local(): (pass)\nvalues 1 | local()\n")
+	writeFile(t, filepath.Join(root, "a.spq"), "from data | shared() | missingA()\n")
+	writeFile(t, filepath.Join(root, "b.spq"), "op own(): (pass)\nfrom data | own() | local() | missingB()\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1, RootURI: pathToURI(root)}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	response, err := h.ProcessRequest(2, "workspace/diagnostic", WorkspaceDiagnosticParams{})
+	if err != nil {
+		t.Fatalf("Workspace diagnostic request failed: %v", err)
+	}
+	var report WorkspaceDiagnosticReport
+	decodeResult(t, response, &report)
+
+	// Every file is checked against the declarations of the others
+	unknown := make(map[string][]string)
+	for _, item := range report.Items {
+		for _, d := range *item.Items {
+			if d.Code == "unknown-operator" {
+				unknown[filepath.Base(item.URI)] = append(unknown[filepath.Base(item.URI)], d.Message)
+			}
+		}
+	}
+	if len(unknown) != 2 || len(unknown["a.spq"]) != 1 || !strings.Contains(unknown["a.spq"][0], `"missingA"`) ||
+		len(unknown["b.spq"]) != 1 || !strings.Contains(unknown["b.spq"][0], `"missingB"`) {
+		t.Errorf("Expected only missingA and missingB to be unknown, got %v", unknown)
+	}
+}
+
+func TestWorkspaceDiagnosticCancelled(t *testing.T) {
+	s := NewServer()
+	s.workspace.start([]string{t.TempDir()})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.workspaceDiagnosticReport(ctx, nil); err == nil {
+		t.Error("Expected cancelled workspace diagnostics to return an error")
+	}
+}
+
+// === Syntax tree ===
+
+// nodeText returns the source text a node covers
+func nodeText(tree *SyntaxTree, n *Node) string {
+	return tree.Text[n.Start:n.End]
+}
+
+func TestSyntaxTreeStructure(t *testing.T) {
+	text := `const pi = 3.14
+fn double(x): (x * 2)
+op clean(): (
+  where x > 0
+  | sort x
+)
+
+from "data.json"
+| where status == "active"
+| summarize count() by level
+
+fork (
+  => head 1
+  => tail 1
+)`
+	tree := parseSyntax(text)
+
+	var kinds []NodeKind
+	for _, n := range tree.Root.Children {
+		kinds = append(kinds, n.Kind)
+	}
+	expected := []NodeKind{NodeDecl, NodeDecl, NodeDecl, NodePipeline, NodePipeline}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Fatalf("Expected top-level kinds %v, got %v", expected, kinds)
+	}
+
+	decls := tree.Root.Children[:3]
+	for i, name := range []string{"pi", "double", "clean"} {
+		if got := decls[i].Name(); got == nil || got.value != name {
+			t.Errorf("Expected declaration %d to be named %q, got %+v", i, name, got)
+		}
+	}
+	if decls[2].Keyword() != "op" {
+		t.Errorf("Expected op keyword, got %q", decls[2].Keyword())
+	}
+
+	var stages []string
+	for _, n := range tree.Root.Children[3].Children {
+		if n.Kind == NodeStage {
+			stages = append(stages, n.Name().value)
+		}
+	}
+	if strings.Join(stages, ",") != "from,where,summarize" {
+		t.Errorf("Expected stages from,where,summarize, got %v", stages)
+	}
+
+	fork := tree.NodeAt(strings.Index(text, "head"))
+	for fork != nil && fork.Kind != NodeBranch {
+		fork = fork.Parent
+	}
+	if fork == nil || nodeText(tree, fork) != "=> head 1" {
+		t.Errorf("Expected head 1 to be inside a fork branch, got %+v", fork)
+	}
+}
+
+func TestSyntaxTreeUnclosedGroup(t *testing.T) {
+	text := "from test | put y := ceil(\n  x"
+	tree := parseSyntax(text)
+
+	g := tree.EnclosingGroup(len(text))
+	if g == nil || g.Parent.Kind != NodeCall || g.Parent.Name().value != "ceil" {
+		t.Fatalf("Expected cursor at end to be inside ceil(, got %+v", g)
+	}
+	if g.Closed() {
+		t.Error("Expected group to be reported as unclosed")
+	}
+}
+
+func TestSyntaxTreeCommentsAndStrings(t *testing.T) {
+	text := "-- count(x)\nwhere s == 'len(' /* sum( */ | count()"
+	tree := parseSyntax(text)
+
+	tests := []struct {
+		needle string
+		inside bool
+	}{
+		{"count(x)", true},
+		{"len(", true},
+		{"sum(", true},
+		{"where", false},
+		{"count()", false},
+	}
+	for _, tt := range tests {
+		offset := strings.Index(text, tt.needle) + 1
+		if got := tree.InCommentOrString(offset); got != tt.inside {
+			t.Errorf("InCommentOrString at %q: expected %v, got %v", tt.needle, tt.inside, got)
+		}
+	}
+
+	// Only the real call is a call
+	if g := tree.EnclosingGroup(len(text) - 1); g == nil || g.Parent.Name().value != "count" {
+		t.Errorf("Expected count() to be the only call, got %+v", g)
+	}
+}
+
+func TestSyntaxTreeTokenPositions(t *testing.T) {
+	text := "values {é: \"ü\"}\n| sort x"
+	tree := parseSyntax(text)
+	for _, tok := range tree.Tokens {
+		if text[tok.pos:tok.end()] != tok.value {
+			t.Errorf("Token %q does not match source at offset %d", tok.value, tok.pos)
+		}
+	}
+	if formatted := formatDocument("values é", FormattingOptions{}); formatted != "values é" {
+		t.Errorf("Expected non-ASCII text to survive formatting, got %q", formatted)
+	}
+
+	pos := tree.PositionAt(strings.Index(text, "sort"))
+	if pos.Line != 1 || pos.Character != 2 {
+		t.Errorf("Expected sort at 1:2, got %d:%d", pos.Line, pos.Character)
+	}
+	if offset := tree.OffsetAt(Position{Line: 0, Character: 11}); !strings.HasPrefix(text[offset:], "\"ü\"") {
+		t.Errorf("Expected UTF-16 column 11 to be the string, got offset %d", offset)
+	}
+}
+
+func TestDocumentSyntaxCachedPerVersion(t *testing.T) {
+	store := NewDocumentStore()
+	doc := store.Open("file:///test.spq", 1, "from test")
+	if doc.Syntax() != doc.Syntax() {
+		t.Error("Expected the syntax tree to be parsed once per version")
+	}
+
+	next, err := store.Change("file:///test.spq", 2, []TextDocumentContentChangeEvent{{Text: "from other"}})
+	if err != nil {
+		t.Fatalf("Change failed: %v", err)
+	}
+	if next.Syntax() == doc.Syntax() || next.Syntax().Text != "from other" {
+		t.Error("Expected a new syntax tree for the new version")
+	}
+}
+
+func TestFeaturesIgnoreStringsAndComments(t *testing.T) {
+	text := "-- count\nwhere s == 'count' | count()"
+
+	if hover := hoverAt(parseSyntax(text), Position{Line: 0, Character: 5}); hover != nil {
+		t.Errorf("Expected no hover inside a comment, got %+v", hover)
+	}
+	// A string shows its own type, not docs for the words it contains
+	if hover := hoverAt(parseSyntax(text), Position{Line: 1, Character: 14}); hover == nil || strings.Contains(hover.Contents.Value, "aggregate") {
+		t.Errorf("Expected only the literal type inside a string, got %+v", hover)
+	}
+	if hover := hoverAt(parseSyntax(text), Position{Line: 1, Character: 24}); hover == nil {
+		t.Error("Expected hover for count()")
+	}
+
+	if items := completionsIn(parseSyntax(text), Position{Line: 0, Character: 8}, completionEnv{}); len(items) != 0 {
+		t.Errorf("Expected no completions inside a comment, got %d", len(items))
+	}
+	// The second argument is past len's only parameter, so none is active
+	if help := signatureHelpAt(parseSyntax("len(')', "), Position{Line: 0, Character: 9}); help == nil || help.ActiveParameter != nil {
+		t.Errorf("Expected signature help for len ignoring the quoted paren, got %+v", help)
+	}
+}
+
+func TestMigrationIgnoresStrings(t *testing.T) {
+	for _, text := range []string{
+		"values 'yield'",
+		"values \"a -- b\" | yield x",
+		"/* yield */ values x",
+	} {
+		var codes []string
+		for _, md := range getMigrationDiagnostics(text) {
+			codes = append(codes, md.Diagnostic.Code)
+		}
+		expectYield := strings.Contains(text, "| yield")
+		if got := strings.Contains(strings.Join(codes, ","), "deprecated-yield"); got != expectYield {
+			t.Errorf("%q: expected deprecated-yield=%v, got codes %v", text, expectYield, codes)
+		}
+	}
+}
+
+// === Go to definition ===
+
+// cursorAt returns the position of the n-th (0-based) occurrence of needle,
+// offset by delta bytes
+func cursorAt(t *testing.T, text, needle string, n, delta int) Position {
+	t.Helper()
+	offset := -1
+	for i := 0; i <= n; i++ {
+		next := strings.Index(text[offset+1:], needle)
+		if next < 0 {
+			t.Fatalf("occurrence %d of %q not found", n, needle)
+		}
+		offset += next + 1
+	}
+	return parseSyntax(text).PositionAt(offset + delta)
+}
+
+func TestDefinitionDeclarations(t *testing.T) {
+	text := `const pi = 3.14159
+type port = uint16
+fn double(x): (x * 2)
+op myOperator(): (
+  values pi
+)
+let rows = 10
+from data
+| values double(pi)::port
+| myOperator()
+| head rows`
+
+	tests := []struct {
+		name   string
+		needle string
+		n      int
+		want   string // needle whose first occurrence is the declaration
+	}{
+		{"const", "pi", 2, "pi"},
+		{"const in op body", "pi", 1, "pi"},
+		{"type", "port", 1, "port"},
+		{"fn", "double", 1, "double"},
+		{"op", "myOperator", 1, "myOperator"},
+		{"let", "rows", 1, "rows"},
+		{"declaration itself", "double", 0, "double"},
+	}
+
+	tree := parseSyntax(text)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := definitionAt("file:///test.spq", tree, cursorAt(t, text, tt.needle, tt.n, 1))
+			if loc == nil {
+				t.Fatal("Expected a definition")
+			}
+			want := cursorAt(t, text, tt.want, 0, 0)
+			if loc.Range.Start != want || loc.URI != "file:///test.spq" {
+				t.Errorf("Expected definition at %+v, got %+v", want, loc)
+			}
+		})
+	}
+}
+
+func TestDefinitionParameters(t *testing.T) {
+	text := `fn scale(x, factor): (x * factor)
+values x, [1,2] | values map(this, lambda x: x + 1)`
+	tree := parseSyntax(text)
+
+	// x in the fn body resolves to the parameter
+	loc := definitionAt("file:///test.spq", tree, cursorAt(t, text, "x *", 0, 0))
+	if loc == nil || loc.Range.Start != cursorAt(t, text, "x,", 0, 0) {
+		t.Errorf("Expected fn parameter definition, got %+v", loc)
+	}
+	// x outside the fn is a field, not the parameter
+	if loc := definitionAt("file:///test.spq", tree, cursorAt(t, text, "values x", 0, 7)); loc != nil {
+		t.Errorf("Expected no definition for a field, got %+v", loc)
+	}
+	// x in the lambda body resolves to the lambda parameter
+	loc = definitionAt("file:///test.spq", tree, cursorAt(t, text, "x + 1", 0, 0))
+	if loc == nil || loc.Range.Start != cursorAt(t, text, "x:", 0, 0) {
+		t.Errorf("Expected lambda parameter definition, got %+v", loc)
+	}
+}
+
+func TestDefinitionIgnoresBuiltinsAndFields(t *testing.T) {
+	text := "const x = 1\nvalues {x: x}, y.x, len(s)"
+	tree := parseSyntax(text)
+
+	for _, needle := range []string{"{x", "y.x", "len"} {
+		delta := 0
+		if needle != "len" {
+			delta = len(needle) - 1
+		}
+		if loc := definitionAt("file:///test.spq", tree, cursorAt(t, text, needle, 0, delta)); loc != nil {
+			t.Errorf("%q: expected no definition, got %+v", needle, loc)
+		}
+	}
+	if loc := definitionAt("file:///test.spq", tree, cursorAt(t, text, ": x", 0, 2)); loc == nil {
+		t.Error("Expected record value x to resolve to the const")
+	}
+}
+
+func TestDefinitionRequest(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "const n = 1\nvalues n"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/definition", DefinitionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 1, Character: 7},
+	})
+	if err != nil {
+		t.Fatalf("Definition failed: %v", err)
+	}
+	var loc Location
+	decodeResult(t, response, &loc)
+	want := Range{Start: Position{Line: 0, Character: 6}, End: Position{Line: 0, Character: 7}}
+	if loc.URI != uri || loc.Range != want {
+		t.Errorf("Expected %s %+v, got %+v", uri, want, loc)
+	}
+}
+
+// === References and document highlights ===
+
+func TestReferencesScopeAware(t *testing.T) {
+	text := `const limit_rows = 10
+fn inc(x): (x + 1)
+from data
+| put y := inc(x), z := limit_rows
+| head limit_rows`
+	tree := parseSyntax(text)
+	uri := "file:///test.spq"
+
+	locs := referencesAt(uri, tree, cursorAt(t, text, "limit_rows", 1, 0), true)
+	if len(locs) != 3 {
+		t.Fatalf("Expected 3 references to limit_rows, got %+v", locs)
+	}
+	if locs[0].Range.Start != cursorAt(t, text, "limit_rows", 0, 0) {
+		t.Errorf("Expected declaration first, got %+v", locs[0])
+	}
+	if locs := referencesAt(uri, tree, cursorAt(t, text, "limit_rows", 0, 0), false); len(locs) != 2 {
+		t.Errorf("Expected 2 references without the declaration, got %+v", locs)
+	}
+
+	// The parameter x is only used in the fn body, not by the field x
+	locs = referencesAt(uri, tree, cursorAt(t, text, "x)", 0, 0), true)
+	if len(locs) != 2 || locs[1].Range.Start != cursorAt(t, text, "x +", 0, 0) {
+		t.Errorf("Expected the parameter and its use in the body, got %+v", locs)
+	}
+
+	if locs := referencesAt(uri, tree, cursorAt(t, text, "inc(x)", 0, 0), false); len(locs) != 1 {
+		t.Errorf("Expected 1 call of inc, got %+v", locs)
+	}
+	if locs := referencesAt(uri, tree, cursorAt(t, text, "from", 0, 0), true); locs != nil {
+		t.Errorf("Expected no references for a keyword, got %+v", locs)
+	}
+}
+
+func TestDocumentHighlightReadWrite(t *testing.T) {
+	text := `const base = 1
+put total := base
+| put total := total + base
+| sort total`
+	tree := parseSyntax(text)
+
+	kinds := func(hs []DocumentHighlight) []int {
+		var k []int
+		for _, h := range hs {
+			k = append(k, h.Kind)
+		}
+		return k
+	}
+
+	got := kinds(highlightsAt(tree, cursorAt(t, text, "base", 1, 0)))
+	want := []int{DocumentHighlightKindWrite, DocumentHighlightKindRead, DocumentHighlightKindRead}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("const highlights: expected %v, got %v", want, got)
+	}
+
+	got = kinds(highlightsAt(tree, cursorAt(t, text, "total", 3, 0)))
+	want = []int{DocumentHighlightKindWrite, DocumentHighlightKindWrite, DocumentHighlightKindRead, DocumentHighlightKindRead}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("field highlights: expected %v, got %v", want, got)
+	}
+
+	if hs := highlightsAt(tree, cursorAt(t, text, "sort", 0, 0)); hs != nil {
+		t.Errorf("Expected no highlights for an operator name, got %+v", hs)
+	}
+}
+
+func TestDocumentHighlightFieldShadowedByParameter(t *testing.T) {
+	text := "fn f(x): (x * 2)\nvalues x, y.x"
+	tree := parseSyntax(text)
+
+	hs := highlightsAt(tree, cursorAt(t, text, "values x", 0, 7))
+	if len(hs) != 1 || hs[0].Range.Start != cursorAt(t, text, "values x", 0, 7) {
+		t.Errorf("Expected only the top-level field x, got %+v", hs)
+	}
+	hs = highlightsAt(tree, cursorAt(t, text, "x *", 0, 0))
+	if len(hs) != 2 || hs[0].Kind != DocumentHighlightKindWrite {
+		t.Errorf("Expected the parameter declaration and its use, got %+v", hs)
+	}
+}
+
+func TestReferencesRequest(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "const n = 1\nvalues n, n"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/references", ReferenceParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 0, Character: 6},
+		Context:      ReferenceContext{IncludeDeclaration: true},
+	})
+	if err != nil {
+		t.Fatalf("References failed: %v", err)
+	}
+	var locs []Location
+	decodeResult(t, response, &locs)
+	if len(locs) != 3 {
+		t.Errorf("Expected 3 locations, got %+v", locs)
+	}
+
+	response, err = h.ProcessRequest(3, "textDocument/documentHighlight", DocumentHighlightParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 1, Character: 7},
+	})
+	if err != nil {
+		t.Fatalf("Document highlight failed: %v", err)
+	}
+	var highlights []DocumentHighlight
+	decodeResult(t, response, &highlights)
+	if len(highlights) != 3 || highlights[0].Kind != DocumentHighlightKindWrite {
+		t.Errorf("Expected 3 highlights starting with the declaration, got %+v", highlights)
+	}
+}
+
+// === Rename ===
+
+func TestRenameOnlyRealOccurrences(t *testing.T) {
+	text := `const rate = 2
+op scaled(rate): (
+  put y := rate
+)
+from data
+| put rate := rate * 2
+| scaled(rate)`
+	tree := parseSyntax(text)
+	uri := "file:///test.spq"
+
+	edit, warnings, err := renameAt(uri, tree, cursorAt(t, text, "rate", 0, 0), "factor")
+	if err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+	// The declaration and the two reads in the main query; the op parameter
+	// shadows the const in its body and the := target is a field
+	var got []Position
+	for _, e := range edit.Changes[uri] {
+		got = append(got, e.Range.Start)
+	}
+	want := []Position{
+		cursorAt(t, text, "rate", 0, 0),
+		cursorAt(t, text, "rate", 4, 0),
+		cursorAt(t, text, "rate", 5, 0),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected edits at %v, got %v", want, got)
+	}
+
+	edit, _, err = renameAt(uri, tree, cursorAt(t, text, "rate): (", 0, 0), "r")
+	if err != nil {
+		t.Fatalf("rename parameter: %v", err)
+	}
+	if n := len(edit.Changes[uri]); n != 2 {
+		t.Errorf("Expected the parameter and its use in the op body, got %d edits", n)
+	}
+}
+
+func TestRenameRefusesBuiltinsAndKeywords(t *testing.T) {
+	text := "const n = 1\nfrom data | where len(s) > n | sort x"
+	tree := parseSyntax(text)
+
+	for _, needle := range []string{"len", "from", "sort", "x", "data"} {
+		if _, err := prepareRenameAt(tree, cursorAt(t, text, needle, 0, 0)); err == nil {
+			t.Errorf("%q: expected prepareRename to refuse", needle)
+		}
+	}
+	result, err := prepareRenameAt(tree, cursorAt(t, text, "n", 1, 0))
+	if err != nil {
+		t.Fatalf("prepareRename: %v", err)
+	}
+	if result.Placeholder != "n" || result.Range.Start != cursorAt(t, text, "n = ", 0, 0) {
+		t.Errorf("Unexpected prepareRename result %+v", result)
+	}
+
+	for _, name := range []string{"", "two words", "1x", "select", "where", "a.b"} {
+		if _, _, err := renameAt("file:///test.spq", tree, result.Range.Start, name); err == nil {
+			t.Errorf("%q: expected invalid new name to be refused", name)
+		}
+	}
+}
+
+func TestRenameWarnings(t *testing.T) {
+	text := "const a = 1\nconst b = 2\nvalues a + b"
+	tree := parseSyntax(text)
+
+	_, warnings, err := renameAt("file:///test.spq", tree, Position{Line: 0, Character: 6}, "len")
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "builtin function") {
+		t.Errorf("Expected a builtin shadowing warning, got %v, %v", warnings, err)
+	}
+	_, _, err = renameAt("file:///test.spq", tree, Position{Line: 0, Character: 6}, "b")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected a collision error, got %v", err)
+	}
+}
+
+func TestRenameKeepsBindings(t *testing.T) {
+	text := "const pi = 3\nfn f(x): (x + pi)\nvalues f(1), b"
+	tree := parseSyntax(text)
+	tests := []struct {
+		needle  string
+		newName string
+	}{
+		// The parameter would capture the const referenced in the body
+		{"x): ", "pi"},
+		// The parameter would shadow the renamed const in the body
+		{"pi = ", "x"},
+		// The const would capture the field b
+		{"pi = ", "b"},
+	}
+	for _, tt := range tests {
+		if _, _, err := renameAt("file:///test.spq", tree, cursorAt(t, text, tt.needle, 0, 0), tt.newName); err == nil ||
+			!strings.Contains(err.Error(), "would change what") {
+			t.Errorf("Renaming %q to %q: expected a refusal, got %v", tt.needle, tt.newName, err)
+		}
+	}
+	// Names that bind the same way are fine
+	for _, tt := range []struct{ needle, newName string }{{"x): ", "y"}, {"pi = ", "tau"}} {
+		if _, _, err := renameAt("file:///test.spq", tree, cursorAt(t, text, tt.needle, 0, 0), tt.newName); err != nil {
+			t.Errorf("Renaming %q to %q: %v", tt.needle, tt.newName, err)
+		}
+	}
+}
+
+func TestRenameAcrossFiles(t *testing.T) {
+	root := t.TempDir()
+	lib := filepath.Join(root, "lib.spq")
+	writeFile(t, lib, "op cleanRecords(): (\n  pass\n)\nfn helper(x): (x)\n")
+	writeFile(t, filepath.Join(root, "query.spq"), "from data\n| cleanRecords()\n| call cleanRecords\n")
+	writeFile(t, filepath.Join(root, "own.spq"), "op cleanRecords(): (head 1)\nfrom data | cleanRecords()\n")
+	writeFile(t, filepath.Join(root, "local.spq"), "fn tidy(x): (x)\nfrom data | cleanRecords()\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1, RootURI: pathToURI(root)}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := pathToURI(lib)
+	text := "op cleanRecords(): (\n  pass\n)\nfn helper(x): (x)\n"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: text},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/rename", RenameParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 0, Character: 4},
+		NewName:      "dropBad",
+	})
+	if err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	var edit WorkspaceEdit
+	decodeResult(t, response, &edit)
+	// own.spq calls its own declaration
+	query, local := pathToURI(filepath.Join(root, "query.spq")), pathToURI(filepath.Join(root, "local.spq"))
+	if len(edit.Changes) != 3 || len(edit.Changes[uri]) != 1 || len(edit.Changes[query]) != 2 || len(edit.Changes[local]) != 1 {
+		t.Errorf("Expected edits in lib, query and local, got %+v", edit.Changes)
+	}
+
+	// A call in local.spq would resolve to its own tidy
+	response, err = h.ProcessRequest(3, "textDocument/rename", RenameParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 0, Character: 4},
+		NewName:      "tidy",
+	})
+	if err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if response.Error == nil || !strings.Contains(response.Error.Message, "local.spq") {
+		t.Errorf("Expected a collision error naming local.spq, got %+v", response)
+	}
+
+	// Functions aren't called by other files here, so only lib.spq changes
+	response, err = h.ProcessRequest(4, "textDocument/rename", RenameParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 3, Character: 4},
+		NewName:      "ident",
+	})
+	if err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	edit = WorkspaceEdit{}
+	decodeResult(t, response, &edit)
+	if len(edit.Changes) != 1 || len(edit.Changes[uri]) != 1 {
+		t.Errorf("Expected one edit in lib.spq, got %+v", edit.Changes)
+	}
+}
+
+func TestRenameRequest(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID: 1,
+		Capabilities: ClientCapabilities{
+			TextDocument: TextDocumentClientCapabilities{Rename: &RenameClientCapabilities{PrepareSupport: true}},
+		},
+	}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "const n = 1\nvalues n, len(n)"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/prepareRename", PrepareRenameParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 1, Character: 10},
+	})
+	if err != nil {
+		t.Fatalf("prepareRename failed: %v", err)
+	}
+	if response.Error == nil || response.Error.Code != RequestFailed {
+		t.Errorf("Expected RequestFailed for a builtin, got %+v", response)
+	}
+
+	response, err = h.ProcessRequest(3, "textDocument/rename", RenameParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 1, Character: 7},
+		NewName:      "count",
+	})
+	if err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	var edit WorkspaceEdit
+	decodeResult(t, response, &edit)
+	if len(edit.Changes[uri]) != 3 {
+		t.Errorf("Expected 3 edits, got %+v", edit)
+	}
+	msg, err := h.WaitNotification("window/showMessage")
+	if err != nil {
+		t.Fatalf("Expected a shadowing warning: %v", err)
+	}
+	var show ShowMessageParams
+	if err := json.Unmarshal(msg.Params, &show); err != nil || show.Type != MessageTypeWarning {
+		t.Errorf("Expected a warning message, got %s", msg.Params)
+	}
+}
+
+// === Document symbols ===
+
+// symbolNames returns "name" for each symbol, with children indented
+func symbolNames(symbols []DocumentSymbol, indent string) []string {
+	var names []string
+	for _, sym := range symbols {
+		names = append(names, indent+sym.Name)
+		names = append(names, symbolNames(sym.Children, indent+"  ")...)
+	}
+	return names
+}
+
+func TestDocumentSymbolsOutline(t *testing.T) {
+	text := `const pi = 3.14
+type port = uint16
+fn double(x): (x * 2)
+op cleanup(): (
+  where ok | drop tmp
+)
+
+from data
+| where x > 1
+| switch kind (
+    case "a" => put y := 1
+    default => pass
+  )
+| sort y
+`
+	symbols := documentSymbols(parseSyntax(text))
+	want := []string{
+		"pi",
+		"port",
+		"double",
+		"cleanup",
+		"  where ok | drop tmp",
+		"    where",
+		"    drop",
+		`from data | where x > 1 | switch kind ( case "a" => put y :…`,
+		"  from",
+		"  where",
+		"  switch",
+		`    case "a"`,
+		"      put",
+		"    default",
+		"      pass",
+		"  sort",
+	}
+	if got := symbolNames(symbols, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected outline:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	kinds := []int{SymbolKindConstant, SymbolKindTypeParameter, SymbolKindFunction, SymbolKindOperator, SymbolKindNamespace}
+	for i, kind := range kinds {
+		if symbols[i].Kind != kind {
+			t.Errorf("%s: expected kind %d, got %d", symbols[i].Name, kind, symbols[i].Kind)
+		}
+	}
+
+	// Selection ranges pick out the name within the full range
+	double := symbols[2]
+	if double.SelectionRange != (Range{Start: Position{Line: 2, Character: 3}, End: Position{Line: 2, Character: 9}}) {
+		t.Errorf("Unexpected selection range %+v", double.SelectionRange)
+	}
+	if double.Range.Start != (Position{Line: 2, Character: 0}) || double.Range.End != (Position{Line: 2, Character: 21}) {
+		t.Errorf("Unexpected range %+v", double.Range)
+	}
+	switchStage := symbols[4].Children[2]
+	if switchStage.Detail != "kind" || switchStage.Range.End.Line != 12 {
+		t.Errorf("Unexpected switch symbol %+v", switchStage)
+	}
+}
+
+func TestDocumentSymbolRequest(t *testing.T) {
+	for _, hierarchical := range []bool{true, false} {
+		h := NewTestHelper()
+		if _, err := h.ProcessRequest(1, "initialize", InitializeParams{
+			ProcessID: 1,
+			Capabilities: ClientCapabilities{
+				TextDocument: TextDocumentClientCapabilities{
+					DocumentSymbol: &DocumentSymbolClientCapabilities{HierarchicalDocumentSymbolSupport: hierarchical},
+				},
+			},
+		}); err != nil {
+			t.Fatalf("Initialize failed: %v", err)
+		}
+		uri := "file:///test.spq"
+		if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+			TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "const n = 1\nfrom data | head n"},
+		}); err != nil {
+			t.Fatalf("didOpen failed: %v", err)
+		}
+
+		response, err := h.ProcessRequest(2, "textDocument/documentSymbol", DocumentSymbolParams{
+			TextDocument: TextDocumentIdentifier{URI: uri},
+		})
+		if err != nil {
+			t.Fatalf("documentSymbol failed: %v", err)
+		}
+		if hierarchical {
+			var symbols []DocumentSymbol
+			decodeResult(t, response, &symbols)
+			if len(symbols) != 2 || len(symbols[1].Children) != 2 {
+				t.Errorf("Expected a const and a query with 2 stages, got %+v", symbols)
+			}
+			continue
+		}
+		var flat []SymbolInformation
+		decodeResult(t, response, &flat)
+		if len(flat) != 4 || flat[2].Name != "from" || flat[2].ContainerName != "from data | head n" || flat[2].Location.URI != uri {
+			t.Errorf("Expected 4 flat symbols, got %+v", flat)
+		}
+	}
+}
+
+// === Workspace symbols ===
+
+// writeFile creates a file with the given contents, and any parent directories
+func writeFile(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// workspaceSymbolNames runs a workspace/symbol query and returns the names
+func workspaceSymbolNames(t *testing.T, h *TestHelper, id int, query string) []string {
+	t.Helper()
+	response, err := h.ProcessRequest(id, "workspace/symbol", WorkspaceSymbolParams{Query: query})
+	if err != nil {
+		t.Fatalf("workspace/symbol failed: %v", err)
+	}
+	var symbols []SymbolInformation
+	decodeResult(t, response, &symbols)
+	var names []string
+	for _, sym := range symbols {
+		names = append(names, sym.Name)
+	}
+	return names
+}
+
+func TestFuzzyScore(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"", "anything", true},
+		{"gcu", "getCurrentUser", true},
+		{"GCU", "getCurrentUser", true},
+		{"cnt", "count_total", true},
+		{"xyz", "count_total", false},
+		{"tc", "count", false},
+	}
+	for _, tt := range tests {
+		if _, ok := fuzzyScore(tt.pattern, tt.name); ok != tt.match {
+			t.Errorf("fuzzyScore(%q, %q): expected match=%v", tt.pattern, tt.name, tt.match)
+		}
+	}
+
+	better, _ := fuzzyScore("gcu", "getCurrentUser")
+	worse, _ := fuzzyScore("gcu", "debug_count_user")
+	if better <= worse {
+		t.Errorf("Expected word-boundary match to rank higher: %d vs %d", better, worse)
+	}
+	exact, _ := fuzzyScore("count", "count")
+	prefix, _ := fuzzyScore("count", "counter")
+	if exact <= prefix {
+		t.Errorf("Expected exact match to rank higher: %d vs %d", exact, prefix)
+	}
+}
+
+func TestWorkspaceSymbolIndex(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "lib", "ops.spq"), "op cleanRecords(): (\n  const innerLimit = 5\n  head innerLimit\n)\nfn normalizeName(s): (lower(s))\n")
+	writeFile(t, filepath.Join(root, "lib", "types.spq"), "type port = uint16\nconst maxRows = 100\n")
+	writeFile(t, filepath.Join(root, ".hidden", "skip.spq"), "const hiddenConst = 1\n")
+	writeFile(t, filepath.Join(root, "data.sup"), "{a:1}\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1, RootURI: pathToURI(root)}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+
+	got := workspaceSymbolNames(t, h, 2, "")
+	sort.Strings(got)
+	want := []string{"cleanRecords", "innerLimit", "maxRows", "normalizeName", "port"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Both match; the word-boundary match ranks first
+	if got := workspaceSymbolNames(t, h, 3, "nn"); !reflect.DeepEqual(got, []string{"normalizeName", "innerLimit"}) {
+		t.Errorf("Expected normalizeName ranked above innerLimit, got %v", got)
+	}
+
+	response, err := h.ProcessRequest(4, "workspace/symbol", WorkspaceSymbolParams{Query: "innerLimit"})
+	if err != nil {
+		t.Fatalf("workspace/symbol failed: %v", err)
+	}
+	var symbols []SymbolInformation
+	decodeResult(t, response, &symbols)
+	if len(symbols) != 1 || symbols[0].ContainerName != "cleanRecords" || symbols[0].Kind != SymbolKindConstant ||
+		symbols[0].Location.URI != pathToURI(filepath.Join(root, "lib", "ops.spq")) ||
+		symbols[0].Location.Range.Start != (Position{Line: 1, Character: 8}) {
+		t.Errorf("Unexpected symbol %+v", symbols)
+	}
+}
+
+func TestWorkspaceSymbolWatchedFiles(t *testing.T) {
+	root := t.TempDir()
+	lib := filepath.Join(root, "lib.spq")
+	writeFile(t, lib, "fn oldName(): (1)\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1, RootURI: pathToURI(root)}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if got := workspaceSymbolNames(t, h, 2, ""); !reflect.DeepEqual(got, []string{"oldName"}) {
+		t.Fatalf("Expected initial index, got %v", got)
+	}
+
+	added := filepath.Join(root, "added.spq")
+	writeFile(t, lib, "fn newName(): (1)\n")
+	writeFile(t, added, "const addedConst = 1\n")
+	if _, err := h.ProcessNotification("workspace/didChangeWatchedFiles", DidChangeWatchedFilesParams{
+		Changes: []FileEvent{
+			{URI: pathToURI(lib), Type: FileChangeTypeChanged},
+			{URI: pathToURI(added), Type: FileChangeTypeCreated},
+		},
+	}); err != nil {
+		t.Fatalf("didChangeWatchedFiles failed: %v", err)
+	}
+	got := workspaceSymbolNames(t, h, 3, "")
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"addedConst", "newName"}) {
+		t.Errorf("Expected updated index, got %v", got)
+	}
+
+	if err := os.Remove(added); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ProcessNotification("workspace/didChangeWatchedFiles", DidChangeWatchedFilesParams{
+		Changes: []FileEvent{{URI: pathToURI(added), Type: FileChangeTypeDeleted}},
+	}); err != nil {
+		t.Fatalf("didChangeWatchedFiles failed: %v", err)
+	}
+	if got := workspaceSymbolNames(t, h, 4, ""); !reflect.DeepEqual(got, []string{"newName"}) {
+		t.Errorf("Expected deleted file to be dropped, got %v", got)
+	}
+
+	// Unsaved edits in open documents take precedence over the disk copy
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: pathToURI(lib), LanguageID: "spq", Version: 1, Text: "fn editedName(): (1)\n"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	if got := workspaceSymbolNames(t, h, 5, ""); !reflect.DeepEqual(got, []string{"editedName"}) {
+		t.Errorf("Expected the open document's symbols, got %v", got)
+	}
+}
+
+func TestWorkspaceRootOutsideFolders(t *testing.T) {
+	folder, root := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(folder, "a.spq"), "const inFolder = 1\n")
+	writeFile(t, filepath.Join(root, "b.spq"), "const inRoot = 2\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID:        1,
+		RootURI:          pathToURI(root),
+		WorkspaceFolders: []WorkspaceFolder{{URI: pathToURI(folder), Name: "folder"}},
+	}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if got := workspaceSymbolNames(t, h, 2, ""); !reflect.DeepEqual(got, []string{"inFolder", "inRoot"}) {
+		t.Errorf("Expected the folder and the root URI indexed, got %v", got)
+	}
+
+	// A root URI that is also a workspace folder is indexed once
+	params := InitializeParams{
+		RootURI:          pathToURI(folder),
+		WorkspaceFolders: []WorkspaceFolder{{URI: pathToURI(folder)}, {URI: pathToURI(root)}},
+	}
+	if got := workspaceFolders(params); !reflect.DeepEqual(got, []string{folder, root}) {
+		t.Errorf("Expected each folder once, got %v", got)
+	}
+}
+
+func TestWorkspaceSymbolFolders(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(first, "a.spq"), "const inFirst = 1\n")
+	writeFile(t, filepath.Join(second, "b.spq"), "const inSecond = 2\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID:        1,
+		WorkspaceFolders: []WorkspaceFolder{{URI: pathToURI(first), Name: "first"}},
+		Capabilities: ClientCapabilities{
+			Workspace: WorkspaceClientCapabilities{
+				DidChangeWatchedFiles: &DidChangeWatchedFilesClientCapabilities{DynamicRegistration: true},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if _, err := h.ProcessNotification("initialized", struct{}{}); err != nil {
+		t.Fatalf("initialized failed: %v", err)
+	}
+	msg, err := h.WaitNotification("client/registerCapability")
+	if err != nil || msg.ID == nil {
+		t.Errorf("Expected a file watcher registration request, got %+v, %v", msg, err)
+	}
+
+	if got := workspaceSymbolNames(t, h, 2, ""); !reflect.DeepEqual(got, []string{"inFirst"}) {
+		t.Fatalf("Expected first folder only, got %v", got)
+	}
+
+	if _, err := h.ProcessNotification("workspace/didChangeWorkspaceFolders", DidChangeWorkspaceFoldersParams{
+		Event: WorkspaceFoldersChangeEvent{
+			Added:   []WorkspaceFolder{{URI: pathToURI(second), Name: "second"}},
+			Removed: []WorkspaceFolder{{URI: pathToURI(first), Name: "first"}},
+		},
+	}); err != nil {
+		t.Fatalf("didChangeWorkspaceFolders failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	var got []string
+	for time.Now().Before(deadline) {
+		if got = workspaceSymbolNames(t, h, 3, ""); reflect.DeepEqual(got, []string{"inSecond"}) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(got, []string{"inSecond"}) {
+		t.Errorf("Expected second folder only, got %v", got)
+	}
+}
+
+// === Cross-file resolution ===
+
+func TestUnknownOperatorDiagnostics(t *testing.T) {
+	text := `op local(): (
+  where x > 0
+)
+fn helper(x): (x + 1)
+from data
+| local()
+| helper(x)
+| count()
+| shared()
+| missingOp(1)
+| call otherMissing
+| where missingFn(x) > 1`
+	tree := parseSyntax(text)
+	workspace := map[string][]indexedSymbol{
+		"shared": {{Name: "shared", Kind: SymbolOp}},
+	}
+
+	var got []string
+	for _, d := range unknownOperatorDiagnostics(tree, workspace) {
+		if d.Code != "unknown-operator" || d.Severity != DiagnosticSeverityWarning {
+			t.Errorf("Unexpected diagnostic %+v", d)
+		}
+		got = append(got, text[tree.OffsetAt(d.Range.Start):tree.OffsetAt(d.Range.End)])
+	}
+	// Only stages are checked; functions in expressions may be builtins the
+	// table doesn't know about
+	if want := []string{"missingOp", "otherMissing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected unknown operators %v, got %v", want, got)
+	}
+}
+
+func TestNestedDeclsStayLocal(t *testing.T) {
+	lib := "file:///ws/lib.spq"
+	files := map[string][]indexedSymbol{
+		"/ws/lib.spq": indexSymbols(lib, parseSyntax("op wrapper(): (\n  op nestedOp(): (pass)\n  fn helper(x): (x)\n  nestedOp\n)\nfn shared(x): (x)\n")),
+	}
+	decls := callableDecls(files, "file:///ws/query.spq")
+	var names []string
+	for name := range decls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"shared", "wrapper"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected only top-level callables %v, got %v", want, names)
+	}
+
+	// A nested operator of another file doesn't declare the name here
+	tree := parseSyntax("from data | nestedOp() | wrapper()")
+	diagnostics := unknownOperatorDiagnostics(tree, decls)
+	if len(diagnostics) != 1 || !strings.Contains(diagnostics[0].Message, `"nestedOp"`) {
+		t.Errorf("Expected nestedOp to be unknown, got %+v", diagnostics)
+	}
+}
+
+func TestCrossFileResolution(t *testing.T) {
+	root := t.TempDir()
+	lib := filepath.Join(root, "lib", "ops.spq")
+	writeFile(t, lib, "op cleanRecords(n): (\n  head n\n)\nfn normalizeName(s): (lower(s))\n")
+
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID: 1,
+		RootURI:   pathToURI(root),
+		Capabilities: ClientCapabilities{
+			TextDocument: TextDocumentClientCapabilities{Diagnostic: &DiagnosticClientCapabilities{}},
+		},
+	}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+
+	uri := pathToURI(filepath.Join(root, "query.spq"))
+	text := "from data\n| cleanRecords(10)\n| put n := normalizeName(name)\n| missingOp()\n"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: text},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	// Diagnostics wait for the index, so unknown operators are final
+	response, err := h.ProcessRequest(2, "textDocument/diagnostic", DocumentDiagnosticParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+	})
+	if err != nil {
+		t.Fatalf("Diagnostic request failed: %v", err)
+	}
+	var report DocumentDiagnosticReport
+	decodeResult(t, response, &report)
+	var unknown []string
+	for _, d := range *report.Items {
+		if d.Code == "unknown-operator" {
+			unknown = append(unknown, d.Message)
+		}
+	}
+	if len(unknown) != 1 || !strings.Contains(unknown[0], `"missingOp"`) {
+		t.Errorf("Expected only missingOp to be unknown, got %v", unknown)
+	}
+
+	response, err = h.ProcessRequest(3, "textDocument/hover", HoverParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     cursorAt(t, text, "cleanRecords", 0, 1),
+	})
+	if err != nil {
+		t.Fatalf("Hover failed: %v", err)
+	}
+	var hover Hover
+	decodeResult(t, response, &hover)
+	if !strings.Contains(hover.Contents.Value, "op cleanRecords(n)") ||
+		!strings.Contains(hover.Contents.Value, "Defined in `lib/ops.spq`") {
+		t.Errorf("Unexpected hover %q", hover.Contents.Value)
+	}
+
+	response, err = h.ProcessRequest(4, "textDocument/definition", DefinitionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     cursorAt(t, text, "normalizeName", 0, 1),
+	})
+	if err != nil {
+		t.Fatalf("Definition failed: %v", err)
+	}
+	var locations []Location
+	decodeResult(t, response, &locations)
+	want := []Location{{URI: pathToURI(lib), Range: Range{
+		Start: Position{Line: 3, Character: 3},
+		End:   Position{Line: 3, Character: 16},
+	}}}
+	if !reflect.DeepEqual(locations, want) {
+		t.Errorf("Expected %+v, got %+v", want, locations)
+	}
+
+	// Declaring the operator elsewhere clears the warning
+	writeFile(t, filepath.Join(root, "more.spq"), "op missingOp(): (pass)\n")
+	if _, err := h.ProcessNotification("workspace/didChangeWatchedFiles", DidChangeWatchedFilesParams{
+		Changes: []FileEvent{{URI: pathToURI(filepath.Join(root, "more.spq")), Type: FileChangeTypeCreated}},
+	}); err != nil {
+		t.Fatalf("didChangeWatchedFiles failed: %v", err)
+	}
+	response, err = h.ProcessRequest(5, "textDocument/diagnostic", DocumentDiagnosticParams{
+		TextDocument:     TextDocumentIdentifier{URI: uri},
+		PreviousResultID: report.ResultID,
+	})
+	if err != nil {
+		t.Fatalf("Diagnostic request failed: %v", err)
+	}
+	var updated DocumentDiagnosticReport
+	decodeResult(t, response, &updated)
+	if updated.Kind != DocumentDiagnosticReportKindFull {
+		t.Fatalf("Expected a full report after the workspace changed, got %q", updated.Kind)
+	}
+	for _, d := range *updated.Items {
+		if d.Code == "unknown-operator" {
+			t.Errorf("Expected no unknown operators, got %+v", d)
+		}
+	}
+}
+
+func TestHoverUserSymbols(t *testing.T) {
+	text := "const pi = 3.14\nfn double(x): (x * 2)\nvalues double(pi)"
+	tests := []struct {
+		needle string
+		n      int
+		want   string
+	}{
+		{"pi", 1, "const pi = 3.14"},
+		{"double", 1, "fn double(x)"},
+		{"x", 1, "(parameter) x"},
+	}
+	for _, tt := range tests {
+		hover := hoverAt(parseSyntax(text), cursorAt(t, text, tt.needle, tt.n, 0))
+		if hover == nil || !strings.Contains(hover.Contents.Value, tt.want) {
+			t.Errorf("Hover on %s #%d: expected %q, got %+v", tt.needle, tt.n, tt.want, hover)
+		}
+	}
+}
+
+// === Semantic tokens ===
+
+// decodedToken is one semantic token with absolute position and names
+type decodedToken struct {
+	Line, Char, Length int
+	Type               string
+	Modifiers          []string
+}
+
+// decodeSemanticTokens expands the relative encoding of semantic tokens
+func decodeSemanticTokens(t *testing.T, data []uint32) []decodedToken {
+	t.Helper()
+	if len(data)%5 != 0 {
+		t.Fatalf("Semantic token data length %d is not a multiple of 5", len(data))
+	}
+	var toks []decodedToken
+	line, char := 0, 0
+	for i := 0; i < len(data); i += 5 {
+		if data[i] > 0 {
+			line += int(data[i])
+			char = 0
+		}
+		char += int(data[i+1])
+		tok := decodedToken{Line: line, Char: char, Length: int(data[i+2]), Type: semanticTokenTypes[data[i+3]]}
+		for bit, name := range semanticTokenModifiers {
+			if data[i+4]&(1<<bit) != 0 {
+				tok.Modifiers = append(tok.Modifiers, name)
+			}
+		}
+		toks = append(toks, tok)
+	}
+	return toks
+}
+
+// tokenTypesByText maps the text of each semantic token to its type and
+// modifiers, e.g. "pi" to "variable.declaration.readonly"
+func tokenTypesByText(text string, toks []decodedToken) map[string][]string {
+	lines := strings.Split(text, "\n")
+	got := make(map[string][]string)
+	for _, tok := range toks {
+		word := lines[tok.Line][tok.Char : tok.Char+tok.Length]
+		got[word] = append(got[word], strings.Join(append([]string{tok.Type}, tok.Modifiers...), "."))
+	}
+	return got
+}
+
+func TestSemanticTokensClassification(t *testing.T) {
+	text := `const pi = 3.14
+fn double(x): (x * 2)
+-- totals
+from data
+| where status == "active" and time > 0
+| put y := double(pi), z := a.b, c := <int64>(x)
+| yield lower(name)
+| where grep(/err/, msg)
+| summarize count() by y
+| cleanUp()`
+	tree := parseSyntax(text)
+	got := tokenTypesByText(text, decodeSemanticTokens(t, encodeSemanticTokens(tree, semanticTokens(tree))))
+
+	want := map[string][]string{
+		"const":     {"keyword"},
+		"pi":        {"variable.declaration.readonly", "variable.readonly"},
+		"3.14":      {"number"},
+		"double":    {"function.declaration", "function"},
+		"x":         {"parameter.declaration", "parameter", "property"},
+		"-- totals": {"comment"},
+		"status":    {"property"},
+		`"active"`:  {"string"},
+		"time":      {"property"},
+		"put":       {"operator.defaultLibrary"},
+		"b":         {"property"},
+		"int64":     {"type.defaultLibrary"},
+		"yield":     {"operator.deprecated.defaultLibrary"},
+		"lower":     {"function.defaultLibrary"},
+		"/err/":     {"regexp"},
+		"count":     {"aggregate.defaultLibrary"},
+		"by":        {"keyword"},
+		"cleanUp":   {"operator"},
+	}
+	for word, types := range want {
+		if !reflect.DeepEqual(got[word], types) {
+			t.Errorf("%s: expected %v, got %v", word, types, got[word])
+		}
+	}
+}
+
+func TestSemanticTokensEncoding(t *testing.T) {
+	text := "/* one\ntwo */ values \"é\", 1"
+	tree := parseSyntax(text)
+	toks := decodeSemanticTokens(t, encodeSemanticTokens(tree, semanticTokens(tree)))
+	want := []decodedToken{
+		{Line: 0, Char: 0, Length: 6, Type: "comment"},
+		{Line: 1, Char: 0, Length: 6, Type: "comment"},
+		{Line: 1, Char: 7, Length: 6, Type: "operator", Modifiers: []string{"defaultLibrary"}},
+		{Line: 1, Char: 14, Length: 3, Type: "string"},
+		{Line: 1, Char: 19, Length: 1, Type: "number"},
+	}
+	if !reflect.DeepEqual(toks, want) {
+		t.Errorf("Expected %+v, got %+v", want, toks)
+	}
+
+	// A range only returns the tokens it overlaps
+	ranged := tokensInRange(tree, semanticTokens(tree), Range{
+		Start: Position{Line: 1, Character: 8},
+		End:   Position{Line: 1, Character: 15},
+	})
+	if len(ranged) != 2 || text[ranged[0].start:ranged[0].end] != "values" {
+		t.Errorf("Unexpected range tokens %+v", ranged)
+	}
+}
+
+func TestSemanticTokensDelta(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "from data\n| sort x\n"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+
+	response, err := h.ProcessRequest(2, "textDocument/semanticTokens/full", SemanticTokensParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+	})
+	if err != nil {
+		t.Fatalf("semanticTokens/full failed: %v", err)
+	}
+	var full SemanticTokens
+	decodeResult(t, response, &full)
+	if full.ResultID == "" || len(full.Data) == 0 {
+		t.Fatalf("Expected tokens with a result ID, got %+v", full)
+	}
+
+	h.changeDocument(t, uri, 2, "from data\n| sort x\n| head 5\n")
+	response, err = h.ProcessRequest(3, "textDocument/semanticTokens/full/delta", SemanticTokensDeltaParams{
+		TextDocument:     TextDocumentIdentifier{URI: uri},
+		PreviousResultID: full.ResultID,
+	})
+	if err != nil {
+		t.Fatalf("semanticTokens/full/delta failed: %v", err)
+	}
+	var delta SemanticTokensDelta
+	decodeResult(t, response, &delta)
+	if delta.ResultID == "" || delta.ResultID == full.ResultID || len(delta.Edits) != 1 {
+		t.Fatalf("Expected one edit under a new result ID, got %+v", delta)
+	}
+
+	// Applying the edit gives the same data as a full request
+	edit := delta.Edits[0]
+	patched := append(append(append([]uint32{}, full.Data[:edit.Start]...), edit.Data...), full.Data[edit.Start+edit.DeleteCount:]...)
+	tree := parseSyntax("from data\n| sort x\n| head 5\n")
+	if want := encodeSemanticTokens(tree, semanticTokens(tree)); !reflect.DeepEqual(patched, want) {
+		t.Errorf("Expected patched data %v, got %v", want, patched)
+	}
+
+	// An unknown result ID gets the full tokens
+	response, err = h.ProcessRequest(4, "textDocument/semanticTokens/full/delta", SemanticTokensDeltaParams{
+		TextDocument:     TextDocumentIdentifier{URI: uri},
+		PreviousResultID: "stale",
+	})
+	if err != nil {
+		t.Fatalf("semanticTokens/full/delta failed: %v", err)
+	}
+	var fallback SemanticTokens
+	decodeResult(t, response, &fallback)
+	if !reflect.DeepEqual(fallback.Data, patched) {
+		t.Errorf("Expected full tokens for an unknown result ID, got %+v", fallback)
+	}
+}
+
+// === Folding ranges ===
+
+func TestFoldingRangesQuery(t *testing.T) {
+	text := `-- Shared helpers
+-- for the report
+const x = 1 -- not part of a run
+-- region setup
+op clean(): (
+  where x > 0
+  | sort x
+)
+-- endregion
+/* block
+   comment */
+from data
+| fork (
+  => head 1
+  => tail 1
+    | sort y
+)`
+	got := foldingRanges(parseSyntax(text), false)
+	want := []FoldingRange{
+		{StartLine: 0, EndLine: 1, Kind: FoldingRangeKindComment},
+		{StartLine: 3, EndLine: 8, Kind: FoldingRangeKindRegion},
+		{StartLine: 4, EndLine: 6},  // op body, up to its closing paren
+		{StartLine: 5, EndLine: 6},  // pipeline in the body
+		{StartLine: 9, EndLine: 10, Kind: FoldingRangeKindComment},
+		{StartLine: 11, EndLine: 16}, // whole query
+		{StartLine: 12, EndLine: 15}, // fork block
+		{StartLine: 14, EndLine: 15}, // multi-line branch
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestFoldingRangesDataFile(t *testing.T) {
+	text := "{\n  a: 1,\n  b: [\n    1,\n    2\n  ],\n  c: |{\n    \"k\": 1\n  }|\n}\n{x: 1}\n{\n  y: 2\n}"
+	got := foldingRanges(parseSyntax(text), true)
+	want := []FoldingRange{
+		{StartLine: 0, EndLine: 8},
+		{StartLine: 2, EndLine: 4},
+		{StartLine: 6, EndLine: 7},
+		{StartLine: 11, EndLine: 12},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestFoldingRangeRequest(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "values 1"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	response, err := h.ProcessRequest(2, "textDocument/foldingRange", FoldingRangeParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+	})
+	if err != nil {
+		t.Fatalf("foldingRange failed: %v", err)
+	}
+	var ranges []FoldingRange
+	decodeResult(t, response, &ranges)
+	if ranges == nil || len(ranges) != 0 {
+		t.Errorf("Expected an empty list for a one-line query, got %+v", ranges)
+	}
+}
+
+// === Selection ranges ===
+
+// selectionTexts returns the text of each range in a selection chain
+func selectionTexts(tree *SyntaxTree, sel SelectionRange) []string {
+	var texts []string
+	for s := &sel; s != nil; s = s.Parent {
+		texts = append(texts, tree.Text[tree.OffsetAt(s.Range.Start):tree.OffsetAt(s.Range.End)])
+	}
+	return texts
+}
+
+func TestSelectionRangeSummarize(t *testing.T) {
+	text := `op report(): (
+  summarize total := sum(a.b.c), n := count() by host
+)
+from data | sort y`
+	tree := parseSyntax(text)
+
+	got := selectionTexts(tree, selectionRangeAt(tree, cursorAt(t, text, "b", 0, 0)))
+	want := []string{
+		"b",
+		"a.b.c",
+		"(a.b.c)",
+		"sum(a.b.c)",
+		"total := sum(a.b.c)",
+		"total := sum(a.b.c), n := count()",
+		"summarize total := sum(a.b.c), n := count()",
+		"summarize total := sum(a.b.c), n := count() by host",
+		"(\n  summarize total := sum(a.b.c), n := count() by host\n)",
+		"op report(): (\n  summarize total := sum(a.b.c), n := count() by host\n)",
+		text,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	got = selectionTexts(tree, selectionRangeAt(tree, cursorAt(t, text, "host", 0, 0)))
+	want = []string{
+		"host",
+		"by host",
+		"summarize total := sum(a.b.c), n := count() by host",
+	}
+	if !reflect.DeepEqual(got[:3], want) {
+		t.Errorf("Expected %q, got %q", want, got[:3])
+	}
+
+	got = selectionTexts(tree, selectionRangeAt(tree, cursorAt(t, text, "sort", 0, 0)))
+	want = []string{"sort", "sort y", "from data | sort y", text}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestSelectionRangeRequest(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := "file:///test.spq"
+	text := "-- note\nvalues x"
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: text},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	response, err := h.ProcessRequest(2, "textDocument/selectionRange", SelectionRangeParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Positions:    []Position{{Line: 0, Character: 3}, {Line: 1, Character: 7}},
+	})
+	if err != nil {
+		t.Fatalf("selectionRange failed: %v", err)
+	}
+	var ranges []SelectionRange
+	decodeResult(t, response, &ranges)
+	if len(ranges) != 2 {
+		t.Fatalf("Expected one selection range per position, got %d", len(ranges))
+	}
+	tree := parseSyntax(text)
+	if got := selectionTexts(tree, ranges[0]); !reflect.DeepEqual(got, []string{"-- note", text}) {
+		t.Errorf("Unexpected comment selection %q", got)
+	}
+	if got := selectionTexts(tree, ranges[1]); !reflect.DeepEqual(got, []string{"x", "values x", text}) {
+		t.Errorf("Unexpected selection %q", got)
+	}
+}
+
+// === Inlay hints ===
+
+// hintLabels returns "line:character label" for each hint
+func hintLabels(hints []InlayHint) []string {
+	var labels []string
+	for _, h := range hints {
+		labels = append(labels, fmt.Sprintf("%d:%d %s", h.Position.Line, h.Position.Character, h.Label))
+	}
+	return labels
+}
+
+func TestInlayHintParameters(t *testing.T) {
+	text := `from data
+| put y := date_part("year", ts), b := bucket(value, 5m), c := abs(x)`
+	tree := parseSyntax(text)
+	got := hintLabels(inlayHints(tree, 0, len(text)))
+	// bucket's first argument already reads as its parameter name, and abs
+	// has a single argument
+	want := []string{"1:21 part:", "1:29 time:", "1:53 size:"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// User functions shadowing a builtin get no builtin hints
+	text = "fn bucket(a, b): (a)\nvalues bucket(1, 2)"
+	if got := inlayHints(parseSyntax(text), 0, len(text)); len(got) != 0 {
+		t.Errorf("Expected no hints for a user function, got %v", hintLabels(got))
+	}
+}
+
+func TestInlayHintAggregates(t *testing.T) {
+	text := `from data
+| summarize count(), total := sum(x), max(y) by host
+| count() by a
+| where count() > 1`
+	tree := parseSyntax(text)
+	got := hintLabels(inlayHints(tree, 0, len(text)))
+	want := []string{"1:12 count :=", "1:38 max :=", "2:2 count :="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestInlayHintConstTypes(t *testing.T) {
+	text := `const pi = 3.14
+const n = -5
+const name = "x"
+const ok = true
+const window = 1h
+const gateway = 10.0.0.1
+const sum2 = n + 1
+let rows = 5`
+	tree := parseSyntax(text)
+	got := hintLabels(inlayHints(tree, 0, len(text)))
+	want := []string{
+		"0:8 : float64",
+		"1:7 : int64",
+		"2:10 : string",
+		"3:8 : bool",
+		"4:12 : duration",
+		"5:13 : ip",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Only hints inside the requested range are returned
+	start := tree.OffsetAt(Position{Line: 2})
+	end := tree.OffsetAt(Position{Line: 3})
+	if got := hintLabels(inlayHints(tree, start, end)); !reflect.DeepEqual(got, []string{"2:10 : string"}) {
+		t.Errorf("Expected only the hint in range, got %v", got)
+	}
+}
+
+// === Type-aware hover ===
+
+func TestExprType(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1", "int64"},
+		{"-2.5", "float64"},
+		{"'a' + 'b'", "string"},
+		{"1 + 2 * 3.0", "float64"},
+		{"'2024-01-01'::time + 1h", "time"},
+		{"now() - '2024-01-01'::time", "duration"},
+		{"2 * -1h", "duration"},
+		{"1h * 2", "duration"},
+		{"(1 + 2)::string", "string"},
+		{"x::uint8", "uint8"},
+		{"len(s) > 3 and ok", "bool"},
+		{"<int64>", "type"},
+		{"x + 1", ""},
+		{"'a' + 1", ""},
+		{"x::port", ""},
+	}
+	for _, tt := range tests {
+		tree := parseSyntax("const c = " + tt.expr)
+		decl := tree.Root.Children[0]
+		if got := typeName(exprType(tree, constValue(decl))); got != tt.want {
+			t.Errorf("exprType(%s): expected %q, got %q", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestHoverLiteralTypes(t *testing.T) {
+	text := `values 'hello', 10.0.0.1, 5m, true`
+	tests := []struct {
+		needle string
+		want   string
+	}{
+		{"hello", "```spq\n'hello'\n```\n\nType: `string`"},
+		{"10.0", "```spq\n10.0.0.1\n```\n\nType: `ip`"},
+		{"5m", "```spq\n5m\n```\n\nType: `duration`"},
+		{"true", "```spq\ntrue\n```\n\nType: `bool`"},
+	}
+	for _, tt := range tests {
+		hover := hoverAt(parseSyntax(text), cursorAt(t, text, tt.needle, 0, 1))
+		if hover == nil || hover.Contents.Value != tt.want {
+			t.Errorf("Hover on %s: expected %q, got %+v", tt.needle, tt.want, hover)
+		}
+	}
+}
+
+func TestHoverCast(t *testing.T) {
+	text := `values '1h'::duration, ts::string::time, x::port`
+	for _, needle := range []string{"1h", "::", "duration"} {
+		hover := hoverAt(parseSyntax(text), cursorAt(t, text, needle, 0, 1))
+		if hover == nil || !strings.HasPrefix(hover.Contents.Value, "```spq\n'1h'::duration\n```\n\nType: `duration`") {
+			t.Errorf("Hover on %s: expected the cast type, got %+v", needle, hover)
+		}
+	}
+	// The type name also keeps its builtin documentation
+	if hover := hoverAt(parseSyntax(text), cursorAt(t, text, "duration", 0, 1)); hover == nil || !strings.Contains(hover.Contents.Value, "**duration** (type)") {
+		t.Errorf("Expected builtin docs on the type name, got %+v", hover)
+	}
+
+	hover := hoverAt(parseSyntax(text), cursorAt(t, text, "time", 0, 1))
+	if hover == nil || !strings.HasPrefix(hover.Contents.Value, "```spq\nts::string::time\n```\n\nType: `time`") {
+		t.Errorf("Expected the chained cast type, got %+v", hover)
+	}
+
+	// Casts to types the server can't resolve get no type hover
+	if hover := hoverAt(parseSyntax(text), cursorAt(t, text, "port", 0, 1)); hover != nil {
+		t.Errorf("Expected no hover for an unknown type, got %+v", hover)
+	}
+}
+
+func TestHoverConstType(t *testing.T) {
+	text := "const start = '2024-01-01T00:00:00Z'::time\nconst stop = start + 1h\nconst f = x + 1\nvalues stop"
+	hover := hoverAt(parseSyntax(text), cursorAt(t, text, "stop", 1, 0))
+	want := "```spq\nconst stop = start + 1h\n```\n\nType: `time`\n\nEstimated value: `2024-01-01T01:00:00Z`"
+	if hover == nil || hover.Contents.Value != want {
+		t.Errorf("Expected %q, got %+v", want, hover)
+	}
+
+	// Constants whose type depends on data only show the declaration
+	hover = hoverAt(parseSyntax(text), cursorAt(t, text, "f", 0, 0))
+	if hover == nil || hover.Contents.Value != "```spq\nconst f = x + 1\n```" {
+		t.Errorf("Expected only the declaration, got %+v", hover)
+	}
+
+	// Self-referential constants don't loop
+	text = "const a = a + 1\nvalues a"
+	if hover := hoverAt(parseSyntax(text), cursorAt(t, text, "a", 3, 0)); hover == nil {
+		t.Error("Expected a hover for a cyclic constant")
+	}
+}
+
+// === Constant evaluation ===
+
+func TestEvalConstant(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"7 / 2", "3"},
+		{"7 / 2.0", "3.5"},
+		{"2.0 * 2", "4."},
+		{"'a' + \"b\\n\"", `"ab\n"`},
+		{"-90m", "-1h30m"},
+		{"90m / 2", "45m"},
+		{"2 * 1500ms", "3s"},
+		{"1500ms * 2", "3s"},
+		{"'2024-01-01T00:00:00Z'::time + 1d", "2024-01-02T00:00:00Z"},
+		{"'2024-03-01T12:00:00Z'::time - '2024-03-01T00:00:00Z'::time", "12h"},
+		{"'80'::uint16", "80::uint16"},
+		{"300::uint8", "error: cannot cast 300 to uint8"},
+		{"1.9::int64", "1"},
+		// Strings that don't spell a literal of the type aren't estimated
+		{"'x'::int64", ""},
+		{"' 80'::int64", ""},
+		{"'abc'::time", ""},
+		{"'2024-01-01'::time", ""},
+		{"'-5'::int64", "-5"},
+		{"'1'::bool", ""},
+		{"1.5::string", ""},
+		{"1 / 0", "error: divide by zero"},
+		{"'a' + 1", "error: incompatible types string and int64"},
+		{"1 < 2 and not false", "true"},
+		{"true or false and false", "true"},
+		{"false and true or true", "true"},
+		{"'b' > 'a'", "true"},
+		{"(1 + 2)::string", `"3"`},
+		{"10.0.0.1::string", `"10.0.0.1"`},
+		{"x + 1", ""},
+		{"now()", ""},
+		{"f'{x}'", ""},
+		// Results that don't fit their type are errors, never wrapped
+		{"1::uint8 + 255::uint8", "error: 256 overflows uint8"},
+		{"200::uint8 - 201::uint8", "error: -1 overflows uint8"},
+		{"100::int8 * 2::int8", "error: 200 overflows int8"},
+		{"9223372036854775807 + 1", "error: 9223372036854775808 overflows int64"},
+		{"-9223372036854775807 - 1", "-9223372036854775808"},
+		{"-1::uint64", "error: -1 overflows uint64"},
+		{"-0::uint64", "0::uint64"},
+		{"9223372036854775808", "error: integer literal 9223372036854775808 out of range"},
+		{"-9223372036854775808", "-9223372036854775808"},
+		{"-9223372036854775809", "error: integer literal -9223372036854775809 out of range"},
+		{"1e400", "error: float literal 1e400 out of range"},
+		{"1h * 1e30", "error: duration out of range"},
+		{"-1h * 1e30", "error: duration out of range"},
+		{"106751d + 106751d", "error: duration out of range"},
+		{"106752d", "error: duration out of range: 106752d"},
+	}
+	for _, tt := range tests {
+		tree := parseSyntax("const c = " + tt.expr)
+		c, err := evalConstant(tree, constValue(tree.Root.Children[0]).Children)
+		var got string
+		switch {
+		case errors.Is(err, errNotConstant):
+		case err != nil:
+			got = "error: " + err.Error()
+		default:
+			got = formatConstant(c)
+		}
+		if got != tt.want {
+			t.Errorf("evalConstant(%s): expected %q, got %q", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestEvalConstantReferences(t *testing.T) {
+	text := "const a = 2\nconst b = a * 21\nconst loop = loop + 1\nvalues b"
+	hover := hoverAt(parseSyntax(text), cursorAt(t, text, "b", 1, 0))
+	if hover == nil || !strings.HasSuffix(hover.Contents.Value, "Estimated value: `42`") {
+		t.Errorf("Expected the value of b, got %+v", hover)
+	}
+	tree := parseSyntax(text)
+	if _, err := evalConstant(tree, constValue(tree.Root.Children[2]).Children); !errors.Is(err, errNotConstant) {
+		t.Errorf("Expected a cyclic constant not to evaluate, got %v", err)
+	}
+}
+
+func TestFormatDurationExtremes(t *testing.T) {
+	if got := formatDuration(math.MinInt64); got != "-106751d23h47m16.854775808s" {
+		t.Errorf("Unexpected most negative duration %q", got)
+	}
+	if got := formatDuration(math.MaxInt64); got != "106751d23h47m16.854775807s" {
+		t.Errorf("Unexpected largest duration %q", got)
+	}
+}
+
+func TestEvalConstantDoubling(t *testing.T) {
+	// Each constant doubles the last; without caching the references
+	// double too, and the strings soon outgrow any preview
+	var b strings.Builder
+	b.WriteString("const c0 = 'ab'\n")
+	for i := 1; i <= 60; i++ {
+		fmt.Fprintf(&b, "const c%d = c%d + c%d\n", i, i-1, i-1)
+	}
+	tree := parseSyntax(b.String())
+	decls := tree.Root.Children
+	start := time.Now()
+	if _, err := evalConstant(tree, constValue(decls[len(decls)-1]).Children); !errors.Is(err, errNotConstant) {
+		t.Errorf("Expected an oversized string not to be previewed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > evalBudget {
+		t.Errorf("Evaluation took %v", elapsed)
+	}
+	if c, err := evalConstant(tree, constValue(decls[3]).Children); err != nil || len(c.val.(string)) != 16 {
+		t.Errorf("Expected a 16-byte string, got %v, %v", c, err)
+	}
+}
+
+func TestEvalConstantBudget(t *testing.T) {
+	tree := parseSyntax("const c = 1 + 2")
+	e := &evaluator{symbols: tree.Symbols(), deadline: time.Now().Add(-time.Second), seen: map[*Node]bool{}}
+	if _, err := e.terms(constValue(tree.Root.Children[0]).Children); !errors.Is(err, errEvalBudget) {
+		t.Errorf("Expected the budget to stop evaluation, got %v", err)
+	}
+}
+
+func TestHoverEvaluatedExpressions(t *testing.T) {
+	text := "const bad = 1 / 0\nvalues '1h'::duration, 2 + 3, x + 1"
+	tests := []struct {
+		needle string
+		want   string
+	}{
+		{"bad", "```spq\nconst bad = 1 / 0\n```\n\nType: `int64`\n\nEstimated error: divide by zero"},
+		{"::", "```spq\n'1h'::duration\n```\n\nType: `duration`\n\nEstimated value: `1h`"},
+		{"+", "```spq\n2 + 3\n```\n\nType: `int64`\n\nEstimated value: `5`"},
+	}
+	for _, tt := range tests {
+		hover := hoverAt(parseSyntax(text), cursorAt(t, text, tt.needle, 0, 0))
+		if hover == nil || hover.Contents.Value != tt.want {
+			t.Errorf("Hover on %s: expected %q, got %+v", tt.needle, tt.want, hover)
+		}
+	}
+	// Operators in expressions that read fields get no preview
+	if hover := hoverAt(parseSyntax(text), cursorAt(t, text, "+", 1, 0)); hover != nil {
+		t.Errorf("Expected no hover for a field expression, got %+v", hover)
+	}
+}
+
+// === Signature forms ===
+
+// activeLabel returns the active signature's label and the text of its
+// active parameter
+func activeLabel(help *SignatureHelp) (string, string) {
+	sig := help.Signatures[help.ActiveSignature]
+	if help.ActiveParameter == nil || *help.ActiveParameter >= len(sig.Parameters) {
+		return sig.Label, ""
+	}
+	r := sig.Parameters[*help.ActiveParameter].Label
+	return sig.Label, sig.Label[r[0]:r[1]]
+}
+
+func TestSignatureHelpOptionalParameters(t *testing.T) {
+	help := signatureHelpAt(parseSyntax("values log(x, "), Position{Line: 0, Character: 14})
+	if help == nil || len(help.Signatures) != 2 {
+		t.Fatalf("Expected a form with and without the optional base, got %+v", help)
+	}
+	if help.Signatures[0].Label != "log(value: number) -> float64" ||
+		help.Signatures[1].Label != "log(value: number, base: number) -> float64" {
+		t.Errorf("Unexpected labels: %q, %q", help.Signatures[0].Label, help.Signatures[1].Label)
+	}
+	if label, param := activeLabel(help); param != "base: number" {
+		t.Errorf("Expected base active in %q, got %q", label, param)
+	}
+
+	help = signatureHelpAt(parseSyntax("values log(x"), Position{Line: 0, Character: 12})
+	if label, param := activeLabel(help); label != "log(value: number) -> float64" || param != "value: number" {
+		t.Errorf("Expected the one-argument form, got %q with %q", label, param)
+	}
+}
+
+func TestSignatureHelpVariadic(t *testing.T) {
+	help := signatureHelpAt(parseSyntax("values coalesce(a, b, c"), Position{Line: 0, Character: 23})
+	if label, param := activeLabel(help); label != "coalesce(value: any, ...) -> any" || param != "value: any" {
+		t.Errorf("Expected the repeated parameter active, got %q with %q", label, param)
+	}
+
+	// max is a variadic function and an aggregate
+	help = signatureHelpAt(parseSyntax("summarize max(x"), Position{Line: 0, Character: 15})
+	if label, _ := activeLabel(help); label != "max(value: number) -> number" || len(help.Signatures) != 2 {
+		t.Errorf("Expected the aggregate form of max, got %q of %d", label, len(help.Signatures))
+	}
+	help = signatureHelpAt(parseSyntax("values max(x, y"), Position{Line: 0, Character: 15})
+	if label, _ := activeLabel(help); label != "max(value: number, ...) -> number" {
+		t.Errorf("Expected the variadic form of max, got %q", label)
+	}
+}
+
+func TestSignatureHelpTooManyArguments(t *testing.T) {
+	help := signatureHelpAt(parseSyntax("values ceil(x, y"), Position{Line: 0, Character: 16})
+	if help == nil || help.ActiveParameter != nil {
+		t.Fatalf("Expected no parameter of ceil to be active, got %+v", help)
+	}
+	// Sent as null, which clients read as no active parameter rather than
+	// the first
+	data, err := json.Marshal(help)
+	if err != nil || !strings.Contains(string(data), `"activeParameter":null`) {
+		t.Errorf("Expected a null activeParameter, got %s", data)
+	}
+	if _, param := activeLabel(help); param != "" {
+		t.Errorf("Expected no active parameter, got %q", param)
+	}
+}
+
+func TestSignatureHelpNullActiveParameterCapability(t *testing.T) {
+	for _, support := range []bool{false, true} {
+		h := NewTestHelper()
+		params := InitializeParams{ProcessID: 1}
+		if support {
+			params.Capabilities.TextDocument.SignatureHelp = &SignatureHelpClientCapabilities{}
+			params.Capabilities.TextDocument.SignatureHelp.SignatureInformation.NoActiveParameterSupport = true
+		}
+		if _, err := h.ProcessRequest(1, "initialize", params); err != nil {
+			t.Fatalf("Initialize failed: %v", err)
+		}
+		if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+			TextDocument: TextDocumentItem{URI: "file:///test.spq", LanguageID: "spq", Version: 1, Text: "values ceil(x, y"},
+		}); err != nil {
+			t.Fatalf("didOpen failed: %v", err)
+		}
+		response, err := h.ProcessRequest(2, "textDocument/signatureHelp", SignatureHelpParams{
+			TextDocument: TextDocumentIdentifier{URI: "file:///test.spq"},
+			Position:     Position{Line: 0, Character: 16},
+		})
+		if err != nil {
+			t.Fatalf("Signature help failed: %v", err)
+		}
+		data, err := json.Marshal(response.Result)
+		if err != nil {
+			t.Fatalf("Marshal result: %v", err)
+		}
+		// Clients without the capability read null as the first parameter;
+		// they get an index past the last one instead
+		want := `"activeParameter":1`
+		if support {
+			want = `"activeParameter":null`
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("noActiveParameterSupport=%v: expected %s, got %s", support, want, data)
+		}
+	}
+}
+
+func TestSignatureParameterOffsets(t *testing.T) {
+	for _, b := range append(Builtins.Functions(), Builtins.Aggregates()...) {
+		if b.Signature == "" {
+			continue
+		}
+		for _, sig := range builtinSignatures(b) {
+			for _, p := range sig.params {
+				if text := sig.label[p.start:p.end]; !strings.HasPrefix(text, p.name) || strings.ContainsAny(text, ",?") {
+					t.Errorf("%s: parameter %s spans %q", sig.label, p.name, text)
+				}
+				if p.doc == "" {
+					t.Errorf("%s: parameter %s has no documentation", sig.label, p.name)
+				}
+			}
+		}
+	}
+}
+
+func TestSignatureHelpUserDeclarations(t *testing.T) {
+	text := "fn scale(x, factor): (x * factor)\nop keep(field,limit): (where field > limit)\nvalues scale(1, 2)\n| keep(a, 5)"
+	help := signatureHelpAt(parseSyntax(text), cursorAt(t, text, "2)", 0, 0))
+	if label, param := activeLabel(help); label != "fn scale(x, factor)" || param != "factor" {
+		t.Errorf("Expected factor active in scale, got %q with %q", label, param)
+	}
+	help = signatureHelpAt(parseSyntax(text), cursorAt(t, text, "a, 5", 0, 0))
+	if label, param := activeLabel(help); label != "op keep(field,limit)" || param != "field" {
+		t.Errorf("Expected field active in keep, got %q with %q", label, param)
+	}
+
+	// A user function shadowing a builtin shows its own signature
+	text = "fn len(a, b): (a)\nvalues len(x, "
+	help = signatureHelpAt(parseSyntax(text), Position{Line: 1, Character: 14})
+	if label, param := activeLabel(help); label != "fn len(a, b)" || param != "b" {
+		t.Errorf("Expected the user len, got %q with %q", label, param)
+	}
+}
+
+func TestSignatureHelpWorkspaceDeclarations(t *testing.T) {
+	text := "values remote(1, "
+	lookup := func(name string) []indexedSymbol {
+		if name != "remote" {
+			return nil
+		}
+		return []indexedSymbol{{Name: "remote", Kind: SymbolFunc, Signature: "fn remote(a, b)",
+			Location: Location{URI: pathToURI(filepath.FromSlash("/ws/lib/util.spq"))}}}
+	}
+	help := workspaceSignatureHelp(parseSyntax(text), Position{Line: 0, Character: 17}, lookup, []string{filepath.FromSlash("/ws")})
+	if help == nil {
+		t.Fatal("Expected signature help for a workspace function")
+	}
+	if label, param := activeLabel(help); label != "fn remote(a, b)" || param != "b" {
+		t.Errorf("Expected b active in remote, got %q with %q", label, param)
+	}
+	if doc := help.Signatures[0].Documentation; doc == nil || doc.Value != "Defined in lib/util.spq" {
+		t.Errorf("Expected the defining file, got %+v", doc)
+	}
+}
+
+func TestInlayHintMalformedNumbers(t *testing.T) {
+	text := "const a = 1e\nconst b = 0x\nconst c = 5q\nconst d = 1.2.3\nconst e = 1h30m\nconst f = 1e400\nconst g = 0xff"
+	tree := parseSyntax(text)
+	got := hintLabels(inlayHints(tree, 0, len(text)))
+	// Out of range literals keep their type; the hover reports the overflow
+	want := []string{"4:7 : duration", "5:7 : float64", "6:7 : int64"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestInlayHintAddressTypes(t *testing.T) {
+	text := "const a = fe80::1\nconst b = ::1\nconst c = 10.0.0.0/8\nconst d = 2001:db8::/32\nconst e = 1.2.3.999\nconst f = 10/8\nconst g = ::ffff:1.2.3.4"
+	tree := parseSyntax(text)
+	got := hintLabels(inlayHints(tree, 0, len(text)))
+	want := []string{"0:7 : ip", "1:7 : ip", "2:7 : net", "3:7 : net", "6:7 : ip"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestInlayHintVariadicParameters(t *testing.T) {
+	text := "values coalesce(a, b), max(x, y), log(x, 2)"
+	got := hintLabels(inlayHints(parseSyntax(text), 0, len(text)))
+	want := []string{"0:38 value:", "0:41 base:"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// === Signature context ===
+
+func TestCallContextLexicalStructure(t *testing.T) {
+	tests := []struct {
+		text  string
+		name  string
+		index int
+	}{
+		{`values concat("a,(b", `, "concat", 1},
+		{`values concat(x, /a(b,c/, `, "concat", 2},
+		{"values concat(a, -- ) ,\n  b, ", "concat", 2},
+		{"values concat(a, /* ( , */ b", "concat", 1},
+		{`values concat([1, 2, 3], `, "concat", 1},
+		{`values concat({a: 1, b: [2, 3]}, `, "concat", 1},
+		{`values concat(|{"a":1,"b":2}|, `, "concat", 1},
+		{`values concat(a, {x: f(1, 2)}, `, "concat", 2},
+		{"values concat(\n  a,\n  b,\n  ", "concat", 2},
+		{`values map(a, lambda x, y: x + `, "map", 1},
+		{`values map(a, lambda x: concat(x, `, "concat", 1},
+		{`values join([1, 2], `, "join", 1},
+		{`values concat(a, ")"`, "concat", 1},
+		{`values 1 + (a, `, "", 0},
+	}
+	for _, tt := range tests {
+		tree := parseSyntax(tt.text)
+		name, index := callContextAt(tree, len(tt.text))
+		if name != tt.name || index != tt.index {
+			t.Errorf("%q: expected %q at %d, got %q at %d", tt.text, tt.name, tt.index, name, index)
+		}
+	}
+}
+
+func TestJoinClauseIsNotCall(t *testing.T) {
+	tree := parseSyntax("from a join (from b) on x=y")
+	var calls int
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		if n.Kind == NodeCall {
+			calls++
+		}
+		for _, c := range n.Children {
+			visit(c)
+		}
+	}
+	visit(tree.Root)
+	if calls != 0 {
+		t.Errorf("Expected the join clause not to parse as a call, got %d calls", calls)
+	}
+}
+
+// === Grammar-aware completion ===
+
+// completionLabels returns the labels of the completions at the end of text
+func completionLabels(text string, env completionEnv) map[string]bool {
+	tree := parseSyntax(text)
+	labels := make(map[string]bool)
+	for _, item := range completionsIn(tree, tree.PositionAt(len(text)), env) {
+		labels[item.Label] = true
+	}
+	return labels
+}
+
+func TestCompletionSites(t *testing.T) {
+	tests := []struct {
+		text   string
+		want   completionContext
+		clause string
+	}{
+		{"", contextStatement, ""},
+		{"const x = 1\n", contextStatement, ""},
+		{"const ", contextName, ""},
+		{"fn f(", contextName, ""},
+		{"op o(a): (", contextStatement, ""},
+		{"from test | ", contextOperator, ""},
+		{"from test | so", contextOperator, ""},
+		{"fork (", contextOperator, ""},
+		{"from ", contextSource, ""},
+		{"select * from ", contextSource, ""},
+		{"from a | join ", contextSource, ""},
+		{"from (", contextStatement, ""},
+		{"from test | sort ", contextSortKey, ""},
+		{"from test | sort x de", contextSortKey, ""},
+		{"select a from t order by ", contextSortKey, ""},
+		{"select a from t group by ", contextExpr, "group"},
+		{"from a | join (from b) on ", contextExpr, "on"},
+		{"from a | join (from b) on x ", contextClause, "on"},
+		{"select a ", contextClause, "select"},
+		{"select a fr", contextClause, "select"},
+		{"count() ", contextClause, "summarize"},
+		{"summarize ", contextExpr, "summarize"},
+		{"where x ", contextClause, ""},
+		{"where x > ", contextExpr, ""},
+		{"values map(a, lambda ", contextName, ""},
+		{"values map(a, lambda x: ", contextExpr, ""},
+		{"values <", contextType, ""},
+		{"values x < ", contextExpr, ""},
+		{"values a.", contextField, ""},
+		{"select a as ", contextName, ""},
+		{"cast(", contextExpr, ""},
+		{"cast(x, ", contextType, ""},
+	}
+	for _, tt := range tests {
+		tree := parseSyntax(tt.text)
+		if got := completionSiteAt(tree, len(tt.text)); got.context != tt.want || got.clause != tt.clause {
+			t.Errorf("%q: expected context %d %q, got %d %q", tt.text, tt.want, tt.clause, got.context, got.clause)
+		}
+	}
+}
+
+func TestCompletionAfterPipeOffersOperators(t *testing.T) {
+	labels := completionLabels("from test | ", completionEnv{})
+	for _, want := range []string{"sort", "where", "summarize", "select"} {
+		if !labels[want] {
+			t.Errorf("Expected %q after a pipe", want)
+		}
+	}
+	for _, unwanted := range []string{"abs", "int64", "const", "and"} {
+		if labels[unwanted] {
+			t.Errorf("Expected no %q after a pipe", unwanted)
+		}
+	}
+}
+
+func TestCompletionSortKeys(t *testing.T) {
+	labels := completionLabels("from test | sort x ", completionEnv{})
+	for _, want := range []string{"asc", "desc", "nulls first", "nulls last", "len"} {
+		if !labels[want] {
+			t.Errorf("Expected %q in sort keys", want)
+		}
+	}
+	if labels["where"] {
+		t.Error("Expected no operators in sort keys")
+	}
+}
+
+func TestCompletionDataSources(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"events.sup", "logs.json", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := parseSyntax("from ev")
+	items := completionsIn(tree, Position{Line: 0, Character: 7}, completionEnv{dir: dir})
+	if len(items) != 1 || items[0].Label != "events.sup" || items[0].InsertText != "'events.sup'" {
+		t.Errorf("Expected events.sup as a quoted source, got %+v", items)
+	}
+	if labels := completionLabels("from ", completionEnv{dir: dir}); !labels["logs.json"] || labels["notes.txt"] {
+		t.Errorf("Expected only data files as sources, got %v", labels)
+	}
+}
+
+// === Sample data fields ===
+
+const sampleEvents = `{"kind": "login", "user": {"name": "ann", "tags": ["admin"]}}
+{"kind": true, "user": {"name": "bob", "tags": ["dev"]}}
+`
+
+// writeSample writes files into a temporary directory and returns it
+func writeSample(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInferFields(t *testing.T) {
+	values, err := parseDataValuesForFormat(sampleEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]string{}
+	for _, f := range inferFields(values) {
+		types[f.name()] = f.typeName()
+	}
+	want := map[string]string{"kind": "(string,bool)", "user.name": "string", "user.tags": "[string]"}
+	for name, typ := range want {
+		if types[name] != typ {
+			t.Errorf("Expected %s to have type %s, got %q", name, typ, types[name])
+		}
+	}
+	if _, ok := types["user"]; !ok || len(types) != 4 {
+		t.Errorf("Expected kind, user, user.name and user.tags, got %v", types)
+	}
+}
+
+func TestCompletionSampleFields(t *testing.T) {
+	dir := writeSample(t, map[string]string{"events.sup": sampleEvents})
+	s := NewServer()
+	path := filepath.Join(dir, "query.spq")
+
+	text := "from 'events.sup' | where "
+	tree := parseSyntax(text)
+	env := completionEnv{dir: dir, fields: s.sampleFields(tree, len(text), path)}
+	details := map[string]string{}
+	for _, item := range completionsIn(tree, tree.PositionAt(len(text)), env) {
+		if item.Kind == CompletionItemKindField {
+			details[item.Label] = item.Detail
+		}
+	}
+	if details["user.name"] != "string" || details["kind"] != "(string,bool)" {
+		t.Errorf("Expected typed field paths, got %v", details)
+	}
+
+	// After a dot, only the members of that record
+	text = "from events.sup | values user."
+	tree = parseSyntax(text)
+	env.fields = s.sampleFields(tree, len(text), path)
+	labels := completionLabels(text, env)
+	if len(labels) != 2 || !labels["name"] || !labels["tags"] {
+		t.Errorf("Expected the members of user, got %v", labels)
+	}
+}
+
+func TestCompletionConfiguredSample(t *testing.T) {
+	root := writeSample(t, map[string]string{"data/events.json": sampleEvents})
+	h := NewTestHelper()
+	_, err := h.ProcessRequest(1, "initialize", InitializeParams{
+		ProcessID:             1,
+		RootURI:               pathToURI(root),
+		InitializationOptions: json.RawMessage(`{"sampleData": {"*.spq": "data/events.json"}}`),
+	})
+	if err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	uri := pathToURI(filepath.Join(root, "queries", "q.spq"))
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "spq", Version: 1, Text: "values ki"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	response, err := h.ProcessRequest(2, "textDocument/completion", CompletionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: 0, Character: 9},
+	})
+	if err != nil {
+		t.Fatalf("Completion failed: %v", err)
+	}
+	var list CompletionList
+	decodeResult(t, response, &list)
+	if len(list.Items) == 0 || list.Items[0].Label != "kind" || list.Items[0].Kind != CompletionItemKindField {
+		t.Errorf("Expected the kind field from the configured sample first, got %+v", list.Items)
+	}
+}
+
+func TestConfiguredSamplePatterns(t *testing.T) {
+	root := filepath.FromSlash("/work")
+	mapping := map[string]string{"queries/**/*.spq": "nested.sup", "logs/*.spq": "logs.sup"}
+	tests := map[string]string{
+		"queries/q.spq":          "nested.sup",
+		"queries/a/b/q.spq":      "nested.sup",
+		"logs/q.spq":             "logs.sup",
+		"logs/old/q.spq":         "",
+		"other/queries/q.spq":    "",
+		"queries/a/b/notes.json": "",
+	}
+	for rel, want := range tests {
+		if want != "" {
+			want = filepath.Join(root, want)
+		}
+		if got := configuredSample(filepath.Join(root, filepath.FromSlash(rel)), []string{root}, mapping); got != want {
+			t.Errorf("%s: expected %q, got %q", rel, want, got)
+		}
+	}
+}
+
+// === Snippets ===
+
+func TestCallSnippet(t *testing.T) {
+	tests := map[string]string{
+		"len":      "len(${1:value})",
+		"log":      "log(${1:value})",
+		"coalesce": "coalesce(${1:value})",
+		"now":      "now()",
+	}
+	for name, want := range tests {
+		if got := callSnippet(Builtins.Lookup(name)); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+// completionItem returns the completion with a label, and a kind unless
+// it's 0, at the end of text
+func completionItem(t *testing.T, text, label string, kind int, env completionEnv) CompletionItem {
+	t.Helper()
+	tree := parseSyntax(text)
+	for _, item := range completionsIn(tree, tree.PositionAt(len(text)), env) {
+		if item.Label == label && (kind == 0 || item.Kind == kind) {
+			return item
+		}
+	}
+	t.Fatalf("Expected %q in completions for %q", label, text)
+	return CompletionItem{}
+}
+
+func TestCompletionCallSnippets(t *testing.T) {
+	item := completionItem(t, "values le", "len", 0, completionEnv{snippets: true})
+	if item.InsertText != "len(${1:value})" || item.InsertTextFormat != InsertTextFormatSnippet {
+		t.Errorf("Expected a call snippet, got %+v", item)
+	}
+	// Without snippet support only the name is inserted
+	item = completionItem(t, "values le", "len", 0, completionEnv{})
+	if item.InsertText != "" || item.InsertTextFormat != 0 {
+		t.Errorf("Expected plain insertion of the name, got %+v", item)
+	}
+}
+
+func TestCompletionConstructSnippets(t *testing.T) {
+	item := completionItem(t, "from test | ", "summarize by", 0, completionEnv{snippets: true})
+	if item.InsertText != "summarize ${1:count()} by ${2:key}" || item.InsertTextFormat != InsertTextFormatSnippet {
+		t.Errorf("Expected a summarize snippet, got %+v", item)
+	}
+	item = completionItem(t, "from test | ", "join on", 0, completionEnv{})
+	if item.InsertText != "join (from right) on left.x=right.y" || item.InsertTextFormat != InsertTextFormatPlainText {
+		t.Errorf("Expected the plain text of the join snippet, got %+v", item)
+	}
+	item = completionItem(t, "", "op name(args)", CompletionItemKindSnippet, completionEnv{snippets: true})
+	if !strings.HasPrefix(item.InsertText, "op ${1:name}(${2:args}): (") {
+		t.Errorf("Expected an op declaration snippet, got %+v", item)
+	}
+	if labels := completionLabels("from test | ", completionEnv{snippets: true}); labels["fn name(args)"] || labels["op name(args)"] {
+		t.Error("Expected no declaration snippets after a pipe")
+	}
+}
+
+func TestCompletionSnippetLabelsAreDistinct(t *testing.T) {
+	for _, text := range []string{"", "from test | "} {
+		kinds := make(map[string][]int)
+		for _, item := range completionsIn(parseSyntax(text), Position{Character: len(text)}, completionEnv{snippets: true}) {
+			kinds[item.Label] = append(kinds[item.Label], item.Kind)
+		}
+		for _, s := range snippetLibrary {
+			if len(kinds[s.label]) > 1 {
+				t.Errorf("%q: snippet label %q shared with %v", text, s.label, kinds[s.label])
+			}
+		}
+	}
+}
+
+func TestCompletionSnippetCapability(t *testing.T) {
+	h := NewTestHelper()
+	params := InitializeParams{ProcessID: 1}
+	params.Capabilities.TextDocument.Completion.CompletionItem.SnippetSupport = true
+	if _, err := h.ProcessRequest(1, "initialize", params); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	if _, err := h.ProcessNotification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: "file:///test.spq", LanguageID: "spq", Version: 1, Text: "values ceil"},
+	}); err != nil {
+		t.Fatalf("didOpen failed: %v", err)
+	}
+	response, err := h.ProcessRequest(2, "textDocument/completion", CompletionParams{
+		TextDocument: TextDocumentIdentifier{URI: "file:///test.spq"},
+		Position:     Position{Line: 0, Character: 11},
+	})
+	if err != nil {
+		t.Fatalf("Completion failed: %v", err)
+	}
+	var list CompletionList
+	decodeResult(t, response, &list)
+	if len(list.Items) != 1 || list.Items[0].InsertText != "ceil(${1:value})" || list.Items[0].InsertTextFormat != InsertTextFormatSnippet {
+		t.Errorf("Expected a ceil snippet, got %+v", list.Items)
+	}
+}
+
+// === Completion resolve ===
+
+func TestCompletionLabelDetails(t *testing.T) {
+	item := completionItem(t, "values nulli", "nullif", 0, completionEnv{})
+	if item.LabelDetails == nil || item.LabelDetails.Detail != "(a: any, b: any)" || item.LabelDetails.Description != "any" {
+		t.Errorf("Expected parameters and result type beside the label, got %+v", item.LabelDetails)
+	}
+	if item.Documentation != nil {
+		t.Errorf("Expected documentation to be left to resolve, got %+v", item.Documentation)
+	}
+	item = completionItem(t, "from x | ", "sort", 0, completionEnv{})
+	if item.LabelDetails == nil || item.LabelDetails.Description != "operator" {
+		t.Errorf("Expected the kind beside the label, got %+v", item.LabelDetails)
+	}
+
+	items := completionsIn(parseSyntax("values "), Position{Line: 0, Character: 7}, completionEnv{})
+	for i := 1; i < len(items); i++ {
+		if items[i-1].SortText >= items[i].SortText {
+			t.Fatalf("Expected sortText to keep the offered order at %q and %q", items[i-1].Label, items[i].Label)
+		}
+	}
+}
+
+func TestCompletionFilterTextOfQuotedField(t *testing.T) {
+	env := completionEnv{fields: []sampleField{{path: []string{"user name"}}}}
+	item := completionItem(t, "values ", "`user name`", 0, env)
+	if item.FilterText != "user name" {
+		t.Errorf("Expected the unquoted name as filterText, got %q", item.FilterText)
+	}
+}
+
+func TestCompletionDeprecatedNames(t *testing.T) {
+	tests := []struct {
+		text, label, insert string
+	}{
+		{"values parse_z", "parse_zson", "parse_sup"},
+		{"from x | yi", "yield", "values"},
+		{"fu", "func", "fn"},
+	}
+	for _, tt := range tests {
+		item := completionItem(t, tt.text, tt.label, 0, completionEnv{})
+		if !item.Deprecated || len(item.Tags) != 1 || item.Tags[0] != CompletionItemTagDeprecated {
+			t.Errorf("Expected %q to be tagged deprecated, got %+v", tt.label, item)
+		}
+		if item.InsertText != tt.insert || item.FilterText != tt.label {
+			t.Errorf("Expected %q to insert %q, got %+v", tt.label, tt.insert, item)
+		}
+	}
+	// Current names aren't tagged
+	if item := completionItem(t, "values parse_s", "parse_sup", 0, completionEnv{}); item.Deprecated || item.Tags != nil {
+		t.Errorf("Expected parse_sup not to be deprecated, got %+v", item)
+	}
+}
+
+func TestResolveCompletion(t *testing.T) {
+	item := resolveCompletion(completionItem(t, "values ma", "max", 0, completionEnv{}))
+	if item.Documentation == nil || item.Documentation.Kind != MarkupKindMarkdown {
+		t.Fatalf("Expected markdown documentation, got %+v", item.Documentation)
+	}
+	doc := item.Documentation.Value
+	for _, want := range []string{
+		"max(value: number, ...) -> number\nmax(value: number) -> number",
+		"Return the maximum of the arguments",
+		"| Parameter | Description |",
+		"| `value` | Values to compare |",
+	} {
+		if !strings.Contains(doc, want) {
+			t.Errorf("Expected %q in documentation:\n%s", want, doc)
+		}
+	}
+
+	item = resolveCompletion(completionItem(t, "values parse_z", "parse_zson", 0, completionEnv{}))
+	if item.Documentation == nil || !strings.HasPrefix(item.Documentation.Value, "**Deprecated:** use `parse_sup`") {
+		t.Errorf("Expected a deprecation note, got %+v", item.Documentation)
+	}
+
+	item = resolveCompletion(completionItem(t, "from x | ", "fork (=> …)", CompletionItemKindSnippet, completionEnv{}))
+	if item.Documentation == nil || !strings.Contains(item.Documentation.Value, "fork (\n\t=> pass") {
+		t.Errorf("Expected the snippet body, got %+v", item.Documentation)
+	}
+
+	// Items without data resolve unchanged
+	plain := CompletionItem{Label: "asc", Kind: CompletionItemKindKeyword}
+	if got := resolveCompletion(plain); got.Documentation != nil {
+		t.Errorf("Expected no documentation, got %+v", got.Documentation)
+	}
+}
+
+func TestCompletionResolveHandler(t *testing.T) {
+	h := NewTestHelper()
+	if _, err := h.ProcessRequest(1, "initialize", InitializeParams{ProcessID: 1}); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	// The item comes back from the client as JSON
+	item := completionItem(t, "values nulli", "nullif", 0, completionEnv{})
+	response, err := h.ProcessRequest(2, "completionItem/resolve", item)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	resultBytes, err := json.Marshal(response.Result)
+	if err != nil {
+		t.Fatalf("Marshal result: %v", err)
+	}
+	var resolved CompletionItem
+	if err := json.Unmarshal(resultBytes, &resolved); err != nil {
+		t.Fatalf("Unmarshal item: %v", err)
+	}
+	if resolved.Label != "nullif" || resolved.Documentation == nil ||
+		!strings.Contains(resolved.Documentation.Value, "| `b` | Value to compare |") {
+		t.Errorf("Expected resolved documentation, got %+v", resolved)
+	}
+}
+
+// === Completion ranking ===
+
+// completionOrder returns the labels offered at the end of text, best first
+func completionOrder(text string) []string {
+	tree := parseSyntax(text)
+	var labels []string
+	for _, item := range completionsIn(tree, tree.PositionAt(len(text)), completionEnv{}) {
+		labels = append(labels, item.Label)
+	}
+	return labels
+}
+
+func indexOf(labels []string, label string) int {
+	for i, l := range labels {
+		if l == label {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestCompletionFuzzyMatch(t *testing.T) {
+	labels := completionOrder("values dp")
+	if len(labels) == 0 || labels[0] != "date_part" {
+		t.Errorf("Expected date_part first for dp, got %v", labels)
+	}
+	if indexOf(completionOrder("from x | sort "), "nulls first") < 0 {
+		t.Error("Expected sort orders with an empty word")
+	}
+	if labels := completionOrder("values zzq"); len(labels) != 0 {
+		t.Errorf("Expected no matches, got %v", labels)
+	}
+}
+
+func TestCompletionRanking(t *testing.T) {
+	// Names starting with the word come before other matches
+	labels := completionOrder("values co")
+	seenOther := false
+	for _, l := range labels {
+		if !strings.HasPrefix(l, "co") {
+			seenOther = true
+		} else if seenOther {
+			t.Fatalf("Expected prefix matches first, got %v", labels)
+		}
+	}
+
+	// Aggregates lead in summarize, functions elsewhere
+	if labels := completionOrder("summarize co"); indexOf(labels, "count") > indexOf(labels, "concat") {
+		t.Errorf("Expected count before concat in summarize, got %v", labels)
+	}
+	if labels := completionOrder("values co"); indexOf(labels, "concat") > indexOf(labels, "count") {
+		t.Errorf("Expected concat before count in values, got %v", labels)
+	}
+
+	// A name the document already uses ranks first
+	if labels := completionOrder("values collect(x) | values co"); labels[0] != "collect" {
+		t.Errorf("Expected collect first after its use, got %v", labels)
+	}
+	// Keywords aren't uses, aggregates aren't recent among grouping keys and
+	// a user function doesn't make the builtin it shadows recent
+	if labels := completionOrder("select * from t join u on "); len(labels) == 0 || labels[0] == "join" {
+		t.Errorf("Expected the join keyword not to rank the join function first, got %v", labels)
+	}
+	if labels := completionOrder("from x | summarize count() by "); len(labels) == 0 || labels[0] == "count" {
+		t.Errorf("Expected count not first among grouping keys, got %v", labels)
+	}
+	if labels := completionOrder("fn count(x): (x)\nvalues count(1) | values co"); indexOf(labels, "concat") > indexOf(labels, "count") {
+		t.Errorf("Expected the user count not to lift the builtin, got %v", labels)
+	}
+
+	// Deprecated names come after their replacements
+	if labels := completionOrder("values parse_"); indexOf(labels, "parse_sup") > indexOf(labels, "parse_zson") {
+		t.Errorf("Expected parse_sup before parse_zson, got %v", labels)
+	}
+
+	// The sort order leads once a key is complete, but not before one
+	labels = completionOrder("from a | sort x ")
+	if len(labels) < 4 || !reflect.DeepEqual(labels[:4], sortOrderKeywords) {
+		t.Errorf("Expected the sort orders first after a key, got %v", labels)
+	}
+	if labels := completionOrder("from a | sort "); indexOf(labels, "asc") < indexOf(labels, "abs") {
+		t.Errorf("Expected functions before the sort order without a key, got %v", labels)
+	}
+
+	// Clause keywords lead keyword operators after a complete expression
+	labels = completionOrder("select a ")
+	if len(labels) == 0 || labels[0] != "as" || indexOf(labels, "from") > indexOf(labels, "and") {
+		t.Errorf("Expected clause keywords first after select a, got %v", labels)
+	}
+}
+
+func TestCompletionListLimit(t *testing.T) {
+	var items []CompletionItem
+	for _, kind := range []BuiltinKind{KindKeyword, KindFunction, KindAggregate, KindType} {
+		items = append(items, getCompletionsByKind(kind, "", CompletionItemKindKeyword, "")...)
+	}
+	list := completionList(items)
+	if !list.IsIncomplete || len(list.Items) != completionLimit {
+		t.Errorf("Expected %d items marked incomplete, got %d incomplete=%v", completionLimit, len(list.Items), list.IsIncomplete)
+	}
+	list = completionList(items[:3])
+	if list.IsIncomplete || len(list.Items) != 3 {
+		t.Errorf("Expected a complete list of 3, got %d incomplete=%v", len(list.Items), list.IsIncomplete)
+	}
+}
+
+// === Parser AST ===
+
+func astID(name string, first, last int) *ast.ID {
+	return &ast.ID{Name: name, Loc: ast.Loc{First: first, Last: last}}
+}
+
+func TestSyntaxTreeFollowsParserStages(t *testing.T) {
+	text := "values a\nwhere x"
+	seq := ast.Seq{
+		&ast.Values{Exprs: []ast.Expr{astID("a", 7, 8)}, Loc: ast.Loc{First: 0, Last: 8}},
+		&ast.Where{Expr: astID("x", 15, 16), Loc: ast.Loc{First: 9, Last: 16}},
+	}
+	tree := newSyntaxTree(text, seq, nil)
+	if len(tree.Root.Children) != 1 || tree.Root.Children[0].Kind != NodePipeline {
+		t.Fatalf("Expected one pipeline, got %+v", tree.Root.Children)
+	}
+	stages := tree.Root.Children[0].Children
+	if len(stages) != 2 || stages[1].Kind != NodeStage || stages[1].Name() == nil || stages[1].Name().value != "where" {
+		t.Errorf("Expected the parser's values and where stages, got %d children", len(stages))
+	}
+}
+
+func TestSyntaxTreeFollowsParserCalls(t *testing.T) {
+	// A space after join reads as a join clause to the token rules
+	text := "values join (a, b)"
+	seq := ast.Seq{
+		&ast.Values{Exprs: []ast.Expr{
+			&ast.Call{
+				Func: astID("join", 7, 11),
+				Args: []ast.Expr{astID("a", 13, 14), astID("b", 16, 17)},
+				Loc:  ast.Loc{First: 7, Last: 18},
+			},
+		}, Loc: ast.Loc{First: 0, Last: 18}},
+	}
+	tree := newSyntaxTree(text, seq, nil)
+	if name, index := callContextAt(tree, 16); name != "join" || index != 1 {
+		t.Errorf("Expected join argument 1, got %q at %d", name, index)
+	}
+}
+
+func TestIndexASTNodeTypes(t *testing.T) {
+	text := "const c = 1\nop o(): (pass)\nvalues f(x => x)\n| o()"
+	at := func(s string) int { return strings.Index(text, s) }
+	seq := ast.Seq{
+		&ast.Values{Exprs: []ast.Expr{
+			&ast.Call{
+				Func: astID("f", at("f("), at("f(")+1),
+				Args: []ast.Expr{&ast.Lambda{Loc: ast.Loc{First: at("x =>"), Last: at("x)") + 1}}},
+				Loc:  ast.Loc{First: at("f("), Last: at("x)") + 2},
+			},
+		}, Loc: ast.Loc{First: at("values"), Last: at("x)") + 2}},
+		&ast.CallOp{Name: astID("o", at("o()"), at("o()")+1), Loc: ast.Loc{First: at("o()"), Last: len(text)}},
+	}
+	decls := []ast.Decl{
+		&ast.ConstDecl{Name: astID("c", 6, 7), Loc: ast.Loc{First: 0, Last: 11}},
+		&ast.OpDecl{Name: astID("o", at("o("), at("o(")+1), Loc: ast.Loc{First: at("op"), Last: at("values") - 1}},
+	}
+	idx := indexAST(tokenize(text), ast.Seq{&ast.Scope{Decls: decls, Body: seq, Loc: ast.Loc{First: 0, Last: len(text)}}})
+	if idx == nil {
+		t.Fatal("Expected an index")
+	}
+	if !idx.decls[0] || !idx.decls[at("op")] {
+		t.Errorf("Expected the const and op declarations, got %v", idx.decls)
+	}
+	if !idx.queries[at("values")] || !idx.stages[at("o()")] || idx.queries[at("o()")] {
+		t.Errorf("Expected values to start the query and o() to follow it, got %v and %v", idx.queries, idx.stages)
+	}
+	if !idx.calls[at("f(")] || !idx.calls[at("o()")] {
+		t.Errorf("Expected the call of f and the operator call, got %v", idx.calls)
+	}
+	if !idx.lambdas[at("x =>")] {
+		t.Errorf("Expected the lambda, got %v", idx.lambdas)
+	}
+}
+
+func TestIndexASTWithoutPositions(t *testing.T) {
+	if idx := indexAST(tokenize("from a"), struct{ Body []string }{[]string{"x"}}); idx != nil {
+		t.Errorf("Expected no index for a result that isn't an ast.Seq, got %+v", idx)
+	}
+	// A parsed query keeps the parser's structure even without nodes
+	if idx := indexAST(tokenize("from a"), ast.Seq{&ast.Where{}}); idx == nil || len(idx.stages) != 0 {
+		t.Errorf("Expected an empty index for nodes without positions, got %+v", idx)
+	}
+	// A failed parse leaves the tree to the token rules
+	tree := newSyntaxTree("values len(", nil, fmt.Errorf("syntax error"))
+	if tree.ParseError() == nil {
+		t.Error("Expected the parse error to be kept")
+	}
+	if name, _ := callContextAt(tree, len(tree.Text)); name != "len" {
+		t.Errorf("Expected len from the token rules, got %q", name)
+	}
+}
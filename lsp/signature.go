@@ -1,18 +1,49 @@
 package main
 
 import (
+	"fmt"
 	"strings"
+
+	"github.com/superdb/superdb-lsp/lsp/sigparse"
 )
 
-// getSignatureHelp returns signature help for the current position
-func getSignatureHelp(text string, pos Position) *SignatureHelp {
+// signature is one form of a callable's signature, with the byte offsets
+// of each parameter in its label
+type signature struct {
+	label    string
+	doc      string
+	params   []signatureParam
+	variadic bool // The last parameter repeats
+}
+
+type signatureParam struct {
+	name       string
+	doc        string
+	start, end int
+}
+
+// signatureHelpAt returns signature help for the cursor position in a
+// parsed document: the forms of the builtin, or the user-declared function
+// or operator, whose argument list holds the cursor
+func signatureHelpAt(tree *SyntaxTree, pos Position) *SignatureHelp {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+
 	// Find the function call context
-	funcName, paramIndex := findFunctionContext(text, pos)
-	if funcName == "" {
+	call, paramIndex := callAt(tree, offset)
+	if call == nil {
 		return nil
 	}
 
-	b := Builtins.Lookup(funcName)
+	name := call.Name()
+	if sym := tree.Symbols().refs[name]; sym != nil && sym.Kind.callable() {
+		sig := parseSignature(declSignature(tree, sym.Decl), nil)
+		return buildSignatureHelp([]signature{sig}, argCount(call, paramIndex), paramIndex)
+	}
+
+	b := Builtins.Lookup(name.value)
 	if b == nil || (b.Kind != KindFunction && b.Kind != KindAggregate) {
 		return nil
 	}
@@ -21,148 +52,168 @@ func getSignatureHelp(text string, pos Position) *SignatureHelp {
 		return nil
 	}
 
-	return buildSignatureHelp(b, paramIndex)
+	return buildSignatureHelp(builtinSignatures(b), argCount(call, paramIndex), paramIndex)
 }
 
-// buildSignatureHelp creates a SignatureHelp from a Builtin
-func buildSignatureHelp(b *Builtin, activeParam int) *SignatureHelp {
-	params := make([]ParameterInformation, len(b.Parameters))
-
-	// Calculate parameter label offsets
-	labelOffset := strings.Index(b.Signature, "(") + 1
-	currentOffset := labelOffset
-
-	for i, p := range b.Parameters {
-		// Find this parameter in the label
-		paramStart := strings.Index(b.Signature[currentOffset:], p.Name)
-		if paramStart == -1 {
-			continue
-		}
-		paramStart += currentOffset
-
-		// Find the end of this parameter (comma or closing paren)
-		paramEnd := paramStart + len(p.Name)
-		for paramEnd < len(b.Signature) && b.Signature[paramEnd] != ',' && b.Signature[paramEnd] != ')' {
-			paramEnd++
-		}
-
-		params[i] = ParameterInformation{
-			Label: [2]int{paramStart, paramEnd},
-			Documentation: &MarkupContent{
-				Kind:  MarkupKindPlainText,
-				Value: p.Doc,
-			},
-		}
-
-		currentOffset = paramEnd + 1
+// replaceNullActiveParameter replaces a null active parameter, which only
+// clients advertising noActiveParameterSupport accept, with the index past
+// the active signature's last parameter
+func (h *SignatureHelp) replaceNullActiveParameter() {
+	if h.ActiveParameter != nil || len(h.Signatures) == 0 {
+		return
 	}
+	past := len(h.Signatures[h.ActiveSignature].Parameters)
+	h.ActiveParameter = &past
+}
 
-	if activeParam >= len(params) {
-		activeParam = len(params) - 1
+// workspaceSignatureHelp returns signature help for a call to a function
+// or operator declared in other workspace files
+func workspaceSignatureHelp(tree *SyntaxTree, pos Position, lookup func(name string) []indexedSymbol, roots []string) *SignatureHelp {
+	offset := tree.OffsetAt(pos)
+	if tree.InCommentOrString(offset) {
+		return nil
+	}
+	call, paramIndex := callAt(tree, offset)
+	if call == nil {
+		return nil
 	}
-	if activeParam < 0 {
-		activeParam = 0
+	name := call.Name()
+	if !tree.Symbols().IsUnresolvedCall(name) || Builtins.Lookup(name.value) != nil {
+		return nil
+	}
+	var sigs []signature
+	for _, def := range lookup(name.value) {
+		sig := parseSignature(def.Signature, nil)
+		sig.doc = fmt.Sprintf("Defined in %s", displayPath(def.Location.URI, roots))
+		sigs = append(sigs, sig)
 	}
+	if len(sigs) == 0 {
+		return nil
+	}
+	return buildSignatureHelp(sigs, argCount(call, paramIndex), paramIndex)
+}
 
+// builtinSignatures expands a builtin's signature and overloads into one
+// form per arity: each optional trailing parameter adds a form
+func builtinSignatures(b *Builtin) []signature {
+	docs := make(map[string]string)
+	for _, p := range b.Parameters {
+		docs[p.Name] = p.Doc
+	}
 	doc := b.Doc
 	if doc == "" {
 		doc = b.Brief
 	}
 
-	return &SignatureHelp{
-		Signatures: []SignatureInformation{
-			{
-				Label: b.Signature,
-				Documentation: &MarkupContent{
-					Kind:  MarkupKindPlainText,
-					Value: doc,
-				},
-				Parameters: params,
-			},
-		},
-		ActiveSignature: 0,
-		ActiveParameter: activeParam,
+	var sigs []signature
+	for _, form := range append([]string{b.Signature}, b.Overloads...) {
+		prefix, params, suffix := sigparse.Split(form)
+		required := len(params)
+		for i, p := range params {
+			if strings.Contains(sigparse.ParamName(p), "?") {
+				required = i
+				break
+			}
+		}
+		for n := required; n <= len(params); n++ {
+			if n > required && params[n-1] == "..." {
+				break // "..." repeats a parameter rather than being one
+			}
+			label := prefix + "(" + strings.ReplaceAll(strings.Join(params[:n], ", "), "?", "") + ")" + suffix
+			sig := parseSignature(label, docs)
+			sig.doc = doc
+			sigs = append(sigs, sig)
+		}
 	}
+	return sigs
 }
 
-// findFunctionContext finds the function name and parameter index at position
-func findFunctionContext(text string, pos Position) (string, int) {
-	lines := strings.Split(text, "\n")
-	if pos.Line >= len(lines) {
-		return "", 0
-	}
-
-	// Get text up to cursor position
-	var textToCursor strings.Builder
-	for i := 0; i <= pos.Line && i < len(lines); i++ {
-		if i == pos.Line {
-			if pos.Character <= len(lines[i]) {
-				textToCursor.WriteString(lines[i][:pos.Character])
-			} else {
-				textToCursor.WriteString(lines[i])
-			}
-		} else {
-			textToCursor.WriteString(lines[i])
-			textToCursor.WriteByte('\n')
+// parseSignature finds the parameters of a signature label, looking up
+// their documentation by name
+func parseSignature(label string, docs map[string]string) signature {
+	sig := signature{label: label}
+	prefix, params, _ := sigparse.Split(label)
+	offset := len(prefix) + 1
+	for _, p := range params {
+		start := offset + strings.Index(label[offset:], p)
+		offset = start + len(p)
+		if p == "..." {
+			sig.variadic = len(sig.params) > 0
+			continue
 		}
+		name := sigparse.ParamName(p)
+		sig.params = append(sig.params, signatureParam{name: name, doc: docs[name], start: start, end: offset})
 	}
+	return sig
+}
 
-	content := textToCursor.String()
-
-	// Walk backward to find matching open paren
-	parenDepth := 0
-	funcEnd := -1
+// argCount returns the number of arguments of a call, counting the one
+// being typed after a trailing comma
+func argCount(call *Node, paramIndex int) int {
+	return max(len(callArgs(call)), paramIndex+1)
+}
 
-	for i := len(content) - 1; i >= 0; i-- {
-		ch := content[i]
-		switch ch {
-		case ')':
-			parenDepth++
-		case '(':
-			if parenDepth == 0 {
-				funcEnd = i
-				break
-			}
-			parenDepth--
+// selectSignature picks the first form that takes the call's arguments,
+// preferring fixed arities to variadic forms. It returns the form and the
+// parameter to highlight, or -1 for the last form when the call has more
+// arguments than any form takes.
+func selectSignature(sigs []signature, args, paramIndex int) (int, int) {
+	for i, sig := range sigs {
+		if !sig.variadic && args <= len(sig.params) && paramIndex < len(sig.params) {
+			return i, paramIndex
 		}
-		if funcEnd >= 0 {
-			break
+	}
+	for i, sig := range sigs {
+		if sig.variadic {
+			return i, min(paramIndex, len(sig.params)-1)
 		}
 	}
+	return len(sigs) - 1, -1
+}
 
-	if funcEnd < 0 {
-		return "", 0
+// buildSignatureHelp creates a SignatureHelp from the forms of a callable
+func buildSignatureHelp(sigs []signature, args, paramIndex int) *SignatureHelp {
+	active, activeParam := selectSignature(sigs, args, paramIndex)
+	help := &SignatureHelp{ActiveSignature: active}
+	if activeParam >= 0 {
+		help.ActiveParameter = &activeParam
 	}
-
-	// Extract function name
-	funcStart := funcEnd - 1
-	for funcStart >= 0 && isIdentifierChar(content[funcStart]) {
-		funcStart--
+	for _, sig := range sigs {
+		info := SignatureInformation{Label: sig.label, Parameters: []ParameterInformation{}}
+		if sig.doc != "" {
+			info.Documentation = &MarkupContent{Kind: MarkupKindPlainText, Value: sig.doc}
+		}
+		for _, p := range sig.params {
+			param := ParameterInformation{Label: [2]int{p.start, p.end}}
+			if p.doc != "" {
+				param.Documentation = &MarkupContent{Kind: MarkupKindPlainText, Value: p.doc}
+			}
+			info.Parameters = append(info.Parameters, param)
+		}
+		help.Signatures = append(help.Signatures, info)
 	}
-	funcStart++
+	return help
+}
 
-	if funcStart >= funcEnd {
-		return "", 0
+// callAt finds the call whose argument list holds the offset and the index
+// of the argument the offset is in. Only the innermost parentheses count:
+// a cursor in a bare "(" group has no call context.
+func callAt(tree *SyntaxTree, offset int) (*Node, int) {
+	g := tree.EnclosingGroup(offset)
+	for g != nil && g.leafAt(0).value != "(" {
+		g = enclosingGroupOf(g)
+	}
+	if g == nil || g.Parent.Kind != NodeCall {
+		return nil, 0
 	}
 
-	funcName := content[funcStart:funcEnd]
-
-	// Count commas to determine parameter index
+	// Count the group's own commas before the cursor
 	paramIndex := 0
-	parenDepth = 0
-	for i := funcEnd + 1; i < len(content); i++ {
-		ch := content[i]
-		switch ch {
-		case '(':
-			parenDepth++
-		case ')':
-			parenDepth--
-		case ',':
-			if parenDepth == 0 {
-				paramIndex++
-			}
+	for _, c := range g.Children {
+		if c.Kind == NodeToken && c.Tok.value == "," && c.End <= offset {
+			paramIndex++
 		}
 	}
 
-	return funcName, paramIndex
+	return g.Parent, paramIndex
 }
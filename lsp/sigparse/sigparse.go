@@ -0,0 +1,50 @@
+// Package sigparse splits the signature labels of builtins.go, such as
+// "log(value: number, base?: number) -> float64", into their parts.
+// The language server reads parameters from them and the gen-builtins
+// script derives arities from them, so both share this one parser.
+package sigparse
+
+import "strings"
+
+// Split splits a signature into the text before its parameter list, the
+// parameters, and the text after the list. Commas inside brackets, as in
+// "r: {a:int64,b:string}", don't separate parameters. A label without a
+// complete parameter list is all prefix.
+func Split(label string) (string, []string, string) {
+	open := strings.Index(label, "(")
+	if open < 0 {
+		return label, nil, ""
+	}
+	var params []string
+	depth, start := 0, open+1
+	for i := open + 1; i < len(label); i++ {
+		switch label[i] {
+		case '(', '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				params = append(params, strings.TrimSpace(label[start:i]))
+				start = i + 1
+			}
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if p := strings.TrimSpace(label[start:i]); p != "" {
+				params = append(params, p)
+			}
+			return label[:open], params, label[i+1:]
+		}
+	}
+	return label, nil, ""
+}
+
+// ParamName returns the name of a "name: type" parameter, keeping the "?"
+// of an optional one
+func ParamName(p string) string {
+	name, _, _ := strings.Cut(p, ":")
+	return strings.TrimSpace(name)
+}
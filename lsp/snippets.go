@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// snippets.go - Snippet completions for common query constructs and for
+// builtin calls. Clients without snippet support get the same text with
+// each placeholder replaced by its default.
+
+// snippet is a template for a construct with ${n:default} placeholders
+type snippet struct {
+	label  string
+	detail string
+	body   string
+	stage  bool // Starts a pipeline stage as well as a statement
+}
+
+// snippetLibrary holds the construct templates in the order offered. Labels
+// differ from the keywords and operators they start, so a list holding both
+// tells them apart.
+var snippetLibrary = []snippet{
+	{"summarize by", "aggregate grouped by key", "summarize ${1:count()} by ${2:key}", true},
+	{"join on", "join with a subquery", "join (${1:from right}) on left.${2:x}=right.${3:y}", true},
+	{"switch (case …)", "route values to branches", "switch (\n\tcase ${1:condition} => ${2:pass}\n\tdefault => ${3:pass}\n)", true},
+	{"fork (=> …)", "copy values to branches", "fork (\n\t=> ${1:pass}\n\t=> ${2:pass}\n)", true},
+	{"select … from", "SQL query", "select ${1:*}\nfrom ${2:source}\nwhere ${3:true}", true},
+	{"select … group by", "SQL aggregation", "select ${1:key}, ${2:count()}\nfrom ${3:source}\ngroup by ${1:key}", true},
+	{"fn name(args)", "function declaration", "fn ${1:name}(${2:args}): (\n\t${3:expr}\n)", false},
+	{"op name(args)", "operator declaration", "op ${1:name}(${2:args}): (\n\t${3:pass}\n)", false},
+}
+
+// getSnippetCompletions returns the construct snippets that may start a
+// statement, or only those that start a stage
+func getSnippetCompletions(prefix string, statement, snippets bool) []CompletionItem {
+	var items []CompletionItem
+	for _, s := range snippetLibrary {
+		if !statement && !s.stage {
+			continue
+		}
+		if matchesWord(prefix, s.label) {
+			item := CompletionItem{
+				Label:  s.label,
+				Kind:   CompletionItemKindSnippet,
+				Detail: s.detail,
+				Data:   &completionData{Snippet: s.label},
+			}
+			setInsertSnippet(&item, s.body, snippets)
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// callSnippet returns a call of a builtin with a placeholder for each
+// parameter of its shortest form
+func callSnippet(b *Builtin) string {
+	var names []string
+	if b.Signature != "" {
+		for _, p := range builtinSignatures(b)[0].params {
+			names = append(names, p.name)
+		}
+	} else {
+		for _, p := range b.Parameters {
+			names = append(names, p.Name)
+		}
+	}
+	args := make([]string, len(names))
+	for i, name := range names {
+		args[i] = fmt.Sprintf("${%d:%s}", i+1, name)
+	}
+	return b.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// setInsertSnippet sets an item's insert text to a snippet, or to its
+// plain text when the client doesn't support snippets
+func setInsertSnippet(item *CompletionItem, body string, snippets bool) {
+	if snippets {
+		item.InsertText = body
+		item.InsertTextFormat = InsertTextFormatSnippet
+		return
+	}
+	item.InsertText = plainSnippet(body)
+	item.InsertTextFormat = InsertTextFormatPlainText
+}
+
+var placeholder = regexp.MustCompile(`\$\{\d+:([^}]*)\}|\$\d+`)
+
+// plainSnippet replaces the placeholders of a snippet with their defaults
+func plainSnippet(body string) string {
+	return placeholder.ReplaceAllString(body, "$1")
+}
@@ -0,0 +1,401 @@
+package main
+
+import "strings"
+
+// symbols.go - Scope-aware resolution of user-declared symbols.
+// Declarations (const, fn, op, type, let) are visible throughout the script
+// that declares them, including nested operator bodies and subqueries.
+// Function and operator parameters are visible in the declaration body, and
+// lambda parameters in the lambda body. Identifiers that resolve to nothing
+// are field references or builtins.
+
+// SymbolKind identifies what declared a symbol
+type SymbolKind int
+
+const (
+	SymbolConst SymbolKind = iota
+	SymbolFunc
+	SymbolOp
+	SymbolType
+	SymbolLet
+	SymbolParam
+)
+
+// String returns the keyword used to describe the symbol kind
+func (k SymbolKind) String() string {
+	switch k {
+	case SymbolConst:
+		return "const"
+	case SymbolFunc:
+		return "fn"
+	case SymbolOp:
+		return "op"
+	case SymbolType:
+		return "type"
+	case SymbolLet:
+		return "let"
+	default:
+		return "param"
+	}
+}
+
+// callable reports whether symbols of this kind are invoked with arguments
+func (k SymbolKind) callable() bool {
+	return k == SymbolFunc || k == SymbolOp
+}
+
+// Symbol is a user-declared name
+type Symbol struct {
+	Name  string
+	Kind  SymbolKind
+	Tok   *token // Defining occurrence
+	Decl  *Node  // Declaring NodeDecl or NodeLambda
+	Scope *Scope
+}
+
+// Scope holds the symbols declared by a script, declaration body or lambda
+type Scope struct {
+	Node    *Node
+	Parent  *Scope
+	Symbols map[string][]*Symbol
+}
+
+func newScope(n *Node, parent *Scope) *Scope {
+	return &Scope{Node: n, Parent: parent, Symbols: make(map[string][]*Symbol)}
+}
+
+// lookup resolves a name in this scope or an enclosing one. Calls only see
+// functions and operators; other references see everything else, plus
+// operators used as a pipeline stage.
+func (s *Scope) lookup(name string, call bool) *Symbol {
+	for ; s != nil; s = s.Parent {
+		for _, sym := range s.Symbols[name] {
+			if sym.Kind.callable() == call || (!call && sym.Kind == SymbolOp) {
+				return sym
+			}
+		}
+	}
+	return nil
+}
+
+// Symbols is the result of resolving every identifier in a syntax tree
+type Symbols struct {
+	All    []*Symbol
+	defs   map[*token]*Symbol
+	refs   map[*token]*Symbol
+	scopes map[*Node]*Scope
+	fields map[*token]bool // Top-level field references
+	writes map[*token]bool // Fields assigned with :=
+	calls  map[*token]bool // Calls to functions and operators not declared here
+}
+
+// Symbols returns the document's resolved symbols, analyzing it on first use
+func (t *SyntaxTree) Symbols() *Symbols {
+	t.symbolsOnce.Do(func() {
+		t.symbols = resolveSymbols(t)
+	})
+	return t.symbols
+}
+
+// resolveSymbols declares and resolves every symbol in a tree
+func resolveSymbols(tree *SyntaxTree) *Symbols {
+	s := &Symbols{
+		defs:   make(map[*token]*Symbol),
+		refs:   make(map[*token]*Symbol),
+		scopes: make(map[*Node]*Scope),
+		fields: make(map[*token]bool),
+		writes: make(map[*token]bool),
+		calls:  make(map[*token]bool),
+	}
+	s.walk(tree.Root, nil)
+	return s
+}
+
+// At returns the symbol defined or referenced by the token under a cursor
+func (s *Symbols) At(tree *SyntaxTree, offset int) (*Symbol, *token) {
+	tok := tree.WordAt(offset)
+	if tok == nil {
+		return nil, nil
+	}
+	if sym, ok := s.defs[tok]; ok {
+		return sym, tok
+	}
+	if sym, ok := s.refs[tok]; ok {
+		return sym, tok
+	}
+	return nil, tok
+}
+
+// References returns every reference to a symbol in document order,
+// optionally including its declaration
+func (s *Symbols) References(tree *SyntaxTree, sym *Symbol, includeDecl bool) []*token {
+	var toks []*token
+	for i := range tree.Tokens {
+		tok := &tree.Tokens[i]
+		if s.refs[tok] == sym || (includeDecl && s.defs[tok] == sym) {
+			toks = append(toks, tok)
+		}
+	}
+	return toks
+}
+
+// Fields returns every top-level reference to a field in document order.
+// Fields are not scoped: each use of the name refers to the same field of
+// the input, except where a declaration or parameter shadows it.
+func (s *Symbols) Fields(tree *SyntaxTree, name string) []*token {
+	var toks []*token
+	for i := range tree.Tokens {
+		tok := &tree.Tokens[i]
+		if s.fields[tok] && tok.value == name {
+			toks = append(toks, tok)
+		}
+	}
+	return toks
+}
+
+// IsField reports whether a token is a top-level field reference
+func (s *Symbols) IsField(tok *token) bool {
+	return s.fields[tok]
+}
+
+// IsWrite reports whether a token is assigned to, either as a declaration
+// or as the target of :=
+func (s *Symbols) IsWrite(tok *token) bool {
+	_, decl := s.defs[tok]
+	return decl || s.writes[tok]
+}
+
+// IsUnresolvedCall reports whether a token names a function or operator
+// that is neither declared in the document nor in scope where it is called.
+// It may be a builtin or be declared in another workspace file.
+func (s *Symbols) IsUnresolvedCall(tok *token) bool {
+	return s.calls[tok]
+}
+
+// ScopeAt returns the innermost scope containing an offset
+func (s *Symbols) ScopeAt(tree *SyntaxTree, offset int) *Scope {
+	for n := tree.NodeAt(offset); n != nil; n = n.Parent {
+		if scope, ok := s.scopes[n]; ok {
+			return scope
+		}
+	}
+	return nil
+}
+
+func (s *Symbols) define(scope *Scope, name *token, kind SymbolKind, decl *Node) {
+	if name == nil || name.typ != tokIdentifier {
+		return
+	}
+	sym := &Symbol{Name: name.value, Kind: kind, Tok: name, Decl: decl, Scope: scope}
+	scope.Symbols[sym.Name] = append(scope.Symbols[sym.Name], sym)
+	s.defs[name] = sym
+	s.All = append(s.All, sym)
+}
+
+// declKinds maps declaration keywords to the symbols they declare
+var declKinds = map[string]SymbolKind{
+	"const": SymbolConst,
+	"fn":    SymbolFunc,
+	"func":  SymbolFunc,
+	"op":    SymbolOp,
+	"type":  SymbolType,
+	"let":   SymbolLet,
+}
+
+func (s *Symbols) walk(n *Node, scope *Scope) {
+	switch n.Kind {
+	case NodeScript:
+		// Declarations are visible throughout their script, even before
+		// the point where they are declared
+		scope = newScope(n, scope)
+		s.scopes[n] = scope
+		for _, c := range n.Children {
+			if kind, ok := declKinds[c.Keyword()]; ok && c.Kind == NodeDecl {
+				s.define(scope, c.Name(), kind, c)
+			}
+		}
+
+	case NodeDecl:
+		switch n.Keyword() {
+		case "fn", "func", "op":
+			body := newScope(n, scope)
+			s.scopes[n] = body
+			if len(n.Children) > 2 && n.Children[2].Kind == NodeGroup {
+				for _, param := range paramNames(n.Children[2]) {
+					s.define(body, param, SymbolParam, n)
+				}
+			}
+			for _, c := range n.Children[min(3, len(n.Children)):] {
+				s.walk(c, body)
+			}
+			return
+		}
+		for _, c := range n.Children[min(2, len(n.Children)):] {
+			s.walk(c, scope)
+		}
+		return
+
+	case NodeLambda:
+		body := newScope(n, scope)
+		s.scopes[n] = body
+		for _, c := range n.Children[1:] {
+			if c.Kind == NodeGroup {
+				for _, param := range paramNames(c) {
+					s.define(body, param, SymbolParam, n)
+				}
+			} else if c.Kind == NodeToken && c.Tok.typ == tokIdentifier {
+				// Only parameters precede the ":", and the body is an Expr
+				s.define(body, c.Tok, SymbolParam, n)
+			}
+		}
+		for _, c := range n.Children {
+			if c.Kind == NodeExpr {
+				s.walk(c, body)
+			}
+		}
+		return
+
+	case NodeToken:
+		s.resolve(n, scope)
+		return
+	}
+
+	for _, c := range n.Children {
+		s.walk(c, scope)
+	}
+}
+
+// paramNames returns the parameter names in a declaration's parameter list
+func paramNames(params *Node) []*token {
+	var names []*token
+	for _, c := range params.Children {
+		if c.Kind == NodeExpr {
+			if t := c.leafAt(0); t != nil && t.typ == tokIdentifier {
+				names = append(names, t)
+			}
+		}
+	}
+	return names
+}
+
+// resolve links an identifier to the symbol it names. Identifiers that
+// name nothing are top-level field references.
+func (s *Symbols) resolve(n *Node, scope *Scope) {
+	tok := n.Tok
+	if tok.typ != tokIdentifier || scope == nil || isMemberName(n) {
+		return
+	}
+	if isAssignTarget(n) {
+		// The left side of := always names an output field
+		s.fields[tok] = true
+		s.writes[tok] = true
+		return
+	}
+	call := isCallee(n)
+	if sym := scope.lookup(tok.value, call); sym != nil {
+		s.refs[tok] = sym
+	} else if call {
+		s.calls[tok] = true
+	} else if !isOperatorWord(n) {
+		s.fields[tok] = true
+	}
+}
+
+// isCallee reports whether an identifier names the function or operator
+// being invoked, as in "name(args)" or "call name"
+func isCallee(n *Node) bool {
+	parent := n.Parent
+	if parent == nil || childIndex(n) != 0 {
+		return false
+	}
+	if parent.Kind == NodeCall {
+		return true
+	}
+	return parent.Kind == NodeExpr && len(parent.Children) == 1 && isCallStageArg(parent)
+}
+
+// isCallStageArg reports whether an expression is the operand of a "call"
+// stage
+func isCallStageArg(expr *Node) bool {
+	stage := expr.Parent
+	if stage == nil || stage.Kind != NodeStage || childIndex(expr) != 1 {
+		return false
+	}
+	head := stage.leafAt(0)
+	return head != nil && strings.EqualFold(head.value, "call")
+}
+
+// stageCallee returns the operator a stage invokes when it isn't a builtin
+// operator: the name in a stage such as "name(args)" or "call name"
+func stageCallee(stage *Node) *token {
+	if len(stage.Children) == 0 {
+		return nil
+	}
+	expr := stage.Children[len(stage.Children)-1]
+	if expr.Kind != NodeExpr || len(expr.Children) != 1 {
+		return nil
+	}
+	callee := expr.Children[0]
+	switch {
+	case callee.Kind == NodeCall && len(stage.Children) == 1:
+		callee = callee.Children[0]
+	case callee.Kind == NodeToken && isCallStageArg(expr):
+	default:
+		return nil
+	}
+	if callee.Kind != NodeToken || callee.Tok.typ != tokIdentifier {
+		return nil
+	}
+	return callee.Tok
+}
+
+// isOperatorWord reports whether an unresolved identifier is part of the
+// query syntax, such as a stage operator name or a clause keyword
+func isOperatorWord(n *Node) bool {
+	if clauseKeywords[strings.ToLower(n.Tok.value)] {
+		return true
+	}
+	return n.Parent.Kind == NodeStage && childIndex(n) == 0 && isStageOperator(n.Tok)
+}
+
+// childIndex returns the position of n among its parent's children
+func childIndex(n *Node) int {
+	if n.Parent != nil {
+		for i, c := range n.Parent.Children {
+			if c == n {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isMemberName reports whether an identifier names a nested field rather
+// than a variable: a path element after a dot, or a key in a record literal
+func isMemberName(n *Node) bool {
+	parent, idx := n.Parent, childIndex(n)
+	if parent == nil {
+		return false
+	}
+	if parent.Kind == NodePath && idx > 0 {
+		return true
+	}
+	// Record keys: {key: value}
+	if next := parent.leafAt(idx + 1); next != nil && next.value == ":" && parent.Kind == NodeExpr {
+		if g := parent.Parent; g != nil && g.Kind == NodeGroup {
+			open := g.leafAt(0)
+			return open != nil && strings.HasPrefix(open.value, "{")
+		}
+	}
+	return false
+}
+
+// isAssignTarget reports whether an identifier, or the path it starts, is
+// assigned to with :=
+func isAssignTarget(n *Node) bool {
+	if n.Parent != nil && n.Parent.Kind == NodePath && childIndex(n) == 0 {
+		n = n.Parent
+	}
+	next := n.Parent.leafAt(childIndex(n) + 1)
+	return next != nil && next.value == ":="
+}
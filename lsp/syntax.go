@@ -0,0 +1,919 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/brimdata/super/compiler/parser"
+)
+
+// syntax.go - Per-version syntax tree shared by every language feature.
+// The tree records where each declaration, pipeline, call and bracket
+// starts and ends, so completion, hover, signature help, code actions and
+// formatting all agree on what is under the cursor. Its leaves are the
+// formatter's tokens. When the brimdata/super parser accepts the document,
+// the parser's AST decides where each construct starts (see
+// syntax_ast.go); otherwise token rules do, so the tree is error tolerant:
+// unterminated brackets and strings still produce nodes that run to the
+// end of the document.
+
+// NodeKind identifies the syntactic role of a Node
+type NodeKind int
+
+const (
+	NodeScript   NodeKind = iota // Declarations and queries of a document or subquery
+	NodeDecl                     // const, fn, func, op, type, let or pragma declaration
+	NodePipeline                 // Stages separated by | or |>
+	NodeStage                    // One operator or SQL statement within a pipeline
+	NodeExpr                     // One comma-separated expression
+	NodeCall                     // Call of a function or user operator: name(args)
+	NodeGroup                    // Bracketed (), [] or {} contents, including call arguments
+	NodeBranch                   // fork or switch branch: [case expr] => pipeline
+	NodeLambda                   // lambda x: expr or fn x, y: expr
+	NodePath                     // Dotted field path: a.b.c
+	NodeToken                    // A single significant token
+)
+
+// Node is an element of the syntax tree. Start and End are byte offsets.
+type Node struct {
+	Kind     NodeKind
+	Start    int
+	End      int
+	Tok      *token // Set for NodeToken
+	Parent   *Node
+	Children []*Node
+}
+
+// add appends a child, extending the node to cover it. Empty interior
+// nodes are dropped so every node spans at least one token.
+func (n *Node) add(child *Node) {
+	if child == nil || (child.Kind != NodeToken && len(child.Children) == 0) {
+		return
+	}
+	if len(n.Children) == 0 {
+		n.Start = child.Start
+	}
+	n.End = child.End
+	child.Parent = n
+	n.Children = append(n.Children, child)
+}
+
+// leafAt returns the token of the i-th child if that child is a token
+func (n *Node) leafAt(i int) *token {
+	if i < 0 || i >= len(n.Children) || n.Children[i].Kind != NodeToken {
+		return nil
+	}
+	return n.Children[i].Tok
+}
+
+// Name returns the token naming a call, declaration or stage operator
+func (n *Node) Name() *token {
+	switch n.Kind {
+	case NodeCall, NodeStage:
+		return n.leafAt(0)
+	case NodeDecl:
+		return n.leafAt(1)
+	}
+	return nil
+}
+
+// Keyword returns the lowercased declaration keyword (const, fn, op, ...)
+func (n *Node) Keyword() string {
+	if n.Kind != NodeDecl {
+		return ""
+	}
+	if t := n.leafAt(0); t != nil {
+		return strings.ToLower(t.value)
+	}
+	return ""
+}
+
+// Closed reports whether a group ends with its matching closing bracket
+func (n *Node) Closed() bool {
+	if n.Kind != NodeGroup || len(n.Children) < 2 {
+		return false
+	}
+	open, last := n.leafAt(0), n.leafAt(len(n.Children)-1)
+	return open != nil && last != nil && last.value == closerOf(open.value)
+}
+
+// Interior reports whether an offset lies between a group's brackets
+func (n *Node) Interior(offset int) bool {
+	if n.Kind != NodeGroup || offset < n.Start+1 {
+		return false
+	}
+	if n.Closed() {
+		return offset < n.End
+	}
+	return offset <= n.End
+}
+
+// SyntaxTree is the parsed form of one version of a document
+type SyntaxTree struct {
+	Text   string
+	Tokens []token
+	Root   *Node
+
+	lines *rope // Line offsets for converting LSP positions
+
+	err error // The brimdata/super parser's error
+
+	symbolsOnce sync.Once
+	symbols     *Symbols
+}
+
+// parseSyntax parses text with the brimdata/super parser and builds its
+// syntax tree from the parser's AST and the tokens
+func parseSyntax(text string) *SyntaxTree {
+	ast, err := parser.Parse("", []byte(text))
+	return newSyntaxTree(text, ast, err)
+}
+
+// newSyntaxTree builds the syntax tree of text from the parser's result
+func newSyntaxTree(text string, ast interface{}, err error) *SyntaxTree {
+	t := &SyntaxTree{
+		Text:   text,
+		Tokens: tokenize(text),
+		lines:  newRope(text),
+	}
+
+	p := &syntaxParser{toks: t.Tokens, textLen: len(text)}
+	if t.err = err; err == nil {
+		p.ast = indexAST(t.Tokens, ast)
+	}
+	for i := range t.Tokens {
+		switch t.Tokens[i].typ {
+		case tokWhitespace, tokNewline, tokComment:
+		default:
+			p.sig = append(p.sig, i)
+		}
+	}
+
+	root := &Node{Kind: NodeScript}
+	ctx := parseCtx{script: true}
+	for {
+		p.parseStatements(root, ctx)
+		if p.tok(0) == nil {
+			break
+		}
+		// Unmatched closing bracket at the top level
+		root.add(p.leaf())
+	}
+	root.Start, root.End = 0, len(text)
+	t.Root = root
+	return t
+}
+
+// ParseError returns the brimdata/super parser's error for the document,
+// or nil if it parses
+func (t *SyntaxTree) ParseError() error {
+	return t.err
+}
+
+// OffsetAt converts an LSP position (UTF-16 code units) into a byte offset.
+// Positions past the end of a line or the document are clamped.
+func (t *SyntaxTree) OffsetAt(pos Position) int {
+	return t.lines.OffsetAt(pos)
+}
+
+// PositionAt converts a byte offset into an LSP position (UTF-16 code units)
+func (t *SyntaxTree) PositionAt(offset int) Position {
+	return t.lines.PositionAt(offset)
+}
+
+// Range converts a pair of byte offsets into an LSP range
+func (t *SyntaxTree) Range(start, end int) Range {
+	return Range{Start: t.PositionAt(start), End: t.PositionAt(end)}
+}
+
+// TokenAt returns the index of the token containing a byte offset, or -1
+// at the end of the document
+func (t *SyntaxTree) TokenAt(offset int) int {
+	i := sort.Search(len(t.Tokens), func(i int) bool { return t.Tokens[i].end() > offset })
+	if i == len(t.Tokens) || t.Tokens[i].pos > offset {
+		return -1
+	}
+	return i
+}
+
+// WordAt returns the identifier or keyword token under a cursor. A cursor
+// just past the end of a word counts as being on it.
+func (t *SyntaxTree) WordAt(offset int) *token {
+	isWord := func(i int) bool {
+		return i >= 0 && (t.Tokens[i].typ == tokIdentifier || t.Tokens[i].typ == tokKeyword)
+	}
+	if i := t.TokenAt(offset); isWord(i) {
+		return &t.Tokens[i]
+	}
+	if i := t.TokenAt(offset - 1); offset > 0 && isWord(i) {
+		return &t.Tokens[i]
+	}
+	return nil
+}
+
+// InCommentOrString reports whether a cursor is inside a comment, string or
+// regexp literal, where no language features apply
+func (t *SyntaxTree) InCommentOrString(offset int) bool {
+	i := t.TokenAt(offset)
+	if i >= 0 && t.Tokens[i].pos < offset && isLiteralOrComment(t.Tokens[i]) {
+		return true
+	}
+	// At the end of a token, only unterminated literals and line comments
+	// still contain the cursor
+	if i = t.TokenAt(offset - 1); offset == 0 || i < 0 || t.Tokens[i].end() != offset {
+		return false
+	}
+	tok := t.Tokens[i]
+	switch tok.typ {
+	case tokComment:
+		return strings.HasPrefix(tok.value, "--") || !strings.HasSuffix(tok.value, "*/") || len(tok.value) < 4
+	case tokString:
+		return !isTerminatedString(tok.value)
+	}
+	return false
+}
+
+func isLiteralOrComment(tok token) bool {
+	return tok.typ == tokComment || tok.typ == tokString || tok.typ == tokRegexp
+}
+
+// isTerminatedString checks that a string token ends with its opening quote
+func isTerminatedString(s string) bool {
+	if strings.HasPrefix(s, "f") || strings.HasPrefix(s, "r") {
+		s = s[1:]
+	}
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return false
+	}
+	// The closing quote must not be escaped
+	backslashes := 0
+	for i := len(s) - 2; i > 0 && s[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 0
+}
+
+// NodeAt returns the innermost node containing a byte offset. A cursor just
+// past the end of a node counts as inside it when no sibling contains it.
+func (t *SyntaxTree) NodeAt(offset int) *Node {
+	n := t.Root
+	for {
+		var next *Node
+		for _, c := range n.Children {
+			if c.Start <= offset && offset < c.End {
+				next = c
+				break
+			}
+			if c.End == offset {
+				next = c
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+}
+
+// EnclosingGroup returns the innermost bracket group whose interior holds
+// the offset, or nil at the top level
+func (t *SyntaxTree) EnclosingGroup(offset int) *Node {
+	for n := t.NodeAt(offset); n != nil; n = n.Parent {
+		if n.Kind == NodeGroup && n.Interior(offset) {
+			return n
+		}
+	}
+	return nil
+}
+
+// TokenBefore returns the last significant token that ends before the word
+// under the cursor, or nil at the start of the document
+func (t *SyntaxTree) TokenBefore(offset int) *token {
+	if w := t.WordAt(offset); w != nil && w.pos < offset {
+		offset = w.pos
+	}
+	i := t.TokenAt(offset)
+	if i < 0 {
+		i = len(t.Tokens)
+	}
+	for i--; i >= 0; i-- {
+		switch t.Tokens[i].typ {
+		case tokWhitespace, tokNewline, tokComment:
+			continue
+		}
+		if t.Tokens[i].end() <= offset {
+			return &t.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// parseCtx describes where a run of tokens is being parsed
+type parseCtx struct {
+	script   bool // Newlines may end statements
+	branches bool // case, default and => start a new fork or switch branch
+}
+
+// syntaxParser builds a Node tree from the significant tokens of a document
+type syntaxParser struct {
+	toks []token
+	sig  []int // Indices of tokens that are not whitespace, newlines or comments
+	i    int   // Current position within sig
+
+	textLen int
+	ast     *astIndex // Node starts from the parser, nil if it failed
+}
+
+// tok returns the k-th significant token from the current one, or nil
+func (p *syntaxParser) tok(k int) *token {
+	if p.i+k >= len(p.sig) {
+		return nil
+	}
+	return &p.toks[p.sig[p.i+k]]
+}
+
+// leaf consumes the current token as a NodeToken
+func (p *syntaxParser) leaf() *Node {
+	t := p.tok(0)
+	p.i++
+	return &Node{Kind: NodeToken, Start: t.pos, End: t.end(), Tok: t}
+}
+
+func (p *syntaxParser) atCloser() bool {
+	t := p.tok(0)
+	return t != nil && t.typ == tokPunctuation && (t.value == ")" || t.value == "]" || t.value == "}")
+}
+
+func (p *syntaxParser) atBranchStart() bool {
+	t := p.tok(0)
+	if t == nil {
+		return false
+	}
+	v := strings.ToLower(t.value)
+	return v == "=>" || v == "case" || v == "default"
+}
+
+// atStop reports whether the current token ends any expression or stage
+func (p *syntaxParser) atStop(ctx parseCtx) bool {
+	t := p.tok(0)
+	return t == nil || t.typ == tokPipe || t.value == ";" || p.atCloser() ||
+		(ctx.branches && p.atBranchStart())
+}
+
+// lineBreaks reports whether a newline, or a blank line, separates the
+// current token from the previous significant token
+func (p *syntaxParser) lineBreaks() (newline, blank bool) {
+	if p.i == 0 || p.i >= len(p.sig) {
+		return false, false
+	}
+	pending := false
+	for j := p.sig[p.i-1] + 1; j < p.sig[p.i]; j++ {
+		switch p.toks[j].typ {
+		case tokNewline:
+			if pending {
+				blank = true
+			}
+			newline, pending = true, true
+		case tokComment:
+			pending = false
+		}
+	}
+	return newline, blank
+}
+
+// startsDecl reports whether the current token begins a declaration
+func (p *syntaxParser) startsDecl() bool {
+	t, name := p.tok(0), p.tok(1)
+	if t == nil || name == nil || name.typ != tokIdentifier {
+		return false
+	}
+	if p.ast != nil {
+		// The parser's declaration may start at the keyword or the name
+		return p.ast.decls[t.pos] || (isDeclKeyword(t.value) && p.ast.decls[name.pos])
+	}
+	switch strings.ToLower(t.value) {
+	case "fn", "func", "op":
+		open := p.tok(2)
+		return open != nil && open.value == "("
+	case "const", "type", "let", "pragma":
+		return true
+	}
+	return false
+}
+
+// isDeclKeyword reports whether a word starts a declaration
+func isDeclKeyword(v string) bool {
+	switch strings.ToLower(v) {
+	case "const", "fn", "func", "op", "type", "let", "pragma":
+		return true
+	}
+	return false
+}
+
+// endsStatement reports whether a line break before the current token ends
+// the statement being parsed. In script context a statement ends at a
+// blank line, at a new declaration, or at a newline that neither side
+// continues (a trailing operator, a leading pipe or clause keyword, ...).
+func (p *syntaxParser) endsStatement(ctx parseCtx, stage *Node) bool {
+	if !ctx.script {
+		return false
+	}
+	if p.ast != nil {
+		return p.i > 0 && p.ast.statementAt(p.tok(0).pos)
+	}
+	newline, blank := p.lineBreaks()
+	if !newline {
+		return false
+	}
+	cur, prev := p.tok(0), &p.toks[p.sig[p.i-1]]
+	if cur.typ == tokPipe {
+		return false
+	}
+	if p.startsDecl() || blank {
+		return true
+	}
+	if continuesAfter(prev) || continuesBefore(cur, stage) {
+		return false
+	}
+	// An operator alone on its line takes its arguments from the next one
+	if stage != nil && len(stage.Children) == 1 && stage.Children[0].Tok == prev {
+		return false
+	}
+	return true
+}
+
+// continuesAfter reports whether a token at the end of a line expects more
+func continuesAfter(t *token) bool {
+	switch t.typ {
+	case tokOperator, tokPipe:
+		return true
+	case tokPunctuation:
+		return strings.Contains(",([{:.?", t.value)
+	case tokKeyword:
+		switch strings.ToLower(t.value) {
+		case "true", "false", "null", "asc", "desc", "end":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// continuesBefore reports whether a token at the start of a line continues
+// the previous line
+func continuesBefore(t *token, stage *Node) bool {
+	switch t.typ {
+	case tokOperator:
+		// Leading + and - are more likely signs than binary operators
+		return t.value != "-" && t.value != "+" && t.value != "!"
+	case tokPunctuation:
+		return strings.Contains(",.:?", t.value)
+	}
+	v := strings.ToLower(t.value)
+	if continuationKeywords[v] {
+		return true
+	}
+	if stage != nil {
+		// SQL clauses continue a SELECT, and SELECT continues a WITH
+		if op := stage.Name(); op != nil {
+			switch strings.ToLower(op.value) {
+			case "select":
+				return v == "from"
+			case "with":
+				return v == "select" || v == "from"
+			}
+		}
+	}
+	return false
+}
+
+// continuationKeywords continue the previous line when they start a line
+var continuationKeywords = map[string]bool{
+	"by": true, "and": true, "or": true, "on": true, "as": true, "then": true,
+	"else": true, "when": true, "end": true, "where": true, "having": true,
+	"group": true, "order": true, "limit": true, "offset": true, "union": true,
+	"except": true, "intersect": true, "join": true, "inner": true, "left": true,
+	"right": true, "full": true, "outer": true, "cross": true, "anti": true,
+	"using": true, "asc": true, "desc": true, "in": true, "like": true,
+	"between": true, "is": true, "nulls": true, "over": true, "window": true,
+}
+
+// clauseKeywords separate the expressions of a stage, e.g. the keys in
+// "summarize count() by key" or the clauses of a SELECT
+var clauseKeywords = map[string]bool{
+	"by": true, "on": true, "from": true, "where": true, "group": true,
+	"having": true, "order": true, "limit": true, "offset": true, "using": true,
+	"join": true, "union": true, "except": true, "intersect": true, "with": true,
+	"into": true,
+}
+
+// stageOperators are the names that start a pipeline stage, in addition to
+// the operators in the Builtins registry
+var stageOperators = map[string]bool{
+	"aggregate": true, "summarize": true, "over": true, "yield": true,
+	"select": true, "with": true, "sample": true, "explode": true,
+	"top": true, "file": true, "get": true, "let": true,
+}
+
+// isStageOperator checks if a token names a pipeline operator
+func isStageOperator(t *token) bool {
+	if t.typ != tokIdentifier && t.typ != tokKeyword {
+		return false
+	}
+	v := strings.ToLower(t.value)
+	if stageOperators[v] {
+		return true
+	}
+	for _, op := range Builtins.Operators() {
+		if op.Name == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatements appends declarations and pipelines to n until a closing
+// bracket, a branch start or the end of the document
+func (p *syntaxParser) parseStatements(n *Node, ctx parseCtx) {
+	for p.tok(0) != nil && !p.atCloser() && !(ctx.branches && p.atBranchStart()) {
+		if p.tok(0).value == ";" {
+			n.add(p.leaf())
+			continue
+		}
+		if p.startsDecl() {
+			n.add(p.parseDecl(ctx))
+			continue
+		}
+		before := p.i
+		n.add(p.parsePipeline(ctx))
+		if p.i == before {
+			n.add(p.leaf())
+		}
+	}
+}
+
+// parseDecl parses a const, fn, op, type, let or pragma declaration
+func (p *syntaxParser) parseDecl(ctx parseCtx) *Node {
+	n := &Node{Kind: NodeDecl}
+	keyword := strings.ToLower(p.tok(0).value)
+	n.add(p.leaf()) // Keyword
+	n.add(p.leaf()) // Name
+
+	switch keyword {
+	case "fn", "func", "op":
+		n.add(p.parseGroup(parseCtx{})) // Parameters
+		if t := p.tok(0); t == nil || t.value != ":" {
+			return n
+		}
+		n.add(p.leaf())
+		if t := p.tok(0); t != nil && t.value == "(" {
+			// Operator bodies are queries; function bodies are expressions
+			n.add(p.parseGroup(parseCtx{script: keyword == "op"}))
+			return n
+		}
+	default:
+		if t := p.tok(0); t != nil && (t.value == "=" || t.value == ":=") {
+			n.add(p.leaf())
+		}
+	}
+	if p.tok(0) != nil && !p.endsStatement(ctx, nil) {
+		n.add(p.parseExpr(ctx, nil))
+	}
+	return n
+}
+
+// parsePipeline parses stages separated by | or |>
+func (p *syntaxParser) parsePipeline(ctx parseCtx) *Node {
+	n := &Node{Kind: NodePipeline}
+	for t := p.tok(0); t != nil; t = p.tok(0) {
+		if len(n.Children) > 0 && p.endsStatement(ctx, nil) {
+			break
+		}
+		if t.typ == tokPipe {
+			n.add(p.leaf())
+			continue
+		}
+		if p.atStop(ctx) || (len(n.Children) > 0 && n.Children[len(n.Children)-1].Kind == NodeStage && !p.startsStage()) {
+			break
+		}
+		n.add(p.parseStage(ctx))
+	}
+	return n
+}
+
+// parseStage parses one pipeline operator and its arguments
+func (p *syntaxParser) parseStage(ctx parseCtx) *Node {
+	n := &Node{Kind: NodeStage}
+	for t := p.tok(0); t != nil; t = p.tok(0) {
+		if len(n.Children) > 0 && p.endsStatement(ctx, n) {
+			break
+		}
+		if p.atStop(ctx) || (len(n.Children) > 0 && p.startsStage()) {
+			break
+		}
+		if len(n.Children) == 0 && p.namesStage() {
+			n.add(p.leaf())
+			continue
+		}
+		if t.value == "," || (len(n.Children) > 0 && clauseKeywords[strings.ToLower(t.value)] && !p.callsKeyword()) {
+			n.add(p.leaf())
+			continue
+		}
+		n.add(p.parseExpr(ctx, n))
+	}
+	return n
+}
+
+// startsStage reports whether the parser found a pipeline operator starting
+// at the current token, as after a newline between SQL-style stages
+func (p *syntaxParser) startsStage() bool {
+	return p.ast != nil && p.ast.stages[p.tok(0).pos]
+}
+
+// namesStage reports whether the current token is the name of the operator
+// of a stage rather than the start of an expression, as in an implied
+// summarize or put
+func (p *syntaxParser) namesStage() bool {
+	t := p.tok(0)
+	if p.ast != nil {
+		return p.ast.stages[t.pos] && !p.ast.exprs[t.pos]
+	}
+	return isStageOperator(t) && !p.startsTerm()
+}
+
+// startsTerm reports whether an operator-like name is really the start of
+// an expression, as in "count()" or "sort := 1"
+func (p *syntaxParser) startsTerm() bool {
+	next := p.tok(1)
+	if next == nil {
+		return false
+	}
+	switch next.value {
+	case "(":
+		// fork ( ... ) and switch ( ... ) are operators with bodies
+		v := strings.ToLower(p.tok(0).value)
+		return v != "fork" && v != "switch" && v != "over" && v != "from"
+	case ":=", ".", "==", "=", "!=":
+		return true
+	}
+	return false
+}
+
+// parseExpr parses one expression up to a comma, pipe, closing bracket or
+// statement boundary. stage is the enclosing stage, if any.
+func (p *syntaxParser) parseExpr(ctx parseCtx, stage *Node) *Node {
+	n := &Node{Kind: NodeExpr}
+	for t := p.tok(0); t != nil; t = p.tok(0) {
+		if len(n.Children) > 0 && p.endsStatement(ctx, stage) {
+			break
+		}
+		if t.value == "," || p.atStop(ctx) {
+			break
+		}
+		if len(n.Children) > 0 && stage != nil && clauseKeywords[strings.ToLower(t.value)] && !p.callsKeyword() {
+			break
+		}
+		if len(n.Children) > 0 && p.startsStage() {
+			break
+		}
+		n.add(p.parseTerm(ctx, stage))
+	}
+	return n
+}
+
+// parseTerm parses a single operand: a bracket group, call, lambda, dotted
+// path or token
+func (p *syntaxParser) parseTerm(ctx parseCtx, stage *Node) *Node {
+	t, next := p.tok(0), p.tok(1)
+	switch {
+	case t.value == "(" || t.value == "[" || t.value == "{":
+		return p.parseGroup(p.groupCtx(stage))
+	case p.startsLambda():
+		return p.parseLambda(ctx, stage)
+	case p.startsCall(stage):
+		n := &Node{Kind: NodeCall}
+		n.add(p.leaf())
+		n.add(p.parseGroup(parseCtx{}))
+		return n
+	case t.typ == tokIdentifier && next != nil && next.value == "." && p.tok(2) != nil && p.tok(2).typ == tokIdentifier:
+		n := &Node{Kind: NodePath}
+		n.add(p.leaf())
+		for dot, name := p.tok(0), p.tok(1); dot != nil && dot.value == "." && name != nil && name.typ == tokIdentifier; dot, name = p.tok(0), p.tok(1) {
+			n.add(p.leaf())
+			n.add(p.leaf())
+		}
+		return n
+	}
+	return p.leaf()
+}
+
+// startsLambda reports whether the current token begins an anonymous
+// function
+func (p *syntaxParser) startsLambda() bool {
+	if p.ast != nil {
+		return p.ast.lambdas[p.tok(0).pos]
+	}
+	return isLambdaStart(p.tok(0), p.tok(1))
+}
+
+// startsCall reports whether the current token names a call followed by its
+// argument list
+func (p *syntaxParser) startsCall(stage *Node) bool {
+	t, next := p.tok(0), p.tok(1)
+	if next == nil || next.value != "(" {
+		return false
+	}
+	if p.ast != nil {
+		return p.ast.calls[t.pos]
+	}
+	return (isCallName(t) || p.callsKeyword()) && !p.opensBody(stage)
+}
+
+// callKeywords are keywords that are called like functions
+var callKeywords = map[string]bool{
+	"cast": true, "error": true, "exists": true, "extract": true, "substring": true,
+}
+
+// isCallName checks if a token can name a function call
+func isCallName(t *token) bool {
+	return t.typ == tokIdentifier || (t.typ == tokKeyword && callKeywords[strings.ToLower(t.value)])
+}
+
+// callsKeyword reports whether the current token is a keyword that also
+// names a builtin function, such as join, immediately followed by "(".
+// "join (select ...)" with a space remains a join clause.
+func (p *syntaxParser) callsKeyword() bool {
+	t, next := p.tok(0), p.tok(1)
+	if next == nil || next.value != "(" {
+		return false
+	}
+	if p.ast != nil {
+		return p.ast.calls[t.pos]
+	}
+	if next.pos != t.end() {
+		return false
+	}
+	b := Builtins.Lookup(t.value)
+	return b != nil && b.Kind == KindFunction
+}
+
+// opensBody reports whether an identifier followed by "(" in a switch stage
+// is the switch expression rather than a call, as in "switch x ( ... )"
+func (p *syntaxParser) opensBody(stage *Node) bool {
+	if stage == nil {
+		return false
+	}
+	op := stage.Name()
+	return op != nil && strings.EqualFold(op.value, "switch")
+}
+
+// groupCtx chooses how to parse a bracket group: as fork/switch branches,
+// as a subquery when it contains a pipeline, or as expressions
+func (p *syntaxParser) groupCtx(stage *Node) parseCtx {
+	if stage != nil && p.tok(0).value == "(" {
+		if op := stage.Name(); op != nil {
+			switch strings.ToLower(op.value) {
+			case "fork", "switch":
+				return parseCtx{script: true, branches: true}
+			}
+		}
+	}
+	if p.tok(0).value == "(" && p.groupHasQuery() {
+		return parseCtx{script: true}
+	}
+	return parseCtx{}
+}
+
+// groupHasQuery looks ahead from an opening paren for a subquery: a pipe
+// at the group's own level, or a leading FROM or SELECT
+func (p *syntaxParser) groupHasQuery() bool {
+	if first := p.tok(1); first != nil && p.ast != nil {
+		return p.ast.queries[first.pos]
+	}
+	if first := p.tok(1); first != nil {
+		switch strings.ToLower(first.value) {
+		case "from", "select", "with":
+			return true
+		}
+	}
+	depth := 0
+	for k := 1; p.tok(k) != nil; k++ {
+		t := p.tok(k)
+		switch {
+		case t.value == "(" || t.value == "[" || t.value == "{":
+			depth++
+		case t.value == ")" || t.value == "]" || t.value == "}":
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case t.typ == tokPipe && depth == 0:
+			return true
+		}
+	}
+	return false
+}
+
+// parseGroup parses a bracketed group. inner decides whether its contents
+// are expressions, statements or branches.
+func (p *syntaxParser) parseGroup(inner parseCtx) *Node {
+	n := &Node{Kind: NodeGroup}
+	t := p.tok(0)
+	if t == nil || (t.value != "(" && t.value != "[" && t.value != "{") {
+		return n
+	}
+	closer := closerOf(t.value)
+	n.add(p.leaf())
+
+	switch {
+	case inner.branches:
+		for p.tok(0) != nil && !p.atCloser() {
+			before := p.i
+			n.add(p.parseBranch(inner))
+			if p.i == before {
+				n.add(p.leaf())
+			}
+		}
+	case inner.script:
+		script := &Node{Kind: NodeScript}
+		p.parseStatements(script, inner)
+		n.add(script)
+	default:
+		for p.tok(0) != nil && !p.atCloser() {
+			if t := p.tok(0); t.value == "," || t.typ == tokPipe || t.value == ";" {
+				n.add(p.leaf())
+				continue
+			}
+			n.add(p.parseExpr(inner, nil))
+		}
+	}
+
+	if t := p.tok(0); t != nil && t.value == closer {
+		n.add(p.leaf())
+	} else if t != nil {
+		// Unclosed: the group runs up to the mismatched closing bracket
+		n.End = t.pos
+	} else {
+		n.End = p.textLen
+	}
+	return n
+}
+
+// parseBranch parses one fork or switch branch
+func (p *syntaxParser) parseBranch(ctx parseCtx) *Node {
+	n := &Node{Kind: NodeBranch}
+	switch strings.ToLower(p.tok(0).value) {
+	case "case":
+		n.add(p.leaf())
+		n.add(p.parseExpr(parseCtx{branches: true}, nil))
+	case "default":
+		n.add(p.leaf())
+	}
+	if t := p.tok(0); t != nil && t.value == "=>" {
+		n.add(p.leaf())
+	}
+	n.add(p.parsePipeline(ctx))
+	return n
+}
+
+// isLambdaStart reports whether t begins an anonymous function
+func isLambdaStart(t, next *token) bool {
+	switch strings.ToLower(t.value) {
+	case "lambda":
+		return true
+	case "fn", "func":
+		return next != nil && (next.typ == tokIdentifier || next.value == "(")
+	}
+	return false
+}
+
+// parseLambda parses "lambda x, y: body" or "fn (x, y): body"
+func (p *syntaxParser) parseLambda(ctx parseCtx, stage *Node) *Node {
+	n := &Node{Kind: NodeLambda}
+	n.add(p.leaf())
+	if t := p.tok(0); t != nil && t.value == "(" {
+		n.add(p.parseGroup(parseCtx{}))
+	}
+	for t := p.tok(0); t != nil && (t.typ == tokIdentifier || t.value == ","); t = p.tok(0) {
+		n.add(p.leaf())
+	}
+	if t := p.tok(0); t != nil && t.value == ":" {
+		n.add(p.leaf())
+		n.add(p.parseExpr(ctx, stage))
+	}
+	return n
+}
+
+// closerOf returns the closing bracket for an opening one
+func closerOf(open string) string {
+	switch open {
+	case "(":
+		return ")"
+	case "[":
+		return "]"
+	case "{":
+		return "}"
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/brimdata/super/compiler/ast"
+)
+
+// syntax_ast.go - Where the brimdata/super parser puts things. When a
+// document parses, the start offsets of the parser's AST nodes decide where
+// statements, pipeline stages, calls and lambdas begin, so the syntax tree
+// agrees with the parser. The token rules in syntax.go only decide for text
+// the parser rejects, which is what completion and signature help mostly
+// see while a query is being typed.
+
+// astIndex holds the start offsets of the nodes of a parsed document
+type astIndex struct {
+	decls   map[int]bool // const, fn, op and type declarations
+	queries map[int]bool // The first stage of each pipeline
+	stages  map[int]bool // Every pipeline operator
+	calls   map[int]bool // Calls of functions and user operators
+	lambdas map[int]bool
+	exprs   map[int]bool // Every other node: expressions, names, ...
+}
+
+// indexAST records where the nodes of a parsed AST start. The elements of
+// an ast.Seq are pipeline stages; other nodes are classified by their ast
+// type. The walk reaches child nodes through the exported fields of each
+// node. Nodes that don't start at a token are ignored, and a result that
+// isn't an ast.Seq gives nil, leaving the tree to the token rules.
+func indexAST(tokens []token, tree interface{}) *astIndex {
+	seq, ok := tree.(ast.Seq)
+	if !ok {
+		return nil
+	}
+	starts := make(map[int]bool, len(tokens))
+	for _, t := range tokens {
+		starts[t.pos] = true
+	}
+	idx := &astIndex{
+		decls:   make(map[int]bool),
+		queries: make(map[int]bool),
+		stages:  make(map[int]bool),
+		calls:   make(map[int]bool),
+		lambdas: make(map[int]bool),
+		exprs:   make(map[int]bool),
+	}
+	record := func(n ast.Node, stage, first bool) {
+		pos := n.Pos()
+		if !starts[pos] || n.End() < pos || (pos == 0 && n.End() == 0 && len(tokens) > 1) {
+			return
+		}
+		if _, ok := n.(*ast.Scope); ok {
+			// Declarations and the pipeline of their body; the scope
+			// itself is no stage
+			return
+		}
+		if stage {
+			idx.stages[pos] = true
+			if first {
+				idx.queries[pos] = true
+			}
+			if _, ok := n.(*ast.CallOp); ok {
+				// A user operator called as a stage
+				idx.calls[pos], idx.exprs[pos] = true, true
+			}
+			return
+		}
+		switch n.(type) {
+		case *ast.ConstDecl, *ast.FuncDecl, *ast.OpDecl, *ast.TypeDecl:
+			idx.decls[pos] = true
+		case *ast.Call:
+			idx.calls[pos], idx.exprs[pos] = true, true
+		case *ast.Lambda:
+			idx.lambdas[pos], idx.exprs[pos] = true, true
+		default:
+			idx.exprs[pos] = true
+		}
+	}
+
+	seqType := reflect.TypeOf(ast.Seq(nil))
+	seen := make(map[uintptr]bool)
+	var walk func(v reflect.Value, stage, first bool)
+	walk = func(v reflect.Value, stage, first bool) {
+		switch v.Kind() {
+		case reflect.Interface:
+			if !v.IsNil() {
+				walk(v.Elem(), stage, first)
+			}
+		case reflect.Pointer:
+			if v.IsNil() || seen[v.Pointer()] {
+				return
+			}
+			seen[v.Pointer()] = true
+			if n, ok := v.Interface().(ast.Node); ok {
+				record(n, stage, first)
+			}
+			walk(v.Elem(), false, false)
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				// The embedded ast.Loc repeats the node's own position
+				if f := v.Type().Field(i); f.IsExported() && !f.Anonymous {
+					walk(v.Field(i), false, false)
+				}
+			}
+		case reflect.Slice, reflect.Array:
+			ops := v.Type() == seqType
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), ops, ops && i == 0)
+			}
+		case reflect.Map:
+			iter := v.MapRange()
+			for iter.Next() {
+				walk(iter.Value(), false, false)
+			}
+		}
+	}
+	walk(reflect.ValueOf(seq), false, false)
+	return idx
+}
+
+// statementAt reports whether a declaration or query starts at an offset
+func (idx *astIndex) statementAt(pos int) bool {
+	return idx.decls[pos] || idx.queries[pos]
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/brimdata/super"
+	"github.com/brimdata/super/sup"
+)
+
+// types.go - Static types of literals, casts and constant expressions.
+// Types are only inferred where they don't depend on the input: literals,
+// "::" casts to primitive types, references to constants, builtin calls
+// returning a primitive, and the operators combining them. Anything else
+// has no static type here.
+
+// exprType returns the static type of an expression, or nil when it's
+// unknown
+func exprType(tree *SyntaxTree, expr *Node) super.Type {
+	return termsType(tree.Symbols(), expr.Children, make(map[*Node]bool))
+}
+
+// Binary operators from lowest to highest precedence
+var (
+	orOps         = map[string]bool{"or": true, "||": true}
+	andOps        = map[string]bool{"and": true, "&&": true}
+	comparisonOps = map[string]bool{
+		"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+		"in": true, "like": true,
+	}
+	additiveOps       = map[string]bool{"+": true, "-": true}
+	multiplicativeOps = map[string]bool{"*": true, "/": true, "%": true}
+)
+
+// termsType infers the type of a sequence of terms. seen holds the
+// constant declarations being inferred, so cycles end in nil.
+func termsType(symbols *Symbols, terms []*Node, seen map[*Node]bool) super.Type {
+	if len(terms) == 0 {
+		return nil
+	}
+	if isTypeValue(terms) {
+		return super.LookupPrimitive("type")
+	}
+	for _, ops := range []map[string]bool{orOps, andOps, comparisonOps} {
+		if i := lastBinaryOp(terms, ops); i >= 0 {
+			return super.LookupPrimitive("bool")
+		}
+	}
+	for _, ops := range []map[string]bool{additiveOps, multiplicativeOps} {
+		if i := lastBinaryOp(terms, ops); i >= 0 {
+			left := termsType(symbols, terms[:i], seen)
+			right := termsType(symbols, terms[i+1:], seen)
+			return arithType(terms[i].Tok.value, left, right)
+		}
+	}
+
+	first := terms[0]
+	if first.Kind == NodeToken && len(terms) > 1 {
+		switch strings.ToLower(first.Tok.value) {
+		case "-":
+			if t := termsType(symbols, terms[1:], seen); isNumeric(t) || typeName(t) == "duration" {
+				return t
+			}
+			return nil
+		case "!", "not":
+			return super.LookupPrimitive("bool")
+		}
+	}
+	if n := len(terms); n >= 3 && isCast(terms[n-2]) {
+		return castType(terms[n-1])
+	}
+	if len(terms) == 1 {
+		return termType(symbols, first, seen)
+	}
+	return nil
+}
+
+// lastBinaryOp returns the index of the last operator from ops that has an
+// operand on both sides, or -1. The last one is the root of a
+// left-associative chain.
+func lastBinaryOp(terms []*Node, ops map[string]bool) int {
+	for i := len(terms) - 2; i > 0; i-- {
+		t := terms[i]
+		if t.Kind != NodeToken || !ops[strings.ToLower(t.Tok.value)] {
+			continue
+		}
+		// A minus after another operator is a sign, not a subtraction
+		if prev := terms[i-1]; prev.Kind == NodeToken && prev.Tok.typ == tokOperator {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// isTypeValue reports whether terms spell a type value such as <int64>
+func isTypeValue(terms []*Node) bool {
+	n := len(terms)
+	return n >= 3 && terms[0].Kind == NodeToken && terms[0].Tok.value == "<" &&
+		terms[n-1].Kind == NodeToken && terms[n-1].Tok.value == ">"
+}
+
+func isCast(n *Node) bool {
+	return n.Kind == NodeToken && n.Tok.value == "::"
+}
+
+// termType returns the type of a single operand
+func termType(symbols *Symbols, n *Node, seen map[*Node]bool) super.Type {
+	switch n.Kind {
+	case NodeToken:
+		if name := literalTokenType(n.Tok); name != "" {
+			return super.LookupPrimitive(name)
+		}
+		if sym := symbols.refs[n.Tok]; sym != nil && sym.Kind == SymbolConst && !seen[sym.Decl] {
+			if value := constValue(sym.Decl); value != nil {
+				seen[sym.Decl] = true
+				defer delete(seen, sym.Decl)
+				return termsType(symbols, value.Children, seen)
+			}
+		}
+	case NodeGroup:
+		// A parenthesized expression
+		if n.Closed() && n.leafAt(0).value == "(" && len(n.Children) == 3 && n.Children[1].Kind == NodeExpr {
+			return termsType(symbols, n.Children[1].Children, seen)
+		}
+	case NodeCall:
+		if b := builtinCall(symbols, n); b != nil {
+			return returnType(b)
+		}
+	}
+	return nil
+}
+
+// castType returns the type named after "::", when it's a primitive
+func castType(n *Node) super.Type {
+	if n.Kind != NodeToken {
+		return nil
+	}
+	return super.LookupPrimitive(strings.ToLower(n.Tok.value))
+}
+
+// returnType returns the primitive type a builtin's signature declares it
+// returns, e.g. int64 for "len(value: any) -> int64"
+func returnType(b *Builtin) super.Type {
+	_, ret, ok := strings.Cut(b.Signature, "->")
+	if !ok {
+		return nil
+	}
+	return super.LookupPrimitive(strings.TrimSpace(ret))
+}
+
+// arithType returns the type of an arithmetic operation, following the
+// promotion of mixed numeric operands and time arithmetic
+func arithType(op string, left, right super.Type) super.Type {
+	if left == nil || right == nil {
+		return nil
+	}
+	l, r := typeName(left), typeName(right)
+	additive := op == "+" || op == "-"
+	switch {
+	case isNumeric(left) && isNumeric(right):
+		switch {
+		case left == right:
+			return left
+		case strings.HasPrefix(l, "float") || strings.HasPrefix(r, "float"):
+			return super.LookupPrimitive("float64")
+		}
+		return super.LookupPrimitive("int64")
+	case op == "+" && l == "string" && r == "string":
+		return left
+	case additive && l == "time" && r == "duration", op == "+" && l == "duration" && r == "time":
+		return super.LookupPrimitive("time")
+	case op == "-" && l == "time" && r == "time", additive && l == "duration" && r == "duration":
+		return super.LookupPrimitive("duration")
+	case (op == "*" || op == "/") && l == "duration" && isNumeric(right), op == "*" && isNumeric(left) && r == "duration":
+		return super.LookupPrimitive("duration")
+	}
+	return nil
+}
+
+// typeName formats a type in SUP notation
+func typeName(t super.Type) string {
+	if t == nil {
+		return ""
+	}
+	return sup.FormatType(t)
+}
+
+func isNumeric(t super.Type) bool {
+	name := typeName(t)
+	return strings.HasPrefix(name, "int") || strings.HasPrefix(name, "uint") || strings.HasPrefix(name, "float")
+}
+
+// constValue returns the value expression of a const declaration
+func constValue(decl *Node) *Node {
+	if decl.Keyword() != "const" || len(decl.Children) < 4 {
+		return nil
+	}
+	if value := decl.Children[len(decl.Children)-1]; value.Kind == NodeExpr {
+		return value
+	}
+	return nil
+}
+
+// typeHoverAt describes the type of the literal or cast under the cursor.
+// Hovering the operand, the "::" or the type name of a cast shows the type
+// the cast produces; hovering a literal shows its own type.
+func typeHoverAt(tree *SyntaxTree, offset int) *Hover {
+	n := tree.NodeAt(offset)
+	if n == nil || n.Kind != NodeToken || n.Tok.typ == tokComment {
+		return nil
+	}
+	term := n
+	if p := n.Parent; p != nil && (p.Kind == NodePath || (p.Kind == NodeCall && p.Children[0] == n)) {
+		term = p
+	}
+	expr := term.Parent
+	if expr == nil || expr.Kind != NodeExpr {
+		return nil
+	}
+	terms, i := expr.Children, childIndex(term)
+
+	// Find the "::" of a cast this term takes part in
+	castAt := -1
+	switch {
+	case isCast(term):
+		castAt = i
+	case i+1 < len(terms) && isCast(terms[i+1]):
+		castAt = i + 1
+	case i > 0 && isCast(terms[i-1]):
+		castAt = i - 1
+	}
+	if castAt > 0 && castAt+1 < len(terms) {
+		// The operand may itself be a cast, as in x::string::int64
+		start := castAt - 1
+		for start >= 2 && isCast(terms[start-1]) {
+			start -= 2
+		}
+		span := terms[start : castAt+2]
+		t := termsType(tree.Symbols(), span, make(map[*Node]bool))
+		if t == nil {
+			return nil
+		}
+		content := formatTypeHover(tree.Text[span[0].Start:span[len(span)-1].End], t)
+		content += formatEvalResult(evalConstant(tree, span))
+		if term == terms[castAt+1] {
+			if b := Builtins.Lookup(term.Tok.value); b != nil && b.Kind == KindType {
+				content += "\n\n---\n\n" + formatHoverContent(b)
+			}
+		}
+		return markdownHover(content)
+	}
+
+	if name := literalTokenType(n.Tok); name != "" {
+		return markdownHover(formatTypeHover(n.Tok.value, super.LookupPrimitive(name)))
+	}
+	if isExprOperator(n.Tok) {
+		// An operator previews the whole expression when it's constant
+		c, err := evalConstant(tree, terms)
+		if errors.Is(err, errNotConstant) {
+			return nil
+		}
+		t := exprType(tree, expr)
+		if t == nil {
+			t = c.typ
+		}
+		return markdownHover(formatTypeHover(tree.Text[expr.Start:expr.End], t) + formatEvalResult(c, err))
+	}
+	return nil
+}
+
+// isExprOperator reports whether a token is a unary or binary operator
+func isExprOperator(tok *token) bool {
+	op := strings.ToLower(tok.value)
+	if op == "!" || op == "not" {
+		return true
+	}
+	for _, ops := range []map[string]bool{orOps, andOps, comparisonOps, additiveOps, multiplicativeOps} {
+		if ops[op] {
+			return true
+		}
+	}
+	return false
+}
+
+// formatTypeHover formats an expression and its type, if known, as
+// markdown
+func formatTypeHover(text string, t super.Type) string {
+	content := fmt.Sprintf("```spq\n%s\n```", collapseSpace(text))
+	if t != nil {
+		content += fmt.Sprintf("\n\nType: `%s`", typeName(t))
+	}
+	return content
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// workspace.go - Workspace file discovery and URI helpers
+
+// uriToPath converts a file:// URI into a filesystem path
+func uriToPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+// pathToURI converts a filesystem path into a file:// URI
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
+
+// isQueryFile checks if a URI or path names a SuperSQL query file
+func isQueryFile(uri string) bool {
+	return strings.HasSuffix(strings.ToLower(uri), ".spq")
+}
+
+// isWorkspaceFile checks if a URI or path is a file the server understands
+func isWorkspaceFile(uri string) bool {
+	return isQueryFile(uri) || isDataFile(uri)
+}
+
+// workspaceFiles returns every .spq and .sup file under root, skipping
+// hidden directories and node_modules
+func workspaceFiles(ctx context.Context, root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable entries are skipped rather than failing the walk
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || name == "node_modules") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if isWorkspaceFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// workspace_index.go - Declarations of every query file in the workspace.
+// The index is built in the background from the files on disk when the
+// server is initialized and kept current by workspace/didChangeWatchedFiles
+// and workspace/didChangeWorkspaceFolders. Open documents take precedence
+// over the index, since the editor's copy may not be saved yet.
+
+// workspaceSymbolLimit caps the number of workspace/symbol results
+const workspaceSymbolLimit = 500
+
+// indexedSymbol is a declaration found in a workspace file
+type indexedSymbol struct {
+	Name      string
+	Kind      SymbolKind
+	Location  Location
+	Container string // Enclosing op, if the declaration is nested
+	TopLevel  bool   // Declared in the script itself, so other files can call it
+	Signature string // Declaration as shown in hover, e.g. "fn double(x)"
+}
+
+// workspaceIndex holds the declarations of every .spq file under the
+// workspace folders, keyed by path
+type workspaceIndex struct {
+	mu      sync.RWMutex
+	folders []string
+	files   map[string][]indexedSymbol
+
+	// generation counts changes to the index, so results that depend on
+	// other files can tell when they are stale
+	generation uint64
+	onChange   func() // Called after changes once the index is ready
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  chan struct{} // Closed once the initial scan finishes
+}
+
+func newWorkspaceIndex() *workspaceIndex {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workspaceIndex{
+		files:  make(map[string][]indexedSymbol),
+		ctx:    ctx,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+	}
+}
+
+// start records the workspace folders and scans them in the background
+func (ix *workspaceIndex) start(folders []string) {
+	ix.mu.Lock()
+	ix.folders = append([]string(nil), folders...)
+	ix.mu.Unlock()
+
+	go func() {
+		for _, folder := range folders {
+			ix.scan(folder)
+		}
+		ix.mu.Lock()
+		ix.generation++
+		ix.mu.Unlock()
+		close(ix.ready)
+		ix.changed()
+	}()
+}
+
+// stop abandons any scan in progress
+func (ix *workspaceIndex) stop() {
+	ix.cancel()
+}
+
+// wait blocks until the initial scan has finished
+func (ix *workspaceIndex) wait(ctx context.Context) error {
+	select {
+	case <-ix.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isReady reports whether the initial scan has finished, so a name missing
+// from the index is missing from the workspace
+func (ix *workspaceIndex) isReady() bool {
+	select {
+	case <-ix.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// version returns the index generation
+func (ix *workspaceIndex) version() uint64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.generation
+}
+
+// changed notifies the server that declarations other documents depend on
+// may have changed. Changes during the initial scan are reported once it
+// finishes.
+func (ix *workspaceIndex) changed() {
+	if ix.onChange != nil && ix.isReady() && ix.ctx.Err() == nil {
+		ix.onChange()
+	}
+}
+
+// roots returns the workspace folders
+func (ix *workspaceIndex) roots() []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return append([]string(nil), ix.folders...)
+}
+
+// addFolder adds a workspace folder and scans it in the background
+func (ix *workspaceIndex) addFolder(folder string) {
+	ix.mu.Lock()
+	ix.folders = append(ix.folders, folder)
+	ix.mu.Unlock()
+	go ix.scan(folder)
+}
+
+// removeFolder drops a workspace folder and every file indexed under it
+func (ix *workspaceIndex) removeFolder(folder string) {
+	defer ix.changed()
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.generation++
+	for i, f := range ix.folders {
+		if f == folder {
+			ix.folders = append(ix.folders[:i], ix.folders[i+1:]...)
+			break
+		}
+	}
+	for path := range ix.files {
+		if withinFolder(path, folder) && !ix.inFolderLocked(path) {
+			delete(ix.files, path)
+		}
+	}
+}
+
+// scan indexes every query file under a folder
+func (ix *workspaceIndex) scan(folder string) {
+	files, err := workspaceFiles(ix.ctx, folder)
+	if err != nil {
+		log.Printf("Indexing %s stopped: %v", folder, err)
+	}
+	for _, path := range files {
+		if ix.ctx.Err() != nil {
+			return
+		}
+		if isQueryFile(path) {
+			ix.update(path)
+		}
+	}
+	log.Printf("Indexed %d files under %s", len(files), folder)
+}
+
+// update re-reads a file and replaces its declarations
+func (ix *workspaceIndex) update(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		ix.remove(path)
+		return
+	}
+	symbols := indexSymbols(pathToURI(path), parseSyntax(string(data)))
+
+	ix.mu.Lock()
+	if ix.inFolderLocked(path) {
+		ix.files[path] = symbols
+		ix.generation++
+	}
+	ix.mu.Unlock()
+	ix.changed()
+}
+
+// remove forgets a deleted file
+func (ix *workspaceIndex) remove(path string) {
+	ix.mu.Lock()
+	delete(ix.files, path)
+	ix.generation++
+	ix.mu.Unlock()
+	ix.changed()
+}
+
+// inFolderLocked reports whether a path is under one of the workspace
+// folders. ix.mu must be held.
+func (ix *workspaceIndex) inFolderLocked(path string) bool {
+	for _, folder := range ix.folders {
+		if withinFolder(path, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinFolder reports whether path is inside folder
+func withinFolder(path, folder string) bool {
+	rel, err := filepath.Rel(folder, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// snapshot returns the indexed declarations of every file, with open
+// documents replacing their indexed copies
+func (ix *workspaceIndex) snapshot(open []*Document) map[string][]indexedSymbol {
+	ix.mu.RLock()
+	files := make(map[string][]indexedSymbol, len(ix.files)+len(open))
+	for path, symbols := range ix.files {
+		files[path] = symbols
+	}
+	ix.mu.RUnlock()
+
+	for _, doc := range open {
+		path, ok := uriToPath(doc.URI)
+		if !ok || !isQueryFile(path) {
+			continue
+		}
+		files[path] = indexSymbols(doc.URI, doc.Syntax())
+	}
+	return files
+}
+
+// indexSymbols returns the constants, functions, operators and types
+// declared in a document
+func indexSymbols(uri string, tree *SyntaxTree) []indexedSymbol {
+	var symbols []indexedSymbol
+	for _, sym := range tree.Symbols().All {
+		switch sym.Kind {
+		case SymbolConst, SymbolFunc, SymbolOp, SymbolType:
+		default:
+			continue
+		}
+		symbols = append(symbols, indexedSymbol{
+			Name:      sym.Name,
+			Kind:      sym.Kind,
+			Location:  Location{URI: uri, Range: tree.Range(sym.Tok.pos, sym.Tok.end())},
+			Container: enclosingDeclName(sym.Decl),
+			TopLevel:  sym.Scope.Parent == nil,
+			Signature: declSignature(tree, sym.Decl),
+		})
+	}
+	return symbols
+}
+
+// callableDecls returns the functions and operators declared at the top of
+// every file except the one being checked, keyed by name. Declarations
+// nested in an op body are only visible inside it.
+func callableDecls(files map[string][]indexedSymbol, uri string) map[string][]indexedSymbol {
+	self, _ := uriToPath(uri)
+	decls := make(map[string][]indexedSymbol)
+	for path, symbols := range files {
+		if path == self {
+			continue
+		}
+		for _, sym := range symbols {
+			if sym.TopLevel && sym.Kind.callable() {
+				decls[sym.Name] = append(decls[sym.Name], sym)
+			}
+		}
+	}
+	for _, defs := range decls {
+		sort.Slice(defs, func(i, j int) bool { return defs[i].Location.URI < defs[j].Location.URI })
+	}
+	return decls
+}
+
+// workspaceCallables returns the functions and operators declared outside
+// a document, taking open documents from the request's snapshot
+func (s *Server) workspaceCallables(ctx context.Context, uri string) map[string][]indexedSymbol {
+	return callableDecls(s.workspace.snapshot(s.openDocuments(ctx)), uri)
+}
+
+// enclosingDeclName returns the name of the declaration a nested
+// declaration appears in, if any
+func enclosingDeclName(decl *Node) string {
+	for n := decl.Parent; n != nil; n = n.Parent {
+		if n.Kind == NodeDecl {
+			if name := n.Name(); name != nil {
+				return name.value
+			}
+		}
+	}
+	return ""
+}
+
+// workspaceSymbols answers a workspace/symbol query, best matches first
+func workspaceSymbols(files map[string][]indexedSymbol, query string) []SymbolInformation {
+	type match struct {
+		sym   indexedSymbol
+		score int
+	}
+	var matches []match
+	for _, symbols := range files {
+		for _, sym := range symbols {
+			if score, ok := fuzzyScore(query, sym.Name); ok {
+				matches = append(matches, match{sym, score})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.sym.Name != b.sym.Name {
+			return a.sym.Name < b.sym.Name
+		}
+		return a.sym.Location.URI < b.sym.Location.URI
+	})
+	if len(matches) > workspaceSymbolLimit {
+		matches = matches[:workspaceSymbolLimit]
+	}
+
+	results := make([]SymbolInformation, 0, len(matches))
+	for _, m := range matches {
+		results = append(results, SymbolInformation{
+			Name:          m.sym.Name,
+			Kind:          symbolKindToLSP(m.sym.Kind),
+			Location:      m.sym.Location,
+			ContainerName: m.sym.Container,
+		})
+	}
+	return results
+}
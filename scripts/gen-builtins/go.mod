@@ -1,3 +1,7 @@
 module github.com/superdb/superdb-lsp/scripts/gen-builtins
 
 go 1.24.7
+
+require github.com/superdb/superdb-lsp/lsp v0.0.0
+
+replace github.com/superdb/superdb-lsp/lsp => ../../lsp
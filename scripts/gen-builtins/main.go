@@ -25,6 +25,8 @@ import (
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/superdb/superdb-lsp/lsp/sigparse"
 )
 
 func main() {
@@ -494,9 +496,10 @@ func extractAggregates(filename string) ([]string, error) {
 // ---------------------------------------------------------------------------
 
 type localBuiltin struct {
-	Name       string
-	Kind       string
-	ParamCount int
+	Name   string
+	Kind   string
+	ArgMin int
+	ArgMax int // -1 for variadic
 }
 
 func extractLocalBuiltins(filename string) ([]localBuiltin, error) {
@@ -516,6 +519,8 @@ func extractLocalBuiltins(filename string) ([]localBuiltin, error) {
 			continue
 		}
 		var lb localBuiltin
+		var signatures []string
+		paramCount := 0
 		for _, field := range cl.Elts {
 			kv, ok := field.(*ast.KeyValueExpr)
 			if !ok {
@@ -534,17 +539,62 @@ func extractLocalBuiltins(filename string) ([]localBuiltin, error) {
 				if ident, ok := kv.Value.(*ast.Ident); ok {
 					lb.Kind = ident.Name
 				}
+			case "Signature":
+				if lit, ok := kv.Value.(*ast.BasicLit); ok {
+					sig, _ := strconv.Unquote(lit.Value)
+					signatures = append(signatures, sig)
+				}
+			case "Overloads":
+				if cl2, ok := kv.Value.(*ast.CompositeLit); ok {
+					signatures = append(signatures, extractStringLiterals(cl2.Elts)...)
+				}
 			case "Parameters":
 				if cl2, ok := kv.Value.(*ast.CompositeLit); ok {
-					lb.ParamCount = len(cl2.Elts)
+					paramCount = len(cl2.Elts)
 				}
 			}
 		}
+		lb.ArgMin, lb.ArgMax = paramCount, paramCount
+		if len(signatures) > 0 {
+			lb.ArgMin, lb.ArgMax = signatureArity(signatures)
+		}
 		builtins = append(builtins, lb)
 	}
 	return builtins, nil
 }
 
+// signatureArity returns the fewest and most arguments the signatures of a
+// builtin accept. "name?" parameters are optional and a trailing "..."
+// makes the form variadic. Signatures are split by the same sigparse
+// package the language server uses.
+func signatureArity(signatures []string) (argmin, argmax int) {
+	argmin = -1
+	for _, sig := range signatures {
+		required, total, variadic := 0, 0, false
+		_, params, _ := sigparse.Split(sig)
+		for _, p := range params {
+			switch {
+			case p == "...":
+				variadic = true
+			case strings.Contains(sigparse.ParamName(p), "?"):
+				total++
+			default:
+				required++
+				total++
+			}
+		}
+		if argmin < 0 || required < argmin {
+			argmin = required
+		}
+		if variadic {
+			argmax = -1
+		} else if argmax >= 0 && total > argmax {
+			argmax = total
+		}
+	}
+	return argmin, argmax
+}
+
 // ---------------------------------------------------------------------------
 // Go AST helpers
 // ---------------------------------------------------------------------------
@@ -649,12 +699,12 @@ func generateFile(outFile string, keywords, operators, primitiveTypes, sqlTypes
 // ---------------------------------------------------------------------------
 
 func printDiffReport(upstreamFuncs []funcInfo, upstreamAggs []string, local []localBuiltin, version string) {
-	localFuncs := make(map[string]int) // name → param count
+	localFuncs := make(map[string]localBuiltin)
 	localAggs := make(map[string]bool)
 	for _, lb := range local {
 		switch lb.Kind {
 		case "KindFunction":
-			localFuncs[lb.Name] = lb.ParamCount
+			localFuncs[lb.Name] = lb
 		case "KindAggregate":
 			localAggs[lb.Name] = true
 		}
@@ -683,11 +733,11 @@ func printDiffReport(upstreamFuncs []funcInfo, upstreamAggs []string, local []lo
 			hasDiff = true
 		}
 	}
-	for name, paramCount := range localFuncs {
+	for name, lb := range localFuncs {
 		if f, ok := upFuncMap[name]; ok {
-			if f.ArgMin != paramCount || f.ArgMax != paramCount {
-				fmt.Printf("  ARITY:   %s (local params=%d, upstream argmin=%d, argmax=%d)\n",
-					name, paramCount, f.ArgMin, f.ArgMax)
+			if f.ArgMin != lb.ArgMin || f.ArgMax != lb.ArgMax {
+				fmt.Printf("  ARITY:   %s (local argmin=%d, argmax=%d, upstream argmin=%d, argmax=%d)\n",
+					name, lb.ArgMin, lb.ArgMax, f.ArgMin, f.ArgMax)
 				hasDiff = true
 			}
 		}